@@ -0,0 +1,128 @@
+package bridge
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	"github.com/tada/mqtt-nats/mqtt/pkg"
+)
+
+const (
+	// AuthPassThrough is the NATS authentication strategy that uses the MQTT user name and password as NATS
+	// user and password
+	AuthPassThrough = "passthrough"
+
+	// AuthToken is the NATS authentication strategy that uses the MQTT password as a NATS token
+	AuthToken = "token"
+
+	// AuthJWT is the NATS authentication strategy that uses the MQTT user name as a NATS user JWT and the
+	// MQTT password as the NKey seed that signs the server nonce
+	AuthJWT = "jwt"
+
+	// AuthCreds is the NATS authentication strategy that uses the NATS credentials file that is found for
+	// the MQTT user name in the NATSCreds table
+	AuthCreds = "creds"
+)
+
+// NATSCreds is an entry in the table of credentials files used with AuthCreds. The password is the one that
+// the MQTT client must provide.
+type NATSCreds struct {
+	Password string `json:"password"`
+	File     string `json:"file"`
+}
+
+// LoadNATSCreds reads a JSON object that maps user names to NATS credentials files from the file at the
+// given path
+func LoadNATSCreds(path string) (map[string]*NATSCreds, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var creds map[string]*NATSCreds
+	if err = json.Unmarshal(bs, &creds); err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
+
+// validAuth returns an error unless the given authentication strategy is known
+func validAuth(auth string) error {
+	switch auth {
+	case ``, AuthPassThrough, AuthToken, AuthJWT, AuthCreds:
+		return nil
+	}
+	return fmt.Errorf("invalid NATS authentication strategy %q", auth)
+}
+
+// credentialsRequired returns true if the given authentication strategy needs the credentials of the MQTT
+// client to create the NATS connection of that client
+func credentialsRequired(auth string) bool {
+	return auth == AuthToken || auth == AuthJWT || auth == AuthCreds
+}
+
+// setNatsAuth sets the authentication of the given NATS options using the credentials of an MQTT client and
+// the strategy of the bridge options. A pkg.ReturnCode is returned when the credentials are rejected.
+func setNatsAuth(bopts *Options, opts *nats.Options, creds *pkg.Credentials) error {
+	switch bopts.NATSAuth {
+	case AuthToken:
+		opts.Token = string(creds.Password)
+	case AuthJWT:
+		jwt := creds.User
+		seed := creds.Password
+		if _, err := nkeys.FromSeed(seed); err != nil {
+			return pkg.RtBadUserNameOrPassword
+		}
+		opts.UserJWT = func() (string, error) {
+			return jwt, nil
+		}
+		opts.SignatureCB = func(nonce []byte) ([]byte, error) {
+			kp, err := nkeys.FromSeed(seed)
+			if err != nil {
+				return nil, err
+			}
+			defer kp.Wipe()
+			return kp.Sign(nonce)
+		}
+	case AuthCreds:
+		nc, ok := bopts.NATSCreds[creds.User]
+		if !ok || subtle.ConstantTimeCompare([]byte(nc.Password), creds.Password) != 1 {
+			return pkg.RtBadUserNameOrPassword
+		}
+		return nats.UserCredentials(nc.File)(opts)
+	default:
+		opts.User = creds.User
+		if creds.Password != nil {
+			opts.Password = string(creds.Password)
+		}
+	}
+	return nil
+}
+
+// authErrors are the errors that NATS reports when a connection is refused due to its credentials
+var authErrors = []error{nats.ErrAuthorization, nats.ErrAuthExpired, nats.ErrAuthRevoked, nats.ErrAccountAuthExpired}
+
+// connectReturnCode returns the CONNACK return code that reports the given error from a NATS connect made
+// with the given credentials
+func connectReturnCode(err error, creds *pkg.Credentials) pkg.ReturnCode {
+	var rt pkg.ReturnCode
+	if errors.As(err, &rt) {
+		return rt
+	}
+	// the NATS client doesn't always return its error variables, so the messages are compared
+	msg := strings.ToLower(err.Error())
+	for _, ae := range authErrors {
+		if strings.HasPrefix(msg, ae.Error()) {
+			if ae == nats.ErrAuthorization && creds != nil {
+				return pkg.RtBadUserNameOrPassword
+			}
+			return pkg.RtNotAuthorized
+		}
+	}
+	return pkg.RtServerUnavailable
+}
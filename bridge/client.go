@@ -39,13 +39,23 @@ type Client interface {
 
 	// SetDisconnected will end the read and write loop and eventually cause Serve() to end.
 	SetDisconnected(error)
+
+	// ClientID returns the client identifier of the CONNECT packet, or an empty string if no CONNECT
+	// packet has been received
+	ClientID() string
+
+	// TakeOver disconnects the client because another connection uses its client identifier. The will
+	// is not published. TakeOver returns when the client has released its session.
+	TakeOver()
 }
 
 type client struct {
 	server         Server
 	log            logger.Logger
 	mqttConn       net.Conn
+	listener       *Listener // the listener that the client connected to, may be nil
 	natsConn       *nats.Conn
+	js             nats.JetStreamContext
 	session        Session
 	connectPacket  *pkg.Connect
 	err            error
@@ -55,21 +65,60 @@ type client struct {
 	stLock         sync.RWMutex
 	subLock        sync.Mutex
 	workers        sync.WaitGroup
+	done           chan struct{} // closed when Serve() ends
 	sessionPresent bool
+	assignedID     bool // set when the bridge assigned the client identifier
+	pooled         bool // set when natsConn is shared with other clients
+	noLocal        bool // set while a subscription has the No Local option, guarded by subLock
 	st             byte
+	protoLevel     byte
+
+	// inAliases are the topic aliases that the client has assigned. Only used by the read loop
+	inAliases map[int]string
+
+	// outAliasMax is the topic alias maximum of the client
+	outAliasMax int
+
+	// outPacketMax is the maximum packet size of the client. Zero means no limit
+	outPacketMax int
+
+	// perm are the permissions enforced by the bridge when the NATS connection is shared. Nil means that
+	// NATS enforces the permissions
+	perm *Permission
+}
+
+// identified is implemented by all packets that carry a packet identifier
+type identified interface {
+	ID() uint16
 }
 
 // TODO: This should probably be configurable.
 const writeQueueSize = 1024
 
+// takeOverTimeout is how long TakeOver waits for the write loop to flush before the connection is closed,
+// and then how long it waits for the client to release its session
+const takeOverTimeout = time.Second
+
+// maxReceiveMaximum is the highest possible MQTT 5 Receive Maximum. It is also the value used when the
+// property is absent.
+const maxReceiveMaximum = 65535
+
 // NewClient returns a new Client instance with StateInfant state.
 func NewClient(s Server, log logger.Logger, conn net.Conn) Client {
+	return newClient(s, log, conn, nil)
+}
+
+// newClient returns a new client that connected to the given listener. A nil listener has no
+// authentication policy.
+func newClient(s Server, log logger.Logger, conn net.Conn, l *Listener) *client {
 	return &client{
 		server:     s,
 		log:        log,
 		mqttConn:   conn,
+		listener:   l,
 		natsSubs:   make(map[string]*nats.Subscription),
 		st:         StateInfant,
+		done:       make(chan struct{}),
 		writeQueue: make(chan pkg.Packet, writeQueueSize)}
 }
 
@@ -78,8 +127,14 @@ func (c *client) Serve() {
 		_ = c.mqttConn.Close()
 
 		if c.natsConn != nil {
-			c.natsConn.Close()
+			if c.pooled {
+				// the connection is shared so only the subscriptions of this client are released
+				c.drainNatsSubscriptions()
+			} else {
+				c.natsConn.Close()
+			}
 		}
+		close(c.done)
 	}()
 
 	c.workers.Add(2)
@@ -96,15 +151,27 @@ func (c *client) Serve() {
 		c.Debug("client connection could not be established")
 	} else {
 		c.Debug("disconnected")
-		if cp.CleanSession() {
-			c.server.SessionManager().Remove(cp.ClientID())
-			c.Debug("session removed")
+		if c.session != nil {
+			if c.session.ExpiryInterval() == 0 {
+				if c.js != nil {
+					deleteDurables(c.js, c.server.Options().JetStreamStream, c.session)
+				}
+				c.server.SessionManager().Remove(cp.ClientID())
+				c.Debug("session removed")
+			} else {
+				c.session.SetDisconnectTime(time.Now())
+				c.server.StartOffline(c.session)
+			}
 		}
 	}
 }
 
 // String returns a text suitable for logging of client messages.
 func (c *client) String() string {
+	if c.connectPacket == nil {
+		// a CONNACK that refuses the connection may be sent before a connect packet is known
+		return "Client (not yet connected)"
+	}
 	switch c.State() {
 	case StateInfant:
 		return "Client (not yet connected)"
@@ -144,28 +211,105 @@ func (c *client) setStateAndMaxWait(newState byte, maxWait time.Duration) {
 	c.stLock.Unlock()
 }
 
+// v5 returns true if the client connected using MQTT 5
+func (c *client) v5() bool {
+	return c.protoLevel == mqtt.ProtocolLevel5
+}
+
+func (c *client) ClientID() string {
+	if cp := c.connectPacket; cp != nil {
+		return cp.ClientID()
+	}
+	return ``
+}
+
+func (c *client) TakeOver() {
+	c.deleteWill()
+	c.setDisconnected(nil, pkg.RcSessionTakenOver, true)
+	select {
+	case <-c.done:
+		return
+	case <-time.After(takeOverTimeout):
+	}
+
+	// the client doesn't read what is written to it so the connection is closed to release the write loop
+	c.Debug("closing connection that was taken over")
+	_ = c.mqttConn.Close()
+	select {
+	case <-c.done:
+	case <-time.After(takeOverTimeout):
+		c.Error("connection that was taken over did not release its session")
+	}
+}
+
+// deleteWill discards the will of the connect packet. The state lock is held so that the will cannot be
+// deleted while setDisconnected decides whether to publish it.
+func (c *client) deleteWill() {
+	c.stLock.Lock()
+	if cp := c.connectPacket; cp != nil {
+		cp.DeleteWill()
+	}
+	c.stLock.Unlock()
+}
+
 func (c *client) SetDisconnected(err error) {
+	rc, ok := pkg.RcServerShuttingDown, true
+	if err != nil {
+		rc, ok = disconnectReason(err)
+	}
+	c.setDisconnected(err, rc, ok)
+}
+
+// disconnectReason returns the reason code that a DISCONNECT sent to the client should have when the
+// connection ends due to the given error. The returned bool is false when no DISCONNECT should be sent
+// because the disconnect was normal, the connection is broken, or a CONNACK has reported the error.
+func disconnectReason(err error) (pkg.ReasonCode, bool) {
+	switch err := err.(type) {
+	case nil, pkg.ReturnCode:
+		return 0, false
+	case pkg.ReasonCode:
+		return err, true
+	case net.Error:
+		return pkg.RcKeepAliveTimeout, err.Timeout()
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return 0, false
+	}
+	return pkg.RcProtocolError, true
+}
+
+// setDisconnected ends the read and write loops. An MQTT 5 client that is connected will receive a
+// DISCONNECT with the given reason code unless sendReason is false.
+func (c *client) setDisconnected(err error, reason pkg.ReasonCode, sendReason bool) {
 	doit := false
+	var will *pkg.Will
+	var creds *pkg.Credentials
 	c.stLock.Lock()
 	if c.st != StateDisconnected {
 		doit = true
+		sendReason = sendReason && c.st == StateConnected && c.v5()
 		c.st = StateDisconnected
 		c.maxWait = time.Millisecond
+		if cp := c.connectPacket; cp != nil && cp.HasWill() {
+			will, creds = cp.Will(), cp.Credentials()
+		}
 	}
 	c.stLock.Unlock()
 
 	if doit {
-		if cp := c.connectPacket; cp != nil && cp.HasWill() {
-			err := c.server.PublishWill(cp.Will(), cp.Credentials())
+		if will != nil {
+			err := c.server.PublishWill(will, creds)
 			if err != nil {
 				c.Error(err)
 			} else {
-				c.Debug("will published to", cp.Will().Topic)
+				c.Debug("will published to", will.Topic)
 			}
 		}
-		// This packet will not be sent but it will terminate the write loop once everything else
-		// has been flushed
-		c.writeQueue <- pkg.DisconnectSingleton
+		// The DisconnectSingleton will not be sent but it will terminate the write loop once everything
+		// else has been flushed
+		if !sendReason || c.tryQueueForWrite(pkg.NewDisconnectV5(reason, nil)) {
+			c.tryQueueForWrite(pkg.DisconnectSingleton)
+		}
 
 		if err == io.EOF {
 			err = io.ErrUnexpectedEOF
@@ -177,6 +321,20 @@ func (c *client) SetDisconnected(err error) {
 	}
 }
 
+// tryQueueForWrite queues the given packet without blocking. The connection is closed when the write queue
+// is full so that a write loop which is stuck on a client that doesn't read is released. The method returns
+// false if the packet could not be queued.
+func (c *client) tryQueueForWrite(p pkg.Packet) bool {
+	select {
+	case c.writeQueue <- p:
+		return true
+	default:
+		c.Debug("write queue is full, closing connection")
+		_ = c.mqttConn.Close()
+		return false
+	}
+}
+
 func (c *client) Debug(args ...interface{}) {
 	if c.log.DebugEnabled() {
 		c.log.Debug(c.addFirst(args)...)
@@ -204,6 +362,9 @@ func (c *client) readLoop() {
 
 	var err error
 
+	// set when a CONNACK has reported the reason for the failure
+	refused := false
+
 readNextPacket:
 	for st, maxWait := c.StateAndMaxWait(); st != StateDisconnected && err == nil; st, maxWait = c.StateAndMaxWait() {
 		var (
@@ -239,13 +400,27 @@ readNextPacket:
 			break
 		}
 
+		// Check the size before the packet is read so that no buffer is allocated for a packet that is too large
+		if mx := c.server.Options().MaximumPacketSize; mx > 0 && 1+mqtt.VarIntLen(rl)+rl > mx {
+			err = pkg.RcPacketTooLarge
+			break
+		}
+
 		var p pkg.Packet
 		switch pkgType {
 		case pkg.TpDisconnect:
-			// Normal disconnect
-			// Discard will
-			c.Debug("received", pkg.DisconnectSingleton)
-			c.connectPacket.DeleteWill()
+			if p, err = pkg.ParseDisconnect(r, b, rl); err == nil {
+				c.Debug("received", p)
+				dp, ok := p.(*pkg.DisconnectV5)
+				if ok {
+					err = c.updateSessionExpiry(dp)
+				}
+				if err == nil && (!ok || dp.ReasonCode() == pkg.RcSuccess) {
+					// Normal disconnect
+					// Discard will
+					c.deleteWill()
+				}
+			}
 			break readNextPacket
 		case pkg.TpPing:
 			pr := pkg.PingRequestSingleton
@@ -254,70 +429,163 @@ readNextPacket:
 		case pkg.TpConnect:
 			if p, err = pkg.ParseConnect(r, b, rl); err == nil {
 				c.Debug("received", p)
-				err = c.handleConnect(p.(*pkg.Connect))
-				if err == nil {
-					c.server.ManageClient(c)
-				}
+				cp := p.(*pkg.Connect)
+				c.protoLevel = cp.ProtocolLevel()
+				r.SetProtocolLevel(c.protoLevel)
+				err = c.handleConnect(cp)
 			}
-			if retCode, ok := err.(pkg.ReturnCode); ok {
-				c.Debug("received", p, "return code", retCode)
+			switch err.(type) {
+			case pkg.ReturnCode, pkg.ReasonCode:
+				c.Debug("received", p, "return code", err)
+				refused = true
 				c.setState(StateConnected)
-				c.queueForWrite(pkg.NewConnAck(c.sessionPresent, retCode))
+				c.queueForWrite(c.connAck(err))
 			}
 		case pkg.TpPublish:
 			if p, err = pkg.ParsePublish(r, b, rl); err == nil {
 				c.Debug("received", p)
-				err = c.natsPublish(c.server.HandleRetain(p.(*pkg.Publish)))
+				pp := p.(*pkg.Publish)
+				if c.v5() {
+					err = c.resolveTopicAlias(pp)
+				}
+				if err == nil {
+					if c.mayPublish(pp) {
+						err = c.natsPublish(c.server.HandleRetain(pp))
+					} else {
+						c.publishDenied(pp)
+					}
+				}
 			}
 		case pkg.TpPubAck:
 			if p, err = pkg.ParsePubAck(r, b, rl); err == nil {
 				c.Debug("received", p)
-				id := p.(pkg.PubAck).ID()
-				c.session.ClientAckReceived(id, c.natsConn)
+				id := p.(identified).ID()
+				if c.session.ClientAckReceived(id, c.natsConn) {
+					c.sendQueued()
+				}
 				c.server.ReleasePacketID(id)
 			}
 		case pkg.TpPubRec:
 			if p, err = pkg.ParsePubRec(r, b, rl); err == nil {
 				c.Debug("received", p)
-				// TODO: handle PubRec
+				id := p.(identified).ID()
+				if c.session.ClientRecReceived(id, c.natsConn) {
+					if a, ok := p.(*pkg.AckV5); ok && a.ReasonCode().IsError() {
+						// The client will not accept the message so there will be no PUBREL/PUBCOMP
+						c.session.ClientCompReceived(id)
+						c.server.ReleasePacketID(id)
+						c.sendQueued()
+					} else {
+						c.queueForWrite(pkg.PubRel(id))
+					}
+				}
 			}
 		case pkg.TpPubRel:
 			if p, err = pkg.ParsePubRel(r, b, rl); err == nil {
 				c.Debug("received", p)
-				// TODO: handle PubRel
+				id := p.(identified).ID()
+				if !c.session.RelReceived(id) && c.v5() {
+					c.queueForWrite(pkg.NewAckV5(pkg.TpPubComp, id, pkg.RcPacketIdentifierNotFound, nil))
+				} else {
+					c.queueForWrite(pkg.PubComp(id))
+				}
 			}
 		case pkg.TpPubComp:
 			if p, err = pkg.ParsePubComp(r, b, rl); err == nil {
 				c.Debug("received", p)
-				// TODO: handle PubComp
+				id := p.(identified).ID()
+				if c.session.ClientCompReceived(id) {
+					c.server.ReleasePacketID(id)
+					c.sendQueued()
+				}
 			}
 		case pkg.TpSubscribe:
 			if p, err = pkg.ParseSubscribe(r, b, rl); err == nil {
 				c.Debug("received", p)
-				sp := p.(*pkg.Subscribe)
-				c.natsSubscribe(sp)
-				c.server.PublishMatching(sp, c)
+				c.server.PublishMatching(c.natsSubscribe(p.(*pkg.Subscribe)), c)
 			}
 		case pkg.TpUnsubscribe:
 			if p, err = pkg.ParseUnsubscribe(r, b, rl); err == nil {
 				c.Debug("received", p)
 				c.natsUnsubscribe(p.(*pkg.Unsubscribe))
 			}
+		case pkg.TpAuth:
+			if !r.V5() {
+				err = fmt.Errorf("received unknown packet type %d", (b&pkg.TpMask)>>4)
+			} else if p, err = pkg.ParseAuth(r, b, rl); err == nil {
+				// Enhanced authentication is never accepted in CONNECT so there's no exchange to continue
+				c.Debug("received", p)
+				err = pkg.RcProtocolError
+			}
 		default:
 			err = fmt.Errorf("received unknown packet type %d", (b&pkg.TpMask)>>4)
 		}
 	}
-	c.SetDisconnected(err)
+	rc, ok := disconnectReason(err)
+	c.setDisconnected(err, rc, ok && !refused)
 }
 
 func (c *client) handleConnect(cp *pkg.Connect) error {
 	var err error
 	c.connectPacket = cp
-	c.natsConn, err = c.server.NatsConn(cp.Credentials())
+	if _, ok := cp.Properties().Text(mqtt.PropAuthenticationMethod); ok {
+		return pkg.RcBadAuthenticationMethod
+	}
+	if cp.ProtocolLevel() == mqtt.ProtocolLevel31 {
+		// MQTT 3.1 requires a client identifier of 1 to 23 characters
+		if n := len(cp.ClientID()); n == 0 || n > pkg.MaxClientIDLength31 {
+			return pkg.RtIdentifierRejected
+		}
+	}
+	if cp.ClientID() == `` {
+		// only a clean session can be given an identifier by the server
+		if !cp.CleanSession() {
+			return pkg.RtIdentifierRejected
+		}
+		cid, ok := assignClientID(c.server.Options(), c.server.SessionManager())
+		if !ok {
+			c.Error("unable to assign a client identifier that the client identifier policy accepts")
+			return pkg.RtIdentifierRejected
+		}
+		cp.SetClientID(cid)
+		c.assignedID = true
+	} else if !validClientID(c.server.Options(), cp.ClientID()) {
+		return pkg.RtIdentifierRejected
+	}
+	if err = c.authenticate(cp); err != nil {
+		return err
+	}
+	if opts := c.server.Options(); opts.NATSPoolSize > 0 {
+		if c.perm, err = authorize(opts.Permissions, cp.Credentials()); err != nil {
+			return err
+		}
+		if cp.HasWill() && !c.perm.mayPublish(mqtt.ToNATS(cp.Will().Topic)) {
+			return pkg.RtNotAuthorized
+		}
+		c.pooled = true
+		c.natsConn, err = c.server.PooledNatsConn(cp.ClientID())
+	} else {
+		if cp.Credentials() == nil && credentialsRequired(opts.NATSAuth) {
+			// the client would otherwise connect using the NATS identity of the bridge
+			return pkg.RtNotAuthorized
+		}
+		c.natsConn, err = c.server.NatsConn(cp.Credentials())
+	}
 	if err != nil {
-		// TODO: Different error codes depending on error from NATS
 		c.Error("NATS connect failed", err)
-		return pkg.RtServerUnavailable
+		return connectReturnCode(err, cp.Credentials())
+	}
+	if c.server.Options().JetStreamStream != `` {
+		if c.js, err = c.natsConn.JetStream(); err != nil {
+			c.Error("JetStream", err)
+			return pkg.RtServerUnavailable
+		}
+	}
+
+	if oc := c.server.ManageClient(c); oc != nil {
+		// the old connection must release the session before it is handed over
+		c.Debug("taking over from an existing connection")
+		oc.TakeOver()
 	}
 
 	cid := cp.ClientID()
@@ -325,15 +593,34 @@ func (c *client) handleConnect(cp *pkg.Connect) error {
 	c.sessionPresent = false
 
 	if cp.CleanSession() {
+		if s := m.Get(cid); s != nil {
+			if c.js != nil {
+				deleteDurables(c.js, c.server.Options().JetStreamStream, s)
+			}
+			m.Remove(cid)
+		}
 		c.session = m.Create(cid)
 	} else {
-		if s := m.Get(cid); s != nil {
+		if s := m.Get(cid); s != nil && !s.Expired(time.Now()) {
 			c.session = s
 			c.sessionPresent = true
 		} else {
+			if s != nil {
+				// expired but not yet swept
+				if c.js != nil {
+					deleteDurables(c.js, c.server.Options().JetStreamStream, s)
+				}
+				m.Remove(cid)
+			}
 			c.session = m.Create(cid)
 		}
 	}
+	c.session.SetExpiryInterval(c.sessionExpiry(cp))
+	c.session.SetInFlightMaximum(c.inFlightMaximum(cp), c.inFlightQueueSize())
+	c.session.SetDisconnectTime(time.Time{})
+
+	c.outAliasMax, _ = cp.Properties().Int(mqtt.PropTopicAliasMaximum)
+	c.outPacketMax, _ = cp.Properties().Int(mqtt.PropMaximumPacketSize)
 
 	var maxWait time.Duration
 	if cp.KeepAlive() > 0 {
@@ -341,15 +628,26 @@ func (c *client) handleConnect(cp *pkg.Connect) error {
 		maxWait = (cp.KeepAlive() * 3) / 2
 	}
 	c.setStateAndMaxWait(StateConnected, maxWait)
-	c.queueForWrite(pkg.NewConnAck(c.sessionPresent, 0))
+	c.queueForWrite(c.connAck(pkg.RtAccepted))
 
 	if cp.CleanSession() {
 		c.Debug("connected with clean session")
 	} else {
 		if c.sessionPresent {
 			c.Debug("connected using preexisting session")
+			c.server.StopOffline(c.session)
 			c.session.RestoreAckSubscriptions(c)
 			c.session.ResendClientUnack(c)
+			c.sendQueued()
+
+			// messages queued while the client was disconnected are delivered before the
+			// subscriptions are restored
+			for _, pp := range c.session.TakeOffline() {
+				c.PublishResponse(pp.QoSLevel(), c.offlineResponse(pp))
+			}
+			if tps := c.session.Subscriptions(); len(tps) > 0 {
+				c.natsSubscribeTopics(tps)
+			}
 		} else {
 			c.Debug("connected using new (unclean) session")
 		}
@@ -357,6 +655,156 @@ func (c *client) handleConnect(cp *pkg.Connect) error {
 	return nil
 }
 
+// offlineResponse returns the given packet that was queued while the client was disconnected. A NATS
+// request is delivered to an MQTT 5 client with a response topic in the same way as natsResponse does it.
+func (c *client) offlineResponse(pp *pkg.Publish) *pkg.Publish {
+	reply := pp.NatsReplyTo()
+	if !c.v5() || ParseReplyTopic(reply) != nil {
+		return pp
+	}
+	rp := pkg.NewPublish(pp.ID(), pp.TopicName(), pp.Flags(), pp.Payload(), false, ``)
+	rp.SetProperties(pp.Properties().Set(mqtt.PropResponseTopic, mqtt.FromNATS(reply)))
+	return rp
+}
+
+// sessionExpiry returns the session expiry interval for the given connect packet. An MQTT 5 client
+// provides the interval in the CONNECT properties. Other clients get zero when they use a clean session
+// and the interval from the bridge options otherwise.
+func (c *client) sessionExpiry(cp *pkg.Connect) uint32 {
+	if c.v5() {
+		exp, _ := cp.Properties().Int(mqtt.PropSessionExpiryInterval)
+		return uint32(exp)
+	}
+	if cp.CleanSession() {
+		return 0
+	}
+	if exp := c.server.Options().SessionExpiry; exp > 0 {
+		return uint32(exp)
+	}
+	return NeverExpires
+}
+
+// inFlightMaximum returns the maximum number of QoS level > 0 packets that can be sent to the client
+// without being acknowledged. An MQTT 5 client provides this as its Receive Maximum. Other clients get
+// the maximum from the bridge options.
+func (c *client) inFlightMaximum(cp *pkg.Connect) int {
+	if c.v5() {
+		if rm, ok := cp.Properties().Int(mqtt.PropReceiveMaximum); ok {
+			return rm
+		}
+		return maxReceiveMaximum
+	}
+	return c.server.Options().InFlightMaximum
+}
+
+// defaultInFlightQueueSize is the number of packets that are queued while the in-flight window of a client
+// is full unless set in the options
+const defaultInFlightQueueSize = 1000
+
+// inFlightQueueSize returns the maximum number of QoS level > 0 packets that are queued while the in-flight
+// window of the client is full
+func (c *client) inFlightQueueSize() int {
+	if qs := c.server.Options().InFlightQueueSize; qs > 0 {
+		return qs
+	}
+	return defaultInFlightQueueSize
+}
+
+// updateSessionExpiry sets the session expiry interval found in an MQTT 5 DISCONNECT packet. It is a
+// protocol error to set a non zero interval when the interval given in the CONNECT was zero.
+func (c *client) updateSessionExpiry(dp *pkg.DisconnectV5) error {
+	exp, ok := dp.Properties().Int(mqtt.PropSessionExpiryInterval)
+	if !ok {
+		return nil
+	}
+	if exp != 0 && c.session.ExpiryInterval() == 0 {
+		return pkg.RcProtocolError
+	}
+	c.session.SetExpiryInterval(uint32(exp))
+	return nil
+}
+
+// connAck returns the CONNACK that reports the given reason to the client. The reason is a pkg.ReturnCode or,
+// when the client uses MQTT 5, a pkg.ReasonCode.
+func (c *client) connAck(reason error) pkg.Packet {
+	var rc pkg.ReasonCode
+	switch reason := reason.(type) {
+	case pkg.ReturnCode:
+		if c.protoLevel == mqtt.ProtocolLevel31 {
+			// MQTT 3.1 has no session present flag
+			return pkg.NewConnAck(false, reason)
+		}
+		if !c.v5() {
+			return pkg.NewConnAck(c.sessionPresent, reason)
+		}
+		rc = reason.ReasonCode()
+	case pkg.ReasonCode:
+		rc = reason
+	}
+	var props mqtt.Properties
+	if rc == pkg.RcSuccess {
+		// Tell the client about features that the bridge doesn't support
+		props = props.Add(mqtt.PropSubscriptionIdentifierAvailable, 0)
+		if rm := c.server.Options().ReceiveMaximum; rm > 0 && rm < maxReceiveMaximum {
+			props = props.Add(mqtt.PropReceiveMaximum, rm)
+		}
+		if mx := c.server.Options().MaximumPacketSize; mx > 0 {
+			props = props.Add(mqtt.PropMaximumPacketSize, mx)
+		}
+		if am := c.server.Options().TopicAliasMaximum; am > 0 {
+			props = props.Add(mqtt.PropTopicAliasMaximum, am)
+		}
+		if c.assignedID {
+			props = props.Add(mqtt.PropAssignedClientIdentifier, c.connectPacket.ClientID())
+		}
+	}
+	return pkg.NewConnAck5(c.sessionPresent, rc, props)
+}
+
+// resolveTopicAlias resolves the MQTT 5 topic alias of a publish received from the client. A new alias is
+// registered when the publish has both a topic name and an alias. The alias property is removed.
+func (c *client) resolveTopicAlias(pp *pkg.Publish) error {
+	alias, ok := pp.Properties().Int(mqtt.PropTopicAlias)
+	if !ok {
+		if pp.TopicName() == `` {
+			return pkg.RcProtocolError
+		}
+		return nil
+	}
+	if alias == 0 || alias > c.server.Options().TopicAliasMaximum {
+		return pkg.RcTopicAliasInvalid
+	}
+	if pp.TopicName() == `` {
+		name, found := c.inAliases[alias]
+		if !found {
+			return pkg.RcProtocolError
+		}
+		pp.SetTopicName(name)
+	} else {
+		if c.inAliases == nil {
+			c.inAliases = make(map[int]string)
+		}
+		c.inAliases[alias] = pp.TopicName()
+	}
+	pp.SetProperties(pp.Properties().Delete(mqtt.PropTopicAlias))
+	return nil
+}
+
+// topicAlias returns a copy of the given publish that uses a topic alias, or the publish itself when the
+// client doesn't accept more aliases. The given map contains the aliases assigned so far.
+func (c *client) topicAlias(pp *pkg.Publish, aliases map[string]int) *pkg.Publish {
+	name := pp.TopicName()
+	if alias, ok := aliases[name]; ok {
+		return pp.WithTopicAlias(alias, false)
+	}
+	if len(aliases) >= c.outAliasMax {
+		return pp
+	}
+	alias := len(aliases) + 1
+	aliases[name] = alias
+	return pp.WithTopicAlias(alias, true)
+}
+
 func (c *client) queueForWrite(p pkg.Packet) {
 	if c.State() == StateConnected {
 		c.writeQueue <- p
@@ -371,6 +819,9 @@ func (c *client) writeLoop() {
 	// writer's buffer is reused for each bulk operation
 	w := mqtt.NewWriter()
 
+	// topic aliases assigned by the bridge
+	aliases := make(map[string]int)
+
 	// Each iteration of this loop with pick max writeQueueSize packets from the writeQueue
 	// and then write those packets on mqtt.Writer (a bytes.Buffer extension). The resulting bytes
 	// are then written to the connection using one single write on the connection.
@@ -388,12 +839,23 @@ func (c *client) writeLoop() {
 		}
 		w.Reset()
 
+		// the protocol level is known once the CONNECT has been received, which is always before the
+		// first packet is queued
+		w.SetProtocolLevel(c.protoLevel)
+
 		for n := 0; n < i; n++ {
 			p := bulk[n]
 			if p == pkg.DisconnectSingleton {
 				connected = false
 				break
 			}
+			if pp, ok := p.(*pkg.Publish); ok {
+				if !c.writePublish(w, pp, aliases) {
+					c.Debug("dropped (exceeds maximum packet size)", pp)
+					c.publishDropped(pp)
+				}
+				continue
+			}
 			c.Debug("sending", p)
 			p.Write(w)
 		}
@@ -412,9 +874,64 @@ func (c *client) writeLoop() {
 	}
 }
 
+// writePublish writes the given publish, using a topic alias when possible, unless the packet is larger
+// than the maximum packet size of the client. It returns false if the packet was not written.
+func (c *client) writePublish(w *mqtt.Writer, pp *pkg.Publish, aliases map[string]int) bool {
+	start := w.Len()
+	ap := pp
+	if c.outAliasMax > 0 {
+		ap = c.topicAlias(pp, aliases)
+	}
+	ap.Write(w)
+	if c.outPacketMax <= 0 || w.Len()-start <= c.outPacketMax {
+		c.Debug("sending", ap)
+		return true
+	}
+	w.Truncate(start)
+	if ap == pp || ap.TopicName() == `` {
+		return false
+	}
+
+	// The alias was assigned by this packet so the client will never know about it. The packet without
+	// the alias might still fit.
+	delete(aliases, pp.TopicName())
+	pp.Write(w)
+	if w.Len()-start <= c.outPacketMax {
+		c.Debug("sending", pp)
+		return true
+	}
+	w.Truncate(start)
+	return false
+}
+
+// publishDropped is called when a publish is never sent to the client. A dropped packet with QoS > 0 is
+// treated as if the client acknowledged it.
+func (c *client) publishDropped(pp *pkg.Publish) {
+	if pp.QoSLevel() > 0 && c.session.ClientAckReceived(pp.ID(), c.natsConn) {
+		c.server.ReleasePacketID(pp.ID())
+
+		// called from the write loop so queued packets must be sent from another go-routine
+		go c.sendQueued()
+	}
+}
+
 func (c *client) PublishResponse(qos byte, pp *pkg.Publish) {
 	if qos > 0 {
-		c.session.ClientAckRequested(pp)
+		if send, queued := c.session.ClientAckRequested(pp, c.server); !send {
+			if queued {
+				c.Debug("queued", pp)
+			} else {
+				c.Debug("queue full, dropped", pp)
+			}
+			return
+		}
 	}
 	c.queueForWrite(pp)
 }
+
+// sendQueued sends the queued packets that fit in the in-flight window of the session
+func (c *client) sendQueued() {
+	for _, pp := range c.session.ReleaseQueued(c.server) {
+		c.queueForWrite(pp)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"sync"
 	"testing"
 	"time"
 
@@ -24,6 +25,7 @@ type mockServer struct {
 	nc        *nats.Conn
 	ncError   error
 	willError error
+	opts      Options
 	t         *testing.T
 }
 
@@ -41,13 +43,18 @@ func (m *mockServer) SessionManager() SessionManager {
 	return m
 }
 
-func (m *mockServer) ManageClient(c Client) {
+func (m *mockServer) ManageClient(c Client) Client {
+	return nil
 }
 
 func (m *mockServer) NatsConn(creds *pkg.Credentials) (*nats.Conn, error) {
 	return m.nc, m.ncError
 }
 
+func (m *mockServer) PooledNatsConn(clientID string) (*nats.Conn, error) {
+	return m.nc, m.ncError
+}
+
 func (m *mockServer) HandleRetain(pp *pkg.Publish) *pkg.Publish {
 	return pp
 }
@@ -59,8 +66,19 @@ func (m *mockServer) PublishWill(will *pkg.Will, creds *pkg.Credentials) error {
 	return m.willError
 }
 
+func (m *mockServer) Options() *Options {
+	return &m.opts
+}
+
+func (m *mockServer) StartOffline(ss Session) {
+}
+
+func (m *mockServer) StopOffline(ss Session) {
+}
+
 func newMockServer(t *testing.T) *mockServer {
-	return &mockServer{sm: sm{m: make(map[string]Session, 3)}, IDManager: pkg.NewIDManager(), t: t}
+	ids := pkg.NewIDManager()
+	return &mockServer{sm: sm{ids: ids, m: make(map[string]Session, 3)}, IDManager: ids, t: t}
 }
 
 func writePacket(t *testing.T, p pkg.Packet, w io.Writer) {
@@ -97,6 +115,50 @@ func Test_client_String(t *testing.T) {
 	utils.CheckEqual("Client client-id (disconnected)", cl.(fmt.Stringer).String(), t)
 }
 
+// Test_client_clientIDPolicy tests that the server responds with a ConnAck containing
+// an pkg.RtIdentifierRejected when the client identifier violates the policy of the options.
+func Test_client_clientIDPolicy(t *testing.T) {
+	ms := newMockServer(t)
+	ms.opts = Options{ClientIDMaxLength: 12, ClientIDCharset: "a-z0-9-", ClientIDPrefix: "dev-"}
+	tests := map[string]pkg.ReturnCode{
+		"dev-abc-123":   pkg.RtServerUnavailable, // accepted, no NATS connection
+		"dev-abcdefghi": pkg.RtIdentifierRejected,
+		"dev-ABC":       pkg.RtIdentifierRejected,
+		"abc-123":       pkg.RtIdentifierRejected,
+	}
+	for cid, rt := range tests {
+		ms.ncError = errors.New("unauthorized")
+		conn := mock.NewConnection()
+		rConn := conn.Remote()
+		cl := NewClient(ms, silent, conn)
+		go cl.Serve()
+
+		writePacket(t, pkg.NewConnect(cid, false, 1, nil, nil), rConn)
+		ca, ok := packet.Parse(t, rConn).(*pkg.ConnAck)
+		utils.CheckTrue(ok, t)
+		utils.CheckEqual(rt, ca.ReturnCode(), t)
+	}
+}
+
+// Test_assignClientID_policy tests that an assigned client identifier is accepted by a restrictive client
+// identifier policy and that no identifier is assigned when the policy leaves no room for one.
+func Test_assignClientID_policy(t *testing.T) {
+	ms := newMockServer(t)
+	opts := &Options{ClientIDMaxLength: 7, ClientIDCharset: "a-f0-9-", ClientIDPrefix: "de-"}
+	for i := 0; i < 100; i++ {
+		cid, ok := assignClientID(opts, ms)
+		utils.CheckTrue(ok, t)
+		utils.CheckEqual(7, len(cid), t)
+		utils.CheckTrue(validClientID(opts, cid), t)
+		ms.Create(cid)
+	}
+
+	_, ok := assignClientID(&Options{ClientIDMaxLength: 4, ClientIDPrefix: "dev-"}, ms)
+	utils.CheckFalse(ok, t)
+	_, ok = assignClientID(&Options{ClientIDCharset: "å-ö"}, ms)
+	utils.CheckFalse(ok, t)
+}
+
 // Test_client_natsConnError tests that the server responds with a ConnAck containing
 // an pkg.RtServerUnavailable when the client was unable to establish a NATS connection.
 func Test_client_natsConnError(t *testing.T) {
@@ -124,8 +186,9 @@ func Test_client_natsSubscribeError(t *testing.T) {
 	cl := NewClient(ms, utils.NewLogger(logger.Error, mt), conn)
 	go cl.Serve()
 
+	// no keep alive, the client must not time out and close the mock NATS connection while other tests run
 	rConn := conn.Remote()
-	writePacket(t, pkg.NewConnect("client-id", true, 1, nil, nil), rConn)
+	writePacket(t, pkg.NewConnect("client-id", true, 0, nil, nil), rConn)
 	ca, ok := packet.Parse(t, rConn).(*pkg.ConnAck)
 	utils.CheckTrue(ok, t)
 	utils.CheckEqual(pkg.RtAccepted, ca.ReturnCode(), t)
@@ -315,3 +378,103 @@ func Test_write_failure_during_drain(t *testing.T) {
 	utils.CheckTrue(ok, t)
 	utils.CheckEqual("write failed", err.Error(), t)
 }
+
+type writeBlock struct {
+	*mock.Connection
+	succeed uint
+	closed  chan struct{}
+	blocked chan struct{}
+	once    sync.Once
+}
+
+func (c *writeBlock) Write(bs []byte) (int, error) {
+	if c.succeed == 0 {
+		if c.blocked != nil {
+			c.blocked <- struct{}{}
+		}
+		<-c.closed
+		return 0, errors.New("connection closed")
+	}
+	c.succeed--
+	return c.Connection.Write(bs)
+}
+
+func (c *writeBlock) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Connection.Close()
+}
+
+// Test_client_takeOverBlockedWrite checks that a take over closes the connection of a client that doesn't
+// read what is written to it
+func Test_client_takeOverBlockedWrite(t *testing.T) {
+	conn := &writeBlock{Connection: mock.NewConnection(), succeed: 1, closed: make(chan struct{})}
+	cl := newClient(newMockServer(t), silent, conn, nil)
+	go cl.Serve()
+
+	rConn := conn.Remote()
+	writePacket(t, pkg.NewConnect("client-id", false, 1, nil, nil), rConn)
+	ca, ok := packet.Parse(t, rConn).(*pkg.ConnAck)
+	utils.CheckTrue(ok, t)
+	utils.CheckEqual(pkg.RtAccepted, ca.ReturnCode(), t)
+
+	// the write loop blocks on this packet
+	cl.queueForWrite(pkg.PingResponseSingleton)
+
+	done := make(chan bool, 1)
+	go func() {
+		cl.TakeOver()
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(3 * takeOverTimeout):
+		t.Fatal("take over did not return")
+	}
+	select {
+	case <-cl.done:
+	default:
+		t.Fatal("client was not released")
+	}
+}
+
+// Test_client_takeOverFullQueue checks that a take over doesn't block when the write queue of a client that
+// doesn't read what is written to it is full
+func Test_client_takeOverFullQueue(t *testing.T) {
+	conn := &writeBlock{Connection: mock.NewConnection(), succeed: 1, closed: make(chan struct{}),
+		blocked: make(chan struct{}, 1)}
+	cl := newClient(newMockServer(t), silent, conn, nil)
+	go cl.Serve()
+
+	rConn := conn.Remote()
+	writePacket(t, pkg.NewConnect5("client-id", false, 1, nil, nil, nil), rConn)
+	ca, ok := packet.Parse5(t, rConn).(*pkg.ConnAck)
+	utils.CheckTrue(ok, t)
+	utils.CheckEqual(pkg.RtAccepted, ca.ReturnCode(), t)
+
+	// the write loop blocks on the first packet and the rest fills up the queue
+	cl.queueForWrite(pkg.PingResponseSingleton)
+	<-conn.blocked
+	for full := false; !full; {
+		select {
+		case cl.writeQueue <- pkg.PingResponseSingleton:
+		default:
+			full = true
+		}
+	}
+
+	done := make(chan bool, 1)
+	go func() {
+		cl.TakeOver()
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(3 * takeOverTimeout):
+		t.Fatal("take over did not return")
+	}
+	select {
+	case <-cl.done:
+	default:
+		t.Fatal("client was not released")
+	}
+}
@@ -0,0 +1,96 @@
+package bridge
+
+import (
+	"strings"
+
+	"github.com/nats-io/nuid"
+)
+
+// validClientID returns true if the given client identifier is accepted by the client identifier policy of
+// the given options.
+func validClientID(opts *Options, clientID string) bool {
+	if opts.ClientIDMaxLength > 0 && len(clientID) > opts.ClientIDMaxLength {
+		return false
+	}
+	if !strings.HasPrefix(clientID, opts.ClientIDPrefix) {
+		return false
+	}
+	if opts.ClientIDCharset != `` {
+		set := []rune(opts.ClientIDCharset)
+		for _, r := range clientID {
+			if !inCharset(set, r) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// inCharset returns true if the given rune is found in the given set of characters. A dash between two
+// characters denotes a range.
+func inCharset(set []rune, r rune) bool {
+	for i := 0; i < len(set); i++ {
+		if i+2 < len(set) && set[i+1] == '-' {
+			if set[i] <= r && r <= set[i+2] {
+				return true
+			}
+			i += 2
+		} else if set[i] == r {
+			return true
+		}
+	}
+	return false
+}
+
+// assignAttempts is the number of identifiers that assignClientID tries before it gives up
+const assignAttempts = 10
+
+// assignClientID returns a unique client identifier for a client that connected without one. The identifier
+// has no session in the given session manager and is accepted by the client identifier policy of the given
+// options. The returned bool is false when no such identifier was found.
+func assignClientID(opts *Options, m SessionManager) (string, bool) {
+	var cs []byte
+	if opts.ClientIDCharset != `` {
+		if cs = charsetBytes(opts.ClientIDCharset); len(cs) == 0 {
+			return ``, false
+		}
+	}
+	n := 0
+	if opts.ClientIDMaxLength > 0 {
+		if n = opts.ClientIDMaxLength - len(opts.ClientIDPrefix); n <= 0 {
+			return ``, false
+		}
+	}
+	for i := 0; i < assignAttempts; i++ {
+		id := []byte(nuid.Next())
+		if n > 0 && n < len(id) {
+			// the end of a nuid is the sequence that changes with each call
+			id = id[len(id)-n:]
+		}
+		if cs != nil {
+			for j := range id {
+				id[j] = cs[int(id[j])%len(cs)]
+			}
+		}
+		cid := opts.ClientIDPrefix + string(id)
+		if !validClientID(opts, cid) {
+			return ``, false
+		}
+		if m.Get(cid) == nil {
+			return cid, true
+		}
+	}
+	return ``, false
+}
+
+// charsetBytes returns the printable ASCII characters that are found in the given client identifier charset
+func charsetBytes(charset string) []byte {
+	set := []rune(charset)
+	var cs []byte
+	for r := rune('!'); r <= '~'; r++ {
+		if inCharset(set, r) {
+			cs = append(cs, byte(r))
+		}
+	}
+	return cs
+}
@@ -0,0 +1,162 @@
+package bridge
+
+import (
+	"encoding/base64"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+	"github.com/tada/mqtt-nats/mqtt"
+	"github.com/tada/mqtt-nats/mqtt/pkg"
+)
+
+// bridgeHeaderPrefix starts the names of the headers that carry the MQTT 5 properties that aren't user
+// properties, and the headers that the bridge uses for its own purposes. User properties with a name in
+// this namespace are dropped.
+const bridgeHeaderPrefix = "Bridge-"
+
+const (
+	// headerContentType is the name of the NATS header that carries the MQTT 5 content type
+	headerContentType = bridgeHeaderPrefix + "Content-Type"
+
+	// headerPayloadFormat is the name of the NATS header that carries the MQTT 5 payload format indicator
+	headerPayloadFormat = bridgeHeaderPrefix + "Payload-Format"
+
+	// headerCorrelationData is the name of the NATS header that carries the base64 encoded MQTT 5
+	// correlation data
+	headerCorrelationData = bridgeHeaderPrefix + "Correlation-Data"
+
+	// headerUserOrder is the name of the NATS header that lists the names of the user properties in the
+	// order that they were sent
+	headerUserOrder = bridgeHeaderPrefix + "User-Order"
+
+	// headerOrigin is the name of the NATS header that carries the client identifier of a publishing client
+	// that has a No Local subscription
+	headerOrigin = bridgeHeaderPrefix + "Origin-Client-Id"
+)
+
+// natsHeader returns the NATS header that corresponds to the user properties, content type, payload format
+// indicator, and correlation data of the given MQTT 5 properties, or nil when there's nothing to map. All
+// header names are prefixed with the given prefix. User properties with names that are reserved by NATS or
+// by the bridge are skipped.
+func natsHeader(prefix string, props mqtt.Properties) nats.Header {
+	var h nats.Header
+	var order []string
+	for i := range props {
+		var k, v string
+		p := props[i]
+		switch p.ID {
+		case mqtt.PropUserProperty:
+			sp := p.Value.(mqtt.StringPair)
+			if prefix+sp.Key == `` || !userHeader(prefix, prefix+sp.Key) {
+				continue
+			}
+			k = sp.Key
+			v = sp.Value
+			order = append(order, k)
+		case mqtt.PropContentType:
+			k = headerContentType
+			v = p.Value.(string)
+		case mqtt.PropPayloadFormatIndicator:
+			k = headerPayloadFormat
+			v = strconv.Itoa(p.Value.(int))
+		case mqtt.PropCorrelationData:
+			k = headerCorrelationData
+			v = base64.StdEncoding.EncodeToString(p.Value.([]byte))
+		default:
+			continue
+		}
+		if h == nil {
+			h = nats.Header{}
+		}
+		h.Add(prefix+k, v)
+	}
+	if len(order) > 1 {
+		h[prefix+headerUserOrder] = order
+	}
+	return h
+}
+
+// natsHeaderPrefix is the prefix of the headers that are reserved by NATS, e.g. for JetStream
+const natsHeaderPrefix = "Nats-"
+
+// reservedHeader returns true if the given header name starts with natsHeaderPrefix, regardless of case
+func reservedHeader(k string) bool {
+	return hasPrefixFold(k, natsHeaderPrefix)
+}
+
+// userHeader returns true if the given header name starts with the given prefix and can carry a user
+// property, i.e. it is reserved neither by NATS nor by the bridge
+func userHeader(prefix, k string) bool {
+	return strings.HasPrefix(k, prefix) && !reservedHeader(k) && !hasPrefixFold(k[len(prefix):], bridgeHeaderPrefix)
+}
+
+// hasPrefixFold returns true if s starts with the given prefix, regardless of case
+func hasPrefixFold(s, prefix string) bool {
+	return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+}
+
+// mqttProperties returns the MQTT 5 properties that corresponds to the given NATS header. Only headers
+// with a name that starts with the given prefix are considered. Headers reserved by NATS are ignored. The
+// user properties keep the order that the bridge recorded when it published the message, or are sorted by
+// name when no order was recorded.
+func mqttProperties(prefix string, h nats.Header) mqtt.Properties {
+	var props mqtt.Properties
+	if v := h.Get(prefix + headerContentType); v != `` {
+		props = props.Set(mqtt.PropContentType, v)
+	}
+	if pf, err := strconv.Atoi(h.Get(prefix + headerPayloadFormat)); err == nil && (pf == 0 || pf == 1) {
+		props = props.Set(mqtt.PropPayloadFormatIndicator, pf)
+	}
+	if v := h.Get(prefix + headerCorrelationData); v != `` {
+		if cd, err := base64.StdEncoding.DecodeString(v); err == nil {
+			props = props.Set(mqtt.PropCorrelationData, cd)
+		}
+	}
+
+	if order, ok := h[prefix+headerUserOrder]; ok {
+		next := make(map[string]int, len(order))
+		for _, k := range order {
+			vs := h[prefix+k]
+			if i := next[k]; i < len(vs) && userHeader(prefix, prefix+k) {
+				props = props.Add(mqtt.PropUserProperty, mqtt.StringPair{Key: k, Value: vs[i]})
+				next[k] = i + 1
+			}
+		}
+		return props
+	}
+
+	// sort the names to get a predictable order of the user properties
+	ks := make([]string, 0, len(h))
+	for k := range h {
+		if userHeader(prefix, k) {
+			ks = append(ks, k)
+		}
+	}
+	sort.Strings(ks)
+	for _, k := range ks {
+		for _, v := range h[k] {
+			props = props.Add(mqtt.PropUserProperty, mqtt.StringPair{Key: k[len(prefix):], Value: v})
+		}
+	}
+	return props
+}
+
+// newNatsMsg creates the NATS message that is used when publishing the given MQTT packet
+func newNatsMsg(prefix, reply string, pp *pkg.Publish) *nats.Msg {
+	return &nats.Msg{
+		Subject: mqtt.ToNATS(pp.TopicName()),
+		Reply:   reply,
+		Header:  natsHeader(prefix, pp.Properties()),
+		Data:    pp.Payload()}
+}
+
+// publishMsg publishes the given message. Headers are silently dropped when the NATS server doesn't
+// support them.
+func publishMsg(nc *nats.Conn, m *nats.Msg) error {
+	if len(m.Header) > 0 && !nc.HeadersSupported() {
+		m.Header = nil
+	}
+	return nc.PublishMsg(m)
+}
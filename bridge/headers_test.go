@@ -0,0 +1,45 @@
+package bridge
+
+import (
+	"testing"
+
+	"github.com/tada/mqtt-nats/mqtt"
+	"github.com/tada/mqtt-nats/test/utils"
+)
+
+func Test_natsHeader_reserved(t *testing.T) {
+	props := mqtt.Properties{}.
+		Add(mqtt.PropUserProperty, mqtt.StringPair{Key: "Nats-Msg-Id", Value: "1"}).
+		Add(mqtt.PropUserProperty, mqtt.StringPair{Key: "nats-expected-last-sequence", Value: "7"}).
+		Add(mqtt.PropUserProperty, mqtt.StringPair{Key: "unit", Value: "C"})
+
+	h := natsHeader(``, props)
+	utils.CheckEqual(1, len(h), t)
+	utils.CheckEqual("C", h.Get("unit"), t)
+
+	// a prefix that isn't reserved makes the names harmless
+	h = natsHeader("Mqtt-", props)
+	utils.CheckEqual(4, len(h), t)
+	utils.CheckEqual("1", h.Get("Mqtt-Nats-Msg-Id"), t)
+}
+
+func Test_mqttProperties_userPropertyOrder(t *testing.T) {
+	props := mqtt.Properties{}.
+		Add(mqtt.PropUserProperty, mqtt.StringPair{Key: "z", Value: "1"}).
+		Add(mqtt.PropUserProperty, mqtt.StringPair{Key: "a", Value: "2"}).
+		Add(mqtt.PropUserProperty, mqtt.StringPair{Key: "z", Value: "3"})
+	utils.CheckEqual(props, mqttProperties("Mqtt-", natsHeader("Mqtt-", props)), t)
+}
+
+func Test_mqttProperties_userPropertyNames(t *testing.T) {
+	props := mqtt.Properties{}.
+		Add(mqtt.PropContentType, "text/plain").
+		Add(mqtt.PropUserProperty, mqtt.StringPair{Key: "Content-Type", Value: "application/json"}).
+		Add(mqtt.PropUserProperty, mqtt.StringPair{Key: "Correlation-Data", Value: "AQID"}).
+		Add(mqtt.PropUserProperty, mqtt.StringPair{Key: "bridge-content-type", Value: "dropped"})
+	utils.CheckEqual(mqtt.Properties{}.
+		Add(mqtt.PropContentType, "text/plain").
+		Add(mqtt.PropUserProperty, mqtt.StringPair{Key: "Content-Type", Value: "application/json"}).
+		Add(mqtt.PropUserProperty, mqtt.StringPair{Key: "Correlation-Data", Value: "AQID"}),
+		mqttProperties(``, natsHeader(``, props)), t)
+}
@@ -0,0 +1,119 @@
+package bridge
+
+import (
+	"hash/fnv"
+	"strconv"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+	"github.com/tada/mqtt-nats/mqtt"
+	"github.com/tada/mqtt-nats/mqtt/pkg"
+)
+
+// jsAckPrefix is the prefix of the reply subject of a message delivered by a JetStream consumer
+const jsAckPrefix = "$JS.ACK."
+
+// ackPayload returns the payload used when acknowledging a message with the given reply subject. A
+// JetStream message is acknowledged with an empty payload.
+func ackPayload(replyTo string) []byte {
+	if strings.HasPrefix(replyTo, jsAckPrefix) {
+		return nil
+	}
+	return []byte{0}
+}
+
+// durableName returns the name of the durable JetStream consumer for the given client ID and topic filter
+func durableName(clientID, filter string) string {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(clientID))
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write([]byte(filter))
+	return `mqtt-` + strconv.FormatUint(h.Sum64(), 16)
+}
+
+// deleteDurables deletes the durable JetStream consumers of the given session
+func deleteDurables(js nats.JetStreamContext, stream string, ss Session) {
+	for _, tp := range ss.Subscriptions() {
+		if tp.QoS > 0 {
+			// the consumer doesn't exist if the subscription used core NATS, so errors are ignored
+			_ = js.DeleteConsumer(stream, durableName(ss.ClientID(), tp.Name))
+		}
+	}
+}
+
+// deleteDurables deletes the durable JetStream consumers of the given session using the NATS connection of
+// the bridge. Nothing happens unless JetStream is enabled in the options.
+func (s *server) deleteDurables(ss Session) {
+	stream := s.opts.JetStreamStream
+	if stream == `` {
+		return
+	}
+	nc, err := s.serverNatsConn()
+	if err != nil {
+		s.Error("NATS connect failed", err)
+		return
+	}
+	js, err := nc.JetStream()
+	if err != nil {
+		s.Error("JetStream", err)
+		return
+	}
+	deleteDurables(js, stream, ss)
+}
+
+// useDurable returns true if a subscription with the given QoS should be served by a durable JetStream
+// consumer, i.e. when JetStream is enabled, the QoS is > 0, and the session outlives the connection.
+func (c *client) useDurable(qos byte) bool {
+	return c.js != nil && qos > 0 && c.session.ExpiryInterval() != 0
+}
+
+// jsPublish publishes the given QoS > 0 packet to the JetStream stream. The client is acknowledged once the
+// stream has stored the message.
+func (c *client) jsPublish(pp *pkg.Publish) error {
+	m := c.natsMsg(``, pp)
+	paf, err := c.js.PublishMsgAsync(m, nats.ExpectStream(c.server.Options().JetStreamStream))
+	if err != nil {
+		return err
+	}
+	c.session.AckRequested(pp.ID(), nil)
+	mt := NewReplyTopic(c.session, pp)
+	go func() {
+		select {
+		case <-paf.Ok():
+			c.natsAckReceived(mt)
+		case err := <-paf.Err():
+			// forget the packet so that a resend from the client is published again
+			c.session.AckReceived(pp.ID())
+			c.Error("JetStream publish", m.Subject, err)
+		}
+	}()
+	return nil
+}
+
+// jsSubscribe subscribes to the given subject using a durable JetStream consumer that belongs to the
+// session and the given topic filter. An existing consumer is resumed. The client's own publications are
+// acknowledged without being delivered when noLocal is true.
+func (c *client) jsSubscribe(filter, subject string, noLocal bool) (*nats.Subscription, error) {
+	return c.js.Subscribe(subject, func(m *nats.Msg) {
+		if noLocal && c.isLocal(m) {
+			_ = m.Ack()
+			return
+		}
+		c.jsResponse(m)
+	},
+		nats.BindStream(c.server.Options().JetStreamStream),
+		nats.Durable(durableName(c.session.ClientID(), filter)),
+		nats.DeliverNew(),
+		nats.AckExplicit(),
+		nats.ManualAck())
+}
+
+// jsResponse delivers a message from a durable JetStream consumer to the client using QoS 1. The message is
+// acknowledged when the client acknowledges it.
+func (c *client) jsResponse(m *nats.Msg) {
+	pp := pkg.NewPublish(0, mqtt.FromNATS(m.Subject), 2, m.Data, false, m.Reply)
+	if len(m.Header) > 0 {
+		pp.SetProperties(mqttProperties(c.server.Options().HeaderPrefix, m.Header))
+	}
+	c.PublishResponse(1, pp)
+}
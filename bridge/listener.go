@@ -0,0 +1,335 @@
+package bridge
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+
+	"github.com/tada/mqtt-nats/mqtt/pkg"
+)
+
+const (
+	// TransportTCP is the transport of a listener that accepts plain MQTT connections
+	TransportTCP = "tcp"
+
+	// TransportTLS is the transport of a listener that accepts MQTT over TLS connections
+	TransportTLS = "tls"
+
+	// TransportWS is the transport of a listener that accepts MQTT over WebSocket connections
+	TransportWS = "ws"
+
+	// TransportWSS is the transport of a listener that accepts MQTT over secure WebSocket connections
+	TransportWSS = "wss"
+
+	// TransportUnix is the transport of a listener that accepts MQTT connections on a Unix domain socket
+	TransportUnix = "unix"
+
+	// TransportMQTTSN is the transport of an MQTT-SN gateway that serves MQTT-SN 1.2 clients over UDP
+	TransportMQTTSN = "mqttsn"
+)
+
+const (
+	// ClientAuthNone is the authentication policy of a listener that accepts clients with and without
+	// credentials
+	ClientAuthNone = "none"
+
+	// ClientAuthPassword is the authentication policy of a listener that requires a user name
+	ClientAuthPassword = "password"
+
+	// ClientAuthCertificate is the authentication policy of a TLS listener that requires a client
+	// certificate that is verified against the CA certificate of the listener and uses the identity of the
+	// certificate as the user name. The identity is the first email address of the certificate, its first DNS
+	// name, or its subject, in that order of preference.
+	ClientAuthCertificate = "certificate"
+
+	// ClientAuthPeer is the authentication policy of a Unix domain socket listener that uses the name of the
+	// user that owns the connecting process as the user name. The name is obtained from the peer credentials
+	// of the socket (SO_PEERCRED), which are only available on Linux.
+	ClientAuthPeer = "peer"
+)
+
+// Listener is the configuration of one of the listeners that MQTT clients connect to
+type Listener struct {
+	// Transport is TransportTCP, TransportTLS, TransportWS, TransportWSS, TransportUnix, or
+	// TransportMQTTSN. The default is TransportTCP.
+	Transport string `json:"transport"`
+
+	// Address is the host and port to listen on, e.g. ":1883", or the path of the socket file when the
+	// transport is TransportUnix. The port of a TransportMQTTSN listener is a UDP port.
+	Address string `json:"address"`
+
+	// Path is the HTTP path where WebSocket clients connect. The default is "/mqtt".
+	Path string `json:"path"`
+
+	// SocketMode is the octal file mode of the socket file of a TransportUnix listener, e.g. "0660". The
+	// default depends on the umask of the process.
+	SocketMode string `json:"socket_mode"`
+
+	// TLSCert and TLSKey are the files with the server certificate and its key. They are mandatory for the
+	// TransportTLS and TransportWSS transports.
+	TLSCert string `json:"tls_cert"`
+	TLSKey  string `json:"tls_key"`
+
+	// TLSCaCert is the file with the root certificates used when verifying client certificates
+	TLSCaCert string `json:"tls_ca_cert"`
+
+	// TLSVerify requires a client certificate that is verified against TLSCaCert
+	TLSVerify bool `json:"tls_verify"`
+
+	// ProxyProtocol requires that each connection starts with a PROXY protocol v1 or v2 header, which
+	// is sent by load balancers such as HAProxy and AWS NLB. The client address of the header is used
+	// instead of the address of the load balancer. The common name of a client certificate that the load
+	// balancer has verified is passed in a v2 header and used by ClientAuthCertificate when the listener
+	// doesn't use TLS itself.
+	ProxyProtocol bool `json:"proxy_protocol"`
+
+	// Auth is the authentication policy of the listener, ClientAuthNone, ClientAuthPassword,
+	// ClientAuthCertificate, or ClientAuthPeer. The default is ClientAuthNone.
+	Auth string `json:"auth"`
+
+	// PredefinedTopics maps the predefined topic IDs of a TransportMQTTSN gateway to topic names. MQTT-SN
+	// clients may publish and subscribe to a predefined topic ID without registering the topic name.
+	PredefinedTopics map[uint16]string `json:"predefined_topics"`
+
+	// GatewayID is the ID that a TransportMQTTSN gateway returns in GWINFO
+	GatewayID byte `json:"gateway_id"`
+}
+
+// LoadListeners reads a JSON list of listeners from the file at the given path
+func LoadListeners(path string) ([]*Listener, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var ls []*Listener
+	if err = json.Unmarshal(bs, &ls); err != nil {
+		return nil, err
+	}
+	return ls, nil
+}
+
+// String returns the transport and the address of the listener
+func (l *Listener) String() string {
+	return l.transport() + `://` + l.Address
+}
+
+func (l *Listener) transport() string {
+	if l.Transport == `` {
+		return TransportTCP
+	}
+	return l.Transport
+}
+
+// secure returns true if the listener uses TLS
+func (l *Listener) secure() bool {
+	t := l.transport()
+	return t == TransportTLS || t == TransportWSS
+}
+
+// validate returns an error if the listener cannot be used
+func (l *Listener) validate() error {
+	switch l.transport() {
+	case TransportTCP, TransportTLS, TransportWS, TransportWSS, TransportUnix, TransportMQTTSN:
+	default:
+		return fmt.Errorf("invalid transport %q of listener %s", l.Transport, l.Address)
+	}
+	if l.transport() == TransportMQTTSN {
+		// MQTT-SN clients have no credentials and UDP has neither TLS nor the PROXY protocol
+		if (l.Auth != `` && l.Auth != ClientAuthNone) || l.ProxyProtocol {
+			return fmt.Errorf("MQTT-SN gateway %s supports neither authentication nor the PROXY protocol", l)
+		}
+		return nil
+	}
+	switch l.Auth {
+	case ``, ClientAuthNone, ClientAuthPassword, ClientAuthCertificate, ClientAuthPeer:
+	default:
+		return fmt.Errorf("invalid authentication policy %q of listener %s", l.Auth, l)
+	}
+	if l.transport() == TransportUnix {
+		if err := validSocketMode(l.SocketMode); err != nil {
+			return fmt.Errorf("listener %s: %v", l, err)
+		}
+	}
+	if l.Auth == ClientAuthPeer {
+		if l.transport() != TransportUnix {
+			return fmt.Errorf("peer authentication on listener %s requires a Unix domain socket", l)
+		}
+		if !peerCredSupported {
+			return fmt.Errorf("peer authentication on listener %s is not supported on this platform", l)
+		}
+	}
+	if !l.secure() {
+		if l.Auth == ClientAuthCertificate && !l.ProxyProtocol {
+			return fmt.Errorf("certificate authentication on listener %s requires TLS or the PROXY protocol", l)
+		}
+		return nil
+	}
+	if l.TLSCert == `` || l.TLSKey == `` {
+		return fmt.Errorf("listener %s requires a TLS certificate and key", l)
+	}
+	if (l.TLSVerify || l.Auth == ClientAuthCertificate) && l.TLSCaCert == `` {
+		return fmt.Errorf("client certificates cannot be verified on listener %s without a CA certificate", l)
+	}
+	return nil
+}
+
+// listeners returns the listeners of the options. The single listener of the Port and TLS options, the
+// listener of the WebSocket options, and the MQTT-SN gateway are used when no listeners are given.
+func (opts *Options) listeners() []*Listener {
+	if len(opts.Listeners) > 0 {
+		return opts.Listeners
+	}
+	l := &Listener{
+		Transport: TransportTCP,
+		Address:   `:` + strconv.Itoa(opts.Port),
+		TLSCert:   opts.TLSCert,
+		TLSKey:    opts.TLSKey,
+		TLSCaCert: opts.TLSCaCert,
+		TLSVerify: opts.TLSVerify,
+		Auth:      ClientAuthNone}
+	ls := []*Listener{l}
+	if opts.WSPort != 0 {
+		wl := *l
+		wl.Transport = TransportWS
+		if opts.WSTLS {
+			wl.Transport = TransportWSS
+		}
+		wl.Address = `:` + strconv.Itoa(opts.WSPort)
+		wl.Path = opts.WSPath
+		ls = append(ls, &wl)
+	}
+	if opts.TLS {
+		l.Transport = TransportTLS
+	}
+	for _, l := range ls {
+		if opts.TLSMap && l.secure() {
+			l.Auth = ClientAuthCertificate
+		}
+	}
+	if opts.MQTTSNPort != 0 {
+		ls = append(ls, &Listener{
+			Transport:        TransportMQTTSN,
+			Address:          `:` + strconv.Itoa(opts.MQTTSNPort),
+			PredefinedTopics: opts.MQTTSNTopics})
+	}
+	return ls
+}
+
+// validListeners returns an error unless all listeners of the options can be used
+func validListeners(opts *Options) error {
+	ls := opts.listeners()
+	secure := false
+	for _, l := range ls {
+		if err := l.validate(); err != nil {
+			return err
+		}
+		secure = secure || l.secure()
+	}
+	if opts.TLSMap && !secure {
+		return errors.New("certificate mapping requires TLS")
+	}
+	return nil
+}
+
+// boundListener is a net.Listener and the configuration that it was created from
+type boundListener struct {
+	net.Listener
+	config *Listener
+}
+
+// listen creates the net.Listener of the given configuration. The returned tlsFiles is nil unless the
+// listener uses TLS.
+func (s *server) listen(l *Listener) (*boundListener, *tlsFiles, error) {
+	var (
+		tf  *tlsFiles
+		nl  net.Listener
+		err error
+	)
+	if l.transport() == TransportMQTTSN {
+		gw, err := s.listenMQTTSN(l)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &boundListener{Listener: gw, config: l}, nil, nil
+	}
+	if l.secure() {
+		if tf, err = newTLSFiles(l); err != nil {
+			return nil, nil, err
+		}
+	}
+	if l.transport() == TransportUnix {
+		nl, err = listenUnix(l)
+	} else {
+		nl, err = net.Listen(`tcp`, l.Address)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if l.ProxyProtocol {
+		// the PROXY protocol header precedes the TLS handshake
+		nl = &proxyListener{Listener: nl, timeout: s.tlsTimeout()}
+	}
+	if tf != nil {
+		nl = tls.NewListener(nl, tf.listenerConfig())
+	}
+	switch l.transport() {
+	case TransportWS, TransportWSS:
+		nl = newWSListener(nl, l.Path, s.tlsTimeout(), s)
+	}
+	return &boundListener{Listener: nl, config: l}, tf, nil
+}
+
+// getListeners creates the listeners of the options and collects the TLS files of the listeners
+func (s *server) getListeners() ([]*boundListener, error) {
+	var bls []*boundListener
+	s.tlsFiles = nil
+	for _, l := range s.opts.listeners() {
+		bl, tf, err := s.listen(l)
+		if err != nil {
+			closeListeners(bls)
+			return nil, err
+		}
+		bls = append(bls, bl)
+		if tf != nil {
+			s.tlsFiles = append(s.tlsFiles, tf)
+		}
+	}
+	return bls, nil
+}
+
+func closeListeners(listeners []*boundListener) {
+	for _, listener := range listeners {
+		_ = listener.Close()
+	}
+}
+
+// authenticate applies the authentication policy of the listener that the client connected to
+func (c *client) authenticate(cp *pkg.Connect) error {
+	if c.listener == nil {
+		return nil
+	}
+	switch c.listener.Auth {
+	case ClientAuthPassword:
+		if creds := cp.Credentials(); creds == nil || creds.User == `` {
+			return pkg.RtNotAuthorized
+		}
+	case ClientAuthCertificate:
+		user, ok := c.peerIdentity()
+		if !ok {
+			return pkg.RtNotAuthorized
+		}
+		cp.SetUserName(user)
+	case ClientAuthPeer:
+		user, err := peerUser(c.mqttConn)
+		if err != nil {
+			c.Error("peer credentials", err)
+			return pkg.RtNotAuthorized
+		}
+		cp.SetUserName(user)
+	}
+	return nil
+}
@@ -0,0 +1,805 @@
+package bridge
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/tada/mqtt-nats/mqtt"
+	"github.com/tada/mqtt-nats/mqtt/pkg"
+	"github.com/tada/mqtt-nats/mqttsn"
+)
+
+// snMaxDatagram is the size of the largest MQTT-SN message that the gateway can receive
+const snMaxDatagram = 0xffff
+
+// snSleepQueueSize is the maximum number of messages that are buffered for a sleeping client. The oldest
+// message is dropped when the buffer is full.
+const snSleepQueueSize = 100
+
+// snMaxRetries is the number of times that an unacknowledged QoS 1 message is sent again before it is dropped
+const snMaxRetries = 3
+
+// defaultSNRetryRate is the delay between each check for unacknowledged messages and expired clients unless
+// the RepeatRate option is set
+const defaultSNRetryRate = 5 * time.Second
+
+var errSNNotAuthorized = errors.New("not authorized")
+
+// LoadPredefinedTopics reads a JSON object that maps predefined MQTT-SN topic IDs to topic names from the
+// file at the given path, e.g. {"1": "sensors/temperature"}
+func LoadPredefinedTopics(path string) (map[uint16]string, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var topics map[uint16]string
+	if err = json.Unmarshal(bs, &topics); err != nil {
+		return nil, err
+	}
+	return topics, nil
+}
+
+// MQTT-SN client states
+const (
+	snConnecting   = iota // CONNECT received, waiting for the will topic and message
+	snActive              // connected
+	snAsleep              // sleeping, messages are buffered until the client wakes up
+	snDisconnected        // disconnected or lost, subscriptions are kept but messages are dropped
+)
+
+// snMessage is a message that is delivered to an MQTT-SN client
+type snMessage struct {
+	topic  string
+	data   []byte
+	qos    byte
+	retain bool
+	reply  string // NATS subject that acknowledges the message
+}
+
+// snInFlight is a QoS 1 message that awaits a PUBACK from the client
+type snInFlight struct {
+	pp      *mqttsn.Publish
+	reply   string
+	sent    time.Time
+	retries int
+}
+
+// snSubscription is the NATS subscription of a topic filter that an MQTT-SN client subscribed to
+type snSubscription struct {
+	ns  *nats.Subscription
+	qos byte
+}
+
+type snWill struct {
+	flags byte
+	topic string
+	msg   []byte
+}
+
+// snClient is the state of an MQTT-SN client. It is protected by the lock of the gateway.
+type snClient struct {
+	addr        net.Addr
+	id          string
+	state       int
+	clean       bool
+	duration    time.Duration // keep alive or sleep duration, zero means forever
+	lastSeen    time.Time
+	will        *snWill
+	topics      map[uint16]string // normal topic IDs registered by the client or the gateway
+	topicIDs    map[string]uint16
+	nextTopicID uint16
+	nextMsgID   uint16
+	subs        map[string]*snSubscription // keyed by topic filter
+	buffered    []*snMessage               // received while asleep
+	inFlight    map[uint16]*snInFlight
+	awaitsRel   map[uint16]bool // QoS 2 message IDs received but not yet released
+}
+
+func newSNClient(addr net.Addr, id string) *snClient {
+	return &snClient{
+		addr:      addr,
+		id:        id,
+		topics:    make(map[uint16]string),
+		topicIDs:  make(map[string]uint16),
+		subs:      make(map[string]*snSubscription),
+		inFlight:  make(map[uint16]*snInFlight),
+		awaitsRel: make(map[uint16]bool)}
+}
+
+// topicID returns the normal topic ID of the given topic name. An ID is assigned if the name has none. The
+// returned bool is true when the ID was assigned.
+func (c *snClient) topicID(name string) (uint16, bool) {
+	if id, ok := c.topicIDs[name]; ok {
+		return id, false
+	}
+	c.nextTopicID++
+	if c.nextTopicID == 0 || c.nextTopicID == 0xffff {
+		// IDs are exhausted, start over and forget the oldest registrations
+		c.nextTopicID = 1
+	}
+	id := c.nextTopicID
+	if old, ok := c.topics[id]; ok {
+		delete(c.topicIDs, old)
+	}
+	c.topics[id] = name
+	c.topicIDs[name] = id
+	return id, true
+}
+
+func (c *snClient) msgID() uint16 {
+	c.nextMsgID++
+	if c.nextMsgID == 0 {
+		c.nextMsgID = 1
+	}
+	return c.nextMsgID
+}
+
+// expired returns true if nothing has been heard from the client for one and a half times its keep alive or
+// sleep duration
+func (c *snClient) expired(now time.Time) bool {
+	return c.duration > 0 && now.Sub(c.lastSeen) > c.duration*3/2
+}
+
+// snGateway is an MQTT-SN gateway that serves clients over UDP. It implements net.Listener so that it is
+// started and closed along with the other listeners, but it serves its clients itself and Accept only
+// waits for the gateway to close.
+type snGateway struct {
+	s          *server
+	config     *Listener
+	conn       net.PacketConn
+	perm       *Permission
+	permErr    error
+	predefined map[string]uint16 // predefined topic IDs keyed by topic name
+	lock       sync.Mutex
+	clients    map[string]*snClient // keyed by address
+	nc         *nats.Conn
+	timer      *time.Timer
+	closed     chan struct{}
+	served     chan struct{}
+	closeOnce  sync.Once
+}
+
+// listenMQTTSN starts an MQTT-SN gateway on the UDP address of the given listener
+func (s *server) listenMQTTSN(l *Listener) (*snGateway, error) {
+	conn, err := net.ListenPacket(`udp`, l.Address)
+	if err != nil {
+		return nil, err
+	}
+	gw := &snGateway{
+		s:          s,
+		config:     l,
+		conn:       conn,
+		predefined: make(map[string]uint16, len(l.PredefinedTopics)),
+		clients:    make(map[string]*snClient),
+		closed:     make(chan struct{}),
+		served:     make(chan struct{})}
+
+	// MQTT-SN clients have no credentials so they get the permission of clients without a user name
+	gw.perm, gw.permErr = authorize(s.opts.Permissions, nil)
+	for id, name := range l.PredefinedTopics {
+		gw.predefined[name] = id
+	}
+	gw.lock.Lock()
+	gw.timer = time.AfterFunc(gw.retryRate(), gw.tick)
+	gw.lock.Unlock()
+	go gw.serve()
+	return gw, nil
+}
+
+// Accept waits until the gateway is closed
+func (gw *snGateway) Accept() (net.Conn, error) {
+	<-gw.closed
+	return nil, errListenerClosed
+}
+
+// Close tells the clients that the gateway disconnects them and stops the gateway
+func (gw *snGateway) Close() error {
+	var err error
+	gw.closeOnce.Do(func() {
+		close(gw.closed)
+		gw.lock.Lock()
+		gw.timer.Stop()
+		for _, c := range gw.clients {
+			if c.state == snActive || c.state == snAsleep {
+				gw.send(c.addr, &mqttsn.Disconnect{})
+			}
+			gw.unsubscribeAll(c)
+		}
+		gw.clients = nil
+		err = gw.conn.Close()
+		gw.lock.Unlock()
+		<-gw.served
+		if gw.nc != nil {
+			gw.nc.Close()
+		}
+	})
+	return err
+}
+
+// Addr returns the UDP address of the gateway
+func (gw *snGateway) Addr() net.Addr {
+	return gw.conn.LocalAddr()
+}
+
+func (gw *snGateway) retryRate() time.Duration {
+	if gw.s.opts.RepeatRate > 0 {
+		return time.Duration(gw.s.opts.RepeatRate) * time.Millisecond
+	}
+	return defaultSNRetryRate
+}
+
+func (gw *snGateway) natsConn() (*nats.Conn, error) {
+	var err error
+	if gw.nc == nil {
+		gw.nc, err = gw.s.NatsConn(nil)
+	}
+	return gw.nc, err
+}
+
+func (gw *snGateway) serve() {
+	defer close(gw.served)
+	buf := make([]byte, snMaxDatagram)
+	for {
+		n, addr, err := gw.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-gw.closed:
+				return
+			default:
+			}
+			gw.s.Error("MQTT-SN read", err)
+			continue
+		}
+		p, err := mqttsn.Parse(buf[:n])
+		if err != nil {
+			gw.s.Debug("MQTT-SN message from", addr, "dropped:", err)
+			continue
+		}
+		gw.s.Debug("MQTT-SN received", p, "from", addr)
+		gw.lock.Lock()
+		if gw.clients != nil {
+			gw.handle(addr, p)
+		}
+		gw.lock.Unlock()
+	}
+}
+
+func (gw *snGateway) send(addr net.Addr, p mqttsn.Packet) {
+	gw.s.Debug("MQTT-SN sending", p, "to", addr)
+	if _, err := gw.conn.WriteTo(mqttsn.Encode(p), addr); err != nil {
+		gw.s.Error("MQTT-SN write to", addr, err)
+	}
+}
+
+// handle handles a message from the given address. It is called with the lock held.
+func (gw *snGateway) handle(addr net.Addr, p mqttsn.Packet) {
+	c := gw.clients[addr.String()]
+	if c != nil && c.state != snDisconnected {
+		c.lastSeen = time.Now()
+	}
+	switch p := p.(type) {
+	case *mqttsn.SearchGw:
+		gw.send(addr, &mqttsn.GwInfo{GatewayID: gw.config.GatewayID})
+	case *mqttsn.Connect:
+		gw.handleConnect(addr, c, p)
+	case *mqttsn.PingReq:
+		gw.handlePing(addr, c, p)
+	case *mqttsn.Publish:
+		gw.handlePublish(addr, c, p)
+	default:
+		if c == nil {
+			gw.s.Debug("MQTT-SN message from unknown client", addr, "dropped")
+			return
+		}
+		gw.handleClientMessage(c, p)
+	}
+}
+
+// handleClientMessage handles a message that requires a known client
+func (gw *snGateway) handleClientMessage(c *snClient, p mqttsn.Packet) {
+	switch p := p.(type) {
+	case *mqttsn.WillTopic:
+		gw.handleWillTopic(c, p)
+	case *mqttsn.WillMsg:
+		if c.state == snConnecting && c.will != nil {
+			c.will.msg = p.Message
+			gw.connected(c)
+		}
+	case *mqttsn.Register:
+		gw.handleRegister(c, p)
+	case *mqttsn.RegAck:
+		if p.ReturnCode != mqttsn.RcAccepted {
+			gw.s.Debug("MQTT-SN client", c.id, "rejected topic ID", p.TopicID, p.ReturnCode)
+		}
+	case *mqttsn.PubAck:
+		if f, ok := c.inFlight[p.MsgID]; ok {
+			delete(c.inFlight, p.MsgID)
+			if p.ReturnCode == mqttsn.RcAccepted {
+				gw.ack(f.reply)
+			} else {
+				gw.s.Debug("MQTT-SN client", c.id, "rejected", f.pp, p.ReturnCode)
+			}
+		}
+	case *mqttsn.Ack:
+		switch p.MsgType {
+		case mqttsn.TpPubRel:
+			delete(c.awaitsRel, p.MsgID)
+			gw.send(c.addr, &mqttsn.Ack{MsgType: mqttsn.TpPubComp, MsgID: p.MsgID})
+		default:
+			gw.s.Debug("MQTT-SN client", c.id, "sent unexpected", p)
+		}
+	case *mqttsn.Subscribe:
+		gw.handleSubscribe(c, p)
+	case *mqttsn.Unsubscribe:
+		gw.handleUnsubscribe(c, p)
+	case *mqttsn.Disconnect:
+		gw.handleDisconnect(c, p)
+	default:
+		gw.s.Debug("MQTT-SN client", c.id, "sent unexpected", p)
+	}
+}
+
+// clientByID returns the client with the given client ID or nil
+func (gw *snGateway) clientByID(id string) *snClient {
+	for _, c := range gw.clients {
+		if c.id == id {
+			return c
+		}
+	}
+	return nil
+}
+
+// moveClient makes the given client known by the given address
+func (gw *snGateway) moveClient(c *snClient, addr net.Addr) {
+	delete(gw.clients, c.addr.String())
+	c.addr = addr
+	gw.clients[addr.String()] = c
+}
+
+func (gw *snGateway) removeClient(c *snClient) {
+	gw.unsubscribeAll(c)
+	delete(gw.clients, c.addr.String())
+}
+
+func (gw *snGateway) handleConnect(addr net.Addr, c *snClient, cp *mqttsn.Connect) {
+	if gw.permErr != nil || cp.ClientID == `` || !validClientID(gw.s.opts, cp.ClientID) {
+		gw.s.Debug("MQTT-SN client", cp.ClientID, "at", addr, "refused")
+		gw.send(addr, &mqttsn.ConnAck{ReturnCode: mqttsn.RcNotSupported})
+		return
+	}
+	if c != nil && c.id != cp.ClientID {
+		// another client used this address before
+		gw.removeClient(c)
+		c = nil
+	}
+	if c == nil {
+		if c = gw.clientByID(cp.ClientID); c != nil {
+			gw.moveClient(c, addr)
+		}
+	}
+	if c != nil && cp.Flags&mqttsn.FlagCleanSession != 0 {
+		gw.removeClient(c)
+		c = nil
+	}
+	if c == nil {
+		c = newSNClient(addr, cp.ClientID)
+		gw.clients[addr.String()] = c
+	}
+	c.clean = cp.Flags&mqttsn.FlagCleanSession != 0
+	c.duration = time.Duration(cp.Duration) * time.Second
+	c.lastSeen = time.Now()
+	c.will = nil
+	if cp.Flags&mqttsn.FlagWill != 0 {
+		c.state = snConnecting
+		gw.send(addr, mqttsn.Empty(mqttsn.TpWillTopicReq))
+		return
+	}
+	gw.connected(c)
+}
+
+func (gw *snGateway) handleWillTopic(c *snClient, wp *mqttsn.WillTopic) {
+	if c.state != snConnecting {
+		return
+	}
+	if wp.Topic == `` {
+		// the client has no will after all
+		gw.connected(c)
+		return
+	}
+	if !gw.perm.mayPublish(mqtt.ToNATS(wp.Topic)) {
+		gw.s.Debug("MQTT-SN client", c.id, "will not authorized", wp.Topic)
+		gw.send(c.addr, &mqttsn.ConnAck{ReturnCode: mqttsn.RcNotSupported})
+		gw.removeClient(c)
+		return
+	}
+	c.will = &snWill{flags: wp.Flags, topic: wp.Topic}
+	gw.send(c.addr, mqttsn.Empty(mqttsn.TpWillMsgReq))
+}
+
+// connected completes the connection of the given client and sends the messages that were buffered while
+// it was asleep
+func (gw *snGateway) connected(c *snClient) {
+	c.state = snActive
+	gw.s.Debug("MQTT-SN client", c.id, "connected from", c.addr)
+	gw.send(c.addr, &mqttsn.ConnAck{ReturnCode: mqttsn.RcAccepted})
+	gw.flush(c)
+}
+
+// flush sends the messages that were buffered for the given client along with the messages that still await
+// an acknowledgement
+func (gw *snGateway) flush(c *snClient) {
+	for _, f := range c.inFlight {
+		f.pp.Flags |= mqttsn.FlagDup
+		f.sent = time.Now()
+		gw.send(c.addr, f.pp)
+	}
+	buffered := c.buffered
+	c.buffered = nil
+	for _, m := range buffered {
+		gw.deliver(c, m)
+	}
+}
+
+func (gw *snGateway) handlePing(addr net.Addr, c *snClient, pr *mqttsn.PingReq) {
+	if pr.ClientID != `` && (c == nil || c.id != pr.ClientID) {
+		// a sleeping client may wake up with another address
+		if c = gw.clientByID(pr.ClientID); c != nil {
+			gw.moveClient(c, addr)
+			c.lastSeen = time.Now()
+		}
+	}
+	if c != nil && c.state == snAsleep && pr.ClientID != `` {
+		// the client is awake until it gets the PINGRESP
+		c.state = snActive
+		gw.flush(c)
+		c.state = snAsleep
+	}
+	gw.send(addr, mqttsn.Empty(mqttsn.TpPingResp))
+}
+
+func (gw *snGateway) handleDisconnect(c *snClient, dp *mqttsn.Disconnect) {
+	if dp.Duration > 0 && c.state == snActive {
+		c.state = snAsleep
+		c.duration = time.Duration(dp.Duration) * time.Second
+		gw.s.Debug("MQTT-SN client", c.id, "sleeps for", c.duration)
+	} else {
+		gw.disconnected(c)
+	}
+	gw.send(c.addr, &mqttsn.Disconnect{})
+}
+
+// disconnected removes the given client unless it has a persistent session, in which case its
+// subscriptions are kept until it connects again or the session expires
+func (gw *snGateway) disconnected(c *snClient) {
+	gw.s.Debug("MQTT-SN client", c.id, "disconnected")
+	if c.clean {
+		gw.removeClient(c)
+		return
+	}
+	c.state = snDisconnected
+	c.buffered = nil
+	c.duration = time.Duration(gw.s.opts.SessionExpiry) * time.Second
+	c.lastSeen = time.Now()
+}
+
+// topicName returns the topic name of the given topic ID. The client is nil when a QoS -1 message is
+// received from an unknown client.
+func (gw *snGateway) topicName(c *snClient, idType byte, id uint16) (string, bool) {
+	switch idType {
+	case mqttsn.TopicIDNormal:
+		if c != nil {
+			name, ok := c.topics[id]
+			return name, ok
+		}
+	case mqttsn.TopicIDPredefined:
+		name, ok := gw.config.PredefinedTopics[id]
+		return name, ok
+	case mqttsn.TopicIDShort:
+		return mqttsn.ShortTopic(id), true
+	}
+	return ``, false
+}
+
+func (gw *snGateway) handleRegister(c *snClient, rp *mqttsn.Register) {
+	if c.state != snActive {
+		return
+	}
+	if rp.TopicName == `` || strings.ContainsAny(rp.TopicName, `+#`) {
+		gw.send(c.addr, &mqttsn.RegAck{MsgID: rp.MsgID, ReturnCode: mqttsn.RcNotSupported})
+		return
+	}
+	id, _ := c.topicID(rp.TopicName)
+	gw.send(c.addr, &mqttsn.RegAck{TopicID: id, MsgID: rp.MsgID, ReturnCode: mqttsn.RcAccepted})
+}
+
+func (gw *snGateway) handlePublish(addr net.Addr, c *snClient, pp *mqttsn.Publish) {
+	qos := pp.QoS()
+	if qos != mqttsn.QoSMinusOne && (c == nil || c.state != snActive) {
+		gw.s.Debug("MQTT-SN publish from unconnected client", addr, "dropped")
+		return
+	}
+	topic, ok := gw.topicName(c, pp.TopicIDType(), pp.TopicID)
+	if !ok {
+		gw.s.Debug("MQTT-SN publish from", addr, "with unknown topic ID", pp.TopicID)
+		if qos != mqttsn.QoSMinusOne {
+			gw.send(addr, &mqttsn.PubAck{TopicID: pp.TopicID, MsgID: pp.MsgID, ReturnCode: mqttsn.RcInvalidTopicID})
+		}
+		return
+	}
+	if qos == 2 && c.awaitsRel[pp.MsgID] {
+		// a duplicate that has been published already
+		gw.send(addr, &mqttsn.Ack{MsgType: mqttsn.TpPubRec, MsgID: pp.MsgID})
+		return
+	}
+
+	rc := mqttsn.RcAccepted
+	if err := gw.publish(topic, pp.Data, qos, pp.Retain()); err != nil {
+		gw.s.Debug("MQTT-SN publish to", topic, "from", addr, "failed:", err)
+		rc = mqttsn.RcCongestion
+		if err == errSNNotAuthorized {
+			rc = mqttsn.RcNotSupported
+		}
+	}
+	switch {
+	case qos == 2 && rc == mqttsn.RcAccepted:
+		c.awaitsRel[pp.MsgID] = true
+		gw.send(addr, &mqttsn.Ack{MsgType: mqttsn.TpPubRec, MsgID: pp.MsgID})
+	case qos == 1 || qos == 2:
+		gw.send(addr, &mqttsn.PubAck{TopicID: pp.TopicID, MsgID: pp.MsgID, ReturnCode: rc})
+	}
+}
+
+// publish publishes a message from an MQTT-SN client to NATS. Retained messages are kept in the same store
+// as the retained messages of MQTT clients. Messages with QoS 1 and 2 are acknowledged by the gateway
+// once they have been handed to NATS.
+func (gw *snGateway) publish(topic string, data []byte, qos byte, retain bool) error {
+	subject := mqtt.ToNATS(topic)
+	if !gw.perm.mayPublish(subject) {
+		return errSNNotAuthorized
+	}
+	nc, err := gw.natsConn()
+	if err != nil {
+		return err
+	}
+	if qos == mqttsn.QoSMinusOne {
+		qos = 0
+	}
+
+	// the retained packet has no ID, one is assigned when it is delivered
+	gw.s.HandleRetain(pkg.NewPublish2(0, topic, data, qos, false, retain))
+	return nc.Publish(subject, data)
+}
+
+// ack acknowledges a message that was delivered to a client by replying to its NATS reply subject
+func (gw *snGateway) ack(reply string) {
+	if reply == `` || gw.nc == nil {
+		return
+	}
+	if err := gw.nc.Publish(reply, nil); err != nil {
+		gw.s.Error("NATS publish ack", reply, err)
+	}
+}
+
+// subscriptionFilter returns the topic filter of the given SUBSCRIBE or UNSUBSCRIBE without registering a
+// topic ID for it
+func (gw *snGateway) subscriptionFilter(sp *mqttsn.Subscribe) (string, bool) {
+	switch sp.TopicIDType() {
+	case mqttsn.TopicIDNormal:
+		return sp.TopicName, sp.TopicName != ``
+	case mqttsn.TopicIDPredefined:
+		name, ok := gw.config.PredefinedTopics[sp.TopicID]
+		return name, ok
+	}
+	return mqttsn.ShortTopic(sp.TopicID), true
+}
+
+// subscriptionTopic returns the topic filter of the given SUBSCRIBE and the topic ID that is returned in the
+// SUBACK
+func (gw *snGateway) subscriptionTopic(c *snClient, sp *mqttsn.Subscribe) (string, uint16, bool) {
+	filter, ok := gw.subscriptionFilter(sp)
+	if !ok {
+		return ``, 0, false
+	}
+	switch sp.TopicIDType() {
+	case mqttsn.TopicIDNormal:
+		if strings.ContainsAny(filter, `+#`) {
+			return filter, 0, true
+		}
+		id, _ := c.topicID(filter)
+		return filter, id, true
+	case mqttsn.TopicIDPredefined:
+		return filter, sp.TopicID, true
+	}
+	return filter, 0, true
+}
+
+func (gw *snGateway) handleSubscribe(c *snClient, sp *mqttsn.Subscribe) {
+	if c.state != snActive {
+		return
+	}
+	filter, id, ok := gw.subscriptionTopic(c, sp)
+	if !ok {
+		gw.send(c.addr, &mqttsn.SubAck{MsgID: sp.MsgID, ReturnCode: mqttsn.RcInvalidTopicID})
+		return
+	}
+
+	// messages are delivered with at most QoS 1
+	qos := sp.QoS()
+	if qos == mqttsn.QoSMinusOne {
+		qos = 0
+	} else if qos > 1 {
+		qos = 1
+	}
+	subject := mqtt.ToNATSSubscription(filter)
+	if !gw.perm.maySubscribe(subject) {
+		gw.s.Debug("MQTT-SN client", c.id, "subscription not authorized", filter)
+		gw.send(c.addr, &mqttsn.SubAck{MsgID: sp.MsgID, ReturnCode: mqttsn.RcNotSupported})
+		return
+	}
+	if old, ok := c.subs[filter]; ok {
+		delete(c.subs, filter)
+		gw.unsubscribe(old)
+	}
+	nc, err := gw.natsConn()
+	var ns *nats.Subscription
+	if err == nil {
+		ns, err = nc.Subscribe(subject, func(m *nats.Msg) {
+			gw.natsMessage(c, qos, m)
+		})
+	}
+	if err != nil {
+		gw.s.Error("NATS subscribe", subject, err)
+		gw.send(c.addr, &mqttsn.SubAck{MsgID: sp.MsgID, ReturnCode: mqttsn.RcCongestion})
+		return
+	}
+	c.subs[filter] = &snSubscription{ns: ns, qos: qos}
+	gw.send(c.addr, &mqttsn.SubAck{
+		Flags: mqttsn.QoSFlags(qos), TopicID: id, MsgID: sp.MsgID, ReturnCode: mqttsn.RcAccepted})
+
+	pps, qs := gw.s.retainedPackets.matchingMessages([]pkg.Topic{{Name: filter, QoS: qos}})
+	for i, pp := range pps {
+		rq := qs[i]
+		if pp.QoSLevel() < rq {
+			rq = pp.QoSLevel()
+		}
+		gw.deliver(c, &snMessage{topic: pp.TopicName(), data: pp.Payload(), qos: rq, retain: true})
+	}
+}
+
+func (gw *snGateway) handleUnsubscribe(c *snClient, up *mqttsn.Unsubscribe) {
+	if filter, ok := gw.subscriptionFilter((*mqttsn.Subscribe)(up)); ok {
+		if sub, ok := c.subs[filter]; ok {
+			delete(c.subs, filter)
+			gw.unsubscribe(sub)
+		}
+	}
+	gw.send(c.addr, &mqttsn.Ack{MsgType: mqttsn.TpUnsubAck, MsgID: up.MsgID})
+}
+
+func (gw *snGateway) unsubscribe(sub *snSubscription) {
+	if err := sub.ns.Unsubscribe(); err != nil {
+		gw.s.Error("NATS unsubscribe", sub.ns.Subject, err)
+	}
+}
+
+func (gw *snGateway) unsubscribeAll(c *snClient) {
+	for _, sub := range c.subs {
+		gw.unsubscribe(sub)
+	}
+	c.subs = make(map[string]*snSubscription)
+}
+
+// natsMessage delivers a message that arrived on a NATS subscription of the given client. A message is
+// delivered with QoS 1 when the subscription was granted QoS 1 and the message has a reply subject that
+// acknowledges it.
+func (gw *snGateway) natsMessage(c *snClient, qos byte, m *nats.Msg) {
+	gw.lock.Lock()
+	defer gw.lock.Unlock()
+	if gw.clients == nil || gw.clients[c.addr.String()] != c {
+		return
+	}
+	if m.Reply == `` {
+		qos = 0
+	}
+	gw.deliver(c, &snMessage{topic: mqtt.FromNATS(m.Subject), data: m.Data, qos: qos, reply: m.Reply})
+}
+
+// deliver sends a message to the given client, or buffers it if the client is asleep. A topic name that
+// has no topic ID is registered with the client first.
+func (gw *snGateway) deliver(c *snClient, m *snMessage) {
+	switch c.state {
+	case snAsleep:
+		if len(c.buffered) >= snSleepQueueSize {
+			gw.s.Debug("MQTT-SN client", c.id, "is asleep and its buffer is full, dropping oldest message")
+			c.buffered = c.buffered[1:]
+		}
+		c.buffered = append(c.buffered, m)
+		return
+	case snActive:
+	default:
+		return
+	}
+
+	flags := mqttsn.QoSFlags(m.qos)
+	if m.retain {
+		flags |= mqttsn.FlagRetain
+	}
+	var id uint16
+	if pid, ok := gw.predefined[m.topic]; ok {
+		id = pid
+		flags |= mqttsn.TopicIDPredefined
+	} else if len(m.topic) == 2 {
+		id = mqttsn.ShortTopicID(m.topic)
+		flags |= mqttsn.TopicIDShort
+	} else {
+		var isNew bool
+		if id, isNew = c.topicID(m.topic); isNew {
+			gw.send(c.addr, &mqttsn.Register{TopicID: id, MsgID: c.msgID(), TopicName: m.topic})
+		}
+	}
+	pp := &mqttsn.Publish{Flags: flags, TopicID: id, Data: m.data}
+	if m.qos > 0 {
+		pp.MsgID = c.msgID()
+		c.inFlight[pp.MsgID] = &snInFlight{pp: pp, reply: m.reply, sent: time.Now()}
+	}
+	gw.send(c.addr, pp)
+}
+
+// tick sends unacknowledged messages again, handles clients that have been silent for too long, and then
+// schedules the next tick
+func (gw *snGateway) tick() {
+	gw.lock.Lock()
+	defer gw.lock.Unlock()
+	if gw.clients == nil {
+		return
+	}
+	now := time.Now()
+	rate := gw.retryRate()
+	for _, c := range gw.clients {
+		if c.expired(now) {
+			gw.lost(c)
+			continue
+		}
+		if c.state != snActive {
+			continue
+		}
+		for id, f := range c.inFlight {
+			if now.Sub(f.sent) < rate {
+				continue
+			}
+			if f.retries >= snMaxRetries {
+				gw.s.Debug("MQTT-SN client", c.id, "didn't acknowledge", f.pp, "dropping it")
+				delete(c.inFlight, id)
+				continue
+			}
+			f.retries++
+			f.sent = now
+			f.pp.Flags |= mqttsn.FlagDup
+			gw.send(c.addr, f.pp)
+		}
+	}
+	gw.timer.Reset(rate)
+}
+
+// lost is called when a client has been silent for longer than its keep alive or sleep duration, or when
+// the session of a disconnected client expires
+func (gw *snGateway) lost(c *snClient) {
+	if c.state == snDisconnected {
+		gw.s.Debug("MQTT-SN session expired", c.id)
+		gw.removeClient(c)
+		return
+	}
+	gw.s.Debug("MQTT-SN client", c.id, "lost")
+	if w := c.will; w != nil {
+		if err := gw.publish(w.topic, w.msg, mqttsn.QoS(w.flags), w.flags&mqttsn.FlagRetain != 0); err != nil {
+			gw.s.Error("MQTT-SN will of", c.id, err)
+		}
+	}
+	gw.disconnected(c)
+}
@@ -1,7 +1,9 @@
 package bridge
 
 import (
+	"encoding/base64"
 	"errors"
+	"time"
 
 	"github.com/nats-io/nats.go"
 	"github.com/tada/mqtt-nats/mqtt"
@@ -10,71 +12,349 @@ import (
 
 func (c *client) natsPublish(pp *pkg.Publish) error {
 	var err error
-	if pp.IsDup() {
+	if pp.QoSLevel() == 2 {
+		// Until PUBREL arrives, a QoS 2 packet with the same identifier is a duplicate regardless of
+		// the dup flag. It must not be forwarded again.
+		if c.session.AwaitsRel(pp.ID()) {
+			c.queueForWrite(pkg.PubRec(pp.ID()))
+			return nil
+		}
+		if c.session.AwaitsAck(pp.ID()) {
+			return nil
+		}
+	} else if pp.IsDup() {
 		if c.session.AwaitsAck(pp.ID()) {
 			// Already waiting for this one
 			return nil
 		}
 	}
 
-	natsSubject := mqtt.ToNATS(pp.TopicName())
+	if pp.QoSLevel() > 0 && c.v5() {
+		if rm := c.server.Options().ReceiveMaximum; rm > 0 && c.session.AwaitsAckCount() >= rm {
+			return pkg.RcReceiveMaximumExceeded
+		}
+	}
+
+	if responseTopic, isRequest := pp.Properties().Text(mqtt.PropResponseTopic); isRequest && pp.QoSLevel() <= 2 {
+		return c.natsRequest(responseTopic, pp)
+	}
 	switch pp.QoSLevel() {
 	case 0:
 		// Fire and forget
-		err = c.natsConn.Publish(natsSubject, pp.Payload())
-	case 1:
-		// use client id and packet id to form a reply subject
-		replyTo := NewReplyTopic(c.session, pp).String()
-		var sub *nats.Subscription
-		sub, err = c.natsSubscribeAck(replyTo)
+		err = publishMsg(c.natsConn, c.natsMsg(``, pp))
+	case 1, 2:
+		var (
+			replyTo string
+			sub     *nats.Subscription
+		)
+		if c.js != nil {
+			// acknowledged when the stream has stored the message
+			return c.jsPublish(pp)
+		} else {
+			// use client id and packet id to form a reply subject
+			replyTo = NewReplyTopic(c.session, pp).String()
+			sub, err = c.natsSubscribeAck(replyTo)
+		}
 		if err == nil {
 			c.session.AckRequested(pp.ID(), sub)
-			err = c.natsConn.PublishRequest(natsSubject, replyTo, pp.Payload())
+			err = publishMsg(c.natsConn, c.natsMsg(replyTo, pp))
 		}
-	case 2:
-		err = errors.New("QoS level 2 is not supported")
 	default:
 		err = errors.New("invalid QoS level")
 	}
 	return err
 }
 
+// natsMsg creates the NATS message that is used when publishing the given packet. The message carries the
+// client identifier when the client has a No Local subscription.
+func (c *client) natsMsg(reply string, pp *pkg.Publish) *nats.Msg {
+	prefix := c.server.Options().HeaderPrefix
+	m := newNatsMsg(prefix, reply, pp)
+	c.subLock.Lock()
+	noLocal := c.noLocal
+	c.subLock.Unlock()
+	if noLocal {
+		if m.Header == nil {
+			m.Header = nats.Header{}
+		}
+		m.Header.Set(prefix+headerOrigin, c.ClientID())
+	}
+	return m
+}
+
+// updateNoLocal sets the noLocal flag if one of the current subscriptions of the session has the No Local
+// option and clears it otherwise
+func (c *client) updateNoLocal() {
+	noLocal := false
+	for _, tp := range c.session.Subscriptions() {
+		if tp.NoLocal {
+			noLocal = true
+			break
+		}
+	}
+	c.subLock.Lock()
+	c.noLocal = noLocal
+	c.subLock.Unlock()
+}
+
+// isLocal returns true if the given message was published by this client
+func (c *client) isLocal(m *nats.Msg) bool {
+	return m.Header.Get(c.server.Options().HeaderPrefix+headerOrigin) == c.ClientID()
+}
+
 func (c *client) natsSubscribeAck(topic string) (*nats.Subscription, error) {
 	return c.natsConn.Subscribe(topic, func(m *nats.Msg) {
-		// Client may have disconnected at this point which is why it is essential to ask
-		// the session manager for the session based on the replyTo subject
-		mt := ParseReplyTopic(m.Subject)
-		if mt != nil {
-			if s := c.server.SessionManager().Get(mt.ClientID()); s != nil && s.ID() == mt.SessionID() {
-				c.cancelNatsSubscriptions(s.AckReceived(mt.PacketID()))
-				c.queueForWrite(pkg.PubAck(mt.PacketID()))
-			}
-		}
+		c.natsAckReceived(ParseReplyTopic(m.Subject))
 	})
 }
 
+// natsAckReceived acknowledges the publication that is identified by the given reply topic. Nothing
+// happens if the reply topic is nil.
+func (c *client) natsAckReceived(mt *ReplyTopic) {
+	if mt == nil {
+		return
+	}
+	// Client may have disconnected at this point which is why it is essential to ask
+	// the session manager for the session based on the replyTo subject
+	if s := c.server.SessionManager().Get(mt.ClientID()); s != nil && s.ID() == mt.SessionID() {
+		id := mt.PacketID()
+		c.cancelNatsSubscriptions(s.AckReceived(id))
+		if (mt.Flags()&pkg.PublishQoS)>>1 == 2 {
+			s.RelRequested(id)
+			c.queueForWrite(pkg.PubRec(id))
+		} else {
+			c.queueForWrite(pkg.PubAck(id))
+		}
+	}
+}
+
+// natsRequest publishes an MQTT 5 request to NATS with a reply inbox. A request with QoS > 0 is acknowledged
+// once it has been published. The reply is forwarded by the subscription of the inbox.
+func (c *client) natsRequest(responseTopic string, pp *pkg.Publish) error {
+	inbox := nats.NewInbox()
+	sub, err := c.natsSubscribeResponse(inbox, responseTopic, pp)
+	if err != nil {
+		return err
+	}
+	if err = publishMsg(c.natsConn, c.natsMsg(inbox, pp)); err != nil {
+		_ = sub.Unsubscribe()
+		return err
+	}
+	switch pp.QoSLevel() {
+	case 1:
+		c.queueForWrite(pkg.PubAck(pp.ID()))
+	case 2:
+		c.session.RelRequested(pp.ID())
+		c.queueForWrite(pkg.PubRec(pp.ID()))
+	}
+	return nil
+}
+
+// natsSubscribeResponse subscribes to the given inbox, which is used as the NATS reply subject for an MQTT 5
+// request. A reply is forwarded to the response topic of the request along with its correlation data. The
+// subscription ends when the first reply arrives, when NATS reports that there are no responders, or when the
+// request times out.
+func (c *client) natsSubscribeResponse(inbox, responseTopic string, pp *pkg.Publish) (*nats.Subscription, error) {
+	sub, err := c.natsConn.SubscribeSync(inbox)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		m, err := sub.NextMsg(c.requestTimeout())
+		switch err {
+		case nil:
+			c.publishResponse(responseTopic, pp, m)
+		case nats.ErrNoResponders:
+			c.Debug("request has no responders", pp)
+		case nats.ErrTimeout:
+			c.Debug("request timed out", pp)
+		default:
+			// the subscription was cancelled
+			return
+		}
+		_ = sub.Unsubscribe()
+	}()
+	return sub, nil
+}
+
+// defaultRequestTimeout is the time to wait for the reply to a request unless set in the options
+const defaultRequestTimeout = 30 * time.Second
+
+func (c *client) requestTimeout() time.Duration {
+	if rt := c.server.Options().RequestTimeout; rt > 0 {
+		return time.Duration(rt) * time.Millisecond
+	}
+	return defaultRequestTimeout
+}
+
+// publishResponse forwards the reply m to the response topic of the request pp
+func (c *client) publishResponse(responseTopic string, pp *pkg.Publish, m *nats.Msg) {
+	rm := &nats.Msg{Subject: mqtt.ToNATS(responseTopic), Reply: m.Reply, Data: m.Data}
+	cd, hasCD := pp.Properties().Binary(mqtt.PropCorrelationData)
+	if len(m.Header) > 0 || hasCD {
+		rm.Header = make(nats.Header, len(m.Header)+1)
+		for k, v := range m.Header {
+			rm.Header[k] = v
+		}
+		if hasCD {
+			rm.Header.Set(c.server.Options().HeaderPrefix+headerCorrelationData, base64.StdEncoding.EncodeToString(cd))
+		}
+	}
+	if err := publishMsg(c.natsConn, rm); err != nil {
+		c.Error("NATS publish response", rm.Subject, err)
+	}
+}
+
+// mayPublish returns true if the client is permitted to publish the given packet. The response topic of a
+// request is checked too since the bridge publishes the response to it on behalf of the client.
+func (c *client) mayPublish(pp *pkg.Publish) bool {
+	if !c.perm.mayPublish(mqtt.ToNATS(pp.TopicName())) {
+		return false
+	}
+	responseTopic, isRequest := pp.Properties().Text(mqtt.PropResponseTopic)
+	return !isRequest || c.perm.mayPublish(mqtt.ToNATS(responseTopic))
+}
+
+// publishDenied is called when the client isn't permitted to publish the given packet. The packet is
+// dropped. A packet with QoS > 0 is acknowledged, with a reason code when the client uses MQTT 5.
+func (c *client) publishDenied(pp *pkg.Publish) {
+	c.Debug("publish not authorized", pp)
+	var tp byte
+	switch pp.QoSLevel() {
+	case 1:
+		tp = pkg.TpPubAck
+	case 2:
+		tp = pkg.TpPubRec
+	default:
+		return
+	}
+	if c.v5() {
+		c.queueForWrite(pkg.NewAckV5(tp, pp.ID(), pkg.RcNotAuthorized, nil))
+	} else if tp == pkg.TpPubAck {
+		c.queueForWrite(pkg.PubAck(pp.ID()))
+	} else {
+		c.queueForWrite(pkg.PubRec(pp.ID()))
+	}
+}
+
+// drainNatsSubscriptions drains all subscriptions of the client. Used instead of closing the NATS connection
+// when the connection is shared. Durable JetStream consumers are kept.
+func (c *client) drainNatsSubscriptions() {
+	c.subLock.Lock()
+	nss := make([]*nats.Subscription, 0, len(c.natsSubs))
+	for k, ns := range c.natsSubs {
+		nss = append(nss, ns)
+		delete(c.natsSubs, k)
+	}
+	c.subLock.Unlock()
+	for _, ns := range nss {
+		if err := ns.Drain(); err != nil && err != nats.ErrConnectionClosed && err != nats.ErrBadSubscription {
+			c.Error("NATS drain", ns.Subject, err)
+		}
+	}
+}
+
 func (c *client) cancelNatsSubscriptions(nss []*nats.Subscription) {
 	for i := range nss {
 		ns := nss[i]
-		if err := ns.Unsubscribe(); err != nil {
+		if ns == nil {
+			// acks of JetStream publications have no subscription
+			continue
+		}
+		if err := ns.Unsubscribe(); err != nil && err != nats.ErrBadSubscription {
 			c.Error("NATS unsubscribe", ns.Subject, err)
 		}
 	}
 }
 
-func (c *client) natsSubscribe(sp *pkg.Subscribe) {
+// subscriptionKey returns the key used for a NATS subscription in the client's natsSubs map. The key is
+// the subject for plain subscriptions and the subject followed by a space and the queue group for shared
+// subscriptions.
+func subscriptionKey(subject, queue string) string {
+	if queue == `` {
+		return subject
+	}
+	return subject + ` ` + queue
+}
+
+// natsSubscription returns the NATS subject and queue group for the given MQTT subscription. The
+// returned bool is false if the subscription is a malformed shared subscription.
+func natsSubscription(mqttSub string) (string, string, bool) {
+	group, filter, _ := mqtt.SplitSharedSubscription(mqttSub)
+	if filter == `` {
+		return ``, ``, false
+	}
+	return mqtt.ToNATSSubscription(filter), group, true
+}
+
+// natsSubscribe subscribes to the topics of the given packet and acknowledges it. It returns a subscribe
+// packet with the granted topics that retained messages should be sent for.
+func (c *client) natsSubscribe(sp *pkg.Subscribe) *pkg.Subscribe {
 	tps := sp.Topics()
+	existed := c.subscribed(tps)
+	qss, _ := c.natsSubscribeTopics(tps)
+	c.queueForWrite(pkg.NewSubAck(sp.ID(), qss...))
+
+	rtps := make([]pkg.Topic, 0, len(tps))
+	for i := range tps {
+		tp := tps[i]
+		if qss[i] >= 0x80 || tp.RetainHandling == 2 || tp.RetainHandling == 1 && existed[i] {
+			continue
+		}
+		rtps = append(rtps, pkg.Topic{Name: tp.Name, QoS: qss[i]})
+	}
+	return pkg.NewSubscribe(sp.ID(), rtps...)
+}
+
+// subscribed returns, for each of the given topics, true if the client already has a subscription with
+// the same topic filter
+func (c *client) subscribed(tps []pkg.Topic) []bool {
+	existed := make([]bool, len(tps))
+	c.subLock.Lock()
+	for i := range tps {
+		if nm, gp, ok := natsSubscription(tps[i].Name); ok {
+			existed[i] = c.natsSubs[subscriptionKey(nm, gp)] != nil
+		}
+	}
+	c.subLock.Unlock()
+	return existed
+}
+
+// natsSubscribeTopics creates a NATS subscription for each of the given topics and remembers the topics
+// in the session. The returned slice contains the granted QoS or a failure reason code for each topic. The
+// granted topics are also returned.
+func (c *client) natsSubscribeTopics(tps []pkg.Topic) ([]byte, []pkg.Topic) {
 	nms := make([]string, len(tps))
+	gps := make([]string, len(tps))
 	qss := make([]byte, len(tps))
 	var nss []*nats.Subscription
 	c.subLock.Lock()
 	for i := range tps {
 		tp := tps[i]
-		nm := mqtt.ToNATSSubscription(tp.Name)
+		nm, gp, ok := natsSubscription(tp.Name)
+		if !ok {
+			if c.v5() {
+				qss[i] = byte(pkg.RcTopicFilterInvalid)
+			} else {
+				qss[i] = byte(pkg.RcUnspecifiedError)
+			}
+			continue
+		}
+		if !c.perm.maySubscribe(nm) {
+			c.Debug("subscription not authorized", tp.Name)
+			if c.v5() {
+				qss[i] = byte(pkg.RcNotAuthorized)
+			} else {
+				qss[i] = byte(pkg.RcUnspecifiedError)
+			}
+			continue
+		}
 		nms[i] = nm
+		gps[i] = gp
 		qss[i] = tp.QoS
-		if os := c.natsSubs[nm]; os != nil {
-			delete(c.natsSubs, nm)
+		key := subscriptionKey(nm, gp)
+		if os := c.natsSubs[key]; os != nil {
+			delete(c.natsSubs, key)
 			nss = append(nss, os)
 		}
 	}
@@ -84,59 +364,123 @@ func (c *client) natsSubscribe(sp *pkg.Subscribe) {
 	nss = make([]*nats.Subscription, 0, len(nms))
 	for i := range nms {
 		nm := nms[i]
-		qs := qss[i]
-		if qs > 1 {
-			qs = 1
-			qss[i] = 1
+		if nm == `` {
+			continue
 		}
-		ns, err := c.natsConn.Subscribe(nm, func(m *nats.Msg) {
+		qs := qss[i]
+		noLocal := tps[i].NoLocal
+		handler := func(m *nats.Msg) {
+			if noLocal && c.isLocal(m) {
+				return
+			}
 			c.natsResponse(qs, m)
-		})
+		}
+		var (
+			ns  *nats.Subscription
+			err error
+		)
+		if gps[i] == `` && c.useDurable(qs) {
+			if ns, err = c.jsSubscribe(tps[i].Name, nm, noLocal); err != nil {
+				// the stream might not capture the subject
+				c.Error("JetStream subscribe", nm, err)
+				ns, err = c.natsConn.Subscribe(nm, handler)
+			}
+		} else if gps[i] == `` {
+			ns, err = c.natsConn.Subscribe(nm, handler)
+		} else {
+			// a shared subscription is a queue subscription where the share name is the queue group
+			ns, err = c.natsConn.QueueSubscribe(nm, gps[i], handler)
+		}
 		if err == nil {
 			nss = append(nss, ns)
 		} else {
 			c.Error("NATS subscribe", nm, err)
-			qss[i] = 0x80
+			qss[i] = byte(pkg.RcUnspecifiedError)
 		}
 	}
 	c.subLock.Lock()
 	for i := range nss {
 		ns := nss[i]
-		c.natsSubs[ns.Subject] = ns
+		c.natsSubs[subscriptionKey(ns.Subject, ns.Queue)] = ns
 	}
 	c.subLock.Unlock()
-	c.queueForWrite(pkg.NewSubAck(sp.ID(), qss...))
+
+	granted := make([]pkg.Topic, 0, len(tps))
+	for i := range tps {
+		if qss[i] < 0x80 {
+			tp := tps[i]
+			tp.QoS = qss[i]
+			granted = append(granted, tp)
+		}
+	}
+	c.session.AddSubscriptions(granted)
+	c.updateNoLocal()
+	return qss, granted
 }
 
 func (c *client) natsUnsubscribe(up *pkg.Unsubscribe) {
 	tps := up.Topics()
 	nss := make([]*nats.Subscription, 0, len(tps))
+	rcs := make([]byte, len(tps))
 	c.subLock.Lock()
 	for i := range tps {
-		subj := mqtt.ToNATSSubscription(tps[i])
-		if ns := c.natsSubs[subj]; ns != nil {
+		nm, gp, _ := natsSubscription(tps[i])
+		key := subscriptionKey(nm, gp)
+		if ns := c.natsSubs[key]; ns != nil {
 			nss = append(nss, ns)
-			delete(c.natsSubs, subj)
+			delete(c.natsSubs, key)
+		} else {
+			rcs[i] = byte(pkg.RcNoSubscriptionExisted)
 		}
 	}
 	c.subLock.Unlock()
 	c.cancelNatsSubscriptions(nss)
-	c.queueForWrite(pkg.UnsubAck(up.ID()))
+	c.session.RemoveSubscriptions(tps)
+	c.updateNoLocal()
+	if c.v5() {
+		c.queueForWrite(pkg.NewUnsubAckV5(up.ID(), nil, rcs...))
+	} else {
+		c.queueForWrite(pkg.UnsubAck(up.ID()))
+	}
 }
 
 func (c *client) natsResponse(desiredQoS byte, m *nats.Msg) {
 	id := uint16(0)
 	flags := byte(0)
-	if desiredQoS > 0 && m.Reply != `` {
+	var props mqtt.Properties
+	if len(m.Header) > 0 {
+		props = mqttProperties(c.server.Options().HeaderPrefix, m.Header)
+	}
+	natsReplyTo := m.Reply
+	if m.Reply == `` && desiredQoS > 0 && c.js != nil && m.Header.Get(nats.ExpectedStreamHdr) != `` {
+		// A QoS > 0 publication that the bridge stored in the stream. It is already acknowledged so
+		// the client gets its own packet id when the packet enters the in-flight window.
+		flags = 2 // QoS level 1
+	} else if m.Reply != `` {
 		if mt := ParseReplyTopic(m.Reply); mt != nil {
-			id = mt.PacketID()
-			flags = mt.Flags()
+			if desiredQoS > 0 {
+				id = mt.PacketID()
+				flags = mt.Flags()
+				if (flags&pkg.PublishQoS)>>1 > desiredQoS {
+					// downgrade to the QoS granted to the subscription
+					flags = (flags &^ pkg.PublishQoS) | desiredQoS<<1
+				}
+			}
 		} else {
-			id = c.server.NextFreePacketID()
-			flags = 2 // QoS level 1
+			if c.v5() {
+				// A NATS request. The MQTT 5 client responds using the response topic and that response
+				// is then the only reply to the request.
+				props = props.Set(mqtt.PropResponseTopic, mqtt.FromNATS(m.Reply))
+				natsReplyTo = ``
+			}
+			if desiredQoS > 0 {
+				// the packet id is assigned when the packet enters the in-flight window
+				flags = 2 // QoS level 1
+			}
 		}
 	}
-	pp := pkg.NewPublish(id, mqtt.FromNATS(m.Subject), flags, m.Data, false, m.Reply)
+	pp := pkg.NewPublish(id, mqtt.FromNATS(m.Subject), flags, m.Data, false, natsReplyTo)
+	pp.SetProperties(props)
 	qos := desiredQoS
 	if pp.QoSLevel() < qos {
 		qos = pp.QoSLevel()
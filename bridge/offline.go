@@ -0,0 +1,109 @@
+package bridge
+
+import (
+	"github.com/nats-io/nats.go"
+	"github.com/tada/mqtt-nats/mqtt"
+	"github.com/tada/mqtt-nats/mqtt/pkg"
+)
+
+const (
+	// DropOldest is the offline drop policy that drops the oldest message when the queue is full
+	DropOldest = "oldest"
+
+	// DropNewest is the offline drop policy that drops the arriving message when the queue is full
+	DropNewest = "newest"
+)
+
+// StartOffline subscribes to the QoS > 0 subscriptions of the given session using the NATS connection of the
+// bridge. Matching QoS 1 messages are queued in the session until StopOffline is called. Nothing happens
+// unless offline queueing is enabled in the options, or when JetStream durable consumers retain the messages.
+func (s *server) StartOffline(ss Session) {
+	if s.opts.OfflineQueueSize <= 0 || s.opts.JetStreamStream != `` || s.isDraining() {
+		// sessions that are persisted during shutdown are started when the bridge starts again
+		return
+	}
+	tps := ss.Subscriptions()
+	nss := make([]*nats.Subscription, 0, len(tps))
+	if len(tps) > 0 {
+		nc, err := s.serverNatsConn()
+		if err != nil {
+			s.Error("NATS connect failed", err)
+			return
+		}
+		for i := range tps {
+			tp := tps[i]
+			if tp.QoS == 0 {
+				continue
+			}
+			nm, gp, ok := natsSubscription(tp.Name)
+			if !ok {
+				continue
+			}
+			handler := func(m *nats.Msg) {
+				s.offlineMessage(ss, m)
+			}
+			var ns *nats.Subscription
+			if gp == `` {
+				ns, err = nc.Subscribe(nm, handler)
+			} else {
+				ns, err = nc.QueueSubscribe(nm, gp, handler)
+			}
+			if err != nil {
+				s.Error("NATS subscribe", nm, err)
+				continue
+			}
+			nss = append(nss, ns)
+		}
+
+		// ensure that the subscriptions are known to the NATS server before the client is considered gone
+		if err = nc.Flush(); err != nil {
+			s.Error("NATS flush", err)
+		}
+	}
+	s.cancelSubscriptions(ss.SetOfflineSubscriptions(nss))
+}
+
+// StopOffline cancels the subscriptions created by StartOffline for the given session
+func (s *server) StopOffline(ss Session) {
+	s.cancelSubscriptions(ss.SetOfflineSubscriptions(nil))
+}
+
+// startOfflineSessions calls StartOffline for all sessions that belong to disconnected clients. It is
+// used when the bridge starts so that sessions restored from storage continue to queue messages.
+func (s *server) startOfflineSessions() {
+	for _, ss := range s.sm.Sessions() {
+		if ss != s.session && !ss.DisconnectTime().IsZero() && ss.ExpiryInterval() != 0 {
+			s.StartOffline(ss)
+		}
+	}
+}
+
+// offlineMessage queues a QoS > 0 message from NATS in the given session. A NATS request is queued as a
+// QoS 1 message, just like it is delivered to a connected client. The message is acknowledged when the
+// client acknowledges it after having resumed the session. The packet ID is assigned when the message
+// enters the in-flight window of the client.
+func (s *server) offlineMessage(ss Session, m *nats.Msg) {
+	if m.Reply == `` {
+		// only QoS 1 and 2 messages are queued
+		return
+	}
+	if mt := ParseReplyTopic(m.Reply); mt != nil && mt.Flags()&pkg.PublishQoS == 0 {
+		return
+	}
+	pp := pkg.NewPublish(0, mqtt.FromNATS(m.Subject), 2, m.Data, false, m.Reply)
+	if len(m.Header) > 0 {
+		pp.SetProperties(mqttProperties(s.opts.HeaderPrefix, m.Header))
+	}
+	if dp := ss.QueueOffline(pp, s.opts.OfflineQueueSize, s.opts.OfflineDropPolicy != DropNewest); dp != nil {
+		s.Debug("offline queue full for", ss.ClientID(), "dropped", dp)
+	}
+}
+
+func (s *server) cancelSubscriptions(nss []*nats.Subscription) {
+	for i := range nss {
+		ns := nss[i]
+		if err := ns.Unsubscribe(); err != nil && err != nats.ErrConnectionClosed && err != nats.ErrBadSubscription {
+			s.Error("NATS unsubscribe", ns.Subject, err)
+		}
+	}
+}
@@ -21,24 +21,149 @@ type Options struct {
 	// base64 encoded string
 	RetainedRequestTopic string
 
-	// Port is the MQTT port
+	// Listeners are the listeners that MQTT clients connect to. When no listeners are given, the bridge
+	// listens on Port using the TLS options and on WSPort using the WebSocket options.
+	Listeners []*Listener
+
+	// Port is the MQTT port. Ignored when Listeners are given.
 	Port int
 
+	// WSPort is the port of the MQTT over WebSocket listener. Zero means no WebSocket listener. Ignored
+	// when Listeners are given.
+	WSPort int
+
+	// WSPath is the HTTP path where WebSocket clients connect. The default is "/mqtt".
+	WSPath string
+
+	// WSTLS makes the WebSocket listener use TLS (wss) with the certificate, key, and client verification
+	// given by the TLS options
+	WSTLS bool
+
+	// MQTTSNPort is the UDP port of the MQTT-SN gateway. Zero means no gateway. Ignored when Listeners are
+	// given.
+	MQTTSNPort int
+
+	// MQTTSNTopics maps the predefined topic IDs of the MQTT-SN gateway to topic names. Ignored when Listeners
+	// are given.
+	MQTTSNTopics map[uint16]string
+
 	// RepeatRate is the delay in milliseconds between publishing packets that originated in this server
 	// that have QoS > 0 but hasn't been acknowledged.
 	RepeatRate int
 
+	// SessionExpiry is the number of seconds that the session of an MQTT 3.1.1 client that connects without
+	// a clean session is kept after the client disconnects. Zero means that such sessions never expire. MQTT 5
+	// clients use the session expiry interval of the CONNECT packet.
+	SessionExpiry int
+
+	// SessionSweepRate is the delay in milliseconds between each removal of expired sessions. The default
+	// is one minute.
+	SessionSweepRate int
+
+	// OfflineQueueSize is the maximum number of QoS 1 messages that are queued for a disconnected client
+	// with a session that isn't clean. The messages are delivered when the client resumes the session.
+	// Zero disables the queueing.
+	OfflineQueueSize int
+
+	// OfflineDropPolicy decides what happens when a message arrives and the offline queue is full. It is
+	// either DropOldest (the default) or DropNewest.
+	OfflineDropPolicy string
+
+	// JetStreamStream is the name of an existing JetStream stream. When set, QoS 1 and 2 publications from
+	// clients are acknowledged when the stream has stored them, and QoS > 0 subscriptions of sessions that
+	// outlive their connection are served by durable consumers on the stream. The stream must capture the
+	// subjects that the clients publish and subscribe to. The in-memory offline queue isn't used in this mode.
+	JetStreamStream string
+
+	// ClientIDMaxLength is the maximum length in bytes of a client identifier. Zero means no limit other
+	// than the one imposed by the protocol.
+	ClientIDMaxLength int
+
+	// ClientIDCharset contains the characters that are allowed in a client identifier. A range of characters
+	// is written as "a-z". Empty means that all characters are allowed.
+	ClientIDCharset string
+
+	// ClientIDPrefix is a prefix that all client identifiers must start with. It is also used for the
+	// identifiers that the bridge assigns to clients that connect without one.
+	ClientIDPrefix string
+
+	// NATSPoolSize is the number of NATS connections that the clients share. Zero means that each client gets
+	// a NATS connection of its own that uses the credentials of the client. When the connections are shared,
+	// the bridge authenticates the clients and enforces their permissions using the Permissions table.
+	NATSPoolSize int
+
+	// Permissions maps user names to passwords and permissions. Only used when NATSPoolSize > 0. All clients
+	// may publish and subscribe to everything when the table is empty.
+	Permissions map[string]*Permission
+
+	// NATSAuth decides how the credentials of an MQTT client are used when the bridge connects to NATS on
+	// behalf of the client. It is one of AuthPassThrough (the default), AuthToken, AuthJWT, or AuthCreds.
+	NATSAuth string
+
+	// NATSCreds maps MQTT user names to passwords and NATS credentials files. Used with AuthCreds.
+	NATSCreds map[string]*NATSCreds
+
 	// NATSOpts are options specific to the NATS connection
 	NATSOpts []nats.Option
 
+	// ReceiveMaximum is the number of QoS level 1 and 2 publications that an MQTT 5 client may send to the
+	// bridge without having received their acknowledgements. It is advertised in the CONNACK. Zero means
+	// no limit.
+	ReceiveMaximum int
+
+	// InFlightMaximum is the number of QoS level 1 and 2 publications that the bridge sends to an MQTT 3.1.1
+	// client before it waits for acknowledgements. Additional publications are queued in the session. MQTT 5
+	// clients use the Receive Maximum of the CONNECT packet. Zero means no limit.
+	InFlightMaximum int
+
+	// InFlightQueueSize is the maximum number of QoS level 1 and 2 publications that are queued in a session
+	// while the in-flight window of the client is full. Publications that arrive when the queue is full are
+	// dropped without being acknowledged so that their publisher sends them again. The default is 1000.
+	InFlightQueueSize int
+
+	// MaximumPacketSize is the size in bytes of the largest packet that the bridge accepts from a client.
+	// It is advertised to MQTT 5 clients. Zero means no limit other than the one imposed by the protocol.
+	MaximumPacketSize int
+
+	// TopicAliasMaximum is the highest MQTT 5 topic alias that the bridge accepts from a client. Zero
+	// means that topic aliases aren't accepted. The bridge assigns aliases to publications that it sends
+	// up to the maximum of each client regardless of this setting.
+	TopicAliasMaximum int
+
+	// HeaderPrefix is prepended to the names of the NATS headers that carry MQTT 5 user properties,
+	// content type ("Bridge-Content-Type"), payload format indicator ("Bridge-Payload-Format"), and
+	// correlation data ("Bridge-Correlation-Data"). Only NATS headers that start with this prefix are passed
+	// on as properties to MQTT 5 clients. NATS headers require NATS server 2.2 or later.
+	HeaderPrefix string
+
+	// RequestTimeout is the time in milliseconds that the bridge waits for the reply to a request from an
+	// MQTT 5 client. The reply inbox is unsubscribed when the reply arrives, when NATS reports that there
+	// are no responders, or when the wait is over. The default is 30 seconds.
+	RequestTimeout int
+
+	// TLSTimeout is the number of seconds that a client has to complete the TLS handshake. The default
+	// is two seconds.
 	TLSTimeout float64
-	TLSCert    string
-	TLSKey     string
-	TLSCaCert  string
-	TLSConfig  *tls.Config
-	TLS        bool
-	TLSVerify  bool
-	TLSMap     bool
+
+	// TLSCert, TLSKey, TLSCaCert, TLS, and TLSVerify are the TLS settings of the listener on Port and the
+	// listener on WSPort. Ignored when Listeners are given.
+	TLSCert   string
+	TLSKey    string
+	TLSCaCert string
+	TLSConfig *tls.Config
+	TLS       bool
+	TLSVerify bool
+
+	// TLSMap requires a client certificate that is verified against TLSCaCert and uses the identity of
+	// the certificate as the user name of the client. The identity is the first email address of the
+	// certificate, its first DNS name, or its subject, in that order of preference. Ignored when Listeners
+	// are given. The Auth field of each Listener is used instead.
+	TLSMap bool
+
+	// TLSReloadRate is the delay in milliseconds between each check for changes to the TLS certificate, key,
+	// and CA certificate files. Changed files are used for new connections. The files are also reloaded when
+	// the bridge receives a SIGHUP. The default is ten seconds.
+	TLSReloadRate int
 
 	// Debug enables debug level log output
 	Debug bool
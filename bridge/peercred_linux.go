@@ -0,0 +1,29 @@
+package bridge
+
+import (
+	"net"
+	"syscall"
+)
+
+// peerCredSupported is true on the platforms where peer credentials can be read
+const peerCredSupported = true
+
+// peerUID returns the user ID of the process at the other end of the given connection using SO_PEERCRED
+func peerUID(conn *net.UnixConn) (uint32, error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	err = rc.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err == nil {
+		err = credErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	return cred.Uid, nil
+}
@@ -0,0 +1,15 @@
+// +build !linux
+
+package bridge
+
+import (
+	"errors"
+	"net"
+)
+
+// peerCredSupported is true on the platforms where peer credentials can be read
+const peerCredSupported = false
+
+func peerUID(*net.UnixConn) (uint32, error) {
+	return 0, errors.New("peer credentials are not supported on this platform")
+}
@@ -0,0 +1,104 @@
+package bridge
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+
+	"github.com/tada/mqtt-nats/mqtt/pkg"
+)
+
+// Permission contains the password of a user and the NATS subjects that the user may publish and subscribe
+// to. The subjects may contain wildcards. A nil list allows all subjects and an empty list allows none.
+type Permission struct {
+	Password  string   `json:"password"`
+	Publish   []string `json:"publish"`
+	Subscribe []string `json:"subscribe"`
+}
+
+// LoadPermissions reads a JSON object that maps user names to permissions from the file at the given path
+func LoadPermissions(path string) (map[string]*Permission, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var perms map[string]*Permission
+	if err = json.Unmarshal(bs, &perms); err != nil {
+		return nil, err
+	}
+	return perms, nil
+}
+
+// authorize returns the permission of the user with the given credentials. All subjects are allowed when
+// the given table is empty. A client without credentials uses the entry for the empty user name.
+func authorize(perms map[string]*Permission, creds *pkg.Credentials) (*Permission, error) {
+	if len(perms) == 0 {
+		return nil, nil
+	}
+	user, password := ``, ``
+	if creds != nil {
+		user, password = creds.User, string(creds.Password)
+	}
+	perm, ok := perms[user]
+	if !ok {
+		if user == `` {
+			return nil, pkg.RtNotAuthorized
+		}
+		return nil, pkg.RtBadUserNameOrPassword
+	}
+	if subtle.ConstantTimeCompare([]byte(perm.Password), []byte(password)) != 1 {
+		return nil, pkg.RtBadUserNameOrPassword
+	}
+	return perm, nil
+}
+
+// mayPublish returns true if the permission allows publishing to the given NATS subject. A nil permission
+// allows everything.
+func (p *Permission) mayPublish(subject string) bool {
+	return p == nil || subjectAllowed(p.Publish, subject)
+}
+
+// maySubscribe returns true if the permission allows subscribing to the given NATS subject. A nil
+// permission allows everything.
+func (p *Permission) maySubscribe(subject string) bool {
+	return p == nil || subjectAllowed(p.Subscribe, subject)
+}
+
+func subjectAllowed(patterns []string, subject string) bool {
+	if patterns == nil {
+		return true
+	}
+	for _, pt := range patterns {
+		if subjectMatches(pt, subject) {
+			return true
+		}
+	}
+	return false
+}
+
+// subjectMatches returns true if all subjects that the given subject matches are also matched by the given
+// pattern. Both may contain the NATS wildcards "*" and ">".
+func subjectMatches(pattern, subject string) bool {
+	pts := strings.Split(pattern, ".")
+	sts := strings.Split(subject, ".")
+	for i, pt := range pts {
+		if pt == ">" {
+			return i < len(sts)
+		}
+		if i >= len(sts) {
+			return false
+		}
+		st := sts[i]
+		if pt == "*" {
+			if st == ">" {
+				return false
+			}
+			continue
+		}
+		if pt != st {
+			return false
+		}
+	}
+	return len(pts) == len(sts)
+}
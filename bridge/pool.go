@@ -0,0 +1,58 @@
+package bridge
+
+import (
+	"hash/fnv"
+
+	"github.com/nats-io/nats.go"
+	"github.com/tada/mqtt-nats/mqtt/pkg"
+)
+
+// PooledNatsConn returns the NATS connection that the client with the given identifier shares with other
+// clients. The connection is created on demand using the credentials of the bridge.
+func (s *server) PooledNatsConn(clientID string) (*nats.Conn, error) {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(clientID))
+	i := int(h.Sum32() % uint32(s.opts.NATSPoolSize))
+
+	s.poolLock.Lock()
+	defer s.poolLock.Unlock()
+	if s.pool == nil {
+		s.pool = make([]*nats.Conn, s.opts.NATSPoolSize)
+	}
+	nc := s.pool[i]
+	if nc == nil || nc.IsClosed() {
+		var err error
+		if nc, err = s.NatsConn(nil); err != nil {
+			return nil, err
+		}
+		s.pool[i] = nc
+	}
+	return nc, nil
+}
+
+// closePool closes all pooled NATS connections
+func (s *server) closePool() {
+	s.poolLock.Lock()
+	for _, nc := range s.pool {
+		if nc != nil {
+			nc.Close()
+		}
+	}
+	s.pool = nil
+	s.poolLock.Unlock()
+}
+
+// publishConn returns the NATS connection used for a publication that the bridge makes on behalf of a client
+// with the given credentials, and a function that releases the connection. The server's own connection is
+// used when clients share connections.
+func (s *server) publishConn(creds *pkg.Credentials) (*nats.Conn, func(), error) {
+	if s.opts.NATSPoolSize > 0 {
+		nc, err := s.serverNatsConn()
+		return nc, func() {}, err
+	}
+	nc, err := s.NatsConn(creds)
+	if err != nil {
+		return nil, nil, err
+	}
+	return nc, nc.Close, nil
+}
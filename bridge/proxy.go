@@ -0,0 +1,331 @@
+package bridge
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyV2Signature starts a binary PROXY protocol header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyV1MaxLength is the maximum length of a text PROXY protocol header, including the CRLF
+const proxyV1MaxLength = 107
+
+// PROXY protocol v2 constants
+const (
+	proxyCmdLocal  = 0x0
+	proxyCmdProxy  = 0x1
+	proxyFamInet   = 0x1
+	proxyFamInet6  = 0x2
+	proxyTypeSSL   = 0x20
+	proxySSLCN     = 0x22
+	proxySSLVer    = 0x21
+	proxySSLCipher = 0x23
+
+	proxyClientSSL      = 0x01
+	proxyClientCertConn = 0x02
+	proxyClientCertSess = 0x04
+)
+
+// proxyTLS is the TLS information that a load balancer which terminated TLS passed on in a PROXY protocol v2
+// header
+type proxyTLS struct {
+	version    string
+	cipher     string
+	commonName string // common name of the client certificate
+
+	// verified is true if the client presented a certificate that the load balancer verified
+	verified bool
+}
+
+func (pt *proxyTLS) String() string {
+	s := pt.version + ` ` + pt.cipher
+	if pt.verified {
+		s += ` verified client ` + pt.commonName
+	}
+	return s
+}
+
+// proxyListener is a net.Listener for connections that start with a PROXY protocol header
+type proxyListener struct {
+	net.Listener
+	timeout time.Duration
+}
+
+func (pl *proxyListener) Accept() (net.Conn, error) {
+	conn, err := pl.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: conn, r: bufio.NewReader(conn), timeout: pl.timeout}, nil
+}
+
+// proxyConn is a connection that starts with a PROXY protocol header. The header is read on the first Read
+// or call to readHeader. RemoteAddr and LocalAddr then return the addresses of the original connection.
+type proxyConn struct {
+	net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+	once    sync.Once
+	err     error
+	lock    sync.RWMutex
+	remote  net.Addr
+	local   net.Addr
+	tls     *proxyTLS
+
+	// readDeadline is the read deadline set by the user of the connection
+	readDeadline time.Time
+}
+
+func (pc *proxyConn) Read(p []byte) (int, error) {
+	if err := pc.readHeader(); err != nil {
+		return 0, err
+	}
+	return pc.r.Read(p)
+}
+
+// RemoteAddr returns the source address of the original connection once the header has been read
+func (pc *proxyConn) RemoteAddr() net.Addr {
+	pc.lock.RLock()
+	defer pc.lock.RUnlock()
+	if pc.remote != nil {
+		return pc.remote
+	}
+	return pc.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the destination address of the original connection once the header has been read
+func (pc *proxyConn) LocalAddr() net.Addr {
+	pc.lock.RLock()
+	defer pc.lock.RUnlock()
+	if pc.local != nil {
+		return pc.local
+	}
+	return pc.Conn.LocalAddr()
+}
+
+func (pc *proxyConn) SetDeadline(t time.Time) error {
+	pc.lock.Lock()
+	pc.readDeadline = t
+	pc.lock.Unlock()
+	return pc.Conn.SetDeadline(t)
+}
+
+func (pc *proxyConn) SetReadDeadline(t time.Time) error {
+	pc.lock.Lock()
+	pc.readDeadline = t
+	pc.lock.Unlock()
+	return pc.Conn.SetReadDeadline(t)
+}
+
+// proxyTLS returns the TLS information of the header, or nil if the header has none
+func (pc *proxyConn) proxyTLS() *proxyTLS {
+	pc.lock.RLock()
+	defer pc.lock.RUnlock()
+	return pc.tls
+}
+
+// readHeader reads the PROXY protocol header unless it has been read already. The header must be received
+// within the timeout of the connection and before the read deadline set by the user of the connection.
+func (pc *proxyConn) readHeader() error {
+	pc.once.Do(func() {
+		pc.lock.RLock()
+		userDeadline := pc.readDeadline
+		pc.lock.RUnlock()
+		deadline := time.Now().Add(pc.timeout)
+		if !userDeadline.IsZero() && userDeadline.Before(deadline) {
+			deadline = userDeadline
+		}
+		if pc.err = pc.Conn.SetReadDeadline(deadline); pc.err != nil {
+			return
+		}
+		if pc.err = pc.parseHeader(); pc.err != nil {
+			pc.err = fmt.Errorf("PROXY protocol: %v", pc.err)
+			return
+		}
+		pc.err = pc.Conn.SetReadDeadline(userDeadline)
+	})
+	return pc.err
+}
+
+func (pc *proxyConn) parseHeader() error {
+	sig, err := pc.r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(sig, proxyV2Signature) {
+		return pc.parseV2()
+	}
+	if bytes.HasPrefix(sig, []byte("PROXY ")) {
+		return pc.parseV1()
+	}
+	return errors.New("header missing")
+}
+
+// parseV1 parses a text header, e.g. "PROXY TCP4 192.0.2.1 192.0.2.2 56324 1883\r\n"
+func (pc *proxyConn) parseV1() error {
+	var line []byte
+	for len(line) < proxyV1MaxLength {
+		b, err := pc.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return errors.New("v1 header too long")
+	}
+	fields := strings.Split(string(line[:len(line)-2]), ` `)
+	if len(fields) >= 2 && fields[1] == `UNKNOWN` {
+		// the original addresses are unknown, so the addresses of the connection are kept
+		return nil
+	}
+	if len(fields) != 6 || fields[1] != `TCP4` && fields[1] != `TCP6` {
+		return fmt.Errorf("invalid v1 header %q", line)
+	}
+	src, err := proxyV1Addr(fields[2], fields[4])
+	if err != nil {
+		return err
+	}
+	dst, err := proxyV1Addr(fields[3], fields[5])
+	if err != nil {
+		return err
+	}
+	pc.setAddrs(src, dst, nil)
+	return nil
+}
+
+func proxyV1Addr(ip, port string) (net.Addr, error) {
+	a := net.ParseIP(ip)
+	p, err := strconv.ParseUint(port, 10, 16)
+	if a == nil || err != nil {
+		return nil, fmt.Errorf("invalid v1 address %s:%s", ip, port)
+	}
+	return &net.TCPAddr{IP: a, Port: int(p)}, nil
+}
+
+// parseV2 parses a binary header
+func (pc *proxyConn) parseV2() error {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(pc.r, hdr); err != nil {
+		return err
+	}
+	if hdr[12]>>4 != 2 {
+		return fmt.Errorf("unsupported version %d", hdr[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(pc.r, body); err != nil {
+		return err
+	}
+	switch hdr[12] & 0x0f {
+	case proxyCmdLocal:
+		// a health check from the load balancer itself, so the addresses of the connection are kept
+		return nil
+	case proxyCmdProxy:
+	default:
+		return fmt.Errorf("unsupported command %d", hdr[12]&0x0f)
+	}
+
+	var src, dst net.Addr
+	var tlvs []byte
+	switch hdr[13] >> 4 {
+	case proxyFamInet:
+		if len(body) < 12 {
+			return errors.New("v2 header too short")
+		}
+		src = &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}
+		dst = &net.TCPAddr{IP: net.IP(body[4:8]), Port: int(binary.BigEndian.Uint16(body[10:]))}
+		tlvs = body[12:]
+	case proxyFamInet6:
+		if len(body) < 36 {
+			return errors.New("v2 header too short")
+		}
+		src = &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}
+		dst = &net.TCPAddr{IP: net.IP(body[16:32]), Port: int(binary.BigEndian.Uint16(body[34:]))}
+		tlvs = body[36:]
+	default:
+		// unspecified or Unix addresses, the addresses of the connection are kept
+		return nil
+	}
+	pt, err := parseProxyTLVs(tlvs)
+	if err != nil {
+		return err
+	}
+	pc.setAddrs(src, dst, pt)
+	return nil
+}
+
+// forEachTLV calls the given function with the type and value of each TLV in the given bytes
+func forEachTLV(bs []byte, f func(byte, []byte)) error {
+	for len(bs) > 0 {
+		if len(bs) < 3 {
+			return errors.New("truncated TLV")
+		}
+		n := int(binary.BigEndian.Uint16(bs[1:])) + 3
+		if len(bs) < n {
+			return errors.New("truncated TLV")
+		}
+		f(bs[0], bs[3:n])
+		bs = bs[n:]
+	}
+	return nil
+}
+
+// parseProxyTLVs returns the TLS information of the given TLVs, or nil if there is none
+func parseProxyTLVs(tlvs []byte) (*proxyTLS, error) {
+	var pt *proxyTLS
+	var subErr error
+	err := forEachTLV(tlvs, func(t byte, v []byte) {
+		if t != proxyTypeSSL || len(v) < 5 || v[0]&proxyClientSSL == 0 {
+			return
+		}
+		pt = &proxyTLS{
+			verified: v[0]&(proxyClientCertConn|proxyClientCertSess) != 0 && binary.BigEndian.Uint32(v[1:]) == 0}
+		subErr = forEachTLV(v[5:], func(st byte, sv []byte) {
+			switch st {
+			case proxySSLVer:
+				pt.version = string(sv)
+			case proxySSLCN:
+				pt.commonName = string(sv)
+			case proxySSLCipher:
+				pt.cipher = string(sv)
+			}
+		})
+	})
+	if err == nil {
+		err = subErr
+	}
+	return pt, err
+}
+
+func (pc *proxyConn) setAddrs(remote, local net.Addr, pt *proxyTLS) {
+	pc.lock.Lock()
+	pc.remote = remote
+	pc.local = local
+	pc.tls = pt
+	pc.lock.Unlock()
+}
+
+// proxied returns the proxyConn of the given connection, or nil if the connection didn't start with a PROXY
+// protocol header
+func proxied(conn net.Conn) *proxyConn {
+	switch c := conn.(type) {
+	case *proxyConn:
+		return c
+	case *wsConn:
+		return proxied(c.Conn)
+	}
+	return nil
+}
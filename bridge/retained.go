@@ -111,7 +111,14 @@ func (r *retained) messagesMatchingRetainRequest(m *nats.Msg) ([]*pkg.Publish, [
 }
 
 func (r *retained) publishMatching(s *pkg.Subscribe, c Client) {
-	pps, qs := r.matchingMessages(s.Topics())
+	// retained messages are never sent to shared subscriptions
+	tps := make([]pkg.Topic, 0, len(s.Topics()))
+	for _, tp := range s.Topics() {
+		if _, _, shared := mqtt.SplitSharedSubscription(tp.Name); !shared {
+			tps = append(tps, tp)
+		}
+	}
+	pps, qs := r.matchingMessages(tps)
 	for i := range pps {
 		pp := pps[i]
 		c.PublishResponse(qs[i], pp)
@@ -4,18 +4,15 @@ import (
 	"bufio"
 	"bytes"
 	"crypto/tls"
-	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net"
 	"os"
 	"os/signal"
 	"sort"
-	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -32,15 +29,33 @@ import (
 	"github.com/tada/mqtt-nats/mqtt/pkg"
 )
 
+var errNoFreePacketID = errors.New("no free packet ID")
+
 // A Server implements the methods needed to support a Client connection.
 type Server interface {
 	pkg.IDManager
 	SessionManager() SessionManager
-	ManageClient(c Client)
+
+	// ManageClient adds the client to the clients managed by the server and returns the client that was
+	// previously managed under the same client ID, or nil if there was no such client
+	ManageClient(c Client) Client
 	NatsConn(creds *pkg.Credentials) (*nats.Conn, error)
+
+	// PooledNatsConn returns a NATS connection that the client with the given identifier shares with other
+	// clients. Only used when Options.NATSPoolSize > 0
+	PooledNatsConn(clientID string) (*nats.Conn, error)
 	HandleRetain(pp *pkg.Publish) *pkg.Publish
 	PublishMatching(sp *pkg.Subscribe, c Client)
 	PublishWill(will *pkg.Will, creds *pkg.Credentials) error
+
+	// Options returns the options that the server was created with
+	Options() *Options
+
+	// StartOffline starts queueing messages for the given session while its client is disconnected
+	StartOffline(ss Session)
+
+	// StopOffline stops queueing messages for the given session
+	StopOffline(ss Session)
 }
 
 // A Bridge extends the Server with methods needed to start, restard, terminate, and
@@ -67,29 +82,52 @@ type server struct {
 	session         Session
 	retainedPackets *retained
 	sm              SessionManager
-	natsConn        *nats.Conn // servers NATS connection
-	clients         []Client
+	natsConn        *nats.Conn        // servers NATS connection
+	clients         map[string]Client // connected clients keyed by client ID
 	clientWG        sync.WaitGroup
 	clientLock      sync.RWMutex
+	draining        bool // set during shutdown, protected by clientLock
 	trackAckLock    sync.RWMutex
 	pubAcks         map[uint16]*natsPub // will be republished until ack arrives from nats
 	pubAckTimeout   time.Duration
 	pubAckTimer     *time.Timer
+	sweepLock       sync.Mutex
+	sweepTimer      *time.Timer // removes expired sessions
+	tlsFiles        []*tlsFiles // the TLS files of the listeners that use TLS
+	tlsReloadLock   sync.Mutex
+	tlsReloadTimer  *time.Timer // reloads changed TLS files
+	poolLock        sync.Mutex
+	pool            []*nats.Conn // NATS connections shared by clients
 	done            chan bool
 	signals         chan os.Signal
 }
 
 // New creates a new Bridge configured using the given options and logger.
 func New(opts *Options, logger logger.Logger) (Bridge, error) {
+	switch opts.OfflineDropPolicy {
+	case ``, DropOldest, DropNewest:
+	default:
+		return nil, fmt.Errorf("invalid offline drop policy %q", opts.OfflineDropPolicy)
+	}
+	if err := validListeners(opts); err != nil {
+		return nil, err
+	}
+	if err := validAuth(opts.NATSAuth); err != nil {
+		return nil, err
+	}
+	if opts.NATSPoolSize < 0 {
+		return nil, fmt.Errorf("invalid NATS pool size %d", opts.NATSPoolSize)
+	}
+	ids := pkg.NewIDManager()
 	s := &server{
 		Logger:    logger,
-		IDManager: pkg.NewIDManager(),
+		IDManager: ids,
 		opts:      opts,
 		retainedPackets: &retained{
 			msgs: make(map[string]*pkg.Publish),
 		},
 		pubAckTimeout: time.Duration(opts.RepeatRate) * time.Millisecond,
-		sm:            &sm{m: make(map[string]Session, 37)},
+		sm:            &sm{ids: ids, m: make(map[string]Session, 37)},
 		signals:       make(chan os.Signal, 1),
 	}
 
@@ -132,59 +170,109 @@ func (s *server) Done() <-chan bool {
 	return s.done
 }
 
-func (s *server) bootUp(ready *sync.WaitGroup) (net.Listener, error) {
+func (s *server) bootUp(ready *sync.WaitGroup) ([]*boundListener, error) {
 	if ready != nil {
 		defer ready.Done()
 	}
 
-	listener, err := getTCPListener(s.opts)
+	listeners, err := s.getListeners()
 	if err != nil {
 		return nil, err
 	}
 
 	if s.opts.RetainedRequestTopic != "" {
 		if err = s.startRetainedRequestHandler(); err != nil {
+			closeListeners(listeners)
 			return nil, err
 		}
 	}
 
 	s.done = make(chan bool, 1)
-	return listener, nil
+	s.clientLock.Lock()
+	s.draining = false
+	s.clientLock.Unlock()
+	s.startOfflineSessions()
+	s.sweepLock.Lock()
+	s.sweepTimer = time.AfterFunc(s.sweepRate(), s.sweepTick)
+	s.sweepLock.Unlock()
+	if len(s.tlsFiles) > 0 {
+		s.tlsReloadLock.Lock()
+		s.tlsReloadTimer = time.AfterFunc(s.tlsReloadRate(), s.tlsReloadTick)
+		s.tlsReloadLock.Unlock()
+	}
+	return listeners, nil
+}
+
+// defaultSweepRate is the delay between each removal of expired sessions unless set in the options
+const defaultSweepRate = time.Minute
+
+func (s *server) sweepRate() time.Duration {
+	if s.opts.SessionSweepRate > 0 {
+		return time.Duration(s.opts.SessionSweepRate) * time.Millisecond
+	}
+	return defaultSweepRate
+}
+
+// sweepTick removes expired sessions and then schedules the next sweep
+func (s *server) sweepTick() {
+	for _, ss := range s.sm.RemoveExpired(time.Now()) {
+		s.Debug("expired session removed", ss.ClientID())
+		s.deleteDurables(ss)
+	}
+	s.sweepLock.Lock()
+	if s.sweepTimer != nil {
+		s.sweepTimer.Reset(s.sweepRate())
+	}
+	s.sweepLock.Unlock()
 }
 
 func (s *server) Serve(ready *sync.WaitGroup) error {
-	listener, err := s.bootUp(ready)
+	listeners, err := s.bootUp(ready)
 	if err != nil {
 		return err
 	}
 
-	signal.Notify(s.signals, syscall.SIGINT, syscall.SIGTERM)
-	shuttingDown := false
+	signal.Notify(s.signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
 	go func() {
-		sig := <-s.signals
-		s.Debug("trapped signal", sig)
-		switch sig {
-		case syscall.SIGINT, syscall.SIGTERM:
-			s.Debug("mqtt-nats is shutting down")
-			shuttingDown = true
-			_ = listener.Close()
+		for {
+			sig := <-s.signals
+			s.Debug("trapped signal", sig)
+			switch sig {
+			case syscall.SIGINT, syscall.SIGTERM:
+				s.Debug("mqtt-nats is shutting down")
+				s.clientLock.Lock()
+				s.draining = true
+				s.clientLock.Unlock()
+				closeListeners(listeners)
+				return
+			case syscall.SIGHUP:
+				s.reloadTLS(s.tlsFiles)
+			}
 		}
-		// TODO: Add signal to reload config.
 	}()
 
-	for {
-		mqttConn, err := listener.Accept()
-		if err != nil {
-			if shuttingDown {
-				// error due to close of listener
-				break
+	var acceptWG sync.WaitGroup
+	for _, listener := range listeners {
+		acceptWG.Add(1)
+		go func(listener *boundListener) {
+			defer acceptWG.Done()
+			s.Debug("listening on", listener.config)
+			for {
+				mqttConn, err := listener.Accept()
+				if err != nil {
+					if s.isDraining() {
+						// error due to close of listener
+						break
+					}
+					s.Error(err)
+				} else {
+					go s.serveClient(mqttConn, listener.config)
+				}
 			}
-			s.Error(err)
-		} else {
-			go s.ServeClient(mqttConn)
-		}
+		}(listener)
 	}
+	acceptWG.Wait()
 	return s.drainAndShutdown()
 }
 
@@ -193,10 +281,11 @@ func (s *server) drainAndShutdown() error {
 	s.clientLock.Lock()
 	clients := s.clients
 	s.clients = nil
+	s.draining = true
 	s.clientLock.Unlock()
 
-	for i := range clients {
-		clients[i].SetDisconnected(nil)
+	for _, c := range clients {
+		c.SetDisconnected(nil)
 	}
 	s.clientWG.Wait()
 	s.Debug("client drain complete")
@@ -208,6 +297,20 @@ func (s *server) drainAndShutdown() error {
 	}
 	s.trackAckLock.Unlock()
 
+	s.sweepLock.Lock()
+	if s.sweepTimer != nil {
+		s.sweepTimer.Stop()
+		s.sweepTimer = nil
+	}
+	s.sweepLock.Unlock()
+	s.tlsReloadLock.Lock()
+	if s.tlsReloadTimer != nil {
+		s.tlsReloadTimer.Stop()
+		s.tlsReloadTimer = nil
+	}
+	s.tlsReloadLock.Unlock()
+
+	s.closePool()
 	if s.natsConn != nil {
 		s.natsConn.Close()
 		s.natsConn = nil
@@ -279,10 +382,8 @@ func (s *server) natsOptions(creds *pkg.Credentials) (*nats.Options, error) {
 		}
 	}
 	if creds != nil {
-		opts.User = creds.User
-		if creds.Password != nil {
-			// TODO: Handle password correctly, definitions differ
-			opts.Password = string(creds.Password)
+		if err := setNatsAuth(s.opts, &opts, creds); err != nil {
+			return nil, err
 		}
 	}
 	return &opts, nil
@@ -292,20 +393,21 @@ func (s *server) PublishWill(will *pkg.Will, creds *pkg.Credentials) error {
 	id := uint16(0)
 	qos := will.QoS
 	if qos > 0 {
-		id = s.NextFreePacketID()
+		if id = s.NextFreePacketID(); id == 0 {
+			return errNoFreePacketID
+		}
 	}
 	pp := pkg.NewPublish2(id, will.Topic, will.Message, qos, false, will.Retain)
-	nc, err := s.NatsConn(creds)
+	pp.SetProperties(will.Props)
+	nc, release, err := s.publishConn(creds)
 	if err == nil {
-		defer nc.Close()
-		natsSubj := mqtt.ToNATS(will.Topic)
-		if qos == 0 {
-			err = nc.Publish(natsSubj, will.Message)
-		} else {
+		defer release()
+		replyTo := ``
+		if qos > 0 {
 			// use client id and packet id to form a reply subject
-			replyTo := NewReplyTopic(s.session, pp).String()
-			err = nc.PublishRequest(natsSubj, replyTo, will.Message)
+			replyTo = NewReplyTopic(s.session, pp).String()
 		}
+		err = publishMsg(nc, newNatsMsg(s.opts.HeaderPrefix, replyTo, pp))
 		if err == nil {
 			if will.Retain {
 				s.HandleRetain(pp)
@@ -376,10 +478,13 @@ func (s *server) republish(np *natsPub) {
 	)
 	if np.creds == nil {
 		conn, err = s.serverNatsConn()
-	} else if conn, err = s.NatsConn(np.creds); err == nil {
-		// temporary connection with credentials from the client where the
-		// message originated, must be closed on function return
-		defer conn.Close()
+	} else {
+		// possibly a temporary connection with credentials from the client where the
+		// message originated, must be released on function return
+		var release func()
+		if conn, release, err = s.publishConn(np.creds); err == nil {
+			defer release()
+		}
 	}
 
 	if err == nil {
@@ -388,7 +493,7 @@ func (s *server) republish(np *natsPub) {
 		var sub *nats.Subscription
 		if sub, err = conn.SubscribeSync(replyTo); err == nil {
 			s.Debug("republish", pp)
-			if err = conn.PublishRequest(mqtt.ToNATS(pp.TopicName()), replyTo, pp.Payload()); err == nil {
+			if err = publishMsg(conn, newNatsMsg(s.opts.HeaderPrefix, replyTo, pp)); err == nil {
 				if _, err = sub.NextMsg(2 * time.Second); err == nil {
 					s.Debug("ack", pp.ID())
 					s.trackAckLock.Lock()
@@ -498,37 +603,74 @@ func (s *server) HandleRetain(pp *pkg.Publish) *pkg.Publish {
 	return pp
 }
 
+func (s *server) Options() *Options {
+	return s.opts
+}
+
 func (s *server) PublishMatching(ps *pkg.Subscribe, c Client) {
 	s.retainedPackets.publishMatching(ps, c)
 }
 
 func (s *server) ServeClient(conn net.Conn) {
+	s.serveClient(conn, nil)
+}
+
+// serveClient serves a client that connected to the given listener
+func (s *server) serveClient(conn net.Conn, l *Listener) {
 	s.clientWG.Add(1)
 	defer s.clientWG.Done()
-	c := NewClient(s, s, conn)
+	if pc, ok := conn.(*proxyConn); ok {
+		if err := pc.readHeader(); err != nil {
+			s.Debug("connection from", conn.RemoteAddr(), "refused", err)
+			_ = conn.Close()
+			return
+		}
+		if pt := pc.proxyTLS(); pt != nil {
+			s.Debug("TLS of", conn.RemoteAddr(), "terminated by load balancer:", pt)
+		}
+	}
+	if tc, ok := conn.(*tls.Conn); ok {
+		if err := s.tlsHandshake(tc); err != nil {
+			s.Debug("TLS handshake failed", conn.RemoteAddr(), err)
+			_ = conn.Close()
+			return
+		}
+	}
+	s.Debug("accepted connection from", conn.RemoteAddr())
+	c := newClient(s, s, conn, l)
 	c.Serve()
 	s.unmanageClient(c)
 }
 
-// ManageClient adds the client to the list of clients managed by the server
-func (s *server) ManageClient(c Client) {
+// ManageClient adds the client to the clients managed by the server and returns the client that was
+// previously managed under the same client ID, or nil if there was no such client
+func (s *server) ManageClient(c Client) Client {
+	cid := c.ClientID()
 	s.clientLock.Lock()
-	s.clients = append(s.clients, c)
+	if s.clients == nil {
+		s.clients = make(map[string]Client)
+	}
+	oc := s.clients[cid]
+	s.clients[cid] = c
 	s.clientLock.Unlock()
+	return oc
+}
+
+// isDraining returns true when the server is shutting down
+func (s *server) isDraining() bool {
+	s.clientLock.RLock()
+	draining := s.draining
+	s.clientLock.RUnlock()
+	return draining
 }
 
-// unmanageClient removes the client from the list of clients managed by the server
+// unmanageClient removes the client from the clients managed by the server unless another client has
+// taken over its client ID
 func (s *server) unmanageClient(c Client) {
+	cid := c.ClientID()
 	s.clientLock.Lock()
-	cs := s.clients
-	ln := len(cs) - 1
-	for i := 0; i <= ln; i++ {
-		if c == cs[i] {
-			cs[i] = cs[ln]
-			cs[ln] = nil
-			s.clients = cs[:ln]
-			break
-		}
+	if s.clients[cid] == c {
+		delete(s.clients, cid)
 	}
 	s.clientLock.Unlock()
 }
@@ -569,38 +711,6 @@ func (s *server) persist(path string) error {
 	return err
 }
 
-func getTCPListener(opts *Options) (net.Listener, error) {
-	ps := `:` + strconv.Itoa(opts.Port)
-	if !opts.TLS {
-		return net.Listen("tcp", ps)
-	}
-
-	// Load mandatory server key pair for bridge
-	cer, err := tls.LoadX509KeyPair(opts.TLSCert, opts.TLSKey)
-	if err != nil {
-		return nil, err
-	}
-	cfg := &tls.Config{Certificates: []tls.Certificate{cer}}
-
-	if opts.TLSVerify {
-		cfg.ClientAuth = tls.RequestClientCert
-	}
-
-	if opts.TLSCaCert != `` {
-		roots := x509.NewCertPool()
-		var caPem []byte
-		if caPem, err = ioutil.ReadFile(opts.TLSCaCert); err != nil {
-			return nil, err
-		}
-		if ok := roots.AppendCertsFromPEM(caPem); !ok {
-			return nil, fmt.Errorf("failed to parse root certificate in file: %s", opts.TLSCaCert)
-		}
-		cfg.ClientCAs = roots
-	}
-
-	return tls.Listen(`tcp`, ps, cfg)
-}
-
 func (s *server) SessionManager() SessionManager {
 	return s.sm
 }
@@ -3,8 +3,10 @@ package bridge
 import (
 	"encoding/json"
 	"io"
+	"sort"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/tada/catch"
 
@@ -26,8 +28,25 @@ type Session interface {
 	// ClientID returns the id of the client that this session belongs to
 	ClientID() string
 
-	// Destroy the session
-	Destroy()
+	// Destroy the session and release the IDs of the packets that are in flight to the client
+	Destroy(pkg.IDManager)
+
+	// ExpiryInterval returns the number of seconds that the session is kept after the client disconnects.
+	// Zero means that the session ends with the connection and NeverExpires means that it never ends.
+	ExpiryInterval() uint32
+
+	// SetExpiryInterval sets the number of seconds that the session is kept after the client disconnects
+	SetExpiryInterval(uint32)
+
+	// DisconnectTime returns the time when the client disconnected or the zero time if the client is connected
+	DisconnectTime() time.Time
+
+	// SetDisconnectTime sets the time when the client disconnected. The zero time means that the client is
+	// connected.
+	SetDisconnectTime(time.Time)
+
+	// Expired returns true if the client is disconnected and the expiry interval has elapsed at the given time
+	Expired(time.Time) bool
 
 	// AckRequested remembers the given subscription which represents an awaited ACK
 	// for the given packetID
@@ -41,15 +60,76 @@ type Session interface {
 	// to the caller to cancel the returned subscriptions.
 	AckReceived(uint16) []*nats.Subscription
 
-	// ClientAckRequested remembers the id of a packet which has been sent to the client. The packet stems from a NATS
+	// ClientAckRequested remembers the id of a packet which is sent to the client. The packet stems from a NATS
 	// subscription with QoS level > 0 and it is now expected that the client sends an PubACK back to which can be
-	// propagated to the reply-to address.
-	ClientAckRequested(*pkg.Publish)
+	// propagated to the reply-to address. A packet with a zero id gets its id from the given IDManager when it
+	// enters the in-flight window. The method returns send = false when the in-flight window is full. The packet
+	// is then queued, and must not be sent until it is returned from ReleaseQueued, unless the queue is full
+	// in which case queued is false too and the packet is dropped.
+	ClientAckRequested(*pkg.Publish, pkg.IDManager) (send bool, queued bool)
+
+	// SetInFlightMaximum sets the maximum number of QoS level > 0 packets sent to the client that may await
+	// acknowledgement at the same time, where zero means no limit, and the maximum number of packets that
+	// are queued while the in-flight window is full.
+	SetInFlightMaximum(max int, queueMax int)
+
+	// ReleaseQueued returns the queued packets that fit in the in-flight window in the order that they
+	// were queued. Packets with a zero id get their id from the given IDManager. The returned packets are
+	// remembered as sent to the client.
+	ReleaseQueued(pkg.IDManager) []*pkg.Publish
+
+	// AwaitsAckCount returns the number of QoS level > 0 packets from the client that hasn't been fully
+	// acknowledged yet.
+	AwaitsAckCount() int
 
 	// ClientAckReceived will close a pending response ack subscription and forward the ACK to the
 	// replyTo subject. It returns whether or not such an ack was pending
 	ClientAckReceived(uint16, *nats.Conn) bool
 
+	// RelRequested remembers that a PUBREC has been sent to the client in response to a QoS level 2
+	// publish with the given packet identifier and that a PUBREL is now expected.
+	RelRequested(uint16)
+
+	// AwaitsRel returns true if a PUBREL is expected for the given packet identifier. A publish with
+	// such an identifier is a duplicate and must not be forwarded again.
+	AwaitsRel(uint16) bool
+
+	// RelReceived forgets the given packet identifier and returns whether or not a PUBREL was expected
+	// for it.
+	RelReceived(uint16) bool
+
+	// ClientRecReceived is called when a client sends a PUBREC for a QoS level 2 packet. The ack is
+	// forwarded to the NATS replyTo subject and the packet identifier is then remembered until the client
+	// sends the final PUBCOMP. It returns whether or not the packet identifier is in flight.
+	ClientRecReceived(uint16, *nats.Conn) bool
+
+	// ClientCompReceived forgets the given packet identifier and returns whether or not a PUBCOMP was
+	// expected for it.
+	ClientCompReceived(uint16) bool
+
+	// AddSubscriptions remembers the given subscriptions so that they can be restored when the session is
+	// resumed. A subscription replaces any previous subscription with the same topic filter.
+	AddSubscriptions([]pkg.Topic)
+
+	// RemoveSubscriptions forgets the subscriptions with the given topic filters
+	RemoveSubscriptions([]string)
+
+	// Subscriptions returns the subscriptions of the session sorted by topic filter
+	Subscriptions() []pkg.Topic
+
+	// QueueOffline appends the given packet to the packets that are delivered when the client resumes the
+	// session. The queue holds at most max packets. When it is full, the oldest packet is dropped when
+	// dropOldest is true and the given packet otherwise. The dropped packet, if any, is returned.
+	QueueOffline(pp *pkg.Publish, max int, dropOldest bool) *pkg.Publish
+
+	// TakeOffline returns the packets that were queued while the client was disconnected, in the order that
+	// they were queued, and empties the queue.
+	TakeOffline() []*pkg.Publish
+
+	// SetOfflineSubscriptions replaces the NATS subscriptions that are used while the client is disconnected
+	// and returns the previous subscriptions. It is up to the caller to cancel the returned subscriptions.
+	SetOfflineSubscriptions([]*nats.Subscription) []*nats.Subscription
+
 	// Resend all messages that the client hasn't acknowledged
 	ResendClientUnack(c *client)
 
@@ -58,13 +138,26 @@ type Session interface {
 	RestoreAckSubscriptions(c *client)
 }
 
+// NeverExpires is the session expiry interval of a session that never expires
+const NeverExpires = uint32(0xffffffff)
+
 type session struct {
-	id              string
-	clientID        string
-	prelAwaitsAck   map[uint16]string
-	awaitsAck       map[uint16]*nats.Subscription // awaits ack on reply-to to be propagated to client
-	awaitsClientAck map[uint16]*pkg.Publish       // awaits ack from client to be propagated to nats
-	awaitsAckLock   sync.RWMutex
+	id               string
+	clientID         string
+	expiry           uint32
+	disconnected     time.Time
+	prelAwaitsAck    map[uint16]string
+	awaitsAck        map[uint16]*nats.Subscription // awaits ack on reply-to to be propagated to client
+	awaitsClientAck  map[uint16]*pkg.Publish       // awaits ack from client to be propagated to nats
+	awaitsRel        map[uint16]bool               // QoS 2 packets from client for which PUBREC was sent
+	awaitsClientComp map[uint16]bool               // QoS 2 packets to client for which PUBREL was sent
+	queue            []*pkg.Publish                // packets to client waiting for room in the in-flight window
+	subs             map[string]byte               // topic filter to QoS and subNoLocal of the client's subscriptions
+	offline          []*pkg.Publish                // packets queued while the client is disconnected
+	offlineSubs      []*nats.Subscription          // subscriptions used while the client is disconnected
+	inFlightMax      int
+	queueMax         int
+	awaitsAckLock    sync.RWMutex
 }
 
 func (s *session) MarshalJSON() ([]byte, error) {
@@ -77,17 +170,29 @@ func (s *session) MarshalToJSON(w io.Writer) {
 	pio.WriteString(w, `,"cid":`)
 	jsonstream.WriteString(w, s.clientID)
 	s.awaitsAckLock.RLock()
-	if len(s.awaitsAck) > 0 {
-		pio.WriteString(w, `,"awAck":`)
-		sep := byte('{')
-		for k, v := range s.awaitsAck {
-			pio.WriteByte(w, sep)
-			sep = byte(',')
-			pio.WriteByte(w, '"')
-			pio.WriteInt(w, int64(k))
-			pio.WriteString(w, `":`)
-			jsonstream.WriteString(w, v.Subject)
+	pio.WriteString(w, `,"exp":`)
+	pio.WriteInt(w, int64(s.expiry))
+	if !s.disconnected.IsZero() {
+		pio.WriteString(w, `,"dts":`)
+		jsonstream.WriteString(w, s.disconnected.Format(time.RFC3339))
+	}
+	sep := byte('{')
+	for k, v := range s.awaitsAck {
+		if v == nil {
+			// a JetStream publication that awaits its ack has no subscription that can be restored
+			continue
+		}
+		if sep == '{' {
+			pio.WriteString(w, `,"awAck":`)
 		}
+		pio.WriteByte(w, sep)
+		sep = byte(',')
+		pio.WriteByte(w, '"')
+		pio.WriteInt(w, int64(k))
+		pio.WriteString(w, `":`)
+		jsonstream.WriteString(w, v.Subject)
+	}
+	if sep == ',' {
 		pio.WriteByte(w, '}')
 	}
 	if len(s.awaitsClientAck) > 0 {
@@ -103,10 +208,87 @@ func (s *session) MarshalToJSON(w io.Writer) {
 		}
 		pio.WriteByte(w, '}')
 	}
+	if len(s.subs) > 0 {
+		pio.WriteString(w, `,"subs":`)
+		sep := byte('{')
+		for k, v := range s.subs {
+			pio.WriteByte(w, sep)
+			sep = byte(',')
+			jsonstream.WriteString(w, k)
+			pio.WriteByte(w, ':')
+			pio.WriteInt(w, int64(v))
+		}
+		pio.WriteByte(w, '}')
+	}
+	if len(s.queue) > 0 {
+		pio.WriteString(w, `,"queue":`)
+		writePublishList(w, s.queue)
+	}
+	if len(s.offline) > 0 {
+		pio.WriteString(w, `,"offline":`)
+		writePublishList(w, s.offline)
+	}
+	if len(s.awaitsRel) > 0 {
+		pio.WriteString(w, `,"awRel":`)
+		writeIDSet(w, s.awaitsRel)
+	}
+	if len(s.awaitsClientComp) > 0 {
+		pio.WriteString(w, `,"awClientComp":`)
+		writeIDSet(w, s.awaitsClientComp)
+	}
 	pio.WriteByte(w, '}')
 	s.awaitsAckLock.RUnlock()
 }
 
+func writePublishList(w io.Writer, pps []*pkg.Publish) {
+	sep := byte('[')
+	for i := range pps {
+		pio.WriteByte(w, sep)
+		sep = byte(',')
+		pps[i].MarshalToJSON(w)
+	}
+	pio.WriteByte(w, ']')
+}
+
+func readPublishList(js jsonstream.Decoder) []*pkg.Publish {
+	var pps []*pkg.Publish
+	js.ReadDelim('[')
+	for {
+		pp := &pkg.Publish{}
+		valid, ok := js.ReadConsumerOrEnd(pp, ']')
+		if !ok {
+			break
+		}
+		if valid {
+			pps = append(pps, pp)
+		}
+	}
+	return pps
+}
+
+func writeIDSet(w io.Writer, ids map[uint16]bool) {
+	sep := byte('[')
+	for k := range ids {
+		pio.WriteByte(w, sep)
+		sep = byte(',')
+		pio.WriteInt(w, int64(k))
+	}
+	pio.WriteByte(w, ']')
+}
+
+func readIDSet(js jsonstream.Decoder) map[uint16]bool {
+	ids := make(map[uint16]bool)
+	js.ReadDelim('[')
+	for {
+		i, ok := js.ReadIntOrEnd(']')
+		if !ok {
+			break
+		}
+		ids[uint16(i)] = true
+	}
+	return ids
+}
+
 func (s *session) UnmarshalFromJSON(js jsonstream.Decoder, t json.Token) {
 	jsonstream.AssertDelim(t, '{')
 	for {
@@ -119,6 +301,14 @@ func (s *session) UnmarshalFromJSON(js jsonstream.Decoder, t json.Token) {
 			s.id = js.ReadString()
 		case "cid":
 			s.clientID = js.ReadString()
+		case "exp":
+			s.expiry = uint32(js.ReadInt())
+		case "dts":
+			ts, err := time.Parse(time.RFC3339, js.ReadString())
+			if err != nil {
+				panic(catch.Error(err))
+			}
+			s.disconnected = ts
 		case "awAck":
 			js.ReadDelim('{')
 			for {
@@ -154,6 +344,24 @@ func (s *session) UnmarshalFromJSON(js jsonstream.Decoder, t json.Token) {
 					s.awaitsClientAck[uint16(i)] = pp
 				}
 			}
+		case "subs":
+			js.ReadDelim('{')
+			s.subs = make(map[string]byte)
+			for {
+				k, ok = js.ReadStringOrEnd('}')
+				if !ok {
+					break
+				}
+				s.subs[k] = byte(js.ReadInt())
+			}
+		case "queue":
+			s.queue = readPublishList(js)
+		case "offline":
+			s.offline = readPublishList(js)
+		case "awRel":
+			s.awaitsRel = readIDSet(js)
+		case "awClientComp":
+			s.awaitsClientComp = readIDSet(js)
 		}
 	}
 }
@@ -215,19 +423,209 @@ func (s *session) ClientAckReceived(packetID uint16, c *nats.Conn) bool {
 	}
 	s.awaitsAckLock.Unlock()
 	if pp != nil {
-		_ = c.Publish(pp.NatsReplyTo(), []byte{0})
+		if pp.NatsReplyTo() != "" {
+			_ = c.Publish(pp.NatsReplyTo(), ackPayload(pp.NatsReplyTo()))
+		}
 		return true
 	}
 	return false
 }
 
-func (s *session) ClientAckRequested(pp *pkg.Publish) {
+func (s *session) ClientAckRequested(pp *pkg.Publish, ids pkg.IDManager) (bool, bool) {
+	s.awaitsAckLock.Lock()
+	defer s.awaitsAckLock.Unlock()
+	_, resent := s.awaitsClientAck[pp.ID()]
+	if resent || len(s.queue) == 0 && s.hasRoom() && assignID(pp, ids) {
+		if s.awaitsClientAck == nil {
+			s.awaitsClientAck = make(map[uint16]*pkg.Publish)
+		}
+		s.awaitsClientAck[pp.ID()] = pp
+		return true, true
+	}
+	if len(s.queue) >= s.queueMax {
+		return false, false
+	}
+	s.queue = append(s.queue, pp)
+	return false, true
+}
+
+// assignID gives the packet an id from the given IDManager unless it already has one. It returns false
+// when all ids are in use.
+func assignID(pp *pkg.Publish, ids pkg.IDManager) bool {
+	if pp.ID() == 0 {
+		id := ids.NextFreePacketID()
+		if id == 0 {
+			return false
+		}
+		pp.SetID(id)
+	}
+	return true
+}
+
+// hasRoom returns true if the in-flight window has room for another packet. Must be called with
+// the awaitsAckLock held.
+func (s *session) hasRoom() bool {
+	return s.inFlightMax <= 0 || len(s.awaitsClientAck)+len(s.awaitsClientComp) < s.inFlightMax
+}
+
+func (s *session) SetInFlightMaximum(max int, queueMax int) {
+	s.awaitsAckLock.Lock()
+	s.inFlightMax = max
+	s.queueMax = queueMax
+	s.awaitsAckLock.Unlock()
+}
+
+func (s *session) ReleaseQueued(ids pkg.IDManager) []*pkg.Publish {
+	var pps []*pkg.Publish
+	s.awaitsAckLock.Lock()
+	for len(s.queue) > 0 && s.hasRoom() && assignID(s.queue[0], ids) {
+		pp := s.queue[0]
+		s.queue[0] = nil
+		s.queue = s.queue[1:]
+		if s.awaitsClientAck == nil {
+			s.awaitsClientAck = make(map[uint16]*pkg.Publish)
+		}
+		s.awaitsClientAck[pp.ID()] = pp
+		pps = append(pps, pp)
+	}
+	if len(s.queue) == 0 {
+		s.queue = nil
+	}
+	s.awaitsAckLock.Unlock()
+	return pps
+}
+
+func (s *session) AwaitsAckCount() int {
+	s.awaitsAckLock.RLock()
+	n := len(s.awaitsAck) + len(s.prelAwaitsAck) + len(s.awaitsRel)
+	s.awaitsAckLock.RUnlock()
+	return n
+}
+
+func (s *session) RelRequested(packetID uint16) {
+	s.awaitsAckLock.Lock()
+	if s.awaitsRel == nil {
+		s.awaitsRel = make(map[uint16]bool)
+	}
+	s.awaitsRel[packetID] = true
+	s.awaitsAckLock.Unlock()
+}
+
+func (s *session) AwaitsRel(packetID uint16) bool {
+	s.awaitsAckLock.RLock()
+	awaits := s.awaitsRel[packetID]
+	s.awaitsAckLock.RUnlock()
+	return awaits
+}
+
+func (s *session) RelReceived(packetID uint16) bool {
 	s.awaitsAckLock.Lock()
-	if s.awaitsClientAck == nil {
-		s.awaitsClientAck = make(map[uint16]*pkg.Publish)
+	awaits := s.awaitsRel[packetID]
+	if awaits {
+		delete(s.awaitsRel, packetID)
 	}
-	s.awaitsClientAck[pp.ID()] = pp
 	s.awaitsAckLock.Unlock()
+	return awaits
+}
+
+func (s *session) ClientRecReceived(packetID uint16, c *nats.Conn) bool {
+	var pp *pkg.Publish
+	s.awaitsAckLock.Lock()
+	inFlight := s.awaitsClientComp[packetID]
+	if !inFlight && s.awaitsClientAck != nil {
+		if pp, inFlight = s.awaitsClientAck[packetID]; inFlight {
+			delete(s.awaitsClientAck, packetID)
+			if s.awaitsClientComp == nil {
+				s.awaitsClientComp = make(map[uint16]bool)
+			}
+			s.awaitsClientComp[packetID] = true
+		}
+	}
+	s.awaitsAckLock.Unlock()
+	if pp != nil && pp.NatsReplyTo() != "" {
+		_ = c.Publish(pp.NatsReplyTo(), ackPayload(pp.NatsReplyTo()))
+	}
+	return inFlight
+}
+
+func (s *session) ClientCompReceived(packetID uint16) bool {
+	s.awaitsAckLock.Lock()
+	awaits := s.awaitsClientComp[packetID]
+	if awaits {
+		delete(s.awaitsClientComp, packetID)
+	}
+	s.awaitsAckLock.Unlock()
+	return awaits
+}
+
+// subNoLocal is the bit that is added to the QoS of a remembered subscription that has the No Local option
+const subNoLocal = 0x04
+
+func (s *session) AddSubscriptions(tps []pkg.Topic) {
+	s.awaitsAckLock.Lock()
+	if s.subs == nil {
+		s.subs = make(map[string]byte)
+	}
+	for i := range tps {
+		o := tps[i].QoS
+		if tps[i].NoLocal {
+			o |= subNoLocal
+		}
+		s.subs[tps[i].Name] = o
+	}
+	s.awaitsAckLock.Unlock()
+}
+
+func (s *session) RemoveSubscriptions(names []string) {
+	s.awaitsAckLock.Lock()
+	for i := range names {
+		delete(s.subs, names[i])
+	}
+	s.awaitsAckLock.Unlock()
+}
+
+func (s *session) Subscriptions() []pkg.Topic {
+	s.awaitsAckLock.RLock()
+	tps := make([]pkg.Topic, 0, len(s.subs))
+	for k, v := range s.subs {
+		tps = append(tps, pkg.Topic{Name: k, QoS: v &^ subNoLocal, NoLocal: v&subNoLocal != 0})
+	}
+	s.awaitsAckLock.RUnlock()
+	sort.Slice(tps, func(i, j int) bool { return tps[i].Name < tps[j].Name })
+	return tps
+}
+
+func (s *session) QueueOffline(pp *pkg.Publish, max int, dropOldest bool) *pkg.Publish {
+	var dropped *pkg.Publish
+	s.awaitsAckLock.Lock()
+	if len(s.offline) >= max {
+		if !dropOldest {
+			s.awaitsAckLock.Unlock()
+			return pp
+		}
+		dropped = s.offline[0]
+		s.offline[0] = nil
+		s.offline = s.offline[1:]
+	}
+	s.offline = append(s.offline, pp)
+	s.awaitsAckLock.Unlock()
+	return dropped
+}
+
+func (s *session) TakeOffline() []*pkg.Publish {
+	s.awaitsAckLock.Lock()
+	pps := s.offline
+	s.offline = nil
+	s.awaitsAckLock.Unlock()
+	return pps
+}
+
+func (s *session) SetOfflineSubscriptions(nss []*nats.Subscription) []*nats.Subscription {
+	s.awaitsAckLock.Lock()
+	old := s.offlineSubs
+	s.offlineSubs = nss
+	s.awaitsAckLock.Unlock()
+	return old
 }
 
 func (s *session) ResendClientUnack(c *client) {
@@ -236,11 +634,18 @@ func (s *session) ResendClientUnack(c *client) {
 	for _, a := range s.awaitsClientAck {
 		as = append(as, a)
 	}
+	rs := make([]uint16, 0, len(s.awaitsClientComp))
+	for id := range s.awaitsClientComp {
+		rs = append(rs, id)
+	}
 	s.awaitsAckLock.RUnlock()
 	for i := range as {
 		a := as[i]
 		c.PublishResponse(a.QoSLevel(), a)
 	}
+	for i := range rs {
+		c.queueForWrite(pkg.PubRel(rs[i]))
+	}
 }
 
 func (s *session) ID() string {
@@ -251,7 +656,41 @@ func (s *session) ClientID() string {
 	return s.clientID
 }
 
-func (s *session) Destroy() {
+func (s *session) ExpiryInterval() uint32 {
+	s.awaitsAckLock.RLock()
+	exp := s.expiry
+	s.awaitsAckLock.RUnlock()
+	return exp
+}
+
+func (s *session) SetExpiryInterval(exp uint32) {
+	s.awaitsAckLock.Lock()
+	s.expiry = exp
+	s.awaitsAckLock.Unlock()
+}
+
+func (s *session) DisconnectTime() time.Time {
+	s.awaitsAckLock.RLock()
+	ts := s.disconnected
+	s.awaitsAckLock.RUnlock()
+	return ts
+}
+
+func (s *session) SetDisconnectTime(ts time.Time) {
+	s.awaitsAckLock.Lock()
+	s.disconnected = ts
+	s.awaitsAckLock.Unlock()
+}
+
+func (s *session) Expired(now time.Time) bool {
+	s.awaitsAckLock.RLock()
+	expired := !(s.disconnected.IsZero() || s.expiry == NeverExpires) &&
+		!now.Before(s.disconnected.Add(time.Duration(s.expiry)*time.Second))
+	s.awaitsAckLock.RUnlock()
+	return expired
+}
+
+func (s *session) Destroy(ids pkg.IDManager) {
 	// Unsubscribe all pending subscriptions
 	s.awaitsAckLock.Lock()
 	if s.awaitsAck != nil {
@@ -260,6 +699,21 @@ func (s *session) Destroy() {
 		}
 		s.awaitsAck = nil
 	}
+	for id := range s.awaitsClientAck {
+		ids.ReleasePacketID(id)
+	}
+	for id := range s.awaitsClientComp {
+		ids.ReleasePacketID(id)
+	}
+	s.awaitsClientAck = nil
+	s.awaitsRel = nil
+	s.awaitsClientComp = nil
+	for _, sb := range s.offlineSubs {
+		_ = sb.Unsubscribe()
+	}
+	s.offlineSubs = nil
+	s.offline = nil
+	s.queue = nil
 	s.awaitsAckLock.Unlock()
 }
 
@@ -274,11 +728,19 @@ type SessionManager interface {
 
 	// Remove removes any session for the given clientID
 	Remove(clientID string)
+
+	// Sessions returns all sessions
+	Sessions() []Session
+
+	// RemoveExpired removes and destroys all sessions that have expired at the given time and returns
+	// the removed sessions
+	RemoveExpired(now time.Time) []Session
 }
 
 type sm struct {
 	lock sync.RWMutex
 	seed uint32
+	ids  pkg.IDManager
 	m    map[string]Session
 }
 
@@ -352,6 +814,32 @@ func (m *sm) Remove(clientID string) {
 	delete(m.m, clientID)
 	m.lock.Unlock()
 	if s != nil {
-		s.Destroy()
+		s.Destroy(m.ids)
 	}
 }
+
+func (m *sm) RemoveExpired(now time.Time) []Session {
+	var ss []Session
+	m.lock.Lock()
+	for k, s := range m.m {
+		if s.Expired(now) {
+			ss = append(ss, s)
+			delete(m.m, k)
+		}
+	}
+	m.lock.Unlock()
+	for i := range ss {
+		ss[i].Destroy(m.ids)
+	}
+	return ss
+}
+
+func (m *sm) Sessions() []Session {
+	m.lock.RLock()
+	ss := make([]Session, 0, len(m.m))
+	for _, s := range m.m {
+		ss = append(ss, s)
+	}
+	m.lock.RUnlock()
+	return ss
+}
@@ -0,0 +1,70 @@
+package bridge
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/tada/mqtt-nats/mqtt/pkg"
+	"github.com/tada/mqtt-nats/test/utils"
+)
+
+type releaseRecorder struct {
+	pkg.IDManager
+	released []uint16
+}
+
+func (r *releaseRecorder) ReleasePacketID(id uint16) {
+	r.released = append(r.released, id)
+	r.IDManager.ReleasePacketID(id)
+}
+
+func Test_session_inFlightQueue(t *testing.T) {
+	ids := pkg.NewIDManager()
+	s := &session{}
+	s.SetInFlightMaximum(1, 1)
+	pps := make([]*pkg.Publish, 3)
+	for i := range pps {
+		pps[i] = pkg.NewPublish(0, "t", 2, nil, false, ``)
+	}
+	send, queued := s.ClientAckRequested(pps[0], ids)
+	utils.CheckTrue(send && queued, t)
+	utils.CheckEqual(uint16(2), pps[0].ID(), t)
+
+	// the packet id is assigned when the packet leaves the queue
+	send, queued = s.ClientAckRequested(pps[1], ids)
+	utils.CheckTrue(!send && queued, t)
+	utils.CheckEqual(uint16(0), pps[1].ID(), t)
+
+	// the queue is full
+	send, queued = s.ClientAckRequested(pps[2], ids)
+	utils.CheckTrue(!send && !queued, t)
+
+	utils.CheckEqual(0, len(s.ReleaseQueued(ids)), t)
+	utils.CheckTrue(s.ClientAckReceived(2, nil), t)
+	ids.ReleasePacketID(2)
+	rs := s.ReleaseQueued(ids)
+	utils.CheckEqual(1, len(rs), t)
+	utils.CheckEqual(uint16(3), rs[0].ID(), t)
+}
+
+func Test_sm_destroyReleasesPacketIDs(t *testing.T) {
+	ids := &releaseRecorder{IDManager: pkg.NewIDManager()}
+	m := &sm{ids: ids, m: make(map[string]Session, 3)}
+	s := m.Create("a")
+	s.SetInFlightMaximum(2, 1)
+	for i := 0; i < 3; i++ {
+		s.ClientAckRequested(pkg.NewPublish(0, "t", 2, nil, false, ``), ids)
+	}
+	s.ClientRecReceived(2, nil)
+	s.SetDisconnectTime(time.Now().Add(-time.Second))
+	utils.CheckEqual(1, len(m.RemoveExpired(time.Now())), t)
+	sort.Slice(ids.released, func(i, j int) bool { return ids.released[i] < ids.released[j] })
+	utils.CheckEqual([]uint16{2, 3}, ids.released, t)
+}
+
+func Test_session_subscriptionsNoLocal(t *testing.T) {
+	s := &session{}
+	s.AddSubscriptions([]pkg.Topic{{Name: "a", QoS: 1, NoLocal: true}, {Name: "b", QoS: 2}})
+	utils.CheckEqual([]pkg.Topic{{Name: "a", QoS: 1, NoLocal: true}, {Name: "b", QoS: 2}}, s.Subscriptions(), t)
+}
@@ -0,0 +1,61 @@
+package bridge
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"time"
+)
+
+// defaultTLSTimeout is the TLS handshake timeout used when none is given in the options
+const defaultTLSTimeout = 2 * time.Second
+
+// tlsTimeout returns the TLS handshake timeout
+func (s *server) tlsTimeout() time.Duration {
+	if s.opts.TLSTimeout > 0 {
+		return time.Duration(s.opts.TLSTimeout * float64(time.Second))
+	}
+	return defaultTLSTimeout
+}
+
+// tlsHandshake performs the TLS handshake of the given connection. The handshake fails if it doesn't
+// complete within the TLS timeout.
+func (s *server) tlsHandshake(conn *tls.Conn) error {
+	if err := conn.SetDeadline(time.Now().Add(s.tlsTimeout())); err != nil {
+		return err
+	}
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	return conn.SetDeadline(time.Time{})
+}
+
+// certIdentity returns the user name that the given client certificate maps to. It is the first email
+// address of the certificate, its first DNS name, or its subject, in that order of preference.
+func certIdentity(cert *x509.Certificate) string {
+	if len(cert.EmailAddresses) > 0 {
+		return cert.EmailAddresses[0]
+	}
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+	return cert.Subject.String()
+}
+
+// peerIdentity returns the user name that the verified client certificate of the connection maps to. The
+// common name of a certificate that a load balancer has verified and passed on in a PROXY protocol header is
+// used when the connection doesn't use TLS. The returned bool is false if the connection has no such
+// certificate.
+func (c *client) peerIdentity() (string, bool) {
+	tc, ok := c.mqttConn.(interface{ ConnectionState() tls.ConnectionState })
+	if ok {
+		if chains := tc.ConnectionState().VerifiedChains; len(chains) > 0 && len(chains[0]) > 0 {
+			return certIdentity(chains[0][0]), true
+		}
+	}
+	if pc := proxied(c.mqttConn); pc != nil {
+		if pt := pc.proxyTLS(); pt != nil && pt.verified && pt.commonName != `` {
+			return pt.commonName, true
+		}
+	}
+	return ``, false
+}
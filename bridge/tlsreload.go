@@ -0,0 +1,154 @@
+package bridge
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// defaultTLSReloadRate is the delay between each check for changed TLS files unless set in the options
+const defaultTLSReloadRate = 10 * time.Second
+
+// tlsFiles provides the TLS configuration of a listener. The server certificate, key, and client CA pool are
+// read from disk again when the files change or on request. Connections that are already established keep
+// the configuration that they were established with.
+type tlsFiles struct {
+	listener *Listener
+	lock     sync.RWMutex
+	config   *tls.Config
+	modTimes []time.Time // modification times of the files when they were last read
+}
+
+// newTLSFiles reads the TLS files of the given listener
+func newTLSFiles(l *Listener) (*tlsFiles, error) {
+	tf := &tlsFiles{listener: l}
+	if err := tf.load(); err != nil {
+		return nil, err
+	}
+	return tf, nil
+}
+
+// listenerConfig returns the configuration to use for the listener. It delegates to the most recently read
+// configuration at each handshake.
+func (tf *tlsFiles) listenerConfig() *tls.Config {
+	return &tls.Config{GetConfigForClient: tf.configForClient}
+}
+
+func (tf *tlsFiles) configForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	tf.lock.RLock()
+	defer tf.lock.RUnlock()
+	return tf.config, nil
+}
+
+func (tf *tlsFiles) paths() []string {
+	l := tf.listener
+	paths := []string{l.TLSCert, l.TLSKey}
+	if l.TLSCaCert != `` {
+		paths = append(paths, l.TLSCaCert)
+	}
+	return paths
+}
+
+// currentModTimes returns the modification times of the files. A file that cannot be examined gets the zero
+// time.
+func (tf *tlsFiles) currentModTimes() []time.Time {
+	paths := tf.paths()
+	mts := make([]time.Time, len(paths))
+	for i, path := range paths {
+		if fi, err := os.Stat(path); err == nil {
+			mts[i] = fi.ModTime()
+		}
+	}
+	return mts
+}
+
+// changed returns true if any of the files has changed since it was last read
+func (tf *tlsFiles) changed() bool {
+	mts := tf.currentModTimes()
+	tf.lock.RLock()
+	defer tf.lock.RUnlock()
+	for i, mt := range mts {
+		if !mt.Equal(tf.modTimes[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// load reads the files and replaces the current configuration. The current configuration is retained when
+// the files cannot be read, but the files will not be considered changed again until they are modified.
+func (tf *tlsFiles) load() error {
+	mts := tf.currentModTimes()
+	cfg, err := loadTLSConfig(tf.listener)
+	tf.lock.Lock()
+	tf.modTimes = mts
+	if err == nil {
+		tf.config = cfg
+	}
+	tf.lock.Unlock()
+	return err
+}
+
+func loadTLSConfig(l *Listener) (*tls.Config, error) {
+	// Load mandatory server key pair for bridge
+	cer, err := tls.LoadX509KeyPair(l.TLSCert, l.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cer}}
+
+	if l.TLSVerify || l.Auth == ClientAuthCertificate {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	if l.TLSCaCert != `` {
+		roots := x509.NewCertPool()
+		var caPem []byte
+		if caPem, err = ioutil.ReadFile(l.TLSCaCert); err != nil {
+			return nil, err
+		}
+		if ok := roots.AppendCertsFromPEM(caPem); !ok {
+			return nil, fmt.Errorf("failed to parse root certificate in file: %s", l.TLSCaCert)
+		}
+		cfg.ClientCAs = roots
+	}
+	return cfg, nil
+}
+
+func (s *server) tlsReloadRate() time.Duration {
+	if s.opts.TLSReloadRate > 0 {
+		return time.Duration(s.opts.TLSReloadRate) * time.Millisecond
+	}
+	return defaultTLSReloadRate
+}
+
+// reloadTLS reads the TLS files of the given listeners again
+func (s *server) reloadTLS(tfs []*tlsFiles) {
+	for _, tf := range tfs {
+		if err := tf.load(); err != nil {
+			s.Error("failed to reload TLS files of listener", tf.listener, "keeping the current ones:", err)
+			continue
+		}
+		s.Debug("TLS files of listener", tf.listener, "reloaded")
+	}
+}
+
+// tlsReloadTick reloads the TLS files that have changed and then schedules the next check
+func (s *server) tlsReloadTick() {
+	var changed []*tlsFiles
+	for _, tf := range s.tlsFiles {
+		if tf.changed() {
+			changed = append(changed, tf)
+		}
+	}
+	s.reloadTLS(changed)
+	s.tlsReloadLock.Lock()
+	if s.tlsReloadTimer != nil {
+		s.tlsReloadTimer.Reset(s.tlsReloadRate())
+	}
+	s.tlsReloadLock.Unlock()
+}
@@ -0,0 +1,84 @@
+package bridge
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"time"
+)
+
+// unixDialTimeout limits the time spent checking if an existing socket file is in use
+const unixDialTimeout = time.Second
+
+// listenUnix listens on the Unix domain socket at the address of the given listener. A stale socket file
+// that no process listens on is removed first. The permissions of the socket file are set to the socket mode
+// of the listener.
+func listenUnix(l *Listener) (net.Listener, error) {
+	if err := removeStaleSocket(l.Address); err != nil {
+		return nil, err
+	}
+	nl, err := net.Listen(`unix`, l.Address)
+	if err != nil {
+		return nil, err
+	}
+	if l.SocketMode != `` {
+		// the mode has been validated already
+		mode, _ := strconv.ParseUint(l.SocketMode, 8, 32)
+		if err = os.Chmod(l.Address, os.FileMode(mode)); err != nil {
+			_ = nl.Close()
+			return nil, err
+		}
+	}
+	return nl, nil
+}
+
+// removeStaleSocket removes the socket file at the given path unless a process listens on it. An error is
+// returned if the file is in use or isn't a socket.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if conn, err := net.DialTimeout(`unix`, path, unixDialTimeout); err == nil {
+		_ = conn.Close()
+		return fmt.Errorf("socket %s is in use", path)
+	}
+	return os.Remove(path)
+}
+
+// validSocketMode returns an error unless the given mode is empty or an octal file mode
+func validSocketMode(mode string) error {
+	if mode == `` {
+		return nil
+	}
+	if m, err := strconv.ParseUint(mode, 8, 32); err != nil || m > 0777 {
+		return fmt.Errorf("invalid socket mode %q", mode)
+	}
+	return nil
+}
+
+// peerUser returns the name of the user that owns the process at the other end of the given Unix domain
+// socket connection. The numeric user ID is returned when the user has no name.
+func peerUser(conn net.Conn) (string, error) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return ``, fmt.Errorf("peer credentials require a Unix domain socket, not %T", conn)
+	}
+	uid, err := peerUID(uc)
+	if err != nil {
+		return ``, err
+	}
+	id := strconv.FormatUint(uint64(uid), 10)
+	if u, err := user.LookupId(id); err == nil {
+		return u.Username, nil
+	}
+	return id, nil
+}
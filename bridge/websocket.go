@@ -0,0 +1,360 @@
+package bridge
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tada/mqtt-nats/logger"
+)
+
+// DefaultWSPath is the HTTP path of the WebSocket endpoint unless set in the options
+const DefaultWSPath = `/mqtt`
+
+// wsSubprotocol is the WebSocket subprotocol that MQTT clients must request
+const wsSubprotocol = `mqtt`
+
+// wsGUID is appended to the key of the client when computing the accept key of the upgrade response
+const wsGUID = `258EAFA5-E914-47DA-95CA-C5AB0DC85B11`
+
+// WebSocket frame opcodes
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// WebSocket close status codes
+const (
+	wsNormalClosure   = 1000
+	wsProtocolError   = 1002
+	wsUnsupportedData = 1003
+)
+
+// wsMaxControlPayload is the maximum payload length of a control frame
+const wsMaxControlPayload = 125
+
+// wsCloseTimeout limits the time spent sending the close frame when a connection is closed
+const wsCloseTimeout = time.Second
+
+var errListenerClosed = errors.New("listener closed")
+
+// wsListener is a net.Listener that accepts WebSocket connections on the HTTP path given in the options and
+// returns them as connections that carry the payload of binary frames
+type wsListener struct {
+	listener  net.Listener
+	server    *http.Server
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// newWSListener starts serving WebSocket upgrade requests on the given listener. The upgrade request must be
+// received within the given timeout.
+func newWSListener(l net.Listener, path string, timeout time.Duration, lg logger.Logger) *wsListener {
+	if path == `` {
+		path = DefaultWSPath
+	}
+	wl := &wsListener{listener: l, conns: make(chan net.Conn), closed: make(chan struct{})}
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, wl.upgrade)
+	wl.server = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: timeout,
+		ErrorLog:          log.New(debugWriter{lg}, `websocket: `, 0)}
+	go func() {
+		_ = wl.server.Serve(l)
+	}()
+	return wl
+}
+
+func (wl *wsListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-wl.conns:
+		return conn, nil
+	case <-wl.closed:
+		return nil, errListenerClosed
+	}
+}
+
+func (wl *wsListener) Close() error {
+	err := errListenerClosed
+	wl.closeOnce.Do(func() {
+		close(wl.closed)
+		err = wl.server.Close()
+	})
+	return err
+}
+
+func (wl *wsListener) Addr() net.Addr {
+	return wl.listener.Addr()
+}
+
+// headerContains returns true if the comma separated list of the given header contains the given token
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, `,`) {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsAcceptKey computes the Sec-WebSocket-Accept value for the given Sec-WebSocket-Key
+func wsAcceptKey(key string) string {
+	h := sha1.New()
+	_, _ = io.WriteString(h, key+wsGUID)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// upgrade validates a WebSocket upgrade request, completes the handshake, and hands the connection over to
+// Accept.
+func (wl *wsListener) upgrade(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key := r.Header.Get(`Sec-WebSocket-Key`)
+	if !headerContains(r.Header, `Connection`, `upgrade`) || !headerContains(r.Header, `Upgrade`, `websocket`) || key == `` {
+		http.Error(w, "not a websocket upgrade request", http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get(`Sec-WebSocket-Version`) != `13` {
+		w.Header().Set(`Sec-WebSocket-Version`, `13`)
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return
+	}
+	if !headerContains(r.Header, `Sec-WebSocket-Protocol`, wsSubprotocol) {
+		http.Error(w, "the mqtt subprotocol is required", http.StatusBadRequest)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket upgrade not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+	_, err = io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: "+wsAcceptKey(key)+"\r\n"+
+		"Sec-WebSocket-Protocol: "+wsSubprotocol+"\r\n\r\n")
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	// the server sets deadlines while reading the request, so they must be cleared
+	_ = conn.SetDeadline(time.Time{})
+	select {
+	case wl.conns <- &wsConn{Conn: conn, r: brw.Reader}:
+	case <-wl.closed:
+		_ = conn.Close()
+	}
+}
+
+// wsConn is a net.Conn that reads the payload of the binary frames sent by a WebSocket client and writes
+// binary frames. An MQTT packet may span several frames and a frame may contain several packets.
+type wsConn struct {
+	net.Conn
+	r         *bufio.Reader
+	writeLock sync.Mutex
+	remaining uint64 // unread payload bytes of the current frame
+	mask      [4]byte
+	maskPos   int
+	inMessage bool // set while the frames of a fragmented message are read
+	closeOnce sync.Once
+}
+
+func (wc *wsConn) Read(p []byte) (int, error) {
+	for wc.remaining == 0 {
+		if err := wc.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if uint64(len(p)) > wc.remaining {
+		p = p[:wc.remaining]
+	}
+	n, err := wc.r.Read(p)
+	wc.unmask(p[:n])
+	wc.remaining -= uint64(n)
+	return n, err
+}
+
+func (wc *wsConn) unmask(p []byte) {
+	for i := range p {
+		p[i] ^= wc.mask[wc.maskPos&3]
+		wc.maskPos++
+	}
+}
+
+// readHeader reads a frame header and returns its fin flag, opcode, and payload length. The mask of the frame
+// becomes the current mask.
+func (wc *wsConn) readHeader() (bool, byte, uint64, error) {
+	var h [2]byte
+	if _, err := io.ReadFull(wc.r, h[:]); err != nil {
+		return false, 0, 0, err
+	}
+	fin := h[0]&0x80 != 0
+	op := h[0] & 0x0f
+	if h[0]&0x70 != 0 {
+		return false, 0, 0, wc.fail(wsProtocolError, "websocket frame has reserved bits set")
+	}
+	if h[1]&0x80 == 0 {
+		return false, 0, 0, wc.fail(wsProtocolError, "websocket frame from client is not masked")
+	}
+	n := uint64(h[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(wc.r, ext[:]); err != nil {
+			return false, 0, 0, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(wc.r, ext[:]); err != nil {
+			return false, 0, 0, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if _, err := io.ReadFull(wc.r, wc.mask[:]); err != nil {
+		return false, 0, 0, err
+	}
+	wc.maskPos = 0
+	return fin, op, n, nil
+}
+
+// nextFrame reads frame headers until a data frame is found. Control frames are handled on the way.
+func (wc *wsConn) nextFrame() error {
+	for {
+		fin, op, n, err := wc.readHeader()
+		if err != nil {
+			return err
+		}
+		switch op {
+		case wsBinary, wsContinuation:
+			if wc.inMessage != (op == wsContinuation) {
+				if wc.inMessage {
+					return wc.fail(wsProtocolError, "websocket message started before the previous one was finished")
+				}
+				return wc.fail(wsProtocolError, "websocket continuation frame without a message")
+			}
+			wc.inMessage = !fin
+			wc.remaining = n
+			return nil
+		case wsText:
+			return wc.fail(wsUnsupportedData, "MQTT must be sent in binary websocket frames")
+		case wsClose, wsPing, wsPong:
+			if !fin || n > wsMaxControlPayload {
+				return wc.fail(wsProtocolError, "invalid websocket control frame")
+			}
+			payload := make([]byte, n)
+			if _, err = io.ReadFull(wc.r, payload); err != nil {
+				return err
+			}
+			wc.unmask(payload)
+			switch op {
+			case wsClose:
+				wc.closeWith(wsNormalClosure)
+				return io.EOF
+			case wsPing:
+				if err = wc.writeFrame(wsPong, payload); err != nil {
+					return err
+				}
+			}
+		default:
+			return wc.fail(wsProtocolError, "unknown websocket opcode")
+		}
+	}
+}
+
+// fail sends a close frame with the given status code and returns an error with the given message
+func (wc *wsConn) fail(status uint16, msg string) error {
+	wc.closeWith(status)
+	return errors.New(msg)
+}
+
+// closeWith sends a close frame with the given status code unless one has been sent already
+func (wc *wsConn) closeWith(status uint16) {
+	wc.closeOnce.Do(func() {
+		var payload [2]byte
+		binary.BigEndian.PutUint16(payload[:], status)
+		_ = wc.writeFrame(wsClose, payload[:])
+	})
+}
+
+func (wc *wsConn) writeFrame(op byte, payload []byte) error {
+	var h [10]byte
+	h[0] = 0x80 | op
+	hl := 2
+	switch n := len(payload); {
+	case n < 126:
+		h[1] = byte(n)
+	case n <= 0xffff:
+		h[1] = 126
+		binary.BigEndian.PutUint16(h[2:], uint16(n))
+		hl = 4
+	default:
+		h[1] = 127
+		binary.BigEndian.PutUint64(h[2:], uint64(n))
+		hl = 10
+	}
+	wc.writeLock.Lock()
+	defer wc.writeLock.Unlock()
+	if _, err := wc.Conn.Write(h[:hl]); err != nil {
+		return err
+	}
+	_, err := wc.Conn.Write(payload)
+	return err
+}
+
+// Write sends the given bytes in one binary frame
+func (wc *wsConn) Write(p []byte) (int, error) {
+	if err := wc.writeFrame(wsBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (wc *wsConn) Close() error {
+	// a write that blocks must not prevent the close
+	_ = wc.Conn.SetWriteDeadline(time.Now().Add(wsCloseTimeout))
+	wc.closeWith(wsNormalClosure)
+	return wc.Conn.Close()
+}
+
+// ConnectionState returns the TLS state of a secure WebSocket connection
+func (wc *wsConn) ConnectionState() tls.ConnectionState {
+	if tc, ok := wc.Conn.(*tls.Conn); ok {
+		return tc.ConnectionState()
+	}
+	return tls.ConnectionState{}
+}
+
+// debugWriter writes each log line as a debug message
+type debugWriter struct {
+	logger.Logger
+}
+
+func (w debugWriter) Write(p []byte) (int, error) {
+	w.Debug(strings.TrimSpace(string(p)))
+	return len(p), nil
+}
@@ -23,13 +23,38 @@ func Bridge(args []string, stdout, stderr io.Writer) int {
 		natsClientKey  string
 		natsRootCAs    string
 		natsCredsFile  string
+		permissionFile string
+		natsCredsTable string
+		listenerFile   string
+		snTopicFile    string
 	)
 	opts := &bridge.Options{}
 	fs.StringVar(&opts.NATSUrls, "natsurl", nats.DefaultURL, "NATS server URLs separated by comma")
 	fs.IntVar(&opts.Port, "port", 0, "MQTT Port to listen on (defaults to 1883 or 8883 with TLS)")
+	fs.IntVar(&opts.WSPort, "ws-port", 0, "MQTT over WebSocket port to listen on (0 = no WebSocket listener)")
+	fs.StringVar(&opts.WSPath, "ws-path", bridge.DefaultWSPath, "HTTP path of the WebSocket endpoint")
+	fs.BoolVar(&opts.WSTLS, "wss", false, "Use TLS on the WebSocket listener. If true, the -tlscert and -tlskey options are mandatory")
+	fs.IntVar(&opts.MQTTSNPort, "mqttsn-port", 0, "UDP port of the MQTT-SN gateway (0 = no gateway)")
+	fs.StringVar(&snTopicFile, "mqttsn-topics", "", "JSON file that maps predefined MQTT-SN topic IDs to topic names")
+	fs.StringVar(&listenerFile, "listeners", "", "JSON file with a list of listeners, used instead of the -port, -ws-*, -mqttsn-*, and -tls* options")
 	fs.BoolVar(&printHelp, "h", false, "")
 	fs.BoolVar(&printHelp, "help", false, "Print this help")
 	fs.IntVar(&opts.RepeatRate, "repeatrate", 5000, "time in milliseconds between each publish of unacknowledged messages")
+	fs.IntVar(&opts.SessionExpiry, "session-expiry", 0, "seconds to keep the session of a disconnected MQTT 3.1.1 client (0 = forever)")
+	fs.IntVar(&opts.SessionSweepRate, "session-sweeprate", 60000, "time in milliseconds between each removal of expired sessions")
+	fs.IntVar(&opts.OfflineQueueSize, "offline-queue", 0, "QoS 1 messages queued for a disconnected client with a persistent session (0 = none)")
+	fs.StringVar(&opts.OfflineDropPolicy, "offline-drop", bridge.DropOldest, "message dropped when the offline queue is full, \"oldest\" or \"newest\"")
+	fs.StringVar(&opts.JetStreamStream, "jetstream-stream", "", "JetStream stream used for acknowledged publications and durable subscriptions (empty = disabled)")
+	fs.IntVar(&opts.ClientIDMaxLength, "clientid-max-len", 0, "maximum length of a client identifier (0 = no limit)")
+	fs.StringVar(&opts.ClientIDCharset, "clientid-charset", "", "characters allowed in a client identifier, e.g. \"a-zA-Z0-9_-\" (empty = all)")
+	fs.StringVar(&opts.ClientIDPrefix, "clientid-prefix", "", "prefix required in client identifiers and used for assigned identifiers")
+	fs.IntVar(&opts.ReceiveMaximum, "receive-max", 0, "QoS 1 and 2 publications that an MQTT 5 client may have in flight (0 = no limit)")
+	fs.IntVar(&opts.InFlightMaximum, "inflight-max", 0, "QoS 1 and 2 publications sent to an MQTT 3.1.1 client before waiting for acks (0 = no limit)")
+	fs.IntVar(&opts.InFlightQueueSize, "inflight-queue", 1000, "QoS 1 and 2 publications queued while the in-flight window of a client is full")
+	fs.IntVar(&opts.MaximumPacketSize, "max-packet-size", 0, "size in bytes of the largest packet accepted from a client (0 = no limit)")
+	fs.IntVar(&opts.TopicAliasMaximum, "topic-alias-max", 0, "highest MQTT 5 topic alias accepted from a client")
+	fs.StringVar(&opts.HeaderPrefix, "header-prefix", "", "prefix for NATS headers that carry MQTT 5 user properties")
+	fs.IntVar(&opts.RequestTimeout, "request-timeout", 30000, "time in milliseconds to wait for the reply to an MQTT 5 request")
 	// persistence
 	fs.StringVar(&opts.StoragePath, "storage", "mqtt-nats.json", "path to json file where server state is persisted")
 
@@ -45,7 +70,17 @@ func Bridge(args []string, stdout, stderr io.Writer) int {
 	fs.BoolVar(&opts.TLSVerify, "tlsverify", false,
 		"Enable verification of client TLS certificate. If true, the -tlscacert option is mandatory")
 	fs.StringVar(&opts.TLSCaCert, "tlscacert", "", "Root Certificate for verification of client TLS certificate")
+	fs.BoolVar(&opts.TLSMap, "tlsmap", false,
+		"Use the identity in the verified client certificate as user name. If true, the -tlscacert option is mandatory")
+	fs.Float64Var(&opts.TLSTimeout, "tlstimeout", 2, "Seconds that a client has to complete the TLS handshake")
+	fs.IntVar(&opts.TLSReloadRate, "tlsreload", 10000,
+		"Milliseconds between each check for changed TLS files. The files are also reloaded on SIGHUP")
 
+	fs.IntVar(&opts.NATSPoolSize, "nats-pool", 0, "number of NATS connections shared by all clients (0 = one connection per client)")
+	fs.StringVar(&permissionFile, "permissions", "", "JSON file with the passwords and permissions of users when -nats-pool is used")
+	fs.StringVar(&opts.NATSAuth, "nats-auth", bridge.AuthPassThrough,
+		"how client credentials are used with NATS, \"passthrough\", \"token\", \"jwt\", or \"creds\"")
+	fs.StringVar(&natsCredsTable, "nats-creds-table", "", "JSON file that maps user names to NATS credentials files when -nats-auth is \"creds\"")
 	fs.StringVar(&natsCredsFile, "nats-creds", "", "User Credentials File used when bridge connects to NATS")
 	// tls when connecting to the NATS server
 	fs.StringVar(&natsClientKey, "nats-key", "", "Public Key used by the bridge when connecting to NATS")
@@ -59,6 +94,10 @@ func Bridge(args []string, stdout, stderr io.Writer) int {
 		return 0
 	}
 
+	if opts.WSTLS && (opts.TLSCert == "" || opts.TLSKey == "") {
+		_, _ = io.WriteString(stderr, "both -tlscert and -tlskey must be given when wss is enabled")
+		return 2
+	}
 	if opts.TLS {
 		if opts.TLSCert == "" || opts.TLSKey == "" {
 			_, _ = io.WriteString(stderr, "both -tlscert and -tlskey must be given when tls is enabled")
@@ -88,6 +127,31 @@ func Bridge(args []string, stdout, stderr io.Writer) int {
 	}
 
 	lg := logger.New(logger.Debug, stdout, stderr)
+	var err error
+	if listenerFile != `` {
+		if opts.Listeners, err = bridge.LoadListeners(listenerFile); err != nil {
+			lg.Error(err)
+			return 1
+		}
+	}
+	if snTopicFile != `` {
+		if opts.MQTTSNTopics, err = bridge.LoadPredefinedTopics(snTopicFile); err != nil {
+			lg.Error(err)
+			return 1
+		}
+	}
+	if permissionFile != `` {
+		if opts.Permissions, err = bridge.LoadPermissions(permissionFile); err != nil {
+			lg.Error(err)
+			return 1
+		}
+	}
+	if natsCredsTable != `` {
+		if opts.NATSCreds, err = bridge.LoadNATSCreds(natsCredsTable); err != nil {
+			lg.Error(err)
+			return 1
+		}
+	}
 	s, err := bridge.New(opts, lg)
 	if err == nil {
 		err = s.Serve(nil)
@@ -3,11 +3,11 @@ module github.com/tada/mqtt-nats
 go 1.14
 
 require (
-	github.com/golang/protobuf v1.3.5 // indirect
-	github.com/nats-io/nats-server/v2 v2.1.4
-	github.com/nats-io/nats.go v1.9.1
+	github.com/nats-io/jwt/v2 v2.0.1
+	github.com/nats-io/nats-server/v2 v2.2.0
+	github.com/nats-io/nats.go v1.11.0
+	github.com/nats-io/nkeys v0.3.0
 	github.com/nats-io/nuid v1.0.1
 	github.com/tada/catch v0.0.0-20200501140707-b8b11d55b4e6
 	github.com/tada/jsonstream v0.0.0-20200501141504-4d34829515db
-	golang.org/x/crypto v0.0.0-20191011191535-87dc89f01550 // indirect
 )
@@ -0,0 +1,90 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/tada/mqtt-nats/mqtt"
+)
+
+// Auth is the MQTT 5 AUTH packet used for extended authentication
+type Auth struct {
+	props  mqtt.Properties
+	reason ReasonCode
+}
+
+// NewAuth creates a new AUTH packet
+func NewAuth(reason ReasonCode, props mqtt.Properties) *Auth {
+	return &Auth{reason: reason, props: props}
+}
+
+// ParseAuth parses an AUTH packet. The packet is only valid when the reader is using MQTT 5.
+func ParseAuth(r *mqtt.Reader, b byte, pkLen int) (Packet, error) {
+	if !r.V5() || (b&0xf) != 0 {
+		return nil, errors.New("malformed AUTH")
+	}
+	a := &Auth{}
+	if pkLen == 0 {
+		return a, nil
+	}
+	var err error
+	if r, err = r.ReadPacket(pkLen); err != nil {
+		return nil, err
+	}
+	var rc byte
+	if rc, err = r.ReadByte(); err != nil {
+		return nil, err
+	}
+	a.reason = ReasonCode(rc)
+	if r.Len() > 0 {
+		if a.props, err = r.ReadProperties(); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// AuthenticationMethod returns the authentication method property of the packet
+func (a *Auth) AuthenticationMethod() string {
+	m, _ := a.props.Text(mqtt.PropAuthenticationMethod)
+	return m
+}
+
+// AuthenticationData returns the authentication data property of the packet
+func (a *Auth) AuthenticationData() []byte {
+	d, _ := a.props.Binary(mqtt.PropAuthenticationData)
+	return d
+}
+
+// Equals returns true if this packet is equal to the given packet, false if not
+func (a *Auth) Equals(other interface{}) bool {
+	oa, ok := other.(*Auth)
+	return ok && a.reason == oa.reason && a.props.Equals(oa.props)
+}
+
+// Properties returns the MQTT 5 properties of the packet
+func (a *Auth) Properties() mqtt.Properties {
+	return a.props
+}
+
+// ReasonCode returns the reason code of the packet
+func (a *Auth) ReasonCode() ReasonCode {
+	return a.reason
+}
+
+// String returns a brief string representation of the packet. Suitable for logging
+func (a *Auth) String() string {
+	return fmt.Sprintf("AUTH (rc%d, '%s')", a.reason, a.AuthenticationMethod())
+}
+
+// Write writes the MQTT bits of this packet on the given Writer
+func (a *Auth) Write(w *mqtt.Writer) {
+	w.WriteU8(TpAuth)
+	if a.reason == RcSuccess && len(a.props) == 0 {
+		w.WriteU8(0)
+		return
+	}
+	w.WriteVarInt(1 + a.props.Size())
+	w.WriteU8(byte(a.reason))
+	w.WriteProperties(a.props)
+}
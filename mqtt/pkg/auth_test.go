@@ -0,0 +1,24 @@
+package pkg_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/tada/mqtt-nats/mqtt"
+	"github.com/tada/mqtt-nats/mqtt/pkg"
+	"github.com/tada/mqtt-nats/test/utils"
+)
+
+func TestParseAuth(t *testing.T) {
+	a := pkg.NewAuth(pkg.RcContinueAuthentication, mqtt.Properties{}.
+		Add(mqtt.PropAuthenticationMethod, "SCRAM-SHA-1").
+		Add(mqtt.PropAuthenticationData, []byte("client-first")))
+	writeReadAndCompare5(t, a, "AUTH (rc24, 'SCRAM-SHA-1')")
+	utils.CheckEqual([]byte("client-first"), a.AuthenticationData(), t)
+	writeReadAndCompare5(t, pkg.NewAuth(pkg.RcSuccess, nil), "AUTH (rc0, '')")
+}
+
+func TestParseAuth_311(t *testing.T) {
+	_, err := pkg.ParseAuth(mqtt.NewReader(bytes.NewReader([]byte{})), pkg.TpAuth, 0)
+	utils.CheckError(err, t)
+}
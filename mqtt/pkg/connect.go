@@ -9,7 +9,11 @@ import (
 )
 
 const (
-	protoName = "MQTT"
+	protoName   = "MQTT"
+	protoName31 = "MQIsdp"
+
+	// MaxClientIDLength31 is the maximum length of a client identifier in MQTT 3.1
+	MaxClientIDLength31 = 23
 
 	cleanSessionFlag = byte(0x02)
 	willFlag         = byte(0x04)
@@ -41,6 +45,26 @@ func (r ReturnCode) Error() string {
 	}
 }
 
+// ReasonCode returns the MQTT 5 reason code that corresponds to this return code
+func (r ReturnCode) ReasonCode() ReasonCode {
+	switch r {
+	case RtAccepted:
+		return RcSuccess
+	case RtUnacceptableProtocolVersion:
+		return RcUnsupportedProtocolVersion
+	case RtIdentifierRejected:
+		return RcClientIdentifierNotValid
+	case RtServerUnavailable:
+		return RcServerUnavailable
+	case RtBadUserNameOrPassword:
+		return RcBadUserNameOrPassword
+	case RtNotAuthorized:
+		return RcNotAuthorized
+	default:
+		return RcUnspecifiedError
+	}
+}
+
 const (
 	// RtAccepted Connection Accepted
 	RtAccepted = ReturnCode(iota)
@@ -66,6 +90,7 @@ type Connect struct {
 	clientID    string
 	creds       *Credentials
 	will        *Will
+	props       mqtt.Properties
 	keepAlive   uint16
 	clientLevel byte
 	flags       byte
@@ -96,11 +121,20 @@ func NewConnect(clientID string, cleanSession bool, keepAlive uint16, will *Will
 		clientID:    clientID,
 		creds:       creds,
 		keepAlive:   keepAlive,
-		clientLevel: 0x4,
+		clientLevel: mqtt.ProtocolLevel311,
 		flags:       flags,
 		will:        will}
 }
 
+// NewConnect5 creates a new MQTT 5 connect packet
+func NewConnect5(clientID string, cleanStart bool, keepAlive uint16, will *Will, creds *Credentials,
+	props mqtt.Properties) *Connect {
+	c := NewConnect(clientID, cleanStart, keepAlive, will, creds)
+	c.clientLevel = mqtt.ProtocolLevel5
+	c.props = props
+	return c
+}
+
 // ParseConnect parses the connect packet from the given reader.
 func ParseConnect(r *mqtt.Reader, _ byte, pkLen int) (Packet, error) {
 	var err error
@@ -113,8 +147,8 @@ func ParseConnect(r *mqtt.Reader, _ byte, pkLen int) (Packet, error) {
 	if proto, err = r.ReadString(); err != nil {
 		return nil, err
 	}
-	if proto != protoName {
-		return nil, fmt.Errorf(`expected connect packet with protocol name "MQTT", got "%s"`, proto)
+	if proto != protoName && proto != protoName31 {
+		return nil, fmt.Errorf(`expected connect packet with protocol name "MQTT" or "MQIsdp", got "%s"`, proto)
 	}
 
 	c := &Connect{}
@@ -123,7 +157,14 @@ func ParseConnect(r *mqtt.Reader, _ byte, pkLen int) (Packet, error) {
 	if c.clientLevel, err = r.ReadByte(); err != nil {
 		return nil, err
 	}
-	if c.clientLevel != 0x4 {
+	if (proto == protoName31) != (c.clientLevel == mqtt.ProtocolLevel31) {
+		return c, RtUnacceptableProtocolVersion
+	}
+	switch c.clientLevel {
+	case mqtt.ProtocolLevel31, mqtt.ProtocolLevel311:
+	case mqtt.ProtocolLevel5:
+		r.SetProtocolLevel(mqtt.ProtocolLevel5)
+	default:
 		return c, RtUnacceptableProtocolVersion
 	}
 
@@ -137,6 +178,13 @@ func ParseConnect(r *mqtt.Reader, _ byte, pkLen int) (Packet, error) {
 		return nil, err
 	}
 
+	// Properties
+	if r.V5() {
+		if c.props, err = r.ReadProperties(); err != nil {
+			return nil, err
+		}
+	}
+
 	// Payload starts here
 
 	// Client Identifier
@@ -147,6 +195,11 @@ func ParseConnect(r *mqtt.Reader, _ byte, pkLen int) (Packet, error) {
 	// Will
 	if c.HasWill() {
 		c.will = &Will{QoS: (c.flags & willQoS) >> 3, Retain: (c.flags & willRetainFlag) != 0}
+		if r.V5() {
+			if c.will.Props, err = r.ReadProperties(); err != nil {
+				return nil, err
+			}
+		}
 		if c.will.Topic, err = r.ReadString(); err != nil {
 			return nil, err
 		}
@@ -181,6 +234,7 @@ func (c *Connect) Equals(other interface{}) bool {
 		c.clientLevel == oc.clientLevel &&
 		c.flags == oc.flags &&
 		c.clientID == oc.clientID &&
+		c.props.Equals(oc.props) &&
 		(c.will == oc.will || (c.will != nil && c.will.Equals(oc.will))) &&
 		(c.creds == oc.creds || (c.creds != nil && c.creds.Equals(oc.creds)))
 }
@@ -190,17 +244,39 @@ func (c *Connect) SetClientLevel(cl byte) {
 	c.clientLevel = cl
 }
 
-// Write writes the MQTT bits of this packet on the given Writer
+// ProtocolLevel returns the protocol level requested by the client
+func (c *Connect) ProtocolLevel() byte {
+	return c.clientLevel
+}
+
+// Properties returns the MQTT 5 properties of the packet
+func (c *Connect) Properties() mqtt.Properties {
+	return c.props
+}
+
+// Write writes the MQTT bits of this packet on the given Writer. The packet is always written using
+// its own protocol level.
 func (c *Connect) Write(w *mqtt.Writer) {
-	pkLen := 2 + len(protoName) +
+	v5 := c.clientLevel >= mqtt.ProtocolLevel5
+	proto := protoName
+	if c.clientLevel == mqtt.ProtocolLevel31 {
+		proto = protoName31
+	}
+	pkLen := 2 + len(proto) +
 		1 + // clientLevel
 		1 + // flags
 		2 + // keepAlive
 		2 + len(c.clientID)
 
+	if v5 {
+		pkLen += c.props.Size()
+	}
 	if c.HasWill() {
 		pkLen += 2 + len(c.will.Topic)
 		pkLen += 2 + len(c.will.Message)
+		if v5 {
+			pkLen += c.will.Props.Size()
+		}
 	}
 	if c.HasUserName() {
 		pkLen += 2 + len(c.creds.User)
@@ -211,12 +287,18 @@ func (c *Connect) Write(w *mqtt.Writer) {
 
 	w.WriteU8(TpConnect)
 	w.WriteVarInt(pkLen)
-	w.WriteString(protoName)
+	w.WriteString(proto)
 	w.WriteU8(c.clientLevel)
 	w.WriteU8(c.flags)
 	w.WriteU16(c.keepAlive)
+	if v5 {
+		w.WriteProperties(c.props)
+	}
 	w.WriteString(c.clientID)
 	if c.HasWill() {
+		if v5 {
+			w.WriteProperties(c.will.Props)
+		}
 		w.WriteString(c.will.Topic)
 		w.WriteBytes(c.will.Message)
 	}
@@ -252,6 +334,22 @@ func (c *Connect) ClientID() string {
 	return c.clientID
 }
 
+// SetClientID replaces the id provided by the client. Used when the server assigns an id to a client that
+// provided none
+func (c *Connect) SetClientID(clientID string) {
+	c.clientID = clientID
+}
+
+// SetUserName replaces the user name of the credentials provided by the client. Used when the server derives
+// the user name from something else, such as a client certificate
+func (c *Connect) SetUserName(user string) {
+	if c.creds == nil {
+		c.creds = &Credentials{}
+	}
+	c.creds.User = user
+	c.flags |= userNameFlag
+}
+
 // HasPassword returns true if the connection contains a password
 func (c *Connect) HasPassword() bool {
 	return (c.flags & passwordFlag) != 0
@@ -290,6 +388,7 @@ func (c *Connect) DeleteWill() {
 
 // ConnAck is the MQTT CONNACK packet sent in response to a CONNECT
 type ConnAck struct {
+	props      mqtt.Properties
 	flags      byte
 	returnCode byte
 }
@@ -303,10 +402,26 @@ func NewConnAck(sessionPresent bool, returnCode ReturnCode) Packet {
 	return &ConnAck{flags: flags, returnCode: byte(returnCode)}
 }
 
+// NewConnAck5 creates an MQTT 5 CONNACK packet with a reason code and properties
+func NewConnAck5(sessionPresent bool, reasonCode ReasonCode, props mqtt.Properties) Packet {
+	flags := byte(0x00)
+	if sessionPresent {
+		flags |= 0x01
+	}
+	return &ConnAck{flags: flags, returnCode: byte(reasonCode), props: props}
+}
+
 // ParseConnAck parses a CONNACK packet
 func ParseConnAck(r *mqtt.Reader, _ byte, pkLen int) (Packet, error) {
 	var err error
-	if pkLen != 2 {
+	if r.V5() {
+		if pkLen < 2 {
+			return nil, errors.New("malformed CONNACK")
+		}
+		if r, err = r.ReadPacket(pkLen); err != nil {
+			return nil, err
+		}
+	} else if pkLen != 2 {
 		return nil, errors.New("malformed CONNACK")
 	}
 	var bs []byte
@@ -314,13 +429,29 @@ func ParseConnAck(r *mqtt.Reader, _ byte, pkLen int) (Packet, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &ConnAck{flags: bs[0], returnCode: bs[1]}, nil
+	a := &ConnAck{flags: bs[0], returnCode: bs[1]}
+	if r.V5() && r.Len() > 0 {
+		if a.props, err = r.ReadProperties(); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
 }
 
 // Equals returns true if this packet is equal to the given packet, false if not
 func (a *ConnAck) Equals(other interface{}) bool {
 	ac, ok := other.(*ConnAck)
-	return ok && *a == *ac
+	return ok && a.flags == ac.flags && a.returnCode == ac.returnCode && a.props.Equals(ac.props)
+}
+
+// Properties returns the MQTT 5 properties of the packet
+func (a *ConnAck) Properties() mqtt.Properties {
+	return a.props
+}
+
+// ReasonCode returns the MQTT 5 reason code from the server
+func (a *ConnAck) ReasonCode() ReasonCode {
+	return ReasonCode(a.returnCode)
 }
 
 // ReturnCode returns the return code from the server
@@ -328,6 +459,11 @@ func (a *ConnAck) ReturnCode() ReturnCode {
 	return ReturnCode(a.returnCode)
 }
 
+// SessionPresent returns true if the server has a session for the client
+func (a *ConnAck) SessionPresent() bool {
+	return (a.flags & 0x01) != 0
+}
+
 // String returns a brief string representation of the packet. Suitable for logging
 func (a *ConnAck) String() string {
 	return fmt.Sprintf("CONNACK (s%d, rt%d)", a.flags, a.returnCode)
@@ -336,9 +472,16 @@ func (a *ConnAck) String() string {
 // Write writes the MQTT bits of this packet on the given Writer
 func (a *ConnAck) Write(w *mqtt.Writer) {
 	w.WriteU8(TpConnAck)
-	w.WriteU8(2)
+	if w.V5() {
+		w.WriteVarInt(2 + a.props.Size())
+	} else {
+		w.WriteU8(2)
+	}
 	w.WriteU8(a.flags)
 	w.WriteU8(a.returnCode)
+	if w.V5() {
+		w.WriteProperties(a.props)
+	}
 }
 
 // The Disconnect type represents the MQTT DISCONNECT packet
@@ -362,3 +505,80 @@ func (Disconnect) Write(w *mqtt.Writer) {
 	w.WriteU8(TpDisconnect)
 	w.WriteU8(0)
 }
+
+// ParseDisconnect parses a DISCONNECT packet. The DisconnectSingleton is returned unless the packet
+// contains an MQTT 5 reason code or properties.
+func ParseDisconnect(r *mqtt.Reader, _ byte, pkLen int) (Packet, error) {
+	if pkLen == 0 {
+		return DisconnectSingleton, nil
+	}
+	if !r.V5() {
+		return nil, errors.New("malformed DISCONNECT")
+	}
+	var err error
+	if r, err = r.ReadPacket(pkLen); err != nil {
+		return nil, err
+	}
+	d := &DisconnectV5{}
+	var rc byte
+	if rc, err = r.ReadByte(); err != nil {
+		return nil, err
+	}
+	d.reason = ReasonCode(rc)
+	if r.Len() > 0 {
+		if d.props, err = r.ReadProperties(); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// DisconnectV5 is the MQTT 5 DISCONNECT packet that carries a reason code and properties
+type DisconnectV5 struct {
+	props  mqtt.Properties
+	reason ReasonCode
+}
+
+// NewDisconnectV5 creates a new MQTT 5 DISCONNECT packet
+func NewDisconnectV5(reason ReasonCode, props mqtt.Properties) *DisconnectV5 {
+	return &DisconnectV5{reason: reason, props: props}
+}
+
+// Equals returns true if this packet is equal to the given packet, false if not
+func (d *DisconnectV5) Equals(other interface{}) bool {
+	od, ok := other.(*DisconnectV5)
+	return ok && d.reason == od.reason && d.props.Equals(od.props)
+}
+
+// Properties returns the MQTT 5 properties of the packet
+func (d *DisconnectV5) Properties() mqtt.Properties {
+	return d.props
+}
+
+// ReasonCode returns the reason code of the packet
+func (d *DisconnectV5) ReasonCode() ReasonCode {
+	return d.reason
+}
+
+// String returns a brief string representation of the packet. Suitable for logging
+func (d *DisconnectV5) String() string {
+	return fmt.Sprintf("DISCONNECT (rc%d)", d.reason)
+}
+
+// Write writes the MQTT bits of this packet on the given Writer. Nothing but the fixed header is
+// written unless the Writer is using MQTT 5.
+func (d *DisconnectV5) Write(w *mqtt.Writer) {
+	w.WriteU8(TpDisconnect)
+	if !w.V5() || d.reason == RcSuccess && len(d.props) == 0 {
+		w.WriteU8(0)
+		return
+	}
+	if len(d.props) == 0 {
+		w.WriteU8(1)
+		w.WriteU8(byte(d.reason))
+		return
+	}
+	w.WriteVarInt(1 + d.props.Size())
+	w.WriteU8(byte(d.reason))
+	w.WriteProperties(d.props)
+}
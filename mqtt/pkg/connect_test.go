@@ -59,6 +59,26 @@ func TestParseConnect_illegalClientLevel(t *testing.T) {
 	utils.CheckError(err, t)
 }
 
+func TestParseConnect31(t *testing.T) {
+	c1 := pkg.NewConnect(`cid`, true, 5, nil, nil)
+	c1.SetClientLevel(mqtt.ProtocolLevel31)
+	writeReadAndCompare(t, c1, "CONNECT (c1, k5, u0, p0)")
+}
+
+func TestParseConnect31_badClientLevel(t *testing.T) {
+	w := mqtt.NewWriter()
+	w.WriteString("MQIsdp")
+	w.WriteU8(4)
+	_, err := pkg.ParseConnect(mqtt.NewReader(bytes.NewReader(w.Bytes())), pkg.TpConnAck, 9)
+	utils.CheckEqual(pkg.RtUnacceptableProtocolVersion, err, t)
+
+	w = mqtt.NewWriter()
+	w.WriteString("MQTT")
+	w.WriteU8(3)
+	_, err = pkg.ParseConnect(mqtt.NewReader(bytes.NewReader(w.Bytes())), pkg.TpConnAck, 7)
+	utils.CheckEqual(pkg.RtUnacceptableProtocolVersion, err, t)
+}
+
 func TestParseConnect_badConnectFlags(t *testing.T) {
 	w := mqtt.NewWriter()
 	w.WriteString("MQTT")
@@ -200,3 +220,69 @@ func TestReturnCode_Error(t *testing.T) {
 		})
 	}
 }
+
+func TestParseConnect5(t *testing.T) {
+	c1 := pkg.NewConnect5(`cid`, true, 5, &pkg.Will{
+		Topic:   "my/will",
+		Message: []byte("the will"),
+		QoS:     1,
+		Props:   mqtt.Properties{}.Add(mqtt.PropWillDelayInterval, 30),
+	}, &pkg.Credentials{User: "bob", Password: []byte("password")},
+		mqtt.Properties{}.Add(mqtt.PropSessionExpiryInterval, 120).Add(mqtt.PropReceiveMaximum, 10))
+	writeReadAndCompare(t, c1, "CONNECT (c1, k5, u1, p1, w(r0, q1, 'my/will', ... (8 bytes)))")
+	utils.CheckEqual(mqtt.ProtocolLevel5, c1.ProtocolLevel(), t)
+}
+
+func TestParseConnect5_badProperties(t *testing.T) {
+	w := mqtt.NewWriter()
+	w.WriteString("MQTT")
+	w.WriteU8(5)
+	w.WriteU8(0)
+	w.WriteU16(5)
+	w.WriteVarInt(2)
+	w.WriteU8(0x7f)
+	w.WriteU8(0)
+	_, err := pkg.ParseConnect(mqtt.NewReader(bytes.NewReader(w.Bytes())), pkg.TpConnect, w.Len())
+	utils.CheckError(err, t)
+}
+
+func TestParseConnAck5(t *testing.T) {
+	writeReadAndCompare5(t, pkg.NewConnAck5(true, pkg.RcSuccess,
+		mqtt.Properties{}.Add(mqtt.PropAssignedClientIdentifier, "abc").Add(mqtt.PropTopicAliasMaximum, 10)),
+		"CONNACK (s1, rt0)")
+	writeReadAndCompare5(t, pkg.NewConnAck5(false, pkg.RcNotAuthorized, nil), "CONNACK (s0, rt135)")
+}
+
+func TestParseConnAck5_badLen(t *testing.T) {
+	r := mqtt.NewReader(bytes.NewReader([]byte{}))
+	r.SetProtocolLevel(mqtt.ProtocolLevel5)
+	_, err := pkg.ParseConnAck(r, pkg.TpConnAck, 1)
+	utils.CheckError(err, t)
+}
+
+func TestParseDisconnect5(t *testing.T) {
+	writeReadAndCompare5(t, pkg.DisconnectSingleton, "DISCONNECT")
+	writeReadAndCompare5(t, pkg.NewDisconnectV5(pkg.RcServerShuttingDown, nil), "DISCONNECT (rc139)")
+	writeReadAndCompare5(t, pkg.NewDisconnectV5(pkg.RcSessionTakenOver,
+		mqtt.Properties{}.Add(mqtt.PropReasonString, "taken over")), "DISCONNECT (rc142)")
+}
+
+func TestParseDisconnect_badLen(t *testing.T) {
+	_, err := pkg.ParseDisconnect(mqtt.NewReader(bytes.NewReader([]byte{0})), pkg.TpDisconnect, 1)
+	utils.CheckError(err, t)
+}
+
+func TestReasonCode_Error(t *testing.T) {
+	utils.CheckEqual("success", pkg.RcSuccess.Error(), t)
+	utils.CheckEqual("session taken over", pkg.RcSessionTakenOver.Error(), t)
+	utils.CheckEqual("unknown reason code 0x7f", pkg.ReasonCode(0x7f).Error(), t)
+	utils.CheckFalse(pkg.RcGrantedQoS2.IsError(), t)
+	utils.CheckTrue(pkg.RcUnspecifiedError.IsError(), t)
+}
+
+func TestReturnCode_ReasonCode(t *testing.T) {
+	utils.CheckEqual(pkg.RcSuccess, pkg.RtAccepted.ReasonCode(), t)
+	utils.CheckEqual(pkg.RcUnsupportedProtocolVersion, pkg.RtUnacceptableProtocolVersion.ReasonCode(), t)
+	utils.CheckEqual(pkg.RcNotAuthorized, pkg.RtNotAuthorized.ReasonCode(), t)
+	utils.CheckEqual(pkg.RcUnspecifiedError, pkg.ReturnCode(17).ReasonCode(), t)
+}
@@ -3,6 +3,7 @@ package pkg
 import (
 	"encoding/json"
 	"io"
+	"math"
 	"sync"
 
 	"github.com/tada/catch/pio"
@@ -12,7 +13,8 @@ import (
 // An IDManager manages packet IDs and ensures their uniqueness by maintaining a list of
 // IDs that are in use
 type IDManager interface {
-	// NextFreePacketID allocates and returns the next free packet ID
+	// NextFreePacketID allocates and returns the next free packet ID. Zero is returned when all
+	// packet IDs are in use.
 	NextFreePacketID() uint16
 
 	// ReleasePacketID releases a previously allocated packet ID
@@ -32,6 +34,11 @@ func NewIDManager() IDManager {
 
 func (s *idManager) NextFreePacketID() uint16 {
 	s.pkgIDLock.Lock()
+	defer s.pkgIDLock.Unlock()
+	if len(s.inFlight) >= math.MaxUint16 {
+		// all IDs are in use
+		return 0
+	}
 	s.nextFreePkgID++
 	if s.nextFreePkgID == 0 {
 		// counter flipped over and zero is not a valid ID
@@ -45,7 +52,6 @@ func (s *idManager) NextFreePacketID() uint16 {
 		}
 	}
 	s.inFlight[s.nextFreePkgID] = true
-	s.pkgIDLock.Unlock()
 	return s.nextFreePkgID
 }
 
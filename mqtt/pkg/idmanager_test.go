@@ -23,6 +23,19 @@ func TestIdManager_NextFreePacketID_flipInFlight(t *testing.T) {
 	utils.CheckEqual(uint16(1), idm.NextFreePacketID(), t)
 }
 
+func TestIdManager_NextFreePacketID_exhausted(t *testing.T) {
+	idm := NewIDManager()
+	for i := 0; i < math.MaxUint16; i++ {
+		if idm.NextFreePacketID() == 0 {
+			t.Fatalf("expected a free packet ID after %d allocations", i)
+		}
+	}
+	utils.CheckEqual(uint16(0), idm.NextFreePacketID(), t)
+	idm.ReleasePacketID(17)
+	utils.CheckEqual(uint16(17), idm.NextFreePacketID(), t)
+	utils.CheckEqual(uint16(0), idm.NextFreePacketID(), t)
+}
+
 func TestIdManager_NextFreePacketID_json(t *testing.T) {
 	idm := NewIDManager().(*idManager)
 	idm.nextFreePkgID = math.MaxUint16 - 3
@@ -46,6 +46,9 @@ const (
 	// TpDisconnect is the MQTT DISCONNECT type
 	TpDisconnect = 0xe0
 
+	// TpAuth is the MQTT 5 AUTH type
+	TpAuth = 0xf0
+
 	// TpMask is bitmask for the MQTT type
 	TpMask = 0xf0
 )
@@ -22,3 +22,18 @@ func writeReadAndCompare(t *testing.T, p pkg.Packet, ex string) {
 		t.Errorf("expected '%s' got '%s'", ex, ac)
 	}
 }
+
+func writeReadAndCompare5(t *testing.T, p pkg.Packet, ex string) {
+	t.Helper()
+	w := mqtt.NewWriter()
+	w.SetProtocolLevel(mqtt.ProtocolLevel5)
+	p.Write(w)
+	p2 := packet.Parse5(t, bytes.NewReader(w.Bytes()))
+	if !p.Equals(p2) {
+		t.Fatal(p, "!=", p2)
+	}
+	ac := p.(fmt.Stringer).String()
+	if ex != ac {
+		t.Errorf("expected '%s' got '%s'", ex, ac)
+	}
+}
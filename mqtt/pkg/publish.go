@@ -31,6 +31,7 @@ type Publish struct {
 	name     string
 	replyTo  string
 	payload  []byte
+	props    mqtt.Properties
 	id       uint16
 	flags    byte
 	sentByUs bool // set if the message originated from this server (happens when a client will is published)
@@ -85,6 +86,11 @@ func ParsePublish(r *mqtt.Reader, flags byte, pkLen int) (Packet, error) {
 			return nil, err
 		}
 	}
+	if r.V5() {
+		if pp.props, err = r.ReadProperties(); err != nil {
+			return nil, err
+		}
+	}
 	if pp.payload, err = r.ReadRemainingBytes(); err != nil {
 		return nil, err
 	}
@@ -100,7 +106,8 @@ func (p *Publish) Equals(other interface{}) bool {
 		p.sentByUs == op.sentByUs &&
 		p.name == op.name &&
 		p.replyTo == op.replyTo &&
-		bytes.Equal(p.payload, op.payload)
+		bytes.Equal(p.payload, op.payload) &&
+		p.props.Equals(op.props)
 }
 
 // Flags returns the packet flags
@@ -113,6 +120,11 @@ func (p *Publish) ID() uint16 {
 	return p.id
 }
 
+// SetID sets the MQTT Packet Identifier
+func (p *Publish) SetID(id uint16) {
+	p.id = id
+}
+
 // IsDup returns true if the packet is a duplicate of a previously sent packet
 func (p *Publish) IsDup() bool {
 	return (p.flags & PublishDup) != 0
@@ -147,6 +159,10 @@ func (p *Publish) MarshalToJSON(w io.Writer) {
 		pio.WriteString(w, `,"replyTo":`)
 		jsonstream.WriteString(w, p.replyTo)
 	}
+	if len(p.props) > 0 {
+		pio.WriteString(w, `,"props":`)
+		p.props.MarshalToJSON(w)
+	}
 	if len(p.payload) > 0 {
 		if IsPrintableASCII(p.payload) {
 			pio.WriteString(w, `,"payload":`)
@@ -170,6 +186,16 @@ func (p *Publish) Payload() []byte {
 	return p.payload
 }
 
+// Properties returns the MQTT 5 properties of the packet
+func (p *Publish) Properties() mqtt.Properties {
+	return p.props
+}
+
+// SetProperties sets the MQTT 5 properties of the packet
+func (p *Publish) SetProperties(props mqtt.Properties) {
+	p.props = props
+}
+
 // QoSLevel returns the quality of service level which is 0, 1 or 2.
 func (p *Publish) QoSLevel() byte {
 	return (p.flags & PublishQoS) >> 1
@@ -202,6 +228,22 @@ func (p *Publish) TopicName() string {
 	return p.name
 }
 
+// SetTopicName sets the name of the topic. Used when an MQTT 5 topic alias has been resolved
+func (p *Publish) SetTopicName(name string) {
+	p.name = name
+}
+
+// WithTopicAlias returns a copy of this packet that has the given MQTT 5 topic alias. The topic name of the
+// copy is empty unless keepName is true.
+func (p *Publish) WithTopicAlias(alias int, keepName bool) *Publish {
+	cp := *p
+	if !keepName {
+		cp.name = ``
+	}
+	cp.props = p.props.Set(mqtt.PropTopicAlias, alias)
+	return &cp
+}
+
 // UnmarshalFromJSON expects the given token to be the object start '{'. If it is, the rest
 // of the object is unmarshalled into the receiver. The method will panic with a pio.Error
 // if any errors are detected.
@@ -223,6 +265,8 @@ func (p *Publish) UnmarshalFromJSON(js jsonstream.Decoder, t json.Token) {
 			p.name = js.ReadString()
 		case "replyTo":
 			p.replyTo = js.ReadString()
+		case "props":
+			js.ReadConsumer(&p.props)
 		case "payload":
 			p.payload = []byte(js.ReadString())
 		case "payloadEnc":
@@ -238,24 +282,38 @@ func (p *Publish) UnmarshalFromJSON(js jsonstream.Decoder, t json.Token) {
 // Write writes the MQTT bits of this packet on the given Writer
 func (p *Publish) Write(w *mqtt.Writer) {
 	w.WriteU8(TpPublish | p.flags)
-	pkLen := 2 + len(p.name) + len(p.payload)
-	if p.QoSLevel() > 0 {
-		pkLen += 2
-	}
-	w.WriteVarInt(pkLen)
+	w.WriteVarInt(p.packetLen(w.V5()))
 	w.WriteString(p.name)
 	if p.QoSLevel() > 0 {
 		w.WriteU16(p.id)
 	}
+	if w.V5() {
+		w.WriteProperties(p.props)
+	}
 	_, _ = w.Write(p.payload)
 }
 
+// packetLen returns the remaining length of the packet, i.e. the length of the variable header and payload
+func (p *Publish) packetLen(v5 bool) int {
+	pkLen := 2 + len(p.name) + len(p.payload)
+	if p.QoSLevel() > 0 {
+		pkLen += 2
+	}
+	if v5 {
+		pkLen += p.props.Size()
+	}
+	return pkLen
+}
+
 // The PubAck type represents the MQTT PUBACK packet
 type PubAck uint16
 
 // ParsePubAck parses a PUBACK packet
 func ParsePubAck(r *mqtt.Reader, _ byte, pkLen int) (Packet, error) {
 	if pkLen != 2 {
+		if r.V5() && pkLen > 2 {
+			return parseAckV5(r, TpPubAck, pkLen)
+		}
 		return PubAck(0), errors.New("malformed PUBACK")
 	}
 	id, err := r.ReadUint16()
@@ -290,6 +348,9 @@ type PubRec uint16
 // ParsePubRec parses a PUBREC packet
 func ParsePubRec(r *mqtt.Reader, _ byte, pkLen int) (Packet, error) {
 	if pkLen != 2 {
+		if r.V5() && pkLen > 2 {
+			return parseAckV5(r, TpPubRec, pkLen)
+		}
 		return PubRec(0), errors.New("malformed PUBREC")
 	}
 	id, err := r.ReadUint16()
@@ -324,6 +385,9 @@ type PubRel uint16
 // ParsePubRel parses a PUBREL packet
 func ParsePubRel(r *mqtt.Reader, _ byte, pkLen int) (Packet, error) {
 	if pkLen != 2 {
+		if r.V5() && pkLen > 2 {
+			return parseAckV5(r, TpPubRel, pkLen)
+		}
 		return PubRel(0), errors.New("malformed PUBREL")
 	}
 	id, err := r.ReadUint16()
@@ -347,7 +411,7 @@ func (p PubRel) String() string {
 
 // Write writes the MQTT bits of this packet on the given Writer
 func (p PubRel) Write(w *mqtt.Writer) {
-	w.WriteU8(TpPubRel)
+	w.WriteU8(TpPubRel | 2)
 	w.WriteU8(2)
 	w.WriteU16(uint16(p))
 }
@@ -358,6 +422,9 @@ type PubComp uint16
 // ParsePubComp parses a PUBCOMP packet
 func ParsePubComp(r *mqtt.Reader, _ byte, pkLen int) (Packet, error) {
 	if pkLen != 2 {
+		if r.V5() && pkLen > 2 {
+			return parseAckV5(r, TpPubComp, pkLen)
+		}
 		return PubComp(0), errors.New("malformed PUBCOMP")
 	}
 	id, err := r.ReadUint16()
@@ -385,3 +452,106 @@ func (p PubComp) Write(w *mqtt.Writer) {
 	w.WriteU8(2)
 	w.WriteU16(uint16(p))
 }
+
+// AckV5 is the MQTT 5 form of the PUBACK, PUBREC, PUBREL, and PUBCOMP packets. It adds a reason code and
+// properties to the packet identifier.
+type AckV5 struct {
+	props  mqtt.Properties
+	id     uint16
+	tp     byte
+	reason ReasonCode
+}
+
+// NewAckV5 creates a new MQTT 5 acknowledgement of the given type, i.e. one of TpPubAck, TpPubRec, TpPubRel,
+// or TpPubComp
+func NewAckV5(tp byte, id uint16, reason ReasonCode, props mqtt.Properties) *AckV5 {
+	return &AckV5{tp: tp, id: id, reason: reason, props: props}
+}
+
+func parseAckV5(r *mqtt.Reader, tp byte, pkLen int) (Packet, error) {
+	var err error
+	if r, err = r.ReadPacket(pkLen); err != nil {
+		return nil, err
+	}
+	a := &AckV5{tp: tp}
+	if a.id, err = r.ReadUint16(); err != nil {
+		return nil, err
+	}
+	var rc byte
+	if rc, err = r.ReadByte(); err != nil {
+		return nil, err
+	}
+	a.reason = ReasonCode(rc)
+	if r.Len() > 0 {
+		if a.props, err = r.ReadProperties(); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// Equals returns true if this packet is equal to the given packet, false if not
+func (a *AckV5) Equals(other interface{}) bool {
+	oa, ok := other.(*AckV5)
+	return ok && a.tp == oa.tp && a.id == oa.id && a.reason == oa.reason && a.props.Equals(oa.props)
+}
+
+// ID returns the packet ID
+func (a *AckV5) ID() uint16 {
+	return a.id
+}
+
+// Properties returns the MQTT 5 properties of the packet
+func (a *AckV5) Properties() mqtt.Properties {
+	return a.props
+}
+
+// ReasonCode returns the reason code of the packet
+func (a *AckV5) ReasonCode() ReasonCode {
+	return a.reason
+}
+
+// Type returns the packet type, i.e. one of TpPubAck, TpPubRec, TpPubRel, or TpPubComp
+func (a *AckV5) Type() byte {
+	return a.tp
+}
+
+// String returns a brief string representation of the packet. Suitable for logging
+func (a *AckV5) String() string {
+	var n string
+	switch a.tp {
+	case TpPubAck:
+		n = "PUBACK"
+	case TpPubRec:
+		n = "PUBREC"
+	case TpPubRel:
+		n = "PUBREL"
+	default:
+		n = "PUBCOMP"
+	}
+	return fmt.Sprintf("%s (m%d, rc%d)", n, a.id, a.reason)
+}
+
+// Write writes the MQTT bits of this packet on the given Writer. The reason code and properties are
+// omitted unless the Writer is using MQTT 5.
+func (a *AckV5) Write(w *mqtt.Writer) {
+	if a.tp == TpPubRel {
+		w.WriteU8(a.tp | 2)
+	} else {
+		w.WriteU8(a.tp)
+	}
+	switch {
+	case !w.V5() || a.reason == RcSuccess && len(a.props) == 0:
+		w.WriteU8(2)
+		w.WriteU16(a.id)
+	case len(a.props) == 0:
+		w.WriteU8(3)
+		w.WriteU16(a.id)
+		w.WriteU8(byte(a.reason))
+	default:
+		w.WriteVarInt(3 + a.props.Size())
+		w.WriteU16(a.id)
+		w.WriteU8(byte(a.reason))
+		w.WriteProperties(a.props)
+	}
+}
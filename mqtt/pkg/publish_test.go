@@ -4,7 +4,9 @@ import (
 	"testing"
 
 	"github.com/tada/jsonstream"
+	"github.com/tada/mqtt-nats/mqtt"
 	"github.com/tada/mqtt-nats/mqtt/pkg"
+	"github.com/tada/mqtt-nats/test/utils"
 )
 
 func TestParsePublish(t *testing.T) {
@@ -61,3 +63,46 @@ func TestPublish_MarshalToJSON_nonUTF(t *testing.T) {
 		t.Fatal(p1, "!=", p2)
 	}
 }
+
+func TestParsePublish5(t *testing.T) {
+	pp := pkg.NewPublish(23, "some/topic", 2, []byte(`the "message"`), false, "")
+	pp.SetProperties(mqtt.Properties{}.
+		Add(mqtt.PropResponseTopic, "some/response").
+		Add(mqtt.PropCorrelationData, []byte{1, 2, 3}).
+		Add(mqtt.PropUserProperty, mqtt.StringPair{Key: "k", Value: "v"}))
+	writeReadAndCompare5(t, pp, "PUBLISH (d0, q1, r0, m23, 'some/topic', ... (13 bytes))")
+	writeReadAndCompare5(t, pkg.SimplePublish("some/topic", []byte("x")), "PUBLISH (d0, q0, r0, m0, 'some/topic', ... (1 bytes))")
+}
+
+func TestParsePubAck5(t *testing.T) {
+	writeReadAndCompare5(t, pkg.PubAck(23), "PUBACK (m23)")
+	writeReadAndCompare5(t, pkg.NewAckV5(pkg.TpPubAck, 23, pkg.RcNoMatchingSubscribers, nil), "PUBACK (m23, rc16)")
+	writeReadAndCompare5(t, pkg.NewAckV5(pkg.TpPubRec, 23, pkg.RcQuotaExceeded,
+		mqtt.Properties{}.Add(mqtt.PropReasonString, "full")), "PUBREC (m23, rc151)")
+	writeReadAndCompare5(t, pkg.NewAckV5(pkg.TpPubRel, 23, pkg.RcPacketIdentifierNotFound, nil), "PUBREL (m23, rc146)")
+	writeReadAndCompare5(t, pkg.NewAckV5(pkg.TpPubComp, 23, pkg.RcPacketIdentifierNotFound, nil), "PUBCOMP (m23, rc146)")
+}
+
+func TestAckV5_Write_311(t *testing.T) {
+	w := mqtt.NewWriter()
+	pkg.NewAckV5(pkg.TpPubRel, 23, pkg.RcPacketIdentifierNotFound, nil).Write(w)
+	utils.CheckEqual([]byte{pkg.TpPubRel | 2, 2, 0, 23}, w.Bytes(), t)
+}
+
+func TestPublish_MarshalToJSON_properties(t *testing.T) {
+	p1 := pkg.NewPublish(23, "some/topic", 2, []byte(`the "message"`), false, "")
+	p1.SetProperties(mqtt.Properties{}.Add(mqtt.PropContentType, "text/plain").Add(mqtt.PropCorrelationData, []byte{0, 1}))
+	bs, err := jsonstream.Marshal(p1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p2 := &pkg.Publish{}
+	err = jsonstream.Unmarshal(p2, bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p1.Equals(p2) {
+		t.Fatal(p1, "!=", p2)
+	}
+}
@@ -0,0 +1,236 @@
+package pkg
+
+import "fmt"
+
+// ReasonCode is the MQTT 5 reason code used in CONNACK, PUBACK, PUBREC, PUBREL, PUBCOMP, SUBACK, UNSUBACK,
+// DISCONNECT and AUTH packets. A value of 0x80 or higher indicates failure.
+type ReasonCode byte
+
+const (
+	// RcSuccess Success, Normal disconnection, or Granted QoS 0
+	RcSuccess = ReasonCode(0x00)
+
+	// RcGrantedQoS1 Granted QoS 1
+	RcGrantedQoS1 = ReasonCode(0x01)
+
+	// RcGrantedQoS2 Granted QoS 2
+	RcGrantedQoS2 = ReasonCode(0x02)
+
+	// RcDisconnectWithWill The Client wishes to disconnect but requires that the Server also publishes its Will
+	RcDisconnectWithWill = ReasonCode(0x04)
+
+	// RcNoMatchingSubscribers The message is accepted but there are no subscribers
+	RcNoMatchingSubscribers = ReasonCode(0x10)
+
+	// RcNoSubscriptionExisted No matching Topic Filter is being used by the Client
+	RcNoSubscriptionExisted = ReasonCode(0x11)
+
+	// RcContinueAuthentication Continue the authentication with another step
+	RcContinueAuthentication = ReasonCode(0x18)
+
+	// RcReAuthenticate Initiate a re-authentication
+	RcReAuthenticate = ReasonCode(0x19)
+
+	// RcUnspecifiedError The Server does not wish to reveal the reason for the failure
+	RcUnspecifiedError = ReasonCode(0x80)
+
+	// RcMalformedPacket Data within the packet could not be correctly parsed
+	RcMalformedPacket = ReasonCode(0x81)
+
+	// RcProtocolError Data in the packet does not conform to the specification
+	RcProtocolError = ReasonCode(0x82)
+
+	// RcImplementationSpecificError The packet is valid but is not accepted by this Server
+	RcImplementationSpecificError = ReasonCode(0x83)
+
+	// RcUnsupportedProtocolVersion The Server does not support the requested version of the MQTT protocol
+	RcUnsupportedProtocolVersion = ReasonCode(0x84)
+
+	// RcClientIdentifierNotValid The Client Identifier is a valid string but is not allowed by the Server
+	RcClientIdentifierNotValid = ReasonCode(0x85)
+
+	// RcBadUserNameOrPassword The Server does not accept the User Name or Password specified by the Client
+	RcBadUserNameOrPassword = ReasonCode(0x86)
+
+	// RcNotAuthorized The Client is not authorized to perform the operation
+	RcNotAuthorized = ReasonCode(0x87)
+
+	// RcServerUnavailable The MQTT Server is not available
+	RcServerUnavailable = ReasonCode(0x88)
+
+	// RcServerBusy The Server is busy
+	RcServerBusy = ReasonCode(0x89)
+
+	// RcBanned This Client has been banned by administrative action
+	RcBanned = ReasonCode(0x8a)
+
+	// RcServerShuttingDown The Server is shutting down
+	RcServerShuttingDown = ReasonCode(0x8b)
+
+	// RcBadAuthenticationMethod The authentication method is not supported or does not match the one in use
+	RcBadAuthenticationMethod = ReasonCode(0x8c)
+
+	// RcKeepAliveTimeout The Connection is closed because no packet has been received for 1.5 times the Keepalive time
+	RcKeepAliveTimeout = ReasonCode(0x8d)
+
+	// RcSessionTakenOver Another Connection using the same ClientID has connected
+	RcSessionTakenOver = ReasonCode(0x8e)
+
+	// RcTopicFilterInvalid The Topic Filter is correctly formed but is not allowed
+	RcTopicFilterInvalid = ReasonCode(0x8f)
+
+	// RcTopicNameInvalid The Topic Name is correctly formed but is not allowed
+	RcTopicNameInvalid = ReasonCode(0x90)
+
+	// RcPacketIdentifierInUse The Packet Identifier is already in use
+	RcPacketIdentifierInUse = ReasonCode(0x91)
+
+	// RcPacketIdentifierNotFound The Packet Identifier is not known
+	RcPacketIdentifierNotFound = ReasonCode(0x92)
+
+	// RcReceiveMaximumExceeded More publications than the Receive Maximum have been received
+	RcReceiveMaximumExceeded = ReasonCode(0x93)
+
+	// RcTopicAliasInvalid The Topic Alias is not valid
+	RcTopicAliasInvalid = ReasonCode(0x94)
+
+	// RcPacketTooLarge The packet size is greater than the Maximum Packet Size
+	RcPacketTooLarge = ReasonCode(0x95)
+
+	// RcMessageRateTooHigh The received data rate is too high
+	RcMessageRateTooHigh = ReasonCode(0x96)
+
+	// RcQuotaExceeded An implementation or administrative imposed limit has been exceeded
+	RcQuotaExceeded = ReasonCode(0x97)
+
+	// RcAdministrativeAction The Connection is closed due to an administrative action
+	RcAdministrativeAction = ReasonCode(0x98)
+
+	// RcPayloadFormatInvalid The payload format does not match the Payload Format Indicator
+	RcPayloadFormatInvalid = ReasonCode(0x99)
+
+	// RcRetainNotSupported The Server does not support retained messages
+	RcRetainNotSupported = ReasonCode(0x9a)
+
+	// RcQoSNotSupported The Client specified a QoS greater than the QoS specified in a Maximum QoS in the CONNACK
+	RcQoSNotSupported = ReasonCode(0x9b)
+
+	// RcUseAnotherServer The Client should temporarily use another server
+	RcUseAnotherServer = ReasonCode(0x9c)
+
+	// RcServerMoved The Client should permanently use another server
+	RcServerMoved = ReasonCode(0x9d)
+
+	// RcSharedSubscriptionsNotSupported The Server does not support Shared Subscriptions
+	RcSharedSubscriptionsNotSupported = ReasonCode(0x9e)
+
+	// RcConnectionRateExceeded The connection rate limit has been exceeded
+	RcConnectionRateExceeded = ReasonCode(0x9f)
+
+	// RcMaximumConnectTime The maximum connection time authorized for this connection has been exceeded
+	RcMaximumConnectTime = ReasonCode(0xa0)
+
+	// RcSubscriptionIdentifiersNotSupported The Server does not support Subscription Identifiers
+	RcSubscriptionIdentifiersNotSupported = ReasonCode(0xa1)
+
+	// RcWildcardSubscriptionsNotSupported The Server does not support Wildcard Subscriptions
+	RcWildcardSubscriptionsNotSupported = ReasonCode(0xa2)
+)
+
+func (r ReasonCode) Error() string {
+	switch r {
+	case RcSuccess:
+		return "success"
+	case RcGrantedQoS1:
+		return "granted QoS 1"
+	case RcGrantedQoS2:
+		return "granted QoS 2"
+	case RcDisconnectWithWill:
+		return "disconnect with will message"
+	case RcNoMatchingSubscribers:
+		return "no matching subscribers"
+	case RcNoSubscriptionExisted:
+		return "no subscription existed"
+	case RcContinueAuthentication:
+		return "continue authentication"
+	case RcReAuthenticate:
+		return "re-authenticate"
+	case RcUnspecifiedError:
+		return "unspecified error"
+	case RcMalformedPacket:
+		return "malformed packet"
+	case RcProtocolError:
+		return "protocol error"
+	case RcImplementationSpecificError:
+		return "implementation specific error"
+	case RcUnsupportedProtocolVersion:
+		return "unsupported protocol version"
+	case RcClientIdentifierNotValid:
+		return "client identifier not valid"
+	case RcBadUserNameOrPassword:
+		return "bad user name or password"
+	case RcNotAuthorized:
+		return "not authorized"
+	case RcServerUnavailable:
+		return "server unavailable"
+	case RcServerBusy:
+		return "server busy"
+	case RcBanned:
+		return "banned"
+	case RcServerShuttingDown:
+		return "server shutting down"
+	case RcBadAuthenticationMethod:
+		return "bad authentication method"
+	case RcKeepAliveTimeout:
+		return "keep alive timeout"
+	case RcSessionTakenOver:
+		return "session taken over"
+	case RcTopicFilterInvalid:
+		return "topic filter invalid"
+	case RcTopicNameInvalid:
+		return "topic name invalid"
+	case RcPacketIdentifierInUse:
+		return "packet identifier in use"
+	case RcPacketIdentifierNotFound:
+		return "packet identifier not found"
+	case RcReceiveMaximumExceeded:
+		return "receive maximum exceeded"
+	case RcTopicAliasInvalid:
+		return "topic alias invalid"
+	case RcPacketTooLarge:
+		return "packet too large"
+	case RcMessageRateTooHigh:
+		return "message rate too high"
+	case RcQuotaExceeded:
+		return "quota exceeded"
+	case RcAdministrativeAction:
+		return "administrative action"
+	case RcPayloadFormatInvalid:
+		return "payload format invalid"
+	case RcRetainNotSupported:
+		return "retain not supported"
+	case RcQoSNotSupported:
+		return "QoS not supported"
+	case RcUseAnotherServer:
+		return "use another server"
+	case RcServerMoved:
+		return "server moved"
+	case RcSharedSubscriptionsNotSupported:
+		return "shared subscriptions not supported"
+	case RcConnectionRateExceeded:
+		return "connection rate exceeded"
+	case RcMaximumConnectTime:
+		return "maximum connect time"
+	case RcSubscriptionIdentifiersNotSupported:
+		return "subscription identifiers not supported"
+	case RcWildcardSubscriptionsNotSupported:
+		return "wildcard subscriptions not supported"
+	default:
+		return fmt.Sprintf("unknown reason code 0x%x", byte(r))
+	}
+}
+
+// IsError returns true if the reason code indicates failure
+func (r ReasonCode) IsError() bool {
+	return r >= RcUnspecifiedError
+}
@@ -15,10 +15,34 @@ type Topic struct {
 
 	// QoS Quality of Service, will be 0, 1, or 2.
 	QoS byte
+
+	// NoLocal is the MQTT 5 option that prevents messages from being forwarded to the connection that
+	// published them
+	NoLocal bool
+
+	// RetainAsPublished is the MQTT 5 option that keeps the retain flag of forwarded messages
+	RetainAsPublished bool
+
+	// RetainHandling is the MQTT 5 option that controls if retained messages are sent when the subscription
+	// is established. 0 = always, 1 = only for new subscriptions, 2 = never.
+	RetainHandling byte
+}
+
+// options returns the MQTT 5 subscription options byte of the topic
+func (t *Topic) options() byte {
+	o := t.QoS | t.RetainHandling<<4
+	if t.NoLocal {
+		o |= 0x04
+	}
+	if t.RetainAsPublished {
+		o |= 0x08
+	}
+	return o
 }
 
 // Subscribe is the MQTT subscribe packet
 type Subscribe struct {
+	props  mqtt.Properties
 	id     uint16
 	topics []Topic
 }
@@ -45,15 +69,34 @@ func ParseSubscribe(r *mqtt.Reader, b byte, pkLen int) (Packet, error) {
 	if sp.id, err = r.ReadUint16(); err != nil {
 		return nil, err
 	}
+	if r.V5() {
+		if sp.props, err = r.ReadProperties(); err != nil {
+			return nil, err
+		}
+	}
 
 	for r.Len() > 0 {
 		t := Topic{}
 		if t.Name, err = r.ReadString(); err != nil {
 			return nil, err
 		}
-		if t.QoS, err = r.ReadByte(); err != nil {
+		var o byte
+		if o, err = r.ReadByte(); err != nil {
 			return nil, err
 		}
+		if r.V5() {
+			if (o & 0xc0) != 0 {
+				return nil, errors.New("malformed subscription options")
+			}
+			t.NoLocal = (o & 0x04) != 0
+			t.RetainAsPublished = (o & 0x08) != 0
+			t.RetainHandling = (o >> 4) & 0x03
+			if t.RetainHandling > 2 {
+				return nil, errors.New("malformed subscription retain handling")
+			}
+			o &= 0x03
+		}
+		t.QoS = o
 		if t.QoS > 2 {
 			return nil, errors.New("malformed subscribed topic QoS")
 		}
@@ -62,6 +105,11 @@ func ParseSubscribe(r *mqtt.Reader, b byte, pkLen int) (Packet, error) {
 	return sp, nil
 }
 
+// NewSubscribe5 creates a new MQTT 5 subscribe packet with properties
+func NewSubscribe5(id uint16, props mqtt.Properties, topics ...Topic) *Subscribe {
+	return &Subscribe{id: id, props: props, topics: topics}
+}
+
 // ID returns the MQTT Packet Identifier
 func (s *Subscribe) ID() uint16 {
 	return s.id
@@ -69,7 +117,7 @@ func (s *Subscribe) ID() uint16 {
 
 // Equals returns true if this packet is equal to the given packet, false if not
 func (s *Subscribe) Equals(other interface{}) bool {
-	if os, ok := other.(*Subscribe); ok && s.id == os.id && len(s.topics) == len(os.topics) {
+	if os, ok := other.(*Subscribe); ok && s.id == os.id && len(s.topics) == len(os.topics) && s.props.Equals(os.props) {
 		for i := range s.topics {
 			if s.topics[i] != os.topics[i] {
 				return false
@@ -110,6 +158,11 @@ func (s *Subscribe) String() string {
 	return bs.String()
 }
 
+// Properties returns the MQTT 5 properties of the packet
+func (s *Subscribe) Properties() mqtt.Properties {
+	return s.props
+}
+
 // Topics returns the list of topics to subscribe to
 func (s *Subscribe) Topics() []Topic {
 	return s.topics
@@ -118,21 +171,32 @@ func (s *Subscribe) Topics() []Topic {
 // Write writes the MQTT bits of this packet on the given Writer
 func (s *Subscribe) Write(w *mqtt.Writer) {
 	pkLen := 2 // id
+	if w.V5() {
+		pkLen += s.props.Size()
+	}
 	for i := range s.topics {
 		pkLen += 3 + len(s.topics[i].Name)
 	}
 	w.WriteU8(TpSubscribe | fixedSubscribeFlags)
 	w.WriteVarInt(pkLen)
 	w.WriteU16(s.id)
+	if w.V5() {
+		w.WriteProperties(s.props)
+	}
 	for i := range s.topics {
 		t := s.topics[i]
 		w.WriteString(t.Name)
-		w.WriteU8(t.QoS)
+		if w.V5() {
+			w.WriteU8(t.options())
+		} else {
+			w.WriteU8(t.QoS)
+		}
 	}
 }
 
 // SubAck is the MQTT SUBACK packet sent in response to a SUBSCRIBE
 type SubAck struct {
+	props        mqtt.Properties
 	id           uint16
 	topicReturns []byte
 }
@@ -142,6 +206,11 @@ func NewSubAck(id uint16, topicReturns ...byte) *SubAck {
 	return &SubAck{id: id, topicReturns: topicReturns}
 }
 
+// NewSubAck5 creates an MQTT 5 SUBACK packet with properties. The topic returns are reason codes.
+func NewSubAck5(id uint16, props mqtt.Properties, topicReturns ...byte) *SubAck {
+	return &SubAck{id: id, props: props, topicReturns: topicReturns}
+}
+
 // ParseSubAck parses a SUBACK packet
 func ParseSubAck(r *mqtt.Reader, _ byte, pkLen int) (Packet, error) {
 	var err error
@@ -152,7 +221,12 @@ func ParseSubAck(r *mqtt.Reader, _ byte, pkLen int) (Packet, error) {
 	if s.id, err = r.ReadUint16(); err != nil {
 		return nil, err
 	}
-	if s.topicReturns, err = r.ReadExact(pkLen - 2); err != nil {
+	if r.V5() {
+		if s.props, err = r.ReadProperties(); err != nil {
+			return nil, err
+		}
+	}
+	if s.topicReturns, err = r.ReadRemainingBytes(); err != nil {
 		return nil, err
 	}
 	return s, nil
@@ -161,7 +235,12 @@ func ParseSubAck(r *mqtt.Reader, _ byte, pkLen int) (Packet, error) {
 // Equals returns true if this packet is equal to the given packet, false if not
 func (s *SubAck) Equals(other interface{}) bool {
 	os, ok := other.(*SubAck)
-	return ok && s.id == os.id && bytes.Equal(s.topicReturns, os.topicReturns)
+	return ok && s.id == os.id && bytes.Equal(s.topicReturns, os.topicReturns) && s.props.Equals(os.props)
+}
+
+// Properties returns the MQTT 5 properties of the packet
+func (s *SubAck) Properties() mqtt.Properties {
+	return s.props
 }
 
 // ID returns the packet ID
@@ -200,7 +279,13 @@ func (s *SubAck) TopicReturns() []byte {
 // Write writes the MQTT bits of this packet on the given Writer
 func (s *SubAck) Write(w *mqtt.Writer) {
 	w.WriteU8(TpSubAck)
-	w.WriteVarInt(2 + len(s.topicReturns))
-	w.WriteU16(s.id)
+	if w.V5() {
+		w.WriteVarInt(2 + s.props.Size() + len(s.topicReturns))
+		w.WriteU16(s.id)
+		w.WriteProperties(s.props)
+	} else {
+		w.WriteVarInt(2 + len(s.topicReturns))
+		w.WriteU16(s.id)
+	}
 	_, _ = w.Write(s.topicReturns)
 }
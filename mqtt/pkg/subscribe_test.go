@@ -97,3 +97,27 @@ func TestSubAck_Equals(t *testing.T) {
 	c := pkg.NewSubscribe(32, pkg.Topic{Name: "a"}, pkg.Topic{Name: "b", QoS: 1})
 	utils.CheckFalse(a.Equals(c), t)
 }
+
+func TestParseSubscribe5(t *testing.T) {
+	writeReadAndCompare5(t, pkg.NewSubscribe5(23, mqtt.Properties{}.Add(mqtt.PropSubscriptionIdentifier, 7),
+		pkg.Topic{Name: "some/topic", QoS: 2, NoLocal: true, RetainAsPublished: true, RetainHandling: 2},
+		pkg.Topic{Name: "some/other", QoS: 1}),
+		"SUBSCRIBE (m23, [(q2, 'some/topic'), (q1, 'some/other')])")
+}
+
+func TestParseSubscribe5_badOptions(t *testing.T) {
+	w := mqtt.NewWriter()
+	w.WriteU16(23)
+	w.WriteVarInt(0)
+	w.WriteString("some/topic")
+	w.WriteU8(0x30)
+	r := mqtt.NewReader(bytes.NewReader(w.Bytes()))
+	r.SetProtocolLevel(mqtt.ProtocolLevel5)
+	_, err := pkg.ParseSubscribe(r, pkg.TpSubscribe|2, w.Len())
+	utils.CheckError(err, t)
+}
+
+func TestParseSubAck5(t *testing.T) {
+	writeReadAndCompare5(t, pkg.NewSubAck5(23, mqtt.Properties{}.Add(mqtt.PropReasonString, "ok"),
+		byte(pkg.RcGrantedQoS1), byte(pkg.RcTopicFilterInvalid)), "SUBACK (m23, [rc1, rc143])")
+}
@@ -11,6 +11,7 @@ import (
 
 // Unsubscribe is the MQTT UNSUBSCRIBE packet
 type Unsubscribe struct {
+	props  mqtt.Properties
 	id     uint16
 	topics []string
 }
@@ -20,6 +21,11 @@ func NewUnsubscribe(id uint16, topics ...string) *Unsubscribe {
 	return &Unsubscribe{id: id, topics: topics}
 }
 
+// NewUnsubscribe5 creates a new MQTT 5 Unsubscribe packet with properties
+func NewUnsubscribe5(id uint16, props mqtt.Properties, topics ...string) *Unsubscribe {
+	return &Unsubscribe{id: id, props: props, topics: topics}
+}
+
 // ParseUnsubscribe parses the unsubscribe packet from the given reader.
 func ParseUnsubscribe(r *mqtt.Reader, b byte, pkLen int) (Packet, error) {
 	if (b & 0xf) != 2 {
@@ -35,6 +41,11 @@ func ParseUnsubscribe(r *mqtt.Reader, b byte, pkLen int) (Packet, error) {
 	if up.id, err = r.ReadUint16(); err != nil {
 		return nil, err
 	}
+	if r.V5() {
+		if up.props, err = r.ReadProperties(); err != nil {
+			return nil, err
+		}
+	}
 
 	for r.Len() > 0 {
 		var name string
@@ -49,6 +60,9 @@ func ParseUnsubscribe(r *mqtt.Reader, b byte, pkLen int) (Packet, error) {
 // Write writes the MQTT bits of this packet on the given Writer
 func (u *Unsubscribe) Write(w *mqtt.Writer) {
 	pkLen := 2 // packet id
+	if w.V5() {
+		pkLen += u.props.Size()
+	}
 	tps := u.topics
 	for i := range tps {
 		pkLen += 2 + len(tps[i])
@@ -56,6 +70,9 @@ func (u *Unsubscribe) Write(w *mqtt.Writer) {
 	w.WriteU8(TpUnsubscribe | 2)
 	w.WriteVarInt(pkLen)
 	w.WriteU16(u.id)
+	if w.V5() {
+		w.WriteProperties(u.props)
+	}
 	for i := range tps {
 		w.WriteString(tps[i])
 	}
@@ -63,7 +80,7 @@ func (u *Unsubscribe) Write(w *mqtt.Writer) {
 
 // Equals returns true if this packet is equal to the given packet, false if not
 func (u *Unsubscribe) Equals(other interface{}) bool {
-	if os, ok := other.(*Unsubscribe); ok && u.id == os.id && len(u.topics) == len(os.topics) {
+	if os, ok := other.(*Unsubscribe); ok && u.id == os.id && len(u.topics) == len(os.topics) && u.props.Equals(os.props) {
 		for i := range u.topics {
 			if u.topics[i] != os.topics[i] {
 				return false
@@ -96,6 +113,11 @@ func (u *Unsubscribe) String() string {
 	return bs.String()
 }
 
+// Properties returns the MQTT 5 properties of the packet
+func (u *Unsubscribe) Properties() mqtt.Properties {
+	return u.props
+}
+
 // Topics returns the list of topics to subscribe to
 func (u *Unsubscribe) Topics() []string {
 	return u.topics
@@ -104,8 +126,12 @@ func (u *Unsubscribe) Topics() []string {
 // UnsubAck is the MQTT UNSUBACK packet
 type UnsubAck uint16
 
-// ParseUnsubAck parses the unsubscribe packet from the given reader.
+// ParseUnsubAck parses the unsubscribe packet from the given reader. An *UnsubAckV5 is returned when the
+// reader is using MQTT 5.
 func ParseUnsubAck(r *mqtt.Reader, b byte, pkLen int) (Packet, error) {
+	if r.V5() {
+		return parseUnsubAckV5(r, pkLen)
+	}
 	if pkLen != 2 {
 		return UnsubAck(0), errors.New("malformed UNSUBACK")
 	}
@@ -134,3 +160,85 @@ func (u UnsubAck) Write(w *mqtt.Writer) {
 	w.WriteU8(2)
 	w.WriteU16(uint16(u))
 }
+
+// UnsubAckV5 is the MQTT 5 UNSUBACK packet which, in addition to the packet identifier, contains
+// properties and one reason code for each topic filter in the UNSUBSCRIBE packet
+type UnsubAckV5 struct {
+	props       mqtt.Properties
+	id          uint16
+	reasonCodes []byte
+}
+
+// NewUnsubAckV5 creates a new MQTT 5 UNSUBACK packet
+func NewUnsubAckV5(id uint16, props mqtt.Properties, reasonCodes ...byte) *UnsubAckV5 {
+	return &UnsubAckV5{id: id, props: props, reasonCodes: reasonCodes}
+}
+
+func parseUnsubAckV5(r *mqtt.Reader, pkLen int) (Packet, error) {
+	var err error
+	if r, err = r.ReadPacket(pkLen); err != nil {
+		return nil, err
+	}
+	u := &UnsubAckV5{}
+	if u.id, err = r.ReadUint16(); err != nil {
+		return nil, err
+	}
+	if u.props, err = r.ReadProperties(); err != nil {
+		return nil, err
+	}
+	if u.reasonCodes, err = r.ReadRemainingBytes(); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// Equals returns true if this packet is equal to the given packet, false if not
+func (u *UnsubAckV5) Equals(other interface{}) bool {
+	ou, ok := other.(*UnsubAckV5)
+	return ok && u.id == ou.id && bytes.Equal(u.reasonCodes, ou.reasonCodes) && u.props.Equals(ou.props)
+}
+
+// ID returns the packet ID
+func (u *UnsubAckV5) ID() uint16 {
+	return u.id
+}
+
+// Properties returns the MQTT 5 properties of the packet
+func (u *UnsubAckV5) Properties() mqtt.Properties {
+	return u.props
+}
+
+// ReasonCodes returns the reason code for each topic filter in the UNSUBSCRIBE packet
+func (u *UnsubAckV5) ReasonCodes() []byte {
+	return u.reasonCodes
+}
+
+// String returns a brief string representation of the packet. Suitable for logging
+func (u *UnsubAckV5) String() string {
+	bs := bytes.NewBufferString("UNSUBACK (m")
+	bs.WriteString(strconv.Itoa(int(u.ID())))
+	bs.WriteString(", [")
+	for i, rc := range u.reasonCodes {
+		if i > 0 {
+			bs.WriteString(", ")
+		}
+		bs.WriteString("rc")
+		bs.WriteString(strconv.Itoa(int(rc)))
+	}
+	bs.WriteString("])")
+	return bs.String()
+}
+
+// Write writes the MQTT bits of this packet on the given Writer. The reason codes and properties are
+// omitted unless the Writer is using MQTT 5.
+func (u *UnsubAckV5) Write(w *mqtt.Writer) {
+	if !w.V5() {
+		UnsubAck(u.id).Write(w)
+		return
+	}
+	w.WriteU8(TpUnsubAck)
+	w.WriteVarInt(2 + u.props.Size() + len(u.reasonCodes))
+	w.WriteU16(u.id)
+	w.WriteProperties(u.props)
+	_, _ = w.Write(u.reasonCodes)
+}
@@ -3,6 +3,7 @@ package pkg_test
 import (
 	"testing"
 
+	"github.com/tada/mqtt-nats/mqtt"
 	"github.com/tada/mqtt-nats/mqtt/pkg"
 )
 
@@ -13,3 +14,13 @@ func TestParseUnsubscribe(t *testing.T) {
 func TestParseUnsubAck(t *testing.T) {
 	writeReadAndCompare(t, pkg.UnsubAck(23), "UNSUBACK (m23)")
 }
+
+func TestParseUnsubscribe5(t *testing.T) {
+	writeReadAndCompare5(t, pkg.NewUnsubscribe5(23, mqtt.Properties{}.Add(mqtt.PropUserProperty, mqtt.StringPair{Key: "a", Value: "b"}),
+		"some/topic", "some/other"), "UNSUBSCRIBE (m23, ['some/topic', 'some/other'])")
+}
+
+func TestParseUnsubAck5(t *testing.T) {
+	writeReadAndCompare5(t, pkg.NewUnsubAckV5(23, nil, byte(pkg.RcSuccess), byte(pkg.RcNoSubscriptionExisted)),
+		"UNSUBACK (m23, [rc0, rc17])")
+}
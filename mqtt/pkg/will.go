@@ -3,6 +3,8 @@ package pkg
 import (
 	"bytes"
 	"fmt"
+
+	"github.com/tada/mqtt-nats/mqtt"
 )
 
 // Will is the optional client will in the MQTT connect packet
@@ -11,11 +13,15 @@ type Will struct {
 	Message []byte
 	QoS     byte
 	Retain  bool
+
+	// Props are the MQTT 5 will properties
+	Props mqtt.Properties
 }
 
 // Equals returns true if this instance is equal to the given instance, false if not
 func (w *Will) Equals(ow *Will) bool {
-	return w.Retain == ow.Retain && w.QoS == ow.QoS && w.Topic == ow.Topic && bytes.Equal(w.Message, ow.Message)
+	return w.Retain == ow.Retain && w.QoS == ow.QoS && w.Topic == ow.Topic && bytes.Equal(w.Message, ow.Message) &&
+		w.Props.Equals(ow.Props)
 }
 
 // String returns a brief string representation of the will. Suitable for logging
@@ -0,0 +1,503 @@
+package mqtt
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/tada/catch"
+	"github.com/tada/catch/pio"
+	"github.com/tada/jsonstream"
+)
+
+// ErrMalformedProperties is returned when the length of MQTT 5 properties exceeds what remains of the packet
+var ErrMalformedProperties = errors.New("malformed properties: length exceeds remaining packet")
+
+// Identifiers of the MQTT 5 properties
+const (
+	PropPayloadFormatIndicator          = 0x01
+	PropMessageExpiryInterval           = 0x02
+	PropContentType                     = 0x03
+	PropResponseTopic                   = 0x08
+	PropCorrelationData                 = 0x09
+	PropSubscriptionIdentifier          = 0x0b
+	PropSessionExpiryInterval           = 0x11
+	PropAssignedClientIdentifier        = 0x12
+	PropServerKeepAlive                 = 0x13
+	PropAuthenticationMethod            = 0x15
+	PropAuthenticationData              = 0x16
+	PropRequestProblemInformation       = 0x17
+	PropWillDelayInterval               = 0x18
+	PropRequestResponseInformation      = 0x19
+	PropResponseInformation             = 0x1a
+	PropServerReference                 = 0x1c
+	PropReasonString                    = 0x1f
+	PropReceiveMaximum                  = 0x21
+	PropTopicAliasMaximum               = 0x22
+	PropTopicAlias                      = 0x23
+	PropMaximumQoS                      = 0x24
+	PropRetainAvailable                 = 0x25
+	PropUserProperty                    = 0x26
+	PropMaximumPacketSize               = 0x27
+	PropWildcardSubscriptionAvailable   = 0x28
+	PropSubscriptionIdentifierAvailable = 0x29
+	PropSharedSubscriptionAvailable     = 0x2a
+)
+
+// the data types that property values can have
+const (
+	propByte = iota + 1
+	propUint16
+	propUint32
+	propVarInt
+	propString
+	propBinary
+	propStringPair
+)
+
+func propertyType(id byte) byte {
+	switch id {
+	case PropPayloadFormatIndicator, PropRequestProblemInformation, PropRequestResponseInformation, PropMaximumQoS,
+		PropRetainAvailable, PropWildcardSubscriptionAvailable, PropSubscriptionIdentifierAvailable,
+		PropSharedSubscriptionAvailable:
+		return propByte
+	case PropServerKeepAlive, PropReceiveMaximum, PropTopicAliasMaximum, PropTopicAlias:
+		return propUint16
+	case PropMessageExpiryInterval, PropSessionExpiryInterval, PropWillDelayInterval, PropMaximumPacketSize:
+		return propUint32
+	case PropSubscriptionIdentifier:
+		return propVarInt
+	case PropContentType, PropResponseTopic, PropAssignedClientIdentifier, PropAuthenticationMethod,
+		PropResponseInformation, PropServerReference, PropReasonString:
+		return propString
+	case PropCorrelationData, PropAuthenticationData:
+		return propBinary
+	case PropUserProperty:
+		return propStringPair
+	default:
+		return 0
+	}
+}
+
+// StringPair is the value of an MQTT 5 User Property
+type StringPair struct {
+	Key   string
+	Value string
+}
+
+// Property is an MQTT 5 property. The type of the value is determined by the property identifier. Numeric
+// values are always represented as an int, strings as a string, binary data as a []byte and user properties
+// as a StringPair.
+type Property struct {
+	ID    byte
+	Value interface{}
+}
+
+// Properties is the list of MQTT 5 properties of a packet. The order of the properties is retained.
+type Properties []Property
+
+// Get returns the value of the first property with the given identifier and true, or nil and false when no
+// such property exists
+func (p Properties) Get(id byte) (interface{}, bool) {
+	for i := range p {
+		if p[i].ID == id {
+			return p[i].Value, true
+		}
+	}
+	return nil, false
+}
+
+// Int returns the value of the first numeric property with the given identifier and true, or zero and false
+// when no such property exists
+func (p Properties) Int(id byte) (int, bool) {
+	if v, ok := p.Get(id); ok {
+		if i, ok := v.(int); ok {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// Text returns the value of the first string property with the given identifier and true, or an empty string
+// and false when no such property exists
+func (p Properties) Text(id byte) (string, bool) {
+	if v, ok := p.Get(id); ok {
+		if s, ok := v.(string); ok {
+			return s, true
+		}
+	}
+	return "", false
+}
+
+// Binary returns the value of the first binary property with the given identifier and true, or nil and false
+// when no such property exists
+func (p Properties) Binary(id byte) ([]byte, bool) {
+	if v, ok := p.Get(id); ok {
+		if bs, ok := v.([]byte); ok {
+			return bs, true
+		}
+	}
+	return nil, false
+}
+
+// Ints returns the values of all numeric properties with the given identifier. Used for properties that can
+// occur more than once such as the Subscription Identifier.
+func (p Properties) Ints(id byte) []int {
+	var is []int
+	for i := range p {
+		if p[i].ID == id {
+			if v, ok := p[i].Value.(int); ok {
+				is = append(is, v)
+			}
+		}
+	}
+	return is
+}
+
+// UserProperties returns all User Properties in the order they appear
+func (p Properties) UserProperties() []StringPair {
+	var ups []StringPair
+	for i := range p {
+		if sp, ok := p[i].Value.(StringPair); ok {
+			ups = append(ups, sp)
+		}
+	}
+	return ups
+}
+
+// Add returns a Properties that has the given property appended. A panic is raised if the value is of a type
+// that doesn't match the property identifier.
+func (p Properties) Add(id byte, value interface{}) Properties {
+	return append(p, Property{ID: id, Value: normalizeValue(id, value)})
+}
+
+// Set returns a Properties where the first property with the given identifier has been replaced by the given
+// value, or, if no such property exists, where the property has been appended. A panic is raised if the value
+// is of a type that doesn't match the property identifier.
+func (p Properties) Set(id byte, value interface{}) Properties {
+	value = normalizeValue(id, value)
+	for i := range p {
+		if p[i].ID == id {
+			np := make(Properties, len(p))
+			copy(np, p)
+			np[i].Value = value
+			return np
+		}
+	}
+	// never append to the given slice since its backing array might be shared
+	np := make(Properties, len(p), len(p)+1)
+	copy(np, p)
+	return append(np, Property{ID: id, Value: value})
+}
+
+// Delete returns a Properties where all properties with the given identifier have been removed
+func (p Properties) Delete(id byte) Properties {
+	var np Properties
+	for i := range p {
+		if p[i].ID != id {
+			np = append(np, p[i])
+		}
+	}
+	return np
+}
+
+// Equals returns true if this instance is equal to the given instance, false if not
+func (p Properties) Equals(op Properties) bool {
+	if len(p) != len(op) {
+		return false
+	}
+	for i := range p {
+		a := p[i]
+		b := op[i]
+		if a.ID != b.ID {
+			return false
+		}
+		if ab, ok := a.Value.([]byte); ok {
+			bb, ok := b.Value.([]byte)
+			if !(ok && string(ab) == string(bb)) {
+				return false
+			}
+		} else if a.Value != b.Value {
+			return false
+		}
+	}
+	return true
+}
+
+// Len returns the number of bytes needed to write the properties, excluding the variable length integer that
+// precedes them.
+func (p Properties) Len() int {
+	l := 0
+	for i := range p {
+		pr := p[i]
+		l += VarIntLen(int(pr.ID))
+		switch v := pr.Value.(type) {
+		case int:
+			switch propertyType(pr.ID) {
+			case propByte:
+				l++
+			case propUint16:
+				l += 2
+			case propUint32:
+				l += 4
+			default:
+				l += VarIntLen(v)
+			}
+		case string:
+			l += 2 + len(v)
+		case []byte:
+			l += 2 + len(v)
+		case StringPair:
+			l += 4 + len(v.Key) + len(v.Value)
+		}
+	}
+	return l
+}
+
+// Size returns the number of bytes needed to write the properties, including the variable length integer that
+// precedes them.
+func (p Properties) Size() int {
+	l := p.Len()
+	return VarIntLen(l) + l
+}
+
+// MarshalToJSON streams the JSON encoded form of this instance onto the given io.Writer
+func (p Properties) MarshalToJSON(w io.Writer) {
+	pio.WriteByte(w, '[')
+	for i := range p {
+		if i > 0 {
+			pio.WriteByte(w, ',')
+		}
+		pr := p[i]
+		pio.WriteString(w, `{"id":`)
+		pio.WriteInt(w, int64(pr.ID))
+		switch v := pr.Value.(type) {
+		case int:
+			pio.WriteString(w, `,"v":`)
+			pio.WriteInt(w, int64(v))
+		case string:
+			pio.WriteString(w, `,"v":`)
+			jsonstream.WriteString(w, v)
+		case []byte:
+			pio.WriteString(w, `,"b":`)
+			jsonstream.WriteString(w, base64.StdEncoding.EncodeToString(v))
+		case StringPair:
+			pio.WriteString(w, `,"k":`)
+			jsonstream.WriteString(w, v.Key)
+			pio.WriteString(w, `,"v":`)
+			jsonstream.WriteString(w, v.Value)
+		}
+		pio.WriteByte(w, '}')
+	}
+	pio.WriteByte(w, ']')
+}
+
+// UnmarshalFromJSON initializes this instance from the tokens stream provided by the json.Decoder. The
+// first token has already been read and is passed as an argument.
+func (p *Properties) UnmarshalFromJSON(js jsonstream.Decoder, t json.Token) {
+	jsonstream.AssertDelim(t, '[')
+	var ps Properties
+	for {
+		pr := &jsonProperty{}
+		valid, ok := js.ReadConsumerOrEnd(pr, ']')
+		if !ok {
+			break
+		}
+		if valid {
+			ps = append(ps, Property(*pr))
+		}
+	}
+	*p = ps
+}
+
+type jsonProperty Property
+
+func (p *jsonProperty) UnmarshalFromJSON(js jsonstream.Decoder, t json.Token) {
+	jsonstream.AssertDelim(t, '{')
+	var key string
+	for {
+		k, ok := js.ReadStringOrEnd('}')
+		if !ok {
+			break
+		}
+		switch k {
+		case "id":
+			p.ID = byte(js.ReadInt())
+		case "k":
+			key = js.ReadString()
+		case "b":
+			bs, err := base64.StdEncoding.DecodeString(js.ReadString())
+			if err != nil {
+				panic(catch.Error(err))
+			}
+			p.Value = bs
+		case "v":
+			switch propertyType(p.ID) {
+			case propString:
+				p.Value = js.ReadString()
+			case propStringPair:
+				p.Value = StringPair{Value: js.ReadString()}
+			default:
+				p.Value = int(js.ReadInt())
+			}
+		}
+	}
+	if sp, ok := p.Value.(StringPair); ok {
+		sp.Key = key
+		p.Value = sp
+	}
+}
+
+// String returns a brief string representation of the properties. Suitable for logging
+func (p Properties) String() string {
+	w := NewWriter()
+	_ = w.WriteByte('[')
+	for i := range p {
+		if i > 0 {
+			_, _ = w.Buffer.WriteString(", ")
+		}
+		pr := p[i]
+		_, _ = w.Buffer.WriteString(strconv.Itoa(int(pr.ID)))
+		_ = w.WriteByte(':')
+		switch v := pr.Value.(type) {
+		case []byte:
+			_, _ = fmt.Fprintf(w, "(%d bytes)", len(v))
+		case StringPair:
+			_, _ = fmt.Fprintf(w, "'%s'='%s'", v.Key, v.Value)
+		case string:
+			_, _ = fmt.Fprintf(w, "'%s'", v)
+		default:
+			_, _ = fmt.Fprint(w, v)
+		}
+	}
+	_ = w.WriteByte(']')
+	return w.String()
+}
+
+func normalizeValue(id byte, value interface{}) interface{} {
+	switch propertyType(id) {
+	case propByte, propUint16, propUint32, propVarInt:
+		switch v := value.(type) {
+		case int:
+			return v
+		case byte:
+			return int(v)
+		case uint16:
+			return int(v)
+		case uint32:
+			return int(v)
+		}
+	case propString:
+		if v, ok := value.(string); ok {
+			return v
+		}
+	case propBinary:
+		if v, ok := value.([]byte); ok {
+			return v
+		}
+	case propStringPair:
+		if v, ok := value.(StringPair); ok {
+			return v
+		}
+	}
+	panic(fmt.Errorf("value %v of type %T is not valid for property 0x%x", value, value, id))
+}
+
+// ReadProperties reads a variable length integer that denotes the number of bytes used by the MQTT 5 properties
+// that follows and then reads those properties.
+//
+// An ErrMalformedProperties is returned if the length exceeds the remaining bytes of the packet, and an
+// io.ErrUnexpectedEOF is returned if EOF is encountered during the read. This method will panic unless the
+// underlying reader is a bytes.Reader.
+func (r *Reader) ReadProperties() (Properties, error) {
+	l, err := r.ReadVarInt()
+	if err != nil || l == 0 {
+		return nil, err
+	}
+	if l > r.Len() {
+		return nil, ErrMalformedProperties
+	}
+	if r, err = r.ReadPacket(l); err != nil {
+		return nil, err
+	}
+	var ps Properties
+	for r.Len() > 0 {
+		var id int
+		if id, err = r.ReadVarInt(); err != nil {
+			return nil, err
+		}
+		pr := Property{ID: byte(id)}
+		switch propertyType(pr.ID) {
+		case propByte:
+			var b byte
+			b, err = r.ReadByte()
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			pr.Value = int(b)
+		case propUint16:
+			var v uint16
+			v, err = r.ReadUint16()
+			pr.Value = int(v)
+		case propUint32:
+			var v uint32
+			v, err = r.ReadUint32()
+			pr.Value = int(v)
+		case propVarInt:
+			pr.Value, err = r.ReadVarInt()
+		case propString:
+			pr.Value, err = r.ReadString()
+		case propBinary:
+			var bs []byte
+			if bs, err = r.ReadBytes(); bs == nil {
+				bs = []byte{}
+			}
+			pr.Value = bs
+		case propStringPair:
+			sp := StringPair{}
+			if sp.Key, err = r.ReadString(); err == nil {
+				sp.Value, err = r.ReadString()
+			}
+			pr.Value = sp
+		default:
+			err = fmt.Errorf("malformed property identifier 0x%x", id)
+		}
+		if err != nil {
+			return nil, err
+		}
+		ps = append(ps, pr)
+	}
+	return ps, nil
+}
+
+// WriteProperties writes the length of the given properties using WriteVarInt and then the properties.
+func (w *Writer) WriteProperties(p Properties) {
+	w.WriteVarInt(p.Len())
+	for i := range p {
+		pr := p[i]
+		w.WriteVarInt(int(pr.ID))
+		switch v := pr.Value.(type) {
+		case int:
+			switch propertyType(pr.ID) {
+			case propByte:
+				w.WriteU8(byte(v))
+			case propUint16:
+				w.WriteU16(uint16(v))
+			case propUint32:
+				w.WriteU32(uint32(v))
+			default:
+				w.WriteVarInt(v)
+			}
+		case string:
+			w.WriteString(v)
+		case []byte:
+			w.WriteBytes(v)
+		case StringPair:
+			w.WriteString(v.Key)
+			w.WriteString(v.Value)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package mqtt
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/tada/jsonstream"
+)
+
+func testProperties() Properties {
+	return Properties{}.
+		Add(PropPayloadFormatIndicator, 1).
+		Add(PropMessageExpiryInterval, uint32(3600)).
+		Add(PropContentType, "text/plain").
+		Add(PropCorrelationData, []byte{0, 1, 2}).
+		Add(PropSubscriptionIdentifier, 268435455).
+		Add(PropTopicAlias, uint16(12)).
+		Add(PropUserProperty, StringPair{Key: "a", Value: "b"}).
+		Add(PropUserProperty, StringPair{Key: "a", Value: "c"})
+}
+
+func TestProperties_roundTrip(t *testing.T) {
+	ps := testProperties()
+	w := NewWriter()
+	w.WriteProperties(ps)
+	if w.Len() != ps.Size() {
+		t.Fatalf("expected size %d, got %d", ps.Size(), w.Len())
+	}
+	rps, err := NewReader(bytes.NewReader(w.Bytes())).ReadProperties()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ps.Equals(rps) {
+		t.Fatal(ps, "!=", rps)
+	}
+}
+
+func TestProperties_empty(t *testing.T) {
+	w := NewWriter()
+	w.WriteProperties(nil)
+	if !bytes.Equal([]byte{0}, w.Bytes()) {
+		t.Fatalf("expected a single zero, got %v", w.Bytes())
+	}
+	rps, err := NewReader(bytes.NewReader(w.Bytes())).ReadProperties()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rps) != 0 {
+		t.Fatalf("expected no properties, got %s", rps)
+	}
+}
+
+func TestProperties_badID(t *testing.T) {
+	_, err := NewReader(bytes.NewReader([]byte{2, 0x7f, 0})).ReadProperties()
+	if err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestProperties_truncated(t *testing.T) {
+	_, err := NewReader(bytes.NewReader([]byte{2, PropTopicAlias, 0})).ReadProperties()
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected unexpected EOF, got %v", err)
+	}
+}
+
+func TestProperties_lengthExceedsPacket(t *testing.T) {
+	_, err := NewReader(bytes.NewReader([]byte{3, PropTopicAlias, 0})).ReadProperties()
+	if err != ErrMalformedProperties {
+		t.Fatalf("expected malformed properties, got %v", err)
+	}
+
+	// a property length of 268435455 must be rejected without allocating it
+	_, err = NewReader(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0x7f, PropTopicAlias})).ReadProperties()
+	if err != ErrMalformedProperties {
+		t.Fatalf("expected malformed properties, got %v", err)
+	}
+}
+
+func TestProperties_accessors(t *testing.T) {
+	ps := testProperties()
+	if v, ok := ps.Int(PropMessageExpiryInterval); !ok || v != 3600 {
+		t.Fatalf("expected 3600, got %d", v)
+	}
+	if v, ok := ps.Text(PropContentType); !ok || v != "text/plain" {
+		t.Fatalf("expected text/plain, got %s", v)
+	}
+	if v, ok := ps.Binary(PropCorrelationData); !ok || !bytes.Equal(v, []byte{0, 1, 2}) {
+		t.Fatalf("expected [0 1 2], got %v", v)
+	}
+	if ups := ps.UserProperties(); len(ups) != 2 || ups[1].Value != "c" {
+		t.Fatalf("unexpected user properties %v", ups)
+	}
+	ps = ps.Set(PropTopicAlias, 13).Delete(PropUserProperty)
+	if v, _ := ps.Int(PropTopicAlias); v != 13 {
+		t.Fatalf("expected 13, got %d", v)
+	}
+	if len(ps.UserProperties()) != 0 {
+		t.Fatal("expected user properties to be deleted")
+	}
+	if _, ok := ps.Get(PropReasonString); ok {
+		t.Fatal("unexpected property")
+	}
+}
+
+func TestProperties_badValue(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic")
+		}
+	}()
+	Properties{}.Add(PropContentType, 3)
+}
+
+func TestProperties_MarshalToJSON(t *testing.T) {
+	ps := testProperties()
+	bs, err := jsonstream.Marshal(ps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rps Properties
+	if err = jsonstream.Unmarshal(&rps, bs); err != nil {
+		t.Fatal(err)
+	}
+	if !ps.Equals(rps) {
+		t.Fatal(ps, "!=", rps)
+	}
+}
+
+func TestReader_ReadUint32(t *testing.T) {
+	w := NewWriter()
+	w.WriteU32(0xfeedbeef)
+	v, err := NewReader(bytes.NewReader(w.Bytes())).ReadUint32()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != 0xfeedbeef {
+		t.Fatalf("expected 0xfeedbeef, got 0x%x", v)
+	}
+}
+
+func TestVarIntLen(t *testing.T) {
+	for _, v := range []int{0, 127, 128, 16383, 16384, 2097151, 2097152, 268435455} {
+		w := NewWriter()
+		w.WriteVarInt(v)
+		if VarIntLen(v) != w.Len() {
+			t.Fatalf("expected %d, got %d for %d", w.Len(), VarIntLen(v), v)
+		}
+	}
+}
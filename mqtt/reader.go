@@ -8,15 +8,45 @@ import (
 	"io"
 )
 
+const (
+	// ProtocolLevel31 is the protocol level of MQTT 3.1
+	ProtocolLevel31 = byte(3)
+
+	// ProtocolLevel311 is the protocol level of MQTT 3.1.1
+	ProtocolLevel311 = byte(4)
+
+	// ProtocolLevel5 is the protocol level of MQTT 5
+	ProtocolLevel5 = byte(5)
+)
+
 // Reader extends the io.Reader with MQTT specific semantics for reading variable length integers,
 // two byte unsigned integers, and length prefixed strings and bytes.
+//
+// The Reader also keeps track of the protocol level that was negotiated for the connection so that
+// packet parsers can tell if MQTT 5 properties and reason codes are present.
 type Reader struct {
 	io.Reader
+	level byte
 }
 
 // NewReader creates a new Reader that reads from the given io.Reader
 func NewReader(r io.Reader) *Reader {
-	return &Reader{r}
+	return &Reader{Reader: r}
+}
+
+// ProtocolLevel returns the protocol level that this reader uses or zero if it has not been set
+func (r *Reader) ProtocolLevel() byte {
+	return r.level
+}
+
+// SetProtocolLevel sets the protocol level that this reader uses
+func (r *Reader) SetProtocolLevel(level byte) {
+	r.level = level
+}
+
+// V5 returns true if the protocol level of this reader is MQTT 5 or higher
+func (r *Reader) V5() bool {
+	return r.level >= ProtocolLevel5
 }
 
 // ReadByte reads and returns the next byte from the input or
@@ -69,6 +99,18 @@ func (r *Reader) ReadUint16() (uint16, error) {
 	return v, err
 }
 
+// ReadUint32 reads the next four bytes from the input stream and returns a big endian unsigned integer
+//
+// An io.ErrUnexpectedEOF is returned if EOF is encountered during the read.
+func (r *Reader) ReadUint32() (uint32, error) {
+	var v uint32
+	bs, err := r.ReadExact(4)
+	if err == nil {
+		v = binary.BigEndian.Uint32(bs)
+	}
+	return v, err
+}
+
 // ReadString will reads a big endian uint16 from the stream that denotes the number of bytes
 // that will follow. It then reads those bytes and returns them as a UTF8 encoded string.
 //
@@ -136,7 +178,7 @@ func (r *Reader) ReadPacket(pkLen int) (*Reader, error) {
 	var rdr *Reader
 	pk, err := r.ReadExact(pkLen)
 	if err == nil {
-		rdr = &Reader{bytes.NewReader(pk)}
+		rdr = &Reader{Reader: bytes.NewReader(pk), level: r.level}
 	}
 	return rdr, err
 }
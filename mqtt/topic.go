@@ -15,6 +15,7 @@ const (
 	gt           = rune('>')
 	matchSegment = `^[/]+`
 	matchRest    = `.*`
+	sharePrefix  = `$share/`
 )
 
 // SubscriptionToRegexp converts an MQTT topic subscription into a regular expression that can be
@@ -40,6 +41,21 @@ func SubscriptionToRegexp(s string) *regexp.Regexp {
 	return regexp.MustCompile(w.String())
 }
 
+// SplitSharedSubscription splits a shared subscription of the form "$share/<group>/<filter>" into its group
+// and topic filter. The returned bool is false and the filter is the given subscription if the subscription
+// isn't shared. The group or the filter will be empty if a shared subscription is malformed.
+func SplitSharedSubscription(s string) (string, string, bool) {
+	if !strings.HasPrefix(s, sharePrefix) {
+		return ``, s, false
+	}
+	s = s[len(sharePrefix):]
+	i := strings.IndexByte(s, '/')
+	if i < 0 || strings.ContainsAny(s[:i], `+#`) {
+		return ``, ``, true
+	}
+	return s[:i], s[i+1:], true
+}
+
 // ToNATS converts an MQTT topic to a NATS subject. The following conversions take place
 //
 // dots become slashes
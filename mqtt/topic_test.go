@@ -68,3 +68,42 @@ func TestFromNATSSubscription(t *testing.T) {
 		})
 	}
 }
+
+func TestSplitSharedSubscription(t *testing.T) {
+	tests := []struct {
+		name   string
+		sub    string
+		group  string
+		filter string
+		shared bool
+	}{{
+		name:   "Not shared",
+		sub:    "a/b/c",
+		filter: "a/b/c",
+	}, {
+		name:   "Shared",
+		sub:    "$share/g/a/+/c",
+		group:  "g",
+		filter: "a/+/c",
+		shared: true,
+	}, {
+		name:   "No filter",
+		sub:    "$share/g",
+		shared: true,
+	}, {
+		name:   "Wildcard in group",
+		sub:    "$share/g+/a",
+		shared: true,
+	},
+	}
+	for i := range tests {
+		tt := tests[i]
+		t.Run(tt.name, func(t *testing.T) {
+			group, filter, shared := SplitSharedSubscription(tt.sub)
+			if group != tt.group || filter != tt.filter || shared != tt.shared {
+				t.Errorf("SplitSharedSubscription() = %v, %v, %v, want %v, %v, %v",
+					group, filter, shared, tt.group, tt.filter, tt.shared)
+			}
+		})
+	}
+}
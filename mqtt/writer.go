@@ -4,8 +4,12 @@ import "bytes"
 
 // Writer extends a bytes.Buffer with MQTT specific semantics for writing variable length integers,
 // two byte unsigned integers, and length prefixed strings and bytes.
+//
+// The Writer also keeps track of the protocol level that was negotiated for the connection so that
+// packets know if MQTT 5 properties and reason codes should be written.
 type Writer struct {
 	bytes.Buffer
+	level byte
 }
 
 // NewWriter returns a new Writer instance
@@ -13,6 +17,21 @@ func NewWriter() *Writer {
 	return &Writer{}
 }
 
+// ProtocolLevel returns the protocol level that this writer uses or zero if it has not been set
+func (w *Writer) ProtocolLevel() byte {
+	return w.level
+}
+
+// SetProtocolLevel sets the protocol level that this writer uses
+func (w *Writer) SetProtocolLevel(level byte) {
+	w.level = level
+}
+
+// V5 returns true if the protocol level of this writer is MQTT 5 or higher
+func (w *Writer) V5() bool {
+	return w.level >= ProtocolLevel5
+}
+
 // WriteU8 writes a byte on the underlying buffer. This is the same as calling WriteByte but there
 // is no error return as opposed to WriteByte which returns the error type although it is always nil.
 func (w *Writer) WriteU8(i uint8) {
@@ -25,6 +44,12 @@ func (w *Writer) WriteU16(i uint16) {
 	w.WriteU8(byte(i))
 }
 
+// WriteU32 writes the big endian four bytes of the given uint32 on the underlying buffer
+func (w *Writer) WriteU32(i uint32) {
+	w.WriteU16(uint16(i >> 16))
+	w.WriteU16(uint16(i))
+}
+
 // WriteString first writes the length of the string using WriteU16 and then the strings bytes.
 func (w *Writer) WriteString(s string) {
 	t := len(s)
@@ -56,3 +81,12 @@ func (w *Writer) WriteVarInt(value int) {
 		}
 	}
 }
+
+// VarIntLen returns the number of bytes needed to write the given value as a variable length integer
+func VarIntLen(value int) int {
+	n := 1
+	for value >>= 7; value > 0; value >>= 7 {
+		n++
+	}
+	return n
+}
@@ -22,7 +22,7 @@ func TestWriteVarInt(t *testing.T) {
 		}
 	}
 
-	r := Reader{bytes.NewReader(w.Bytes())}
+	r := Reader{Reader: bytes.NewReader(w.Bytes())}
 	for _, v := range ints {
 		x, _ := r.ReadVarInt()
 		if v != x {
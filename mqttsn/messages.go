@@ -0,0 +1,644 @@
+package mqttsn
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/tada/mqtt-nats/mqtt"
+)
+
+// Advertise is the ADVERTISE message that a gateway broadcasts periodically
+type Advertise struct {
+	GatewayID byte
+	Duration  uint16 // seconds until the next ADVERTISE
+}
+
+// Type returns TpAdvertise
+func (*Advertise) Type() byte {
+	return TpAdvertise
+}
+
+// WriteBody writes the bits that follow the message type on the given Writer
+func (p *Advertise) WriteBody(w *mqtt.Writer) {
+	w.WriteU8(p.GatewayID)
+	w.WriteU16(p.Duration)
+}
+
+func (p *Advertise) String() string {
+	return fmt.Sprintf("ADVERTISE (g%d, %ds)", p.GatewayID, p.Duration)
+}
+
+func parseAdvertise(r *mqtt.Reader) (*Advertise, error) {
+	p := &Advertise{}
+	var err error
+	if p.GatewayID, err = r.ReadByte(); err == nil {
+		p.Duration, err = r.ReadUint16()
+	}
+	return p, err
+}
+
+// SearchGw is the SEARCHGW message that a client broadcasts to find a gateway
+type SearchGw struct {
+	Radius byte
+}
+
+// Type returns TpSearchGw
+func (*SearchGw) Type() byte {
+	return TpSearchGw
+}
+
+// WriteBody writes the bits that follow the message type on the given Writer
+func (p *SearchGw) WriteBody(w *mqtt.Writer) {
+	w.WriteU8(p.Radius)
+}
+
+func (p *SearchGw) String() string {
+	return fmt.Sprintf("SEARCHGW (r%d)", p.Radius)
+}
+
+func parseSearchGw(r *mqtt.Reader) (*SearchGw, error) {
+	radius, err := r.ReadByte()
+	return &SearchGw{Radius: radius}, err
+}
+
+// GwInfo is the GWINFO response to a SEARCHGW
+type GwInfo struct {
+	GatewayID byte
+
+	// Address is the address of the gateway. It is only present when another client answers on behalf of
+	// the gateway.
+	Address []byte
+}
+
+// Type returns TpGwInfo
+func (*GwInfo) Type() byte {
+	return TpGwInfo
+}
+
+// WriteBody writes the bits that follow the message type on the given Writer
+func (p *GwInfo) WriteBody(w *mqtt.Writer) {
+	w.WriteU8(p.GatewayID)
+	_, _ = w.Write(p.Address)
+}
+
+func (p *GwInfo) String() string {
+	return fmt.Sprintf("GWINFO (g%d)", p.GatewayID)
+}
+
+func parseGwInfo(r *mqtt.Reader) (*GwInfo, error) {
+	p := &GwInfo{}
+	var err error
+	if p.GatewayID, err = r.ReadByte(); err == nil && r.Len() > 0 {
+		p.Address, err = r.ReadRemainingBytes()
+	}
+	return p, err
+}
+
+// Connect is the CONNECT message
+type Connect struct {
+	Flags    byte   // FlagWill and FlagCleanSession
+	Duration uint16 // keep alive in seconds
+	ClientID string
+}
+
+// Type returns TpConnect
+func (*Connect) Type() byte {
+	return TpConnect
+}
+
+// WriteBody writes the bits that follow the message type on the given Writer
+func (p *Connect) WriteBody(w *mqtt.Writer) {
+	w.WriteU8(p.Flags)
+	w.WriteU8(ProtocolID)
+	w.WriteU16(p.Duration)
+	_, _ = w.Buffer.WriteString(p.ClientID)
+}
+
+func (p *Connect) String() string {
+	return fmt.Sprintf("CONNECT (c%s, k%d, w%t, cs%t)",
+		p.ClientID, p.Duration, p.Flags&FlagWill != 0, p.Flags&FlagCleanSession != 0)
+}
+
+func parseConnect(r *mqtt.Reader) (*Connect, error) {
+	p := &Connect{}
+	var (
+		pid byte
+		id  []byte
+		err error
+	)
+	if p.Flags, err = r.ReadByte(); err == nil {
+		if pid, err = r.ReadByte(); err == nil {
+			if pid != ProtocolID {
+				return nil, fmt.Errorf("unknown protocol ID %d", pid)
+			}
+			if p.Duration, err = r.ReadUint16(); err == nil {
+				id, err = r.ReadRemainingBytes()
+				p.ClientID = string(id)
+			}
+		}
+	}
+	return p, err
+}
+
+// ConnAck is the CONNACK message
+type ConnAck struct {
+	ReturnCode ReturnCode
+}
+
+// Type returns TpConnAck
+func (*ConnAck) Type() byte {
+	return TpConnAck
+}
+
+// WriteBody writes the bits that follow the message type on the given Writer
+func (p *ConnAck) WriteBody(w *mqtt.Writer) {
+	w.WriteU8(byte(p.ReturnCode))
+}
+
+func (p *ConnAck) String() string {
+	return fmt.Sprintf("CONNACK (%s)", p.ReturnCode)
+}
+
+func parseConnAck(r *mqtt.Reader) (*ConnAck, error) {
+	rc, err := r.ReadByte()
+	return &ConnAck{ReturnCode: ReturnCode(rc)}, err
+}
+
+// Empty is a message that has nothing but its type: WILLTOPICREQ, WILLMSGREQ, or PINGRESP
+type Empty byte
+
+// Type returns the message type
+func (p Empty) Type() byte {
+	return byte(p)
+}
+
+// WriteBody writes nothing since the message has no body
+func (Empty) WriteBody(*mqtt.Writer) {
+}
+
+func (p Empty) String() string {
+	switch p {
+	case TpWillTopicReq:
+		return "WILLTOPICREQ"
+	case TpWillMsgReq:
+		return "WILLMSGREQ"
+	case TpPingResp:
+		return "PINGRESP"
+	}
+	return fmt.Sprintf("message type 0x%02x", byte(p))
+}
+
+// WillTopic is the WILLTOPIC message. A message without a topic removes the will.
+type WillTopic struct {
+	Flags byte // QoS and FlagRetain
+	Topic string
+}
+
+// Type returns TpWillTopic
+func (*WillTopic) Type() byte {
+	return TpWillTopic
+}
+
+// WriteBody writes the bits that follow the message type on the given Writer
+func (p *WillTopic) WriteBody(w *mqtt.Writer) {
+	if p.Topic != `` {
+		w.WriteU8(p.Flags)
+		_, _ = w.Buffer.WriteString(p.Topic)
+	}
+}
+
+func (p *WillTopic) String() string {
+	return fmt.Sprintf("WILLTOPIC (q%d, r%t, '%s')", QoS(p.Flags), p.Flags&FlagRetain != 0, p.Topic)
+}
+
+func parseWillTopic(r *mqtt.Reader) (*WillTopic, error) {
+	p := &WillTopic{}
+	if r.Len() == 0 {
+		return p, nil
+	}
+	var (
+		topic []byte
+		err   error
+	)
+	if p.Flags, err = r.ReadByte(); err == nil {
+		topic, err = r.ReadRemainingBytes()
+		p.Topic = string(topic)
+	}
+	return p, err
+}
+
+// WillMsg is the WILLMSG message
+type WillMsg struct {
+	Message []byte
+}
+
+// Type returns TpWillMsg
+func (*WillMsg) Type() byte {
+	return TpWillMsg
+}
+
+// WriteBody writes the bits that follow the message type on the given Writer
+func (p *WillMsg) WriteBody(w *mqtt.Writer) {
+	_, _ = w.Write(p.Message)
+}
+
+func (p *WillMsg) String() string {
+	return fmt.Sprintf("WILLMSG (%d bytes)", len(p.Message))
+}
+
+func parseWillMsg(r *mqtt.Reader) (*WillMsg, error) {
+	msg, err := r.ReadRemainingBytes()
+	return &WillMsg{Message: msg}, err
+}
+
+// Register is the REGISTER message that assigns a topic ID to a topic name. A client sends it with topic ID
+// zero and the gateway assigns the ID in its REGACK.
+type Register struct {
+	TopicID   uint16
+	MsgID     uint16
+	TopicName string
+}
+
+// Type returns TpRegister
+func (*Register) Type() byte {
+	return TpRegister
+}
+
+// WriteBody writes the bits that follow the message type on the given Writer
+func (p *Register) WriteBody(w *mqtt.Writer) {
+	w.WriteU16(p.TopicID)
+	w.WriteU16(p.MsgID)
+	_, _ = w.Buffer.WriteString(p.TopicName)
+}
+
+func (p *Register) String() string {
+	return fmt.Sprintf("REGISTER (m%d, t%d, '%s')", p.MsgID, p.TopicID, p.TopicName)
+}
+
+func parseRegister(r *mqtt.Reader) (*Register, error) {
+	p := &Register{}
+	var (
+		name []byte
+		err  error
+	)
+	if p.TopicID, err = r.ReadUint16(); err == nil {
+		if p.MsgID, err = r.ReadUint16(); err == nil {
+			name, err = r.ReadRemainingBytes()
+			p.TopicName = string(name)
+		}
+	}
+	return p, err
+}
+
+// RegAck is the REGACK message
+type RegAck struct {
+	TopicID    uint16
+	MsgID      uint16
+	ReturnCode ReturnCode
+}
+
+// Type returns TpRegAck
+func (*RegAck) Type() byte {
+	return TpRegAck
+}
+
+// WriteBody writes the bits that follow the message type on the given Writer
+func (p *RegAck) WriteBody(w *mqtt.Writer) {
+	w.WriteU16(p.TopicID)
+	w.WriteU16(p.MsgID)
+	w.WriteU8(byte(p.ReturnCode))
+}
+
+func (p *RegAck) String() string {
+	return fmt.Sprintf("REGACK (m%d, t%d, %s)", p.MsgID, p.TopicID, p.ReturnCode)
+}
+
+func parseRegAck(r *mqtt.Reader) (*RegAck, error) {
+	p := &RegAck{}
+	var (
+		rc  byte
+		err error
+	)
+	if p.TopicID, err = r.ReadUint16(); err == nil {
+		if p.MsgID, err = r.ReadUint16(); err == nil {
+			rc, err = r.ReadByte()
+			p.ReturnCode = ReturnCode(rc)
+		}
+	}
+	return p, err
+}
+
+// Publish is the PUBLISH message
+type Publish struct {
+	Flags   byte // FlagDup, QoS, FlagRetain, and topic ID type
+	TopicID uint16
+	MsgID   uint16
+	Data    []byte
+}
+
+// Type returns TpPublish
+func (*Publish) Type() byte {
+	return TpPublish
+}
+
+// WriteBody writes the bits that follow the message type on the given Writer
+func (p *Publish) WriteBody(w *mqtt.Writer) {
+	w.WriteU8(p.Flags)
+	w.WriteU16(p.TopicID)
+	w.WriteU16(p.MsgID)
+	_, _ = w.Write(p.Data)
+}
+
+// QoS returns the QoS level of the message, which is QoSMinusOne for a message sent without a connection
+func (p *Publish) QoS() byte {
+	return QoS(p.Flags)
+}
+
+// Retain returns true if the message should be retained
+func (p *Publish) Retain() bool {
+	return p.Flags&FlagRetain != 0
+}
+
+// TopicIDType returns TopicIDNormal, TopicIDPredefined, or TopicIDShort
+func (p *Publish) TopicIDType() byte {
+	return p.Flags & FlagTopicIDType
+}
+
+func (p *Publish) String() string {
+	return fmt.Sprintf("PUBLISH (d%t, q%d, r%t, m%d, %s, %d bytes)",
+		p.Flags&FlagDup != 0, p.QoS(), p.Retain(), p.MsgID, topicString(p.Flags, p.TopicID, ``), len(p.Data))
+}
+
+func parsePublish(r *mqtt.Reader) (*Publish, error) {
+	p := &Publish{}
+	var err error
+	if p.Flags, err = r.ReadByte(); err == nil {
+		if p.TopicID, err = r.ReadUint16(); err == nil {
+			if p.MsgID, err = r.ReadUint16(); err == nil {
+				p.Data, err = r.ReadRemainingBytes()
+			}
+		}
+	}
+	return p, err
+}
+
+// PubAck is the PUBACK message
+type PubAck struct {
+	TopicID    uint16
+	MsgID      uint16
+	ReturnCode ReturnCode
+}
+
+// Type returns TpPubAck
+func (*PubAck) Type() byte {
+	return TpPubAck
+}
+
+// WriteBody writes the bits that follow the message type on the given Writer
+func (p *PubAck) WriteBody(w *mqtt.Writer) {
+	w.WriteU16(p.TopicID)
+	w.WriteU16(p.MsgID)
+	w.WriteU8(byte(p.ReturnCode))
+}
+
+func (p *PubAck) String() string {
+	return fmt.Sprintf("PUBACK (m%d, t%d, %s)", p.MsgID, p.TopicID, p.ReturnCode)
+}
+
+func parsePubAck(r *mqtt.Reader) (*PubAck, error) {
+	ra, err := parseRegAck(r)
+	return (*PubAck)(ra), err
+}
+
+// Ack is a message that has nothing but a message ID: PUBREC, PUBREL, PUBCOMP, or UNSUBACK
+type Ack struct {
+	MsgType byte
+	MsgID   uint16
+}
+
+// Type returns the message type
+func (p *Ack) Type() byte {
+	return p.MsgType
+}
+
+// WriteBody writes the bits that follow the message type on the given Writer
+func (p *Ack) WriteBody(w *mqtt.Writer) {
+	w.WriteU16(p.MsgID)
+}
+
+func (p *Ack) String() string {
+	name := `UNSUBACK`
+	switch p.MsgType {
+	case TpPubRec:
+		name = `PUBREC`
+	case TpPubRel:
+		name = `PUBREL`
+	case TpPubComp:
+		name = `PUBCOMP`
+	}
+	return fmt.Sprintf("%s (m%d)", name, p.MsgID)
+}
+
+// Subscribe is the SUBSCRIBE message. The topic is a topic name, which may contain wildcards, when the topic
+// ID type of the flags is TopicIDNormal, a predefined topic ID, or a short topic name.
+type Subscribe struct {
+	Flags     byte // FlagDup, QoS, and topic ID type
+	MsgID     uint16
+	TopicName string
+	TopicID   uint16
+}
+
+// Type returns TpSubscribe
+func (*Subscribe) Type() byte {
+	return TpSubscribe
+}
+
+// WriteBody writes the bits that follow the message type on the given Writer
+func (p *Subscribe) WriteBody(w *mqtt.Writer) {
+	w.WriteU8(p.Flags)
+	w.WriteU16(p.MsgID)
+	if p.TopicIDType() == TopicIDNormal {
+		_, _ = w.Buffer.WriteString(p.TopicName)
+	} else {
+		w.WriteU16(p.TopicID)
+	}
+}
+
+// QoS returns the requested QoS level
+func (p *Subscribe) QoS() byte {
+	return QoS(p.Flags)
+}
+
+// TopicIDType returns TopicIDNormal, TopicIDPredefined, or TopicIDShort
+func (p *Subscribe) TopicIDType() byte {
+	return p.Flags & FlagTopicIDType
+}
+
+func (p *Subscribe) String() string {
+	return fmt.Sprintf("SUBSCRIBE (m%d, q%d, %s)", p.MsgID, p.QoS(), topicString(p.Flags, p.TopicID, p.TopicName))
+}
+
+func parseSubscribe(r *mqtt.Reader) (*Subscribe, error) {
+	p := &Subscribe{}
+	var (
+		name []byte
+		err  error
+	)
+	if p.Flags, err = r.ReadByte(); err == nil {
+		if p.MsgID, err = r.ReadUint16(); err == nil {
+			switch p.TopicIDType() {
+			case TopicIDNormal:
+				name, err = r.ReadRemainingBytes()
+				p.TopicName = string(name)
+			case TopicIDPredefined, TopicIDShort:
+				p.TopicID, err = r.ReadUint16()
+			default:
+				err = errors.New("invalid topic ID type")
+			}
+		}
+	}
+	return p, err
+}
+
+// Unsubscribe is the UNSUBSCRIBE message. Its topic is given the same way as in a SUBSCRIBE.
+type Unsubscribe Subscribe
+
+// Type returns TpUnsubscribe
+func (*Unsubscribe) Type() byte {
+	return TpUnsubscribe
+}
+
+// WriteBody writes the bits that follow the message type on the given Writer
+func (p *Unsubscribe) WriteBody(w *mqtt.Writer) {
+	(*Subscribe)(p).WriteBody(w)
+}
+
+func (p *Unsubscribe) String() string {
+	return fmt.Sprintf("UNSUBSCRIBE (m%d, %s)", p.MsgID, topicString(p.Flags, p.TopicID, p.TopicName))
+}
+
+// SubAck is the SUBACK message
+type SubAck struct {
+	Flags      byte // granted QoS
+	TopicID    uint16
+	MsgID      uint16
+	ReturnCode ReturnCode
+}
+
+// Type returns TpSubAck
+func (*SubAck) Type() byte {
+	return TpSubAck
+}
+
+// WriteBody writes the bits that follow the message type on the given Writer
+func (p *SubAck) WriteBody(w *mqtt.Writer) {
+	w.WriteU8(p.Flags)
+	w.WriteU16(p.TopicID)
+	w.WriteU16(p.MsgID)
+	w.WriteU8(byte(p.ReturnCode))
+}
+
+func (p *SubAck) String() string {
+	return fmt.Sprintf("SUBACK (m%d, q%d, t%d, %s)", p.MsgID, QoS(p.Flags), p.TopicID, p.ReturnCode)
+}
+
+func parseSubAck(r *mqtt.Reader) (*SubAck, error) {
+	p := &SubAck{}
+	var err error
+	if p.Flags, err = r.ReadByte(); err == nil {
+		var ra *RegAck
+		ra, err = parseRegAck(r)
+		p.TopicID, p.MsgID, p.ReturnCode = ra.TopicID, ra.MsgID, ra.ReturnCode
+	}
+	return p, err
+}
+
+// PingReq is the PINGREQ message. A sleeping client includes its client ID to receive the messages that the
+// gateway buffered while it was asleep.
+type PingReq struct {
+	ClientID string
+}
+
+// Type returns TpPingReq
+func (*PingReq) Type() byte {
+	return TpPingReq
+}
+
+// WriteBody writes the bits that follow the message type on the given Writer
+func (p *PingReq) WriteBody(w *mqtt.Writer) {
+	_, _ = w.Buffer.WriteString(p.ClientID)
+}
+
+func (p *PingReq) String() string {
+	if p.ClientID == `` {
+		return "PINGREQ"
+	}
+	return fmt.Sprintf("PINGREQ (c%s)", p.ClientID)
+}
+
+// Disconnect is the DISCONNECT message. A client that sends a duration goes to sleep for that many seconds.
+type Disconnect struct {
+	Duration uint16
+}
+
+// Type returns TpDisconnect
+func (*Disconnect) Type() byte {
+	return TpDisconnect
+}
+
+// WriteBody writes the bits that follow the message type on the given Writer
+func (p *Disconnect) WriteBody(w *mqtt.Writer) {
+	if p.Duration > 0 {
+		w.WriteU16(p.Duration)
+	}
+}
+
+func (p *Disconnect) String() string {
+	if p.Duration == 0 {
+		return "DISCONNECT"
+	}
+	return fmt.Sprintf("DISCONNECT (%ds)", p.Duration)
+}
+
+func parseDisconnect(r *mqtt.Reader) (*Disconnect, error) {
+	p := &Disconnect{}
+	var err error
+	if r.Len() > 0 {
+		p.Duration, err = r.ReadUint16()
+	}
+	return p, err
+}
+
+// QoS returns the QoS level of the given flags, which is QoSMinusOne for a message sent without a
+// connection
+func QoS(flags byte) byte {
+	return (flags & FlagQoS) >> 5
+}
+
+// QoSFlags returns the flags of the given QoS level
+func QoSFlags(qos byte) byte {
+	return (qos << 5) & FlagQoS
+}
+
+func topicString(flags byte, id uint16, name string) string {
+	switch flags & FlagTopicIDType {
+	case TopicIDPredefined:
+		return fmt.Sprintf("p%d", id)
+	case TopicIDShort:
+		return fmt.Sprintf("'%s'", ShortTopic(id))
+	}
+	if name != `` {
+		return fmt.Sprintf("'%s'", name)
+	}
+	return fmt.Sprintf("t%d", id)
+}
+
+// ShortTopic returns the two character topic name of the given short topic ID
+func ShortTopic(id uint16) string {
+	return string([]byte{byte(id >> 8), byte(id)})
+}
+
+// ShortTopicID returns the short topic ID of the given two character topic name
+func ShortTopicID(name string) uint16 {
+	return uint16(name[0])<<8 | uint16(name[1])
+}
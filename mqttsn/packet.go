@@ -0,0 +1,259 @@
+// Package mqttsn contains the MQTT-SN 1.2 message structures
+package mqttsn
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/tada/mqtt-nats/mqtt"
+)
+
+const (
+	// TpAdvertise is the MQTT-SN ADVERTISE type
+	TpAdvertise = 0x00
+
+	// TpSearchGw is the MQTT-SN SEARCHGW type
+	TpSearchGw = 0x01
+
+	// TpGwInfo is the MQTT-SN GWINFO type
+	TpGwInfo = 0x02
+
+	// TpConnect is the MQTT-SN CONNECT type
+	TpConnect = 0x04
+
+	// TpConnAck is the MQTT-SN CONNACK type
+	TpConnAck = 0x05
+
+	// TpWillTopicReq is the MQTT-SN WILLTOPICREQ type
+	TpWillTopicReq = 0x06
+
+	// TpWillTopic is the MQTT-SN WILLTOPIC type
+	TpWillTopic = 0x07
+
+	// TpWillMsgReq is the MQTT-SN WILLMSGREQ type
+	TpWillMsgReq = 0x08
+
+	// TpWillMsg is the MQTT-SN WILLMSG type
+	TpWillMsg = 0x09
+
+	// TpRegister is the MQTT-SN REGISTER type
+	TpRegister = 0x0a
+
+	// TpRegAck is the MQTT-SN REGACK type
+	TpRegAck = 0x0b
+
+	// TpPublish is the MQTT-SN PUBLISH type
+	TpPublish = 0x0c
+
+	// TpPubAck is the MQTT-SN PUBACK type
+	TpPubAck = 0x0d
+
+	// TpPubComp is the MQTT-SN PUBCOMP type
+	TpPubComp = 0x0e
+
+	// TpPubRec is the MQTT-SN PUBREC type
+	TpPubRec = 0x0f
+
+	// TpPubRel is the MQTT-SN PUBREL type
+	TpPubRel = 0x10
+
+	// TpSubscribe is the MQTT-SN SUBSCRIBE type
+	TpSubscribe = 0x12
+
+	// TpSubAck is the MQTT-SN SUBACK type
+	TpSubAck = 0x13
+
+	// TpUnsubscribe is the MQTT-SN UNSUBSCRIBE type
+	TpUnsubscribe = 0x14
+
+	// TpUnsubAck is the MQTT-SN UNSUBACK type
+	TpUnsubAck = 0x15
+
+	// TpPingReq is the MQTT-SN PINGREQ type
+	TpPingReq = 0x16
+
+	// TpPingResp is the MQTT-SN PINGRESP type
+	TpPingResp = 0x17
+
+	// TpDisconnect is the MQTT-SN DISCONNECT type
+	TpDisconnect = 0x18
+)
+
+const (
+	// FlagDup is set when a message is sent again
+	FlagDup = 0x80
+
+	// FlagQoS is the bitmask for the QoS level of the flags
+	FlagQoS = 0x60
+
+	// FlagRetain is set when a message should be retained
+	FlagRetain = 0x10
+
+	// FlagWill is set in a CONNECT when the client has a will
+	FlagWill = 0x08
+
+	// FlagCleanSession is set in a CONNECT when the client wants a clean session
+	FlagCleanSession = 0x04
+
+	// FlagTopicIDType is the bitmask for the topic ID type of the flags
+	FlagTopicIDType = 0x03
+)
+
+const (
+	// TopicIDNormal is the type of a topic ID that was registered using REGISTER, or of a topic name in
+	// SUBSCRIBE and UNSUBSCRIBE
+	TopicIDNormal = 0x00
+
+	// TopicIDPredefined is the type of a topic ID that the client and the gateway agreed on in advance
+	TopicIDPredefined = 0x01
+
+	// TopicIDShort is the type of a topic name that is exactly two characters long and sent in place of a
+	// topic ID
+	TopicIDShort = 0x02
+)
+
+// QoSMinusOne is the QoS level of the flags of a PUBLISH that is sent without a connection. The MQTT-SN
+// specification calls it QoS -1.
+const QoSMinusOne = 0x03
+
+// ProtocolID is the protocol ID of a CONNECT
+const ProtocolID = 0x01
+
+// ReturnCode is the return code of CONNACK, REGACK, PUBACK, and SUBACK
+type ReturnCode byte
+
+const (
+	// RcAccepted means that the request was accepted
+	RcAccepted = ReturnCode(0x00)
+
+	// RcCongestion means that the request was rejected because of congestion
+	RcCongestion = ReturnCode(0x01)
+
+	// RcInvalidTopicID means that the request was rejected because of an unknown topic ID
+	RcInvalidTopicID = ReturnCode(0x02)
+
+	// RcNotSupported means that the request was rejected because it isn't supported
+	RcNotSupported = ReturnCode(0x03)
+)
+
+func (rc ReturnCode) String() string {
+	switch rc {
+	case RcAccepted:
+		return `accepted`
+	case RcCongestion:
+		return `rejected: congestion`
+	case RcInvalidTopicID:
+		return `rejected: invalid topic ID`
+	case RcNotSupported:
+		return `rejected: not supported`
+	}
+	return fmt.Sprintf("return code 0x%02x", byte(rc))
+}
+
+// The Packet interface is implemented by all MQTT-SN message types
+type Packet interface {
+	// Type returns the message type
+	Type() byte
+
+	// WriteBody writes the bits that follow the message type on the given Writer
+	WriteBody(w *mqtt.Writer)
+}
+
+// Encode returns the bytes of the given message, starting with its length and type
+func Encode(p Packet) []byte {
+	body := mqtt.NewWriter()
+	p.WriteBody(body)
+	w := mqtt.NewWriter()
+	n := body.Len() + 2
+	if n < 256 {
+		w.WriteU8(byte(n))
+	} else {
+		// the long form has a three byte length
+		w.WriteU8(0x01)
+		w.WriteU16(uint16(n + 2))
+	}
+	w.WriteU8(p.Type())
+	_, _ = w.Write(body.Bytes())
+	return w.Bytes()
+}
+
+// Parse parses the MQTT-SN message in the given datagram
+func Parse(bs []byte) (Packet, error) {
+	if len(bs) < 2 {
+		return nil, errors.New("message too short")
+	}
+	n := int(bs[0])
+	hl := 1
+	if n == 0x01 {
+		if len(bs) < 4 {
+			return nil, errors.New("message too short")
+		}
+		n = int(bs[1])<<8 | int(bs[2])
+		hl = 3
+	}
+	if n != len(bs) || n <= hl {
+		return nil, fmt.Errorf("message length %d doesn't match datagram length %d", n, len(bs))
+	}
+	tp := bs[hl]
+	r := mqtt.NewReader(bytes.NewReader(bs[hl+1:]))
+	p, err := parseBody(r, tp)
+	if err != nil {
+		return nil, fmt.Errorf("malformed message type 0x%02x: %v", tp, err)
+	}
+	return p, nil
+}
+
+func parseBody(r *mqtt.Reader, tp byte) (Packet, error) {
+	switch tp {
+	case TpAdvertise:
+		return parseAdvertise(r)
+	case TpSearchGw:
+		return parseSearchGw(r)
+	case TpGwInfo:
+		return parseGwInfo(r)
+	case TpConnect:
+		return parseConnect(r)
+	case TpConnAck:
+		return parseConnAck(r)
+	case TpWillTopicReq, TpWillMsgReq, TpPingResp:
+		return Empty(tp), nil
+	case TpWillTopic:
+		return parseWillTopic(r)
+	case TpWillMsg:
+		return parseWillMsg(r)
+	case TpRegister:
+		return parseRegister(r)
+	case TpRegAck:
+		return parseRegAck(r)
+	case TpPublish:
+		return parsePublish(r)
+	case TpPubAck:
+		return parsePubAck(r)
+	case TpPubRec, TpPubRel, TpPubComp, TpUnsubAck:
+		id, err := r.ReadUint16()
+		if err != nil {
+			return nil, err
+		}
+		return &Ack{MsgType: tp, MsgID: id}, nil
+	case TpSubscribe:
+		return parseSubscribe(r)
+	case TpSubAck:
+		return parseSubAck(r)
+	case TpUnsubscribe:
+		sp, err := parseSubscribe(r)
+		if err != nil {
+			return nil, err
+		}
+		return (*Unsubscribe)(sp), nil
+	case TpPingReq:
+		id, err := r.ReadRemainingBytes()
+		if err != nil {
+			return nil, err
+		}
+		return &PingReq{ClientID: string(id)}, nil
+	case TpDisconnect:
+		return parseDisconnect(r)
+	}
+	return nil, errors.New("unknown message type")
+}
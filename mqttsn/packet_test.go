@@ -0,0 +1,113 @@
+package mqttsn_test
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/tada/mqtt-nats/mqttsn"
+	"github.com/tada/mqtt-nats/test/utils"
+)
+
+func encodeParseAndCompare(t *testing.T, p mqttsn.Packet, ex string) {
+	t.Helper()
+	p2, err := mqttsn.Parse(mqttsn.Encode(p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(p, p2) {
+		t.Fatal(p, "!=", p2)
+	}
+	ac := p.(fmt.Stringer).String()
+	if ex != ac {
+		t.Errorf("expected '%s' got '%s'", ex, ac)
+	}
+}
+
+func TestParse(t *testing.T) {
+	encodeParseAndCompare(t, &mqttsn.Advertise{GatewayID: 3, Duration: 900}, "ADVERTISE (g3, 900s)")
+	encodeParseAndCompare(t, &mqttsn.SearchGw{Radius: 1}, "SEARCHGW (r1)")
+	encodeParseAndCompare(t, &mqttsn.GwInfo{GatewayID: 3}, "GWINFO (g3)")
+	encodeParseAndCompare(t, &mqttsn.GwInfo{GatewayID: 3, Address: []byte{10, 0, 0, 1}}, "GWINFO (g3)")
+	encodeParseAndCompare(t, &mqttsn.Connect{Flags: mqttsn.FlagCleanSession, Duration: 60, ClientID: "sensor"},
+		"CONNECT (csensor, k60, wfalse, cstrue)")
+	encodeParseAndCompare(t, &mqttsn.ConnAck{ReturnCode: mqttsn.RcCongestion}, "CONNACK (rejected: congestion)")
+	encodeParseAndCompare(t, mqttsn.Empty(mqttsn.TpWillTopicReq), "WILLTOPICREQ")
+	encodeParseAndCompare(t, mqttsn.Empty(mqttsn.TpWillMsgReq), "WILLMSGREQ")
+	encodeParseAndCompare(t, mqttsn.Empty(mqttsn.TpPingResp), "PINGRESP")
+	encodeParseAndCompare(t, &mqttsn.WillTopic{Flags: mqttsn.QoSFlags(1) | mqttsn.FlagRetain, Topic: "a/will"},
+		"WILLTOPIC (q1, rtrue, 'a/will')")
+	encodeParseAndCompare(t, &mqttsn.WillTopic{}, "WILLTOPIC (q0, rfalse, '')")
+	encodeParseAndCompare(t, &mqttsn.WillMsg{Message: []byte("bye")}, "WILLMSG (3 bytes)")
+	encodeParseAndCompare(t, &mqttsn.Register{TopicID: 7, MsgID: 2, TopicName: "a/b"}, "REGISTER (m2, t7, 'a/b')")
+	encodeParseAndCompare(t, &mqttsn.RegAck{TopicID: 7, MsgID: 2}, "REGACK (m2, t7, accepted)")
+	encodeParseAndCompare(t, &mqttsn.PubAck{TopicID: 7, MsgID: 2, ReturnCode: mqttsn.RcInvalidTopicID},
+		"PUBACK (m2, t7, rejected: invalid topic ID)")
+	encodeParseAndCompare(t, &mqttsn.Ack{MsgType: mqttsn.TpPubRec, MsgID: 4}, "PUBREC (m4)")
+	encodeParseAndCompare(t, &mqttsn.Ack{MsgType: mqttsn.TpPubRel, MsgID: 4}, "PUBREL (m4)")
+	encodeParseAndCompare(t, &mqttsn.Ack{MsgType: mqttsn.TpPubComp, MsgID: 4}, "PUBCOMP (m4)")
+	encodeParseAndCompare(t, &mqttsn.Ack{MsgType: mqttsn.TpUnsubAck, MsgID: 4}, "UNSUBACK (m4)")
+	encodeParseAndCompare(t, &mqttsn.SubAck{Flags: mqttsn.QoSFlags(1), TopicID: 7, MsgID: 5},
+		"SUBACK (m5, q1, t7, accepted)")
+	encodeParseAndCompare(t, &mqttsn.PingReq{}, "PINGREQ")
+	encodeParseAndCompare(t, &mqttsn.PingReq{ClientID: "sensor"}, "PINGREQ (csensor)")
+	encodeParseAndCompare(t, &mqttsn.Disconnect{}, "DISCONNECT")
+	encodeParseAndCompare(t, &mqttsn.Disconnect{Duration: 300}, "DISCONNECT (300s)")
+}
+
+func TestParsePublish(t *testing.T) {
+	encodeParseAndCompare(t, &mqttsn.Publish{Flags: mqttsn.QoSFlags(1), TopicID: 7, MsgID: 3, Data: []byte("21.5")},
+		"PUBLISH (dfalse, q1, rfalse, m3, t7, 4 bytes)")
+	encodeParseAndCompare(t, &mqttsn.Publish{
+		Flags: mqttsn.QoSFlags(mqttsn.QoSMinusOne) | mqttsn.TopicIDPredefined, TopicID: 1, Data: []byte{}},
+		"PUBLISH (dfalse, q3, rfalse, m0, p1, 0 bytes)")
+	encodeParseAndCompare(t, &mqttsn.Publish{
+		Flags: mqttsn.FlagDup | mqttsn.FlagRetain | mqttsn.TopicIDShort, TopicID: mqttsn.ShortTopicID("ab"), Data: []byte("x")},
+		"PUBLISH (dtrue, q0, rtrue, m0, 'ab', 1 bytes)")
+}
+
+func TestParsePublish_long(t *testing.T) {
+	p := &mqttsn.Publish{TopicID: 7, Data: bytes.Repeat([]byte{'x'}, 300)}
+	bs := mqttsn.Encode(p)
+	if bs[0] != 0x01 || int(bs[1])<<8|int(bs[2]) != len(bs) {
+		t.Fatalf("expected a three byte length of %d, got %v", len(bs), bs[:3])
+	}
+	encodeParseAndCompare(t, p, "PUBLISH (dfalse, q0, rfalse, m0, t7, 300 bytes)")
+}
+
+func TestParseSubscribe(t *testing.T) {
+	encodeParseAndCompare(t, &mqttsn.Subscribe{Flags: mqttsn.QoSFlags(1), MsgID: 2, TopicName: "a/+"},
+		"SUBSCRIBE (m2, q1, 'a/+')")
+	encodeParseAndCompare(t, &mqttsn.Subscribe{Flags: mqttsn.TopicIDPredefined, MsgID: 2, TopicID: 1},
+		"SUBSCRIBE (m2, q0, p1)")
+	encodeParseAndCompare(t, &mqttsn.Unsubscribe{Flags: mqttsn.TopicIDShort, MsgID: 2, TopicID: mqttsn.ShortTopicID("ab")},
+		"UNSUBSCRIBE (m2, 'ab')")
+}
+
+func TestParse_badLength(t *testing.T) {
+	_, err := mqttsn.Parse([]byte{5, mqttsn.TpPingResp})
+	utils.CheckError(err, t)
+	_, err = mqttsn.Parse([]byte{1})
+	utils.CheckError(err, t)
+}
+
+func TestParse_unknownType(t *testing.T) {
+	_, err := mqttsn.Parse([]byte{2, 0x1a})
+	utils.CheckError(err, t)
+}
+
+func TestParse_truncated(t *testing.T) {
+	_, err := mqttsn.Parse([]byte{4, mqttsn.TpRegAck, 0, 1})
+	utils.CheckError(err, t)
+}
+
+func TestParseConnect_badProtocol(t *testing.T) {
+	_, err := mqttsn.Parse([]byte{6, mqttsn.TpConnect, 0, 2, 0, 60})
+	utils.CheckError(err, t)
+}
+
+func TestParseSubscribe_badTopicIDType(t *testing.T) {
+	_, err := mqttsn.Parse([]byte{7, mqttsn.TpSubscribe, 0x03, 0, 1, 0, 1})
+	utils.CheckError(err, t)
+}
@@ -0,0 +1,176 @@
+package test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/nats-io/nats-server/v2/server"
+	testserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	"github.com/tada/mqtt-nats/bridge"
+	"github.com/tada/mqtt-nats/mqtt/pkg"
+	"github.com/tada/mqtt-nats/test/full"
+)
+
+const (
+	authMqttPort = 11886
+	authNatsPort = 14224
+	authToken    = "s3cr3t"
+)
+
+// authBridge starts the given NATS server and a bridge that uses the given authentication strategy. The
+// returned function stops both.
+func authBridge(t *testing.T, natsServer *server.Server, bopts *bridge.Options) func() {
+	t.Helper()
+	bopts.Port = authMqttPort
+	bopts.NATSUrls = ":" + strconv.Itoa(authNatsPort)
+	bopts.RepeatRate = 50
+	started := false
+	defer func() {
+		if !started {
+			natsServer.Shutdown()
+		}
+	}()
+	stop := full.StartBridge(t, bopts)
+	started = true
+	return func() {
+		stop()
+		natsServer.Shutdown()
+	}
+}
+
+// tokenBridge starts a NATS server that requires a token and a bridge that uses the MQTT password as the
+// token. The bridge has a token of its own.
+func tokenBridge(t *testing.T) func() {
+	t.Helper()
+	opts := testserver.DefaultTestOptions
+	opts.Port = authNatsPort
+	opts.Authorization = authToken
+	return authBridge(t, full.NATSServerWithOptions(&opts), &bridge.Options{
+		NATSAuth: bridge.AuthToken,
+		NATSOpts: []nats.Option{nats.Token(authToken)}})
+}
+
+// jwtBridge starts a NATS server in operator mode and a bridge that uses the MQTT user name and password as
+// user JWT and NKey seed. The key pair of the account that users are created in is returned too.
+func jwtBridge(t *testing.T) (func(), nkeys.KeyPair) {
+	t.Helper()
+	natsServer, akp := full.NATSServerWithOperator(t, authNatsPort)
+	return authBridge(t, natsServer, &bridge.Options{NATSAuth: bridge.AuthJWT}), akp
+}
+
+// credsBridge starts a NATS server in operator mode and a bridge that maps the MQTT user "alice" to a NATS
+// credentials file
+func credsBridge(t *testing.T) func() {
+	t.Helper()
+	natsServer, akp := full.NATSServerWithOperator(t, authNatsPort)
+	dir, err := ioutil.TempDir(``, `mqtt-nats-creds`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "alice.creds")
+	ujwt, seed := full.NATSUser(t, akp)
+	full.NATSCredsFile(t, path, ujwt, seed)
+	stop := authBridge(t, natsServer, &bridge.Options{
+		NATSAuth:  bridge.AuthCreds,
+		NATSCreds: map[string]*bridge.NATSCreds{"alice": {Password: "secret", File: path}}})
+	return func() {
+		stop()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func authConnect(t *testing.T, creds *pkg.Credentials, rt pkg.ReturnCode) {
+	t.Helper()
+	conn := full.MqttConnect(t, authMqttPort)
+	full.MqttSend(t, conn, pkg.NewConnect(full.NextClientID(), true, 1, nil, creds))
+	full.MqttExpect(t, conn, pkg.NewConnAck(false, rt))
+	if rt == pkg.RtAccepted {
+		full.MqttDisconnect(t, conn)
+	} else {
+		full.MqttExpectConnReset(t, conn)
+	}
+}
+
+func TestAuth_token(t *testing.T) {
+	defer tokenBridge(t)()
+
+	conn := full.MqttConnect(t, authMqttPort)
+	full.MqttSend(t, conn, pkg.NewConnect(full.NextClientID(), true, 1, nil,
+		&pkg.Credentials{User: "any", Password: []byte(authToken)}))
+	full.MqttExpect(t, conn, pkg.NewConnAck(false, pkg.RtAccepted))
+	full.MqttDisconnect(t, conn)
+}
+
+func TestAuth_badToken(t *testing.T) {
+	defer tokenBridge(t)()
+
+	conn := full.MqttConnect(t, authMqttPort)
+	full.MqttSend(t, conn, pkg.NewConnect(full.NextClientID(), true, 1, nil,
+		&pkg.Credentials{User: "any", Password: []byte("wrong")}))
+	full.MqttExpect(t, conn, pkg.NewConnAck(false, pkg.RtBadUserNameOrPassword))
+	full.MqttExpectConnReset(t, conn)
+}
+
+func TestAuth_noCredentials(t *testing.T) {
+	defer tokenBridge(t)()
+
+	// the client is refused even though the identity of the bridge is accepted by NATS
+	conn := full.MqttConnect(t, authMqttPort)
+	full.MqttSend(t, conn, pkg.NewConnect(full.NextClientID(), true, 1, nil, nil))
+	full.MqttExpect(t, conn, pkg.NewConnAck(false, pkg.RtNotAuthorized))
+	full.MqttExpectConnReset(t, conn)
+}
+
+func TestAuth5_badToken(t *testing.T) {
+	defer tokenBridge(t)()
+
+	conn := full.MqttConnect(t, authMqttPort)
+	full.MqttSend(t, conn, pkg.NewConnect5(full.NextClientID(), true, 1, nil,
+		&pkg.Credentials{User: "any", Password: []byte("wrong")}, nil))
+	full.MqttExpect5(t, conn, pkg.NewConnAck5(false, pkg.RcBadUserNameOrPassword, nil))
+	full.MqttExpectConnReset(t, conn)
+}
+
+func TestAuth_jwt(t *testing.T) {
+	stop, akp := jwtBridge(t)
+	defer stop()
+
+	ujwt, seed := full.NATSUser(t, akp)
+	authConnect(t, &pkg.Credentials{User: ujwt, Password: seed}, pkg.RtAccepted)
+}
+
+func TestAuth_jwtWrongSeed(t *testing.T) {
+	stop, akp := jwtBridge(t)
+	defer stop()
+
+	// the seed is valid but it doesn't belong to the user of the JWT so the signature of the nonce is rejected
+	ujwt, _ := full.NATSUser(t, akp)
+	_, seed := full.NATSUser(t, akp)
+	authConnect(t, &pkg.Credentials{User: ujwt, Password: seed}, pkg.RtBadUserNameOrPassword)
+}
+
+func TestAuth_jwtBadSeed(t *testing.T) {
+	stop, akp := jwtBridge(t)
+	defer stop()
+
+	ujwt, _ := full.NATSUser(t, akp)
+	authConnect(t, &pkg.Credentials{User: ujwt, Password: []byte("not a seed")}, pkg.RtBadUserNameOrPassword)
+}
+
+func TestAuth_creds(t *testing.T) {
+	defer credsBridge(t)()
+
+	authConnect(t, &pkg.Credentials{User: "alice", Password: []byte("secret")}, pkg.RtAccepted)
+}
+
+func TestAuth_credsBadPassword(t *testing.T) {
+	defer credsBridge(t)()
+
+	authConnect(t, &pkg.Credentials{User: "alice", Password: []byte("wrong")}, pkg.RtBadUserNameOrPassword)
+	authConnect(t, &pkg.Credentials{User: "mallory", Password: []byte("secret")}, pkg.RtBadUserNameOrPassword)
+}
@@ -2,9 +2,11 @@ package test
 
 import (
 	"bytes"
+	"strconv"
 	"testing"
 	"time"
 
+	"github.com/tada/mqtt-nats/mqtt"
 	"github.com/tada/mqtt-nats/mqtt/pkg"
 	"github.com/tada/mqtt-nats/test/full"
 )
@@ -35,6 +37,51 @@ func TestConnect_sessionPresent(t *testing.T) {
 	full.MqttDisconnect(t, conn)
 }
 
+func TestConnect_emptyClientID(t *testing.T) {
+	conn := full.MqttConnect(t, mqttPort)
+	full.MqttSend(t, conn, pkg.NewConnect(``, true, 1, nil, nil))
+	full.MqttExpect(t, conn, pkg.NewConnAck(false, 0))
+	full.MqttDisconnect(t, conn)
+}
+
+func TestConnect_emptyClientID_unclean(t *testing.T) {
+	conn := full.MqttConnect(t, mqttPort)
+	full.MqttSend(t, conn, pkg.NewConnect(``, false, 1, nil, nil))
+	full.MqttExpect(t, conn, pkg.NewConnAck(false, pkg.RtIdentifierRejected))
+	full.MqttExpectConnReset(t, conn)
+}
+
+func TestConnect31(t *testing.T) {
+	conn := full.MqttConnect(t, mqttPort)
+	c := pkg.NewConnect("c31-"+strconv.Itoa(int(nextPacketID())), false, 1, nil, nil)
+	c.SetClientLevel(mqtt.ProtocolLevel31)
+	full.MqttSend(t, conn, c)
+	full.MqttExpect(t, conn, pkg.NewConnAck(false, 0))
+	full.MqttDisconnect(t, conn)
+
+	// MQTT 3.1 has no session present flag
+	conn = full.MqttConnect(t, mqttPort)
+	full.MqttSend(t, conn, c)
+	full.MqttExpect(t, conn, pkg.NewConnAck(false, 0))
+	full.MqttDisconnect(t, conn)
+
+	// but the session is still there for a 3.1.1 client
+	conn = full.MqttConnect(t, mqttPort)
+	c.SetClientLevel(mqtt.ProtocolLevel311)
+	full.MqttSend(t, conn, c)
+	full.MqttExpect(t, conn, pkg.NewConnAck(true, 0))
+	full.MqttDisconnect(t, conn)
+}
+
+func TestConnect31_clientIDTooLong(t *testing.T) {
+	conn := full.MqttConnect(t, mqttPort)
+	c := pkg.NewConnect(full.NextClientID(), true, 1, nil, nil)
+	c.SetClientLevel(mqtt.ProtocolLevel31)
+	full.MqttSend(t, conn, c)
+	full.MqttExpect(t, conn, pkg.NewConnAck(false, pkg.RtIdentifierRejected))
+	full.MqttExpectConnReset(t, conn)
+}
+
 func TestConnect_will_qos_0(t *testing.T) {
 	conn1 := full.MqttConnect(t, mqttPort)
 	full.MqttSend(t, conn1, pkg.NewConnect(full.NextClientID(), true, 1, nil, nil))
@@ -289,7 +336,7 @@ func TestPing_beforeConnect(t *testing.T) {
 func TestConnect_badProtocolVersion(t *testing.T) {
 	conn := full.MqttConnect(t, mqttPort)
 	cp := pkg.NewConnect(full.NextClientID(), true, 1, nil, nil)
-	cp.SetClientLevel(3)
+	cp.SetClientLevel(2)
 	full.MqttSend(t, conn, cp)
 	full.MqttExpect(t, conn, pkg.NewConnAck(false, pkg.RtUnacceptableProtocolVersion))
 	full.MqttDisconnect(t, conn)
@@ -301,6 +348,44 @@ func TestConnect_multiple(t *testing.T) {
 	full.MqttExpectConnReset(t, conn)
 }
 
+func TestConnect_takeover(t *testing.T) {
+	watcher := full.MqttConnectClean(t, mqttPort)
+	mid := nextPacketID()
+	full.MqttSend(t, watcher, pkg.NewSubscribe(mid,
+		pkg.Topic{Name: "testing/takeover/will"}, pkg.Topic{Name: "testing/takeover/marker"}))
+	full.MqttExpect(t, watcher, pkg.NewSubAck(mid, 0, 0))
+
+	cid := full.NextClientID()
+	conn1 := full.MqttConnect(t, mqttPort)
+	full.MqttSend(t, conn1, pkg.NewConnect(cid, false, 1, &pkg.Will{
+		Topic:   "testing/takeover/will",
+		Message: []byte("the will message")}, nil))
+	full.MqttExpect(t, conn1, pkg.NewConnAck(false, 0))
+	mid = nextPacketID()
+	full.MqttSend(t, conn1, pkg.NewSubscribe(mid, pkg.Topic{Name: "testing/takeover/topic", QoS: 1}))
+	full.MqttExpect(t, conn1, pkg.NewSubAck(mid, 1))
+
+	// the second connection takes over the session and the first is closed without publishing its will
+	conn2 := full.MqttConnect(t, mqttPort)
+	full.MqttSend(t, conn2, pkg.NewConnect(cid, false, 1, nil, nil))
+	full.MqttExpect(t, conn2, pkg.NewConnAck(true, 0))
+	full.MqttExpectConnReset(t, conn1)
+
+	full.MqttSend(t, watcher, pkg.NewPublish2(0, "testing/takeover/marker", []byte("marker"), 0, false, false))
+	full.MqttExpect(t, watcher, func(p pkg.Packet) bool {
+		pp, ok := p.(*pkg.Publish)
+		return ok && pp.TopicName() == "testing/takeover/marker"
+	})
+
+	// the restored subscription is served by the new connection
+	pid := nextPacketID()
+	full.MqttSend(t, watcher, pkg.NewPublish2(pid, "testing/takeover/topic", []byte("hello"), 1, false, false))
+	expectOffline(t, conn2, "testing/takeover/topic", "hello")
+	full.MqttExpect(t, watcher, pkg.PubAck(pid))
+	full.MqttDisconnect(t, conn2)
+	full.MqttDisconnect(t, watcher)
+}
+
 func TestBadPacketLength(t *testing.T) {
 	conn := full.MqttConnectClean(t, mqttPort)
 	_, err := conn.Write([]byte{0x01, 0xff, 0xff, 0xff, 0xff})
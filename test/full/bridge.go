@@ -5,6 +5,7 @@
 package full
 
 import (
+	"os"
 	"sync"
 	"testing"
 	"time"
@@ -34,6 +35,28 @@ func RunBridge(lg logger.Logger, opts *bridge.Options) (bridge.Bridge, error) {
 	return srv, err
 }
 
+// StartBridge starts an in-process mqtt-nats bridge configured with the given options that logs debug output
+// on stdout. The test fails if the bridge cannot be started. The returned function shuts the bridge down.
+func StartBridge(t *testing.T, opts *bridge.Options) func() {
+	t.Helper()
+	_, stop := StartBridgeWithLogger(t, logger.New(logger.Debug, os.Stdout, os.Stderr), opts)
+	return stop
+}
+
+// StartBridgeWithLogger is like StartBridge but the bridge uses the given logger. The bridge is also returned.
+func StartBridgeWithLogger(t *testing.T, lg logger.Logger, opts *bridge.Options) (bridge.Bridge, func()) {
+	t.Helper()
+	b, err := RunBridge(lg, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, func() {
+		if err := b.Shutdown(); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
 // RestartBridge restarts the given bridge
 func RestartBridge(t *testing.T, b bridge.Bridge) {
 	serverReady := sync.WaitGroup{}
@@ -53,6 +76,16 @@ func NATSServerOnPort(port int) *server.Server {
 	return NATSServerWithOptions(&opts)
 }
 
+// NATSServerWithJetStream will run a server with JetStream enabled on the given port. The JetStream
+// storage is kept in the given directory.
+func NATSServerWithJetStream(port int, storeDir string) *server.Server {
+	opts := testserver.DefaultTestOptions
+	opts.Port = port
+	opts.JetStream = true
+	opts.StoreDir = storeDir
+	return NATSServerWithOptions(&opts)
+}
+
 // NATSServerWithOptions will run a server with the given options.
 func NATSServerWithOptions(opts *server.Options) *server.Server {
 	return testserver.RunServer(opts)
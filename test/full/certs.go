@@ -0,0 +1,95 @@
+// +build citest
+
+package full
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Certificates creates a CA, a server certificate for 127.0.0.1, and a client certificate for each of the
+// given email addresses in the given directory. The files are named ca.pem, server.pem, server-key.pem,
+// <email>.pem, and <email>-key.pem.
+func Certificates(t *testing.T, dir string, emails ...string) {
+	t.Helper()
+	caKey := newKey(t)
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "mqtt-nats test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true}
+	caDer := writeCert(t, filepath.Join(dir, "ca.pem"), ca, ca, caKey, caKey)
+	ca, err := x509.ParseCertificate(caDer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverKey := newKey(t)
+	writeCert(t, filepath.Join(dir, "server.pem"), &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}, ca, serverKey, caKey)
+	writeKey(t, filepath.Join(dir, "server-key.pem"), serverKey)
+
+	for i, email := range emails {
+		clientKey := newKey(t)
+		writeCert(t, filepath.Join(dir, email+".pem"), &x509.Certificate{
+			SerialNumber:   big.NewInt(int64(3 + i)),
+			Subject:        pkix.Name{CommonName: email},
+			NotBefore:      time.Now().Add(-time.Hour),
+			NotAfter:       time.Now().Add(time.Hour),
+			EmailAddresses: []string{email},
+			KeyUsage:       x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}, ca, clientKey, caKey)
+		writeKey(t, filepath.Join(dir, email+"-key.pem"), clientKey)
+	}
+}
+
+func newKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func writeCert(t *testing.T, path string, cert, parent *x509.Certificate, key, parentKey *ecdsa.PrivateKey) []byte {
+	t.Helper()
+	der, err := x509.CreateCertificate(rand.Reader, cert, parent, &key.PublicKey, parentKey)
+	if err == nil {
+		err = ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func writeKey(t *testing.T, path string, key *ecdsa.PrivateKey) {
+	t.Helper()
+	der, err := x509.MarshalECPrivateKey(key)
+	if err == nil {
+		err = ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
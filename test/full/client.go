@@ -39,6 +39,18 @@ func MqttConnectClean(t *testing.T, port int) net.Conn {
 	return conn
 }
 
+// MqttConnectClean5 is like MqttConnectClean but uses MQTT 5. The given props are used in the connect packet.
+func MqttConnectClean5(t *testing.T, port int, props mqtt.Properties) net.Conn {
+	t.Helper()
+	conn := MqttConnect(t, port)
+	MqttSend(t, conn, pkg.NewConnect5(NextClientID(), true, 1, nil, nil, props))
+	MqttExpect5(t, conn, func(p pkg.Packet) bool {
+		ca, ok := p.(*pkg.ConnAck)
+		return ok && ca.ReasonCode() == pkg.RcSuccess
+	})
+	return conn
+}
+
 // MqttDisconnect sends a disconnect packet and closes the connection
 func MqttDisconnect(t *testing.T, conn io.WriteCloser) {
 	t.Helper()
@@ -57,8 +69,20 @@ func MqttDisconnect(t *testing.T, conn io.WriteCloser) {
 
 // MqttSend writes the given packets on the given connection
 func MqttSend(t *testing.T, conn io.Writer, send ...pkg.Packet) {
+	t.Helper()
+	mqttSend(t, conn, mqtt.NewWriter(), send)
+}
+
+// MqttSend5 writes the given packets on the given connection using MQTT 5
+func MqttSend5(t *testing.T, conn io.Writer, send ...pkg.Packet) {
 	t.Helper()
 	buf := mqtt.NewWriter()
+	buf.SetProtocolLevel(mqtt.ProtocolLevel5)
+	mqttSend(t, conn, buf, send)
+}
+
+func mqttSend(t *testing.T, conn io.Writer, buf *mqtt.Writer, send []pkg.Packet) {
+	t.Helper()
 	for i := range send {
 		send[i].Write(buf)
 	}
@@ -71,9 +95,20 @@ func MqttSend(t *testing.T, conn io.Writer, send ...pkg.Packet) {
 // MqttExpect will read one packet for each entry in the list of expectations and assert that it is matched
 // by that entry. An expectation is either an expected verbatim pkg.Packet or a PacketMatcher function.
 func MqttExpect(t *testing.T, conn io.Reader, expectations ...interface{}) {
+	t.Helper()
+	mqttExpect(t, conn, packet.Parse, expectations)
+}
+
+// MqttExpect5 is like MqttExpect but uses MQTT 5 when parsing the packets
+func MqttExpect5(t *testing.T, conn io.Reader, expectations ...interface{}) {
+	t.Helper()
+	mqttExpect(t, conn, packet.Parse5, expectations)
+}
+
+func mqttExpect(t *testing.T, conn io.Reader, parse func(*testing.T, io.Reader) pkg.Packet, expectations []interface{}) {
 	t.Helper()
 	for _, e := range expectations {
-		a := packet.Parse(t, conn)
+		a := parse(t, conn)
 		switch e := e.(type) {
 		case pkg.Packet:
 			if !e.Equals(a) {
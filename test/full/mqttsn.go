@@ -0,0 +1,80 @@
+// +build citest
+
+package full
+
+import (
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/tada/mqtt-nats/mqttsn"
+)
+
+// SNDial creates a UDP connection to the MQTT-SN gateway on the given port on the default host
+func SNDial(t *testing.T, port int) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("udp", "127.0.0.1:"+strconv.Itoa(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// SNConnect creates a UDP connection to the MQTT-SN gateway on the given port, sends a CONNECT for a clean
+// session with the given client ID, and awaits the CONNACK
+func SNConnect(t *testing.T, port int, clientID string) net.Conn {
+	t.Helper()
+	conn := SNDial(t, port)
+	SNSend(t, conn, &mqttsn.Connect{Flags: mqttsn.FlagCleanSession, Duration: 60, ClientID: clientID})
+	SNExpect(t, conn, &mqttsn.ConnAck{ReturnCode: mqttsn.RcAccepted})
+	return conn
+}
+
+// SNSend sends each of the given messages in a datagram of its own
+func SNSend(t *testing.T, conn net.Conn, send ...mqttsn.Packet) {
+	t.Helper()
+	for _, p := range send {
+		if _, err := conn.Write(mqttsn.Encode(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// SNRead reads one message. It fails unless the message arrives within a second.
+func SNRead(t *testing.T, conn net.Conn) mqttsn.Packet {
+	t.Helper()
+	buf := make([]byte, 0xffff)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := mqttsn.Parse(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// SNExpect will read one message for each entry in the list of expectations and assert that it is matched
+// by that entry. An expectation is either an expected verbatim mqttsn.Packet or a match function.
+func SNExpect(t *testing.T, conn net.Conn, expectations ...interface{}) {
+	t.Helper()
+	for _, e := range expectations {
+		a := SNRead(t, conn)
+		switch e := e.(type) {
+		case mqttsn.Packet:
+			if !reflect.DeepEqual(e, a) {
+				t.Fatalf("expected '%s', got '%s'", e, a)
+			}
+		case func(mqttsn.Packet) bool:
+			if !e(a) {
+				t.Fatalf("message '%s' does not match message match function", a)
+			}
+		default:
+			t.Fatalf("a %T is not a valid expectation", e)
+		}
+	}
+}
@@ -3,10 +3,15 @@
 package full
 
 import (
+	"io/ioutil"
 	"strconv"
 	"testing"
 
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-server/v2/server"
+	testserver "github.com/nats-io/nats-server/v2/test"
 	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
 )
 
 // NatsConnect creates a new NATS connection on the given port.
@@ -17,3 +22,61 @@ func NatsConnect(t *testing.T, port int) *nats.Conn {
 	}
 	return nc
 }
+
+// NATSServerWithOperator will run a server in operator mode on the given port. The server trusts a new
+// operator that has signed one account. The key pair of that account is returned so that users can be
+// created with NATSUser.
+func NATSServerWithOperator(t *testing.T, port int) (*server.Server, nkeys.KeyPair) {
+	t.Helper()
+	okp, err := nkeys.CreateOperator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	opub, _ := okp.PublicKey()
+	akp, err := nkeys.CreateAccount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	apub, _ := akp.PublicKey()
+	ajwt, err := jwt.NewAccountClaims(apub).Encode(okp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver := &server.MemAccResolver{}
+	if err = resolver.Store(apub, ajwt); err != nil {
+		t.Fatal(err)
+	}
+	opts := testserver.DefaultTestOptions
+	opts.Port = port
+	opts.TrustedKeys = []string{opub}
+	opts.AccountResolver = resolver
+	return NATSServerWithOptions(&opts), akp
+}
+
+// NATSUser creates a new user in the given account and returns the user JWT and the NKey seed of the user
+func NATSUser(t *testing.T, akp nkeys.KeyPair) (string, []byte) {
+	t.Helper()
+	ukp, err := nkeys.CreateUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	upub, _ := ukp.PublicKey()
+	ujwt, err := jwt.NewUserClaims(upub).Encode(akp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seed, _ := ukp.Seed()
+	return ujwt, seed
+}
+
+// NATSCredsFile writes a NATS credentials file with the given user JWT and NKey seed to the given path
+func NATSCredsFile(t *testing.T, path, ujwt string, seed []byte) {
+	t.Helper()
+	bs, err := jwt.FormatUserConfig(ujwt, seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(path, bs, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
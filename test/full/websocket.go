@@ -0,0 +1,186 @@
+// +build citest
+
+package full
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+// WSConn is the client side of an MQTT over WebSocket connection. Each Write is sent as one masked binary
+// frame and Read returns the payload of the binary frames sent by the server.
+type WSConn struct {
+	net.Conn
+	r         *bufio.Reader
+	remaining uint64
+}
+
+// WSUpgrade sends a WebSocket upgrade request for the given path and subprotocol on the given connection and
+// returns the response
+func WSUpgrade(t *testing.T, conn net.Conn, path, protocol string) (*http.Response, *bufio.Reader) {
+	t.Helper()
+	key := make([]byte, 16)
+	_, _ = rand.Read(key)
+	req, err := http.NewRequest(http.MethodGet, "http://127.0.0.1"+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", base64.StdEncoding.EncodeToString(key))
+	if protocol != "" {
+		req.Header.Set("Sec-WebSocket-Protocol", protocol)
+	}
+	if err = req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, r
+}
+
+// WSConnect establishes a WebSocket connection with the "mqtt" subprotocol to the given port and path on the
+// default host. TLS is used when cfg is not nil.
+func WSConnect(t *testing.T, port int, path string, cfg *tls.Config) *WSConn {
+	t.Helper()
+	var conn net.Conn
+	var err error
+	if cfg == nil {
+		conn, err = net.Dial("tcp", ":"+strconv.Itoa(port))
+	} else {
+		conn, err = tls.Dial("tcp", ":"+strconv.Itoa(port), cfg)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, r := WSUpgrade(t, conn, path, "mqtt")
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("websocket upgrade failed: %s", resp.Status)
+	}
+	if p := resp.Header.Get("Sec-WebSocket-Protocol"); p != "mqtt" {
+		t.Fatalf("expected subprotocol mqtt, got %q", p)
+	}
+	return &WSConn{Conn: conn, r: r}
+}
+
+// WriteFrame sends the given payload in one frame with the given opcode
+func (wc *WSConn) WriteFrame(op byte, payload []byte) error {
+	return wc.WriteFragment(op, true, payload)
+}
+
+// WriteFragment sends the given payload in one frame with the given opcode. The fin flag of the frame is
+// cleared when more frames of the same message will follow.
+func (wc *WSConn) WriteFragment(op byte, fin bool, payload []byte) error {
+	h := []byte{op, 0x80}
+	if fin {
+		h[0] |= 0x80
+	}
+	switch n := len(payload); {
+	case n < 126:
+		h[1] |= byte(n)
+	case n <= 0xffff:
+		h[1] |= 126
+		h = append(h, byte(n>>8), byte(n))
+	default:
+		t := make([]byte, 8)
+		binary.BigEndian.PutUint64(t, uint64(n))
+		h[1] |= 127
+		h = append(h, t...)
+	}
+	mask := make([]byte, 4)
+	_, _ = rand.Read(mask)
+	h = append(h, mask...)
+	masked := make([]byte, len(payload))
+	for i, b := range payload {
+		masked[i] = b ^ mask[i&3]
+	}
+	_, err := wc.Conn.Write(append(h, masked...))
+	return err
+}
+
+// Write sends the given bytes in one binary frame
+func (wc *WSConn) Write(p []byte) (int, error) {
+	if err := wc.WriteFrame(0x2, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// readHeader reads a frame header and returns its opcode and payload length
+func (wc *WSConn) readHeader() (byte, uint64, error) {
+	h := make([]byte, 2)
+	if _, err := io.ReadFull(wc.r, h); err != nil {
+		return 0, 0, err
+	}
+	if h[1]&0x80 != 0 {
+		return 0, 0, errors.New("websocket frame from server is masked")
+	}
+	n := uint64(h[1] & 0x7f)
+	switch n {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(wc.r, ext); err != nil {
+			return 0, 0, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err := io.ReadFull(wc.r, ext); err != nil {
+			return 0, 0, err
+		}
+		n = binary.BigEndian.Uint64(ext)
+	}
+	return h[0] & 0x0f, n, nil
+}
+
+// ReadFrame reads one frame and returns its opcode and payload
+func (wc *WSConn) ReadFrame() (byte, []byte, error) {
+	op, n, err := wc.readHeader()
+	if err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, n)
+	if _, err = io.ReadFull(wc.r, payload); err != nil {
+		return 0, nil, err
+	}
+	return op, payload, nil
+}
+
+// Read returns the payload of binary frames. A close frame is returned as io.EOF.
+func (wc *WSConn) Read(p []byte) (int, error) {
+	for wc.remaining == 0 {
+		op, n, err := wc.readHeader()
+		if err != nil {
+			return 0, err
+		}
+		if op != 0x0 && op != 0x2 {
+			if op == 0x8 {
+				return 0, io.EOF
+			}
+			if _, err = wc.r.Discard(int(n)); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		wc.remaining = n
+	}
+	if uint64(len(p)) > wc.remaining {
+		p = p[:wc.remaining]
+	}
+	n, err := wc.r.Read(p)
+	wc.remaining -= uint64(n)
+	return n, err
+}
@@ -0,0 +1,135 @@
+package test
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/tada/mqtt-nats/bridge"
+	"github.com/tada/mqtt-nats/logger"
+	"github.com/tada/mqtt-nats/mqtt/pkg"
+	"github.com/tada/mqtt-nats/test/full"
+)
+
+const (
+	jsMqttPort = 11884
+	jsNatsPort = 14223
+	jsStream   = "MQTT"
+)
+
+// jetStreamBridge starts a NATS server with JetStream, creates a stream that captures all subjects that
+// start with "jetstream.", and starts a bridge that uses that stream. The returned function stops both.
+func jetStreamBridge(t *testing.T) (bridge.Bridge, nats.JetStreamContext, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir(``, `mqtt-nats-js`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	natsServer := full.NATSServerWithJetStream(jsNatsPort, dir)
+	nc := full.NatsConnect(t, jsNatsPort)
+	js, err := nc.JetStream()
+	if err == nil {
+		_, err = js.AddStream(&nats.StreamConfig{Name: jsStream, Subjects: []string{"jetstream.>"}})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, stopBridge := full.StartBridgeWithLogger(t, logger.New(logger.Debug, os.Stdout, os.Stderr), &bridge.Options{
+		Port:            jsMqttPort,
+		NATSUrls:        ":" + strconv.Itoa(jsNatsPort),
+		RepeatRate:      50,
+		JetStreamStream: jsStream,
+		StoragePath:     filepath.Join(dir, storageFile)})
+	return b, js, func() {
+		stopBridge()
+		nc.Close()
+		natsServer.Shutdown()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+// consumers returns information about all consumers of the test stream
+func consumers(js nats.JetStreamContext) []*nats.ConsumerInfo {
+	var cis []*nats.ConsumerInfo
+	for ci := range js.ConsumersInfo(jsStream) {
+		cis = append(cis, ci)
+	}
+	return cis
+}
+
+func TestJetStream_publish(t *testing.T) {
+	_, js, stop := jetStreamBridge(t)
+	defer stop()
+
+	conn := full.MqttConnectClean(t, jsMqttPort)
+	pid := nextPacketID()
+	full.MqttSend(t, conn, pkg.NewPublish2(pid, "jetstream/in", []byte("stored"), 1, false, false))
+	full.MqttExpect(t, conn, pkg.PubAck(pid))
+
+	// the ack means that the message is in the stream
+	si, err := js.StreamInfo(jsStream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if si.State.Msgs != 1 {
+		t.Fatalf("expected 1 message in stream, got %d", si.State.Msgs)
+	}
+	full.MqttDisconnect(t, conn)
+}
+
+func TestJetStream_durable(t *testing.T) {
+	b, js, stop := jetStreamBridge(t)
+	defer stop()
+
+	topic := "jetstream/durable"
+	c := pkg.NewConnect(full.NextClientID(), false, 1, nil, nil)
+	connect := func(sessionPresent bool) net.Conn {
+		conn := full.MqttConnect(t, jsMqttPort)
+		full.MqttSend(t, conn, c)
+		full.MqttExpect(t, conn, pkg.NewConnAck(sessionPresent, 0))
+		return conn
+	}
+	conn := connect(false)
+	sid := nextPacketID()
+	full.MqttSend(t, conn, pkg.NewSubscribe(sid, pkg.Topic{Name: topic, QoS: 1}))
+	full.MqttExpect(t, conn, pkg.NewSubAck(sid, 1))
+	if n := len(consumers(js)); n != 1 {
+		t.Fatalf("expected 1 consumer, got %d", n)
+	}
+	disconnectAndWait(t, conn)
+
+	// messages stored while the client and the bridge are gone are delivered when the session resumes
+	full.RestartBridge(t, b)
+	if _, err := js.Publish("jetstream.durable", []byte("offline")); err != nil {
+		t.Fatal(err)
+	}
+	conn = connect(true)
+	expectOffline(t, conn, topic, "offline")
+
+	// the PUBACK acknowledges the message in the stream
+	for i := 0; ; i++ {
+		cis := consumers(js)
+		if len(cis) == 1 && cis[0].NumAckPending == 0 && cis[0].AckFloor.Stream == 1 {
+			break
+		}
+		if i == 20 {
+			t.Fatal("message was not acknowledged in the stream")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	disconnectAndWait(t, conn)
+
+	// a clean session removes the consumer
+	conn = full.MqttConnect(t, jsMqttPort)
+	full.MqttSend(t, conn, pkg.NewConnect(c.ClientID(), true, 1, nil, nil))
+	full.MqttExpect(t, conn, pkg.NewConnAck(false, 0))
+	if n := len(consumers(js)); n != 0 {
+		t.Fatalf("expected no consumers, got %d", n)
+	}
+	full.MqttDisconnect(t, conn)
+}
@@ -0,0 +1,100 @@
+package test
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/tada/mqtt-nats/bridge"
+	"github.com/tada/mqtt-nats/mqtt/pkg"
+	"github.com/tada/mqtt-nats/test/full"
+)
+
+const (
+	lanMqttPort = 11890
+	netMqttPort = 11891
+	webMqttPort = 11892
+)
+
+// listenersBridge starts a bridge with a plain listener that requires a user name, a TLS listener that maps
+// client certificates to user names, and a WebSocket listener that accepts anonymous clients. It returns
+// the directory with the certificates and a function that stops the bridge.
+func listenersBridge(t *testing.T) (string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir(``, `mqtt-nats-listeners`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	full.Certificates(t, dir, tlsDevice)
+	stop := full.StartBridge(t, &bridge.Options{
+		NATSUrls:   ":" + strconv.Itoa(natsPort),
+		RepeatRate: 50,
+		Listeners: []*bridge.Listener{
+			{Address: ":" + strconv.Itoa(lanMqttPort), Auth: bridge.ClientAuthPassword},
+			{
+				Transport: bridge.TransportTLS,
+				Address:   ":" + strconv.Itoa(netMqttPort),
+				TLSCert:   filepath.Join(dir, "server.pem"),
+				TLSKey:    filepath.Join(dir, "server-key.pem"),
+				TLSCaCert: filepath.Join(dir, "ca.pem"),
+				Auth:      bridge.ClientAuthCertificate},
+			{Transport: bridge.TransportWS, Address: ":" + strconv.Itoa(webMqttPort)}}})
+	return dir, stop
+}
+
+func TestListeners_authenticationPolicy(t *testing.T) {
+	dir, stop := listenersBridge(t)
+	defer func() {
+		stop()
+		_ = os.RemoveAll(dir)
+	}()
+
+	conn := full.MqttConnect(t, lanMqttPort)
+	full.MqttSend(t, conn, pkg.NewConnect(full.NextClientID(), true, 1, nil, nil))
+	full.MqttExpect(t, conn, pkg.NewConnAck(false, pkg.RtNotAuthorized))
+	full.MqttExpectConnReset(t, conn)
+
+	conn = full.MqttConnect(t, lanMqttPort)
+	full.MqttSend(t, conn, pkg.NewConnect(full.NextClientID(), true, 1, nil, &pkg.Credentials{User: "lan"}))
+	full.MqttExpect(t, conn, pkg.NewConnAck(false, pkg.RtAccepted))
+	full.MqttDisconnect(t, conn)
+
+	conn = tlsDial(t, netMqttPort, dir, tlsDevice)
+	full.MqttSend(t, conn, pkg.NewConnect(full.NextClientID(), true, 1, nil, nil))
+	full.MqttExpect(t, conn, pkg.NewConnAck(false, pkg.RtAccepted))
+	full.MqttDisconnect(t, conn)
+
+	wc := full.WSConnect(t, webMqttPort, bridge.DefaultWSPath, nil)
+	full.MqttSend(t, wc, pkg.NewConnect(full.NextClientID(), true, 1, nil, nil))
+	full.MqttExpect(t, wc, pkg.NewConnAck(false, pkg.RtAccepted))
+	full.MqttDisconnect(t, wc)
+}
+
+func TestListeners_drain(t *testing.T) {
+	dir, stop := listenersBridge(t)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	conns := []net.Conn{
+		full.MqttConnect(t, lanMqttPort),
+		tlsDial(t, netMqttPort, dir, tlsDevice),
+		full.WSConnect(t, webMqttPort, bridge.DefaultWSPath, nil)}
+	for _, conn := range conns {
+		full.MqttSend(t, conn, pkg.NewConnect(full.NextClientID(), true, 1, nil, &pkg.Credentials{User: "lan"}))
+		full.MqttExpect(t, conn, pkg.NewConnAck(false, pkg.RtAccepted))
+	}
+	stop()
+	for _, conn := range conns {
+		full.MqttExpectConnReset(t, conn)
+	}
+	for _, port := range []int{lanMqttPort, netMqttPort, webMqttPort} {
+		if conn, err := net.Dial("tcp", ":"+strconv.Itoa(port)); err == nil {
+			_ = conn.Close()
+			t.Fatalf("port %d is still open after shutdown", port)
+		}
+	}
+}
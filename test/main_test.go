@@ -15,8 +15,17 @@ var mqttServer bridge.Bridge
 const (
 	storageFile          = "mqtt-nats.json"
 	mqttPort             = 11883
+	wsMqttPort           = 11888
+	snPort               = 11894
+	snPredefinedTopic    = "testing/sn/predefined"
 	natsPort             = 14222
 	retainedRequestTopic = "mqtt.retained.request"
+	headerPrefix         = "Mqtt-"
+	offlineQueueSize     = 3
+	receiveMaximum       = 10
+	maximumPacketSize    = 1024
+	topicAliasMaximum    = 10
+	requestTimeout       = 200
 )
 
 func TestMain(m *testing.M) {
@@ -29,9 +38,19 @@ func TestMain(m *testing.M) {
 
 	opts := bridge.Options{
 		Port:                 mqttPort,
+		WSPort:               wsMqttPort,
+		MQTTSNPort:           snPort,
+		MQTTSNTopics:         map[uint16]string{1: snPredefinedTopic},
 		NATSUrls:             ":" + strconv.Itoa(natsPort),
 		RepeatRate:           50,
+		SessionSweepRate:     50,
+		OfflineQueueSize:     offlineQueueSize,
 		RetainedRequestTopic: retainedRequestTopic,
+		HeaderPrefix:         headerPrefix,
+		ReceiveMaximum:       receiveMaximum,
+		MaximumPacketSize:    maximumPacketSize,
+		TopicAliasMaximum:    topicAliasMaximum,
+		RequestTimeout:       requestTimeout,
 		StoragePath:          storageFile}
 	var err error
 	mqttServer, err = full.RunBridge(lg, &opts)
@@ -0,0 +1,588 @@
+package test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/tada/mqtt-nats/mqtt"
+	"github.com/tada/mqtt-nats/mqtt/pkg"
+	"github.com/tada/mqtt-nats/test/full"
+)
+
+func TestConnect5(t *testing.T) {
+	conn := full.MqttConnect(t, mqttPort)
+	full.MqttSend(t, conn, pkg.NewConnect5(full.NextClientID(), true, 1, nil, nil, nil))
+	full.MqttExpect5(t, conn, pkg.NewConnAck5(false, pkg.RcSuccess, mqtt.Properties{}.
+		Add(mqtt.PropSubscriptionIdentifierAvailable, 0).
+		Add(mqtt.PropReceiveMaximum, receiveMaximum).
+		Add(mqtt.PropMaximumPacketSize, maximumPacketSize).
+		Add(mqtt.PropTopicAliasMaximum, topicAliasMaximum)))
+	full.MqttDisconnect(t, conn)
+}
+
+func TestConnect5_badAuthenticationMethod(t *testing.T) {
+	conn := full.MqttConnect(t, mqttPort)
+	full.MqttSend(t, conn, pkg.NewConnect5(full.NextClientID(), true, 1, nil, nil,
+		mqtt.Properties{}.Add(mqtt.PropAuthenticationMethod, "SCRAM-SHA-1")))
+	full.MqttExpect5(t, conn, pkg.NewConnAck5(false, pkg.RcBadAuthenticationMethod, nil))
+	full.MqttExpectConnReset(t, conn)
+}
+
+func TestConnect5_secondConnect(t *testing.T) {
+	conn := full.MqttConnectClean5(t, mqttPort, nil)
+	full.MqttSend(t, conn, pkg.NewConnect5(full.NextClientID(), true, 1, nil, nil, nil))
+	full.MqttExpect5(t, conn, pkg.NewDisconnectV5(pkg.RcProtocolError, nil))
+	full.MqttExpectConnReset(t, conn)
+}
+
+func TestConnect5_assignedClientID(t *testing.T) {
+	conn := full.MqttConnect(t, mqttPort)
+	full.MqttSend(t, conn, pkg.NewConnect5(``, true, 1, nil, nil, nil))
+	full.MqttExpect5(t, conn, func(p pkg.Packet) bool {
+		ca, ok := p.(*pkg.ConnAck)
+		if !ok || ca.ReasonCode() != pkg.RcSuccess {
+			return false
+		}
+		cid, ok := ca.Properties().Text(mqtt.PropAssignedClientIdentifier)
+		return ok && cid != ``
+	})
+	full.MqttDisconnect(t, conn)
+}
+
+func TestConnect5_emptyClientID_unclean(t *testing.T) {
+	conn := full.MqttConnect(t, mqttPort)
+	full.MqttSend(t, conn, pkg.NewConnect5(``, false, 1, nil, nil, nil))
+	full.MqttExpect5(t, conn, pkg.NewConnAck5(false, pkg.RcClientIdentifierNotValid, nil))
+	full.MqttExpectConnReset(t, conn)
+}
+
+func TestConnect5_takeover(t *testing.T) {
+	cid := full.NextClientID()
+	conn1 := full.MqttConnect(t, mqttPort)
+	full.MqttSend(t, conn1, pkg.NewConnect5(cid, true, 1, nil, nil, nil))
+	full.MqttExpect5(t, conn1, func(p pkg.Packet) bool {
+		ca, ok := p.(*pkg.ConnAck)
+		return ok && ca.ReasonCode() == pkg.RcSuccess
+	})
+
+	conn2 := full.MqttConnect(t, mqttPort)
+	full.MqttSend(t, conn2, pkg.NewConnect5(cid, true, 1, nil, nil, nil))
+	full.MqttExpect5(t, conn1, pkg.NewDisconnectV5(pkg.RcSessionTakenOver, nil))
+	full.MqttExpectConnReset(t, conn1)
+	full.MqttExpect5(t, conn2, func(p pkg.Packet) bool {
+		ca, ok := p.(*pkg.ConnAck)
+		return ok && ca.ReasonCode() == pkg.RcSuccess && !ca.SessionPresent()
+	})
+	full.MqttDisconnect(t, conn2)
+}
+
+func TestDisconnect5_withWill(t *testing.T) {
+	willTopic := "testing/my/will5"
+	c1 := full.MqttConnectClean5(t, mqttPort, nil)
+	sid := nextPacketID()
+	full.MqttSend5(t, c1, pkg.NewSubscribe5(sid, nil, pkg.Topic{Name: willTopic}))
+	full.MqttExpect5(t, c1, pkg.NewSubAck5(sid, nil, 0))
+
+	c2 := full.MqttConnect(t, mqttPort)
+	full.MqttSend(t, c2, pkg.NewConnect5(full.NextClientID(), true, 1,
+		&pkg.Will{Topic: willTopic, Message: []byte("the will message")}, nil, nil))
+	full.MqttExpect5(t, c2, func(p pkg.Packet) bool {
+		ca, ok := p.(*pkg.ConnAck)
+		return ok && ca.ReasonCode() == pkg.RcSuccess
+	})
+	full.MqttSend5(t, c2, pkg.NewDisconnectV5(pkg.RcDisconnectWithWill, nil))
+	full.MqttExpectConnReset(t, c2)
+
+	full.MqttExpect5(t, c1, pkg.SimplePublish(willTopic, []byte("the will message")))
+	full.MqttDisconnect(t, c1)
+}
+
+func TestPublishSubscribe5_mixed(t *testing.T) {
+	topic := "testing/some/topic"
+	mid := nextPacketID()
+	pp := pkg.NewPublish2(mid, topic, []byte("payload"), 1, false, false)
+	c5 := full.MqttConnectClean5(t, mqttPort, nil)
+	c3 := full.MqttConnectClean(t, mqttPort)
+
+	sid := nextPacketID()
+	full.MqttSend5(t, c5, pkg.NewSubscribe5(sid, nil, pkg.Topic{Name: topic, QoS: 1}))
+	full.MqttExpect5(t, c5, pkg.NewSubAck5(sid, nil, 1))
+	full.MqttSend(t, c3, pp)
+	full.MqttExpect5(t, c5, pp)
+	full.MqttSend5(t, c5, pkg.NewAckV5(pkg.TpPubAck, mid, pkg.RcSuccess, nil))
+	full.MqttExpect(t, c3, pkg.PubAck(mid))
+
+	topic = "testing/other/topic"
+	mid = nextPacketID()
+	pp = pkg.NewPublish2(mid, topic, []byte("payload"), 1, false, false)
+	sid = nextPacketID()
+	full.MqttSend(t, c3, pkg.NewSubscribe(sid, pkg.Topic{Name: topic, QoS: 1}))
+	full.MqttExpect(t, c3, pkg.NewSubAck(sid, 1))
+	full.MqttSend5(t, c5, pp)
+	full.MqttExpect(t, c3, pp)
+	full.MqttSend(t, c3, pkg.PubAck(mid))
+	full.MqttExpect5(t, c5, pkg.PubAck(mid))
+	full.MqttDisconnect(t, c3)
+	full.MqttDisconnect(t, c5)
+}
+
+func TestUnsubscribe5(t *testing.T) {
+	topic := "testing/some/topic"
+	conn := full.MqttConnectClean5(t, mqttPort, nil)
+	sid := nextPacketID()
+	full.MqttSend5(t, conn, pkg.NewSubscribe5(sid, nil, pkg.Topic{Name: topic}))
+	full.MqttExpect5(t, conn, pkg.NewSubAck5(sid, nil, 0))
+	uid := nextPacketID()
+	full.MqttSend5(t, conn, pkg.NewUnsubscribe5(uid, nil, topic, "testing/other/topic"))
+	full.MqttExpect5(t, conn, pkg.NewUnsubAckV5(uid, nil, byte(pkg.RcSuccess), byte(pkg.RcNoSubscriptionExisted)))
+	full.MqttDisconnect(t, conn)
+}
+
+func TestSubscribe5_noLocal(t *testing.T) {
+	topic := "testing/nolocal/topic"
+	c5 := full.MqttConnectClean5(t, mqttPort, nil)
+	sid := nextPacketID()
+	full.MqttSend5(t, c5, pkg.NewSubscribe5(sid, nil, pkg.Topic{Name: topic, NoLocal: true}))
+	full.MqttExpect5(t, c5, pkg.NewSubAck5(sid, nil, 0))
+
+	c3 := full.MqttConnectClean(t, mqttPort)
+	sid = nextPacketID()
+	full.MqttSend(t, c3, pkg.NewSubscribe(sid, pkg.Topic{Name: topic}))
+	full.MqttExpect(t, c3, pkg.NewSubAck(sid, 0))
+
+	// the publication of c5 reaches c3 but not c5
+	own := pkg.SimplePublish(topic, []byte("own"))
+	full.MqttSend5(t, c5, own)
+	full.MqttExpect(t, c3, own)
+	other := pkg.SimplePublish(topic, []byte("other"))
+	full.MqttSend(t, c3, other)
+	full.MqttExpect5(t, c5, other)
+	full.MqttExpect(t, c3, other)
+	full.MqttDisconnect(t, c3)
+	full.MqttDisconnect(t, c5)
+}
+
+func TestSubscribe5_noLocalUnsubscribe(t *testing.T) {
+	topic := "testing/nolocal/unsubscribe"
+	origins := make(chan string, 2)
+	nc := full.NatsConnect(t, natsPort)
+	defer nc.Close()
+	_, err := nc.Subscribe("testing.nolocal.unsubscribe", func(m *nats.Msg) {
+		origins <- m.Header.Get(headerPrefix + "Bridge-Origin-Client-Id")
+	})
+	if err == nil {
+		err = nc.Flush()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c5 := full.MqttConnectClean5(t, mqttPort, nil)
+	sid := nextPacketID()
+	full.MqttSend5(t, c5, pkg.NewSubscribe5(sid, nil, pkg.Topic{Name: topic, NoLocal: true}))
+	full.MqttExpect5(t, c5, pkg.NewSubAck5(sid, nil, 0))
+	full.MqttSend5(t, c5, pkg.SimplePublish(topic, []byte("marked")))
+	select {
+	case o := <-origins:
+		if o == `` {
+			t.Fatal("expected an origin header while a No Local subscription exists")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected message did not arrive")
+	}
+
+	// the header is dropped once the No Local subscription is gone
+	uid := nextPacketID()
+	full.MqttSend5(t, c5, pkg.NewUnsubscribe5(uid, nil, topic))
+	full.MqttExpect5(t, c5, pkg.NewUnsubAckV5(uid, nil, byte(pkg.RcSuccess)))
+	full.MqttSend5(t, c5, pkg.SimplePublish(topic, []byte("unmarked")))
+	select {
+	case o := <-origins:
+		if o != `` {
+			t.Fatalf("unexpected origin header %q", o)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected message did not arrive")
+	}
+	full.MqttDisconnect(t, c5)
+}
+
+func TestSubscribe5_retainHandling(t *testing.T) {
+	topic := "testing/retain/handling"
+	retained := func(p pkg.Packet) bool {
+		pp, ok := p.(*pkg.Publish)
+		return ok && pp.TopicName() == topic && pp.Retain() && bytes.Equal(pp.Payload(), []byte("retained"))
+	}
+	conn := full.MqttConnectClean(t, mqttPort)
+	full.MqttSend(t, conn, pkg.NewPublish2(0, topic, []byte("retained"), 0, false, true))
+	full.MqttDisconnect(t, conn)
+	conn = full.MqttConnectClean5(t, mqttPort, nil)
+
+	// never send retained messages
+	sid := nextPacketID()
+	full.MqttSend5(t, conn, pkg.NewSubscribe5(sid, nil, pkg.Topic{Name: topic, RetainHandling: 2}))
+	full.MqttExpect5(t, conn, pkg.NewSubAck5(sid, nil, 0))
+	full.MqttSend5(t, conn, pkg.PingRequestSingleton)
+	full.MqttExpect5(t, conn, pkg.PingResponseSingleton)
+
+	// send retained messages only for a new subscription
+	sid = nextPacketID()
+	full.MqttSend5(t, conn, pkg.NewSubscribe5(sid, nil, pkg.Topic{Name: topic, RetainHandling: 1}))
+	full.MqttExpect5(t, conn, pkg.NewSubAck5(sid, nil, 0))
+	full.MqttSend5(t, conn, pkg.PingRequestSingleton)
+	full.MqttExpect5(t, conn, pkg.PingResponseSingleton)
+	uid := nextPacketID()
+	full.MqttSend5(t, conn, pkg.NewUnsubscribe5(uid, nil, topic))
+	full.MqttExpect5(t, conn, pkg.NewUnsubAckV5(uid, nil, byte(pkg.RcSuccess)))
+	sid = nextPacketID()
+	full.MqttSend5(t, conn, pkg.NewSubscribe5(sid, nil, pkg.Topic{Name: topic, RetainHandling: 1}))
+	full.MqttExpect5(t, conn, pkg.NewSubAck5(sid, nil, 0), retained)
+
+	// always send retained messages
+	sid = nextPacketID()
+	full.MqttSend5(t, conn, pkg.NewSubscribe5(sid, nil, pkg.Topic{Name: topic}))
+	full.MqttExpect5(t, conn, pkg.NewSubAck5(sid, nil, 0), retained)
+	full.MqttDisconnect(t, conn)
+
+	// remove the retained message
+	conn = full.MqttConnectClean(t, mqttPort)
+	full.MqttSend(t, conn, pkg.NewPublish2(0, topic, nil, 0, false, true))
+	full.MqttDisconnect(t, conn)
+}
+
+func TestMqttPublishNatsSubscribe_headers(t *testing.T) {
+	pl := []byte(`{"temp":21}`)
+	pp := pkg.SimplePublish("testing/some/topic", pl)
+	pp.SetProperties(mqtt.Properties{}.
+		Add(mqtt.PropPayloadFormatIndicator, 1).
+		Add(mqtt.PropContentType, "application/json").
+		Add(mqtt.PropUserProperty, mqtt.StringPair{Key: "unit", Value: "C"}).
+		Add(mqtt.PropUserProperty, mqtt.StringPair{Key: "unit", Value: "Celsius"}))
+
+	gotIt := make(chan bool, 1)
+	nc := full.NatsConnect(t, natsPort)
+	defer nc.Close()
+	_, err := nc.Subscribe("testing.some.topic", func(m *nats.Msg) {
+		h := m.Header
+		if !(bytes.Equal(pl, m.Data) &&
+			h.Get(headerPrefix+"Bridge-Payload-Format") == "1" &&
+			h.Get(headerPrefix+"Bridge-Content-Type") == "application/json" &&
+			len(h.Values(headerPrefix+"unit")) == 2 && h.Values(headerPrefix+"unit")[1] == "Celsius") {
+			t.Errorf("nats subscription did not receive expected headers: %v", h)
+		}
+		gotIt <- true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := full.MqttConnectClean5(t, mqttPort, nil)
+	full.MqttSend5(t, c, pp)
+	full.MqttDisconnect(t, c)
+	full.AssertMessageReceived(t, gotIt)
+}
+
+func TestNatsPublishMqttSubscribe_headers(t *testing.T) {
+	topic := "testing/some/topic"
+	pl := []byte("payload")
+
+	c5 := full.MqttConnectClean5(t, mqttPort, nil)
+	sid := nextPacketID()
+	full.MqttSend5(t, c5, pkg.NewSubscribe5(sid, nil, pkg.Topic{Name: topic}))
+	full.MqttExpect5(t, c5, pkg.NewSubAck5(sid, nil, 0))
+
+	c3 := full.MqttConnectClean(t, mqttPort)
+	sid = nextPacketID()
+	full.MqttSend(t, c3, pkg.NewSubscribe(sid, pkg.Topic{Name: topic}))
+	full.MqttExpect(t, c3, pkg.NewSubAck(sid, 0))
+
+	nc := full.NatsConnect(t, natsPort)
+	defer nc.Close()
+	m := nats.NewMsg("testing.some.topic")
+	m.Data = pl
+	m.Header.Add(headerPrefix+"Bridge-Content-Type", "text/plain")
+	m.Header.Add(headerPrefix+"origin", "nats")
+	m.Header.Add("Not-Prefixed", "ignored")
+	if err := nc.PublishMsg(m); err != nil {
+		t.Fatal(err)
+	}
+
+	pp := pkg.SimplePublish(topic, pl)
+	pp.SetProperties(mqtt.Properties{}.
+		Add(mqtt.PropContentType, "text/plain").
+		Add(mqtt.PropUserProperty, mqtt.StringPair{Key: "origin", Value: "nats"}))
+	full.MqttExpect5(t, c5, pp)
+
+	// properties are not sent to an MQTT 3.1.1 client
+	full.MqttExpect(t, c3, pkg.SimplePublish(topic, pl))
+	full.MqttDisconnect(t, c3)
+	full.MqttDisconnect(t, c5)
+}
+
+func TestRequestResponse5_mqttToNats(t *testing.T) {
+	service := "testing/some/service"
+	responseTopic := "testing/some/response"
+	cd := []byte{1, 2, 3}
+
+	nc := full.NatsConnect(t, natsPort)
+	defer nc.Close()
+	_, err := nc.Subscribe(mqtt.ToNATS(service), func(m *nats.Msg) {
+		_ = m.Respond(append([]byte("re: "), m.Data...))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	isResponse := func(p pkg.Packet) bool {
+		pp, ok := p.(*pkg.Publish)
+		if !ok {
+			return false
+		}
+		rcd, _ := pp.Properties().Binary(mqtt.PropCorrelationData)
+		return pp.TopicName() == responseTopic && string(pp.Payload()) == "re: ping" && bytes.Equal(cd, rcd)
+	}
+
+	c := full.MqttConnectClean5(t, mqttPort, nil)
+	sid := nextPacketID()
+	full.MqttSend5(t, c, pkg.NewSubscribe5(sid, nil, pkg.Topic{Name: responseTopic}))
+	full.MqttExpect5(t, c, pkg.NewSubAck5(sid, nil, 0))
+
+	props := mqtt.Properties{}.
+		Add(mqtt.PropResponseTopic, responseTopic).
+		Add(mqtt.PropCorrelationData, cd)
+	pp := pkg.SimplePublish(service, []byte("ping"))
+	pp.SetProperties(props)
+	full.MqttSend5(t, c, pp)
+	full.MqttExpect5(t, c, isResponse)
+
+	// with QoS 1, the request is acknowledged and the response is forwarded
+	mid := nextPacketID()
+	pp = pkg.NewPublish2(mid, service, []byte("ping"), 1, false, false)
+	pp.SetProperties(props)
+	full.MqttSend5(t, c, pp)
+	gotAck := false
+	gotResponse := false
+	ackOrResponse := func(p pkg.Packet) bool {
+		if pkg.PubAck(mid).Equals(p) {
+			gotAck = true
+			return true
+		}
+		gotResponse = isResponse(p)
+		return gotResponse
+	}
+	full.MqttExpect5(t, c, ackOrResponse, ackOrResponse)
+	if !(gotAck && gotResponse) {
+		t.Fatal("expected both ack and response")
+	}
+	full.MqttDisconnect(t, c)
+}
+
+func TestRequestResponse5_noResponders(t *testing.T) {
+	c := full.MqttConnectClean5(t, mqttPort, nil)
+	mid := nextPacketID()
+	pp := pkg.NewPublish2(mid, "testing/no/service", []byte("ping"), 1, false, false)
+	pp.SetProperties(mqtt.Properties{}.Add(mqtt.PropResponseTopic, "testing/no/response"))
+	full.MqttSend5(t, c, pp)
+	full.MqttExpect5(t, c, pkg.PubAck(mid))
+	full.MqttDisconnect(t, c)
+}
+
+func TestRequestResponse5_timeout(t *testing.T) {
+	service := "testing/silent/service"
+	nc := full.NatsConnect(t, natsPort)
+	defer nc.Close()
+	requests := make(chan *nats.Msg, 1)
+	if _, err := nc.Subscribe(mqtt.ToNATS(service), func(m *nats.Msg) { requests <- m }); err != nil {
+		t.Fatal(err)
+	}
+
+	// the request is acknowledged before the reply arrives and a late reply is dropped
+	c := full.MqttConnectClean5(t, mqttPort, nil)
+	responseTopic := "testing/silent/response"
+	sid := nextPacketID()
+	full.MqttSend5(t, c, pkg.NewSubscribe5(sid, nil, pkg.Topic{Name: responseTopic}))
+	full.MqttExpect5(t, c, pkg.NewSubAck5(sid, nil, 0))
+	mid := nextPacketID()
+	pp := pkg.NewPublish2(mid, service, []byte("ping"), 2, false, false)
+	pp.SetProperties(mqtt.Properties{}.Add(mqtt.PropResponseTopic, responseTopic))
+	full.MqttSend5(t, c, pp)
+	full.MqttSend5(t, c, pkg.PingRequestSingleton)
+	full.MqttExpect5(t, c, pkg.PubRec(mid))
+	full.MqttExpect5(t, c, pkg.PingResponseSingleton)
+	full.MqttSend5(t, c, pkg.PubRel(mid))
+	full.MqttExpect5(t, c, pkg.PubComp(mid))
+	m := <-requests
+	time.Sleep(2 * requestTimeout * time.Millisecond)
+	if err := m.Respond([]byte("late")); err != nil {
+		t.Fatal(err)
+	}
+	full.MqttSend5(t, c, pkg.PingRequestSingleton)
+	full.MqttExpect5(t, c, pkg.PingResponseSingleton)
+	full.MqttDisconnect(t, c)
+}
+
+func TestRequestResponse5_natsToMqtt(t *testing.T) {
+	service := "testing/some/service"
+	c := full.MqttConnectClean5(t, mqttPort, nil)
+	sid := nextPacketID()
+	full.MqttSend5(t, c, pkg.NewSubscribe5(sid, nil, pkg.Topic{Name: service, QoS: 1}))
+	full.MqttExpect5(t, c, pkg.NewSubAck5(sid, nil, 1))
+
+	go func() {
+		full.MqttExpect5(t, c, func(p pkg.Packet) bool {
+			pp, ok := p.(*pkg.Publish)
+			if !ok {
+				return false
+			}
+			rt, ok := pp.Properties().Text(mqtt.PropResponseTopic)
+			if !ok {
+				return false
+			}
+			// the ack must not be taken as the reply
+			full.MqttSend5(t, c, pkg.PubAck(pp.ID()))
+			full.MqttSend5(t, c, pkg.SimplePublish(rt, append([]byte("re: "), pp.Payload()...)))
+			return string(pp.Payload()) == "ping"
+		})
+	}()
+
+	nc := full.NatsConnect(t, natsPort)
+	defer nc.Close()
+	m, err := nc.Request(mqtt.ToNATS(service), []byte("ping"), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(m.Data) != "re: ping" {
+		t.Fatalf("unexpected response %q", string(m.Data))
+	}
+	full.MqttDisconnect(t, c)
+}
+
+// aliasPublish returns a QoS 0 publish with the given topic name and topic alias
+func aliasPublish(topic string, alias int) *pkg.Publish {
+	pp := pkg.SimplePublish(topic, []byte("payload"))
+	pp.SetProperties(mqtt.Properties{}.Add(mqtt.PropTopicAlias, alias))
+	return pp
+}
+
+func TestTopicAlias5_inbound(t *testing.T) {
+	topic := "testing/alias/inbound"
+	sub := full.MqttConnectClean(t, mqttPort)
+	sid := nextPacketID()
+	full.MqttSend(t, sub, pkg.NewSubscribe(sid, pkg.Topic{Name: topic}))
+	full.MqttExpect(t, sub, pkg.NewSubAck(sid, 0))
+
+	conn := full.MqttConnectClean5(t, mqttPort, nil)
+	full.MqttSend5(t, conn, aliasPublish(topic, 1))
+	full.MqttSend5(t, conn, aliasPublish(``, 1))
+	pp := pkg.SimplePublish(topic, []byte("payload"))
+	full.MqttExpect(t, sub, pp, pp)
+	full.MqttDisconnect(t, conn)
+	full.MqttDisconnect(t, sub)
+}
+
+func TestTopicAlias5_invalid(t *testing.T) {
+	conn := full.MqttConnectClean5(t, mqttPort, nil)
+	full.MqttSend5(t, conn, aliasPublish("testing/alias/invalid", topicAliasMaximum+1))
+	full.MqttExpect5(t, conn, pkg.NewDisconnectV5(pkg.RcTopicAliasInvalid, nil))
+	full.MqttExpectConnReset(t, conn)
+}
+
+func TestTopicAlias5_unknown(t *testing.T) {
+	conn := full.MqttConnectClean5(t, mqttPort, nil)
+	full.MqttSend5(t, conn, aliasPublish(``, 1))
+	full.MqttExpect5(t, conn, pkg.NewDisconnectV5(pkg.RcProtocolError, nil))
+	full.MqttExpectConnReset(t, conn)
+}
+
+func TestTopicAlias5_outbound(t *testing.T) {
+	t1 := "testing/alias/one"
+	t2 := "testing/alias/two"
+	conn := full.MqttConnectClean5(t, mqttPort, mqtt.Properties{}.Add(mqtt.PropTopicAliasMaximum, 1))
+	sid := nextPacketID()
+	full.MqttSend5(t, conn, pkg.NewSubscribe5(sid, nil, pkg.Topic{Name: "testing/alias/+"}))
+	full.MqttExpect5(t, conn, pkg.NewSubAck5(sid, nil, 0))
+
+	pub := full.MqttConnectClean(t, mqttPort)
+	full.MqttSend(t, pub, pkg.SimplePublish(t1, []byte("payload")))
+	full.MqttExpect5(t, conn, aliasPublish(t1, 1))
+	full.MqttSend(t, pub, pkg.SimplePublish(t1, []byte("payload")))
+	full.MqttExpect5(t, conn, aliasPublish(``, 1))
+
+	// the client's maximum has been reached so no alias is assigned
+	full.MqttSend(t, pub, pkg.SimplePublish(t2, []byte("payload")))
+	full.MqttExpect5(t, conn, pkg.SimplePublish(t2, []byte("payload")))
+	full.MqttDisconnect(t, pub)
+	full.MqttDisconnect(t, conn)
+}
+
+func TestReceiveMaximum5_outbound(t *testing.T) {
+	topic := "testing/receive/max"
+	conn := full.MqttConnectClean5(t, mqttPort, mqtt.Properties{}.Add(mqtt.PropReceiveMaximum, 1))
+	sid := nextPacketID()
+	full.MqttSend5(t, conn, pkg.NewSubscribe5(sid, nil, pkg.Topic{Name: topic, QoS: 1}))
+	full.MqttExpect5(t, conn, pkg.NewSubAck5(sid, nil, 1))
+
+	pub := full.MqttConnectClean(t, mqttPort)
+	m1 := nextPacketID()
+	m2 := nextPacketID()
+	p1 := pkg.NewPublish2(m1, topic, []byte("first"), 1, false, false)
+	p2 := pkg.NewPublish2(m2, topic, []byte("second"), 1, false, false)
+	full.MqttSend(t, pub, p1, p2)
+	full.MqttExpect5(t, conn, p1)
+
+	// the second publication waits until the first is acknowledged
+	time.Sleep(50 * time.Millisecond)
+	full.MqttSend5(t, conn, pkg.PingRequestSingleton)
+	full.MqttExpect5(t, conn, pkg.PingResponseSingleton)
+	full.MqttSend5(t, conn, pkg.NewAckV5(pkg.TpPubAck, m1, pkg.RcSuccess, nil))
+	full.MqttExpect5(t, conn, p2)
+	full.MqttSend5(t, conn, pkg.NewAckV5(pkg.TpPubAck, m2, pkg.RcSuccess, nil))
+	full.MqttExpect(t, pub, pkg.PubAck(m1), pkg.PubAck(m2))
+	full.MqttDisconnect(t, pub)
+	full.MqttDisconnect(t, conn)
+}
+
+func TestReceiveMaximum5_exceeded(t *testing.T) {
+	// no one acknowledges publications on this topic
+	topic := "testing/receive/unacknowledged"
+	conn := full.MqttConnectClean5(t, mqttPort, nil)
+	for i := 0; i < receiveMaximum; i++ {
+		full.MqttSend5(t, conn, pkg.NewPublish2(nextPacketID(), topic, []byte("payload"), 1, false, false))
+	}
+	full.MqttSend5(t, conn, pkg.NewPublish2(nextPacketID(), topic, []byte("payload"), 1, false, false))
+	full.MqttExpect5(t, conn, pkg.NewDisconnectV5(pkg.RcReceiveMaximumExceeded, nil))
+	full.MqttExpectConnReset(t, conn)
+}
+
+func TestMaximumPacketSize5_inbound(t *testing.T) {
+	conn := full.MqttConnectClean5(t, mqttPort, nil)
+	full.MqttSend5(t, conn, pkg.SimplePublish("testing/packet/size", make([]byte, maximumPacketSize)))
+	full.MqttExpect5(t, conn, pkg.NewDisconnectV5(pkg.RcPacketTooLarge, nil))
+	full.MqttExpectConnReset(t, conn)
+}
+
+func TestMaximumPacketSize_inbound(t *testing.T) {
+	conn := full.MqttConnectClean(t, mqttPort)
+	full.MqttSend(t, conn, pkg.SimplePublish("testing/packet/size", make([]byte, maximumPacketSize)))
+	full.MqttExpectConnReset(t, conn)
+}
+
+func TestMaximumPacketSize5_outbound(t *testing.T) {
+	topic := "testing/packet/size"
+	conn := full.MqttConnectClean5(t, mqttPort, mqtt.Properties{}.Add(mqtt.PropMaximumPacketSize, 100))
+	sid := nextPacketID()
+	full.MqttSend5(t, conn, pkg.NewSubscribe5(sid, nil, pkg.Topic{Name: topic, QoS: 1}))
+	full.MqttExpect5(t, conn, pkg.NewSubAck5(sid, nil, 1))
+
+	// the large publication is dropped and acknowledged as if it had been delivered
+	pub := full.MqttConnectClean(t, mqttPort)
+	mid := nextPacketID()
+	small := pkg.SimplePublish(topic, []byte("small"))
+	full.MqttSend(t, pub, pkg.NewPublish2(mid, topic, make([]byte, 100), 1, false, false), small)
+	full.MqttExpect(t, pub, pkg.PubAck(mid))
+	full.MqttExpect5(t, conn, small)
+	full.MqttDisconnect(t, pub)
+	full.MqttDisconnect(t, conn)
+}
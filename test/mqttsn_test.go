@@ -0,0 +1,296 @@
+package test
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/tada/mqtt-nats/mqtt/pkg"
+	"github.com/tada/mqtt-nats/mqttsn"
+	"github.com/tada/mqtt-nats/test/full"
+)
+
+func expectNATSMessage(t *testing.T, ch <-chan []byte, data []byte) {
+	t.Helper()
+	select {
+	case m := <-ch:
+		if !bytes.Equal(m, data) {
+			t.Fatalf("expected %q, got %q", data, m)
+		}
+	case <-time.After(time.Second):
+		t.Fatal(`expected message did not arrive`)
+	}
+}
+
+// natsChannel subscribes to the given NATS subject and returns a channel that receives the message payloads
+func natsChannel(t *testing.T, subject string) (<-chan []byte, func()) {
+	t.Helper()
+	nc := full.NatsConnect(t, natsPort)
+	ch := make(chan []byte, 10)
+	if _, err := nc.Subscribe(subject, func(m *nats.Msg) { ch <- m.Data }); err != nil {
+		t.Fatal(err)
+	}
+	if err := nc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return ch, nc.Close
+}
+
+func TestMQTTSN_searchGateway(t *testing.T) {
+	conn := full.SNDial(t, snPort)
+	defer conn.Close()
+	full.SNSend(t, conn, &mqttsn.SearchGw{Radius: 1})
+	full.SNExpect(t, conn, &mqttsn.GwInfo{})
+}
+
+func TestMQTTSN_registerAndPublish(t *testing.T) {
+	ch, stop := natsChannel(t, "testing.sn.temperature")
+	defer stop()
+
+	conn := full.SNConnect(t, snPort, full.NextClientID())
+	defer conn.Close()
+	full.SNSend(t, conn, &mqttsn.Register{MsgID: 1, TopicName: "testing/sn/temperature"})
+	full.SNExpect(t, conn, &mqttsn.RegAck{TopicID: 1, MsgID: 1, ReturnCode: mqttsn.RcAccepted})
+
+	full.SNSend(t, conn, &mqttsn.Publish{Flags: mqttsn.QoSFlags(1), TopicID: 1, MsgID: 2, Data: []byte("21.5")})
+	full.SNExpect(t, conn, &mqttsn.PubAck{TopicID: 1, MsgID: 2, ReturnCode: mqttsn.RcAccepted})
+	expectNATSMessage(t, ch, []byte("21.5"))
+
+	// a QoS 2 message is published once even when it is sent again before PUBREL
+	pp := &mqttsn.Publish{Flags: mqttsn.QoSFlags(2), TopicID: 1, MsgID: 3, Data: []byte("22.0")}
+	full.SNSend(t, conn, pp)
+	full.SNExpect(t, conn, &mqttsn.Ack{MsgType: mqttsn.TpPubRec, MsgID: 3})
+	pp.Flags |= mqttsn.FlagDup
+	full.SNSend(t, conn, pp)
+	full.SNExpect(t, conn, &mqttsn.Ack{MsgType: mqttsn.TpPubRec, MsgID: 3})
+	full.SNSend(t, conn, &mqttsn.Ack{MsgType: mqttsn.TpPubRel, MsgID: 3})
+	full.SNExpect(t, conn, &mqttsn.Ack{MsgType: mqttsn.TpPubComp, MsgID: 3})
+	expectNATSMessage(t, ch, []byte("22.0"))
+	select {
+	case m := <-ch:
+		t.Fatalf("unexpected message %q", m)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	full.SNSend(t, conn, &mqttsn.Disconnect{})
+	full.SNExpect(t, conn, &mqttsn.Disconnect{})
+}
+
+func TestMQTTSN_publishReleasesPacketIDs(t *testing.T) {
+	topic := "testing/sn/ids"
+	conn := full.SNConnect(t, snPort, full.NextClientID())
+	defer conn.Close()
+	full.SNSend(t, conn, &mqttsn.Register{MsgID: 1, TopicName: topic})
+	full.SNExpect(t, conn, &mqttsn.RegAck{TopicID: 1, MsgID: 1, ReturnCode: mqttsn.RcAccepted})
+
+	// publish more QoS 1 messages than there are packet IDs
+	for i := 0; i <= math.MaxUint16; i++ {
+		mid := uint16(i%math.MaxUint16 + 1)
+		full.SNSend(t, conn, &mqttsn.Publish{Flags: mqttsn.QoSFlags(1), TopicID: 1, MsgID: mid, Data: []byte("x")})
+		full.SNExpect(t, conn, &mqttsn.PubAck{TopicID: 1, MsgID: mid, ReturnCode: mqttsn.RcAccepted})
+	}
+
+	// the bridge still has packet IDs for QoS 1 deliveries of retained messages to MQTT clients
+	full.SNSend(t, conn,
+		&mqttsn.Publish{Flags: mqttsn.QoSFlags(1) | mqttsn.FlagRetain, TopicID: 1, MsgID: 1, Data: []byte("last")})
+	full.SNExpect(t, conn, &mqttsn.PubAck{TopicID: 1, MsgID: 1, ReturnCode: mqttsn.RcAccepted})
+	defer full.SNSend(t, conn, &mqttsn.Publish{Flags: mqttsn.FlagRetain, TopicID: 1})
+
+	mc := full.MqttConnectClean(t, mqttPort)
+	defer full.MqttDisconnect(t, mc)
+	sid := nextPacketID()
+	full.MqttSend(t, mc, pkg.NewSubscribe(sid, pkg.Topic{Name: topic, QoS: 1}))
+	full.MqttExpect(t, mc, pkg.NewSubAck(sid, 1))
+	var id uint16
+	full.MqttExpect(t, mc, func(p pkg.Packet) bool {
+		pp, ok := p.(*pkg.Publish)
+		if ok {
+			id = pp.ID()
+		}
+		return ok && id != 0 && string(pp.Payload()) == "last"
+	})
+	full.MqttSend(t, mc, pkg.PubAck(id))
+}
+
+func TestMQTTSN_unknownTopicID(t *testing.T) {
+	conn := full.SNConnect(t, snPort, full.NextClientID())
+	defer conn.Close()
+	full.SNSend(t, conn, &mqttsn.Publish{Flags: mqttsn.QoSFlags(1), TopicID: 99, MsgID: 1, Data: []byte("x")})
+	full.SNExpect(t, conn, &mqttsn.PubAck{TopicID: 99, MsgID: 1, ReturnCode: mqttsn.RcInvalidTopicID})
+}
+
+func TestMQTTSN_qosMinusOne(t *testing.T) {
+	predefined, stop := natsChannel(t, "testing.sn.predefined")
+	defer stop()
+	short, stopShort := natsChannel(t, "t1")
+	defer stopShort()
+
+	// no CONNECT is needed for QoS -1
+	conn := full.SNDial(t, snPort)
+	defer conn.Close()
+	full.SNSend(t, conn,
+		&mqttsn.Publish{
+			Flags:   mqttsn.QoSFlags(mqttsn.QoSMinusOne) | mqttsn.TopicIDPredefined,
+			TopicID: 1,
+			Data:    []byte("predefined")},
+		&mqttsn.Publish{
+			Flags:   mqttsn.QoSFlags(mqttsn.QoSMinusOne) | mqttsn.TopicIDShort,
+			TopicID: mqttsn.ShortTopicID("t1"),
+			Data:    []byte("short")})
+	expectNATSMessage(t, predefined, []byte("predefined"))
+	expectNATSMessage(t, short, []byte("short"))
+}
+
+func TestMQTTSN_subscribe(t *testing.T) {
+	conn := full.SNConnect(t, snPort, full.NextClientID())
+	defer conn.Close()
+	full.SNSend(t, conn, &mqttsn.Subscribe{Flags: mqttsn.QoSFlags(1), MsgID: 1, TopicName: "testing/sn/+/status"})
+	full.SNExpect(t, conn, &mqttsn.SubAck{Flags: mqttsn.QoSFlags(1), MsgID: 1, ReturnCode: mqttsn.RcAccepted})
+
+	topic := "testing/sn/device/status"
+	mc := full.MqttConnectClean(t, mqttPort)
+	defer full.MqttDisconnect(t, mc)
+	full.MqttSend(t, mc, pkg.SimplePublish(topic, []byte("on")))
+
+	// the gateway registers the topic name before it uses the topic ID
+	full.SNExpect(t, conn,
+		&mqttsn.Register{TopicID: 1, MsgID: 1, TopicName: topic},
+		&mqttsn.Publish{TopicID: 1, Data: []byte("on")})
+
+	// a QoS 1 message is acknowledged when the MQTT-SN client acknowledges it
+	mid := nextPacketID()
+	full.MqttSend(t, mc, pkg.NewPublish2(mid, topic, []byte("off"), 1, false, false))
+	full.SNExpect(t, conn, &mqttsn.Publish{Flags: mqttsn.QoSFlags(1), TopicID: 1, MsgID: 2, Data: []byte("off")})
+	full.SNSend(t, conn, &mqttsn.PubAck{TopicID: 1, MsgID: 2, ReturnCode: mqttsn.RcAccepted})
+	full.MqttExpect(t, mc, pkg.PubAck(mid))
+
+	full.SNSend(t, conn, &mqttsn.Unsubscribe{MsgID: 3, TopicName: "testing/sn/+/status"})
+	full.SNExpect(t, conn, &mqttsn.Ack{MsgType: mqttsn.TpUnsubAck, MsgID: 3})
+}
+
+func TestMQTTSN_unsubscribeRegistersNothing(t *testing.T) {
+	conn := full.SNConnect(t, snPort, full.NextClientID())
+	defer conn.Close()
+	full.SNSend(t, conn, &mqttsn.Unsubscribe{MsgID: 1, TopicName: "testing/sn/unsubscribed"})
+	full.SNExpect(t, conn, &mqttsn.Ack{MsgType: mqttsn.TpUnsubAck, MsgID: 1})
+
+	// the first topic ID is still free
+	full.SNSend(t, conn, &mqttsn.Register{MsgID: 2, TopicName: "testing/sn/registered"})
+	full.SNExpect(t, conn, &mqttsn.RegAck{TopicID: 1, MsgID: 2, ReturnCode: mqttsn.RcAccepted})
+}
+
+func TestMQTTSN_subscribePredefined(t *testing.T) {
+	conn := full.SNConnect(t, snPort, full.NextClientID())
+	defer conn.Close()
+	full.SNSend(t, conn, &mqttsn.Subscribe{Flags: mqttsn.TopicIDPredefined, MsgID: 1, TopicID: 1})
+	full.SNExpect(t, conn, &mqttsn.SubAck{TopicID: 1, MsgID: 1, ReturnCode: mqttsn.RcAccepted})
+
+	nc := full.NatsConnect(t, natsPort)
+	defer nc.Close()
+	if err := nc.Publish("testing.sn.predefined", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	full.SNExpect(t, conn, &mqttsn.Publish{Flags: mqttsn.TopicIDPredefined, TopicID: 1, Data: []byte("hello")})
+}
+
+func TestMQTTSN_retained(t *testing.T) {
+	topic := "testing/sn/retained"
+	conn := full.SNConnect(t, snPort, full.NextClientID())
+	defer conn.Close()
+	full.SNSend(t, conn, &mqttsn.Register{MsgID: 1, TopicName: topic})
+	full.SNExpect(t, conn, &mqttsn.RegAck{TopicID: 1, MsgID: 1, ReturnCode: mqttsn.RcAccepted})
+	full.SNSend(t, conn,
+		&mqttsn.Publish{Flags: mqttsn.FlagRetain, TopicID: 1, Data: []byte("kept")},
+		&mqttsn.PingReq{})
+	full.SNExpect(t, conn, mqttsn.Empty(mqttsn.TpPingResp))
+
+	// the message is retained for MQTT clients
+	mc := full.MqttConnectClean(t, mqttPort)
+	defer full.MqttDisconnect(t, mc)
+	mid := nextPacketID()
+	full.MqttSend(t, mc, pkg.NewSubscribe(mid, pkg.Topic{Name: topic}))
+	full.MqttExpect(t, mc, pkg.NewSubAck(mid, 0), pkg.NewPublish2(0, topic, []byte("kept"), 0, false, true))
+
+	// and for MQTT-SN clients
+	sc := full.SNConnect(t, snPort, full.NextClientID())
+	defer sc.Close()
+	full.SNSend(t, sc, &mqttsn.Subscribe{MsgID: 1, TopicName: topic})
+	full.SNExpect(t, sc,
+		&mqttsn.SubAck{TopicID: 1, MsgID: 1, ReturnCode: mqttsn.RcAccepted},
+		&mqttsn.Publish{Flags: mqttsn.FlagRetain, TopicID: 1, Data: []byte("kept")})
+
+	// an empty retained message deletes it
+	full.MqttSend(t, mc, pkg.NewPublish2(0, topic, nil, 0, false, true))
+	full.SNExpect(t, sc, &mqttsn.Publish{TopicID: 1, Data: []byte{}})
+}
+
+func TestMQTTSN_sleep(t *testing.T) {
+	clientID := full.NextClientID()
+	conn := full.SNConnect(t, snPort, clientID)
+	defer conn.Close()
+	full.SNSend(t, conn, &mqttsn.Subscribe{MsgID: 1, TopicName: "testing/sn/sleepy"})
+	full.SNExpect(t, conn, &mqttsn.SubAck{TopicID: 1, MsgID: 1, ReturnCode: mqttsn.RcAccepted})
+	full.SNSend(t, conn, &mqttsn.Disconnect{Duration: 10})
+	full.SNExpect(t, conn, &mqttsn.Disconnect{})
+
+	nc := full.NatsConnect(t, natsPort)
+	defer nc.Close()
+	for _, m := range []string{"first", "second"} {
+		if err := nc.Publish("testing.sn.sleepy", []byte(m)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := nc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing is sent while the client sleeps
+	_ = conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if n, err := conn.Read(make([]byte, 100)); err == nil {
+		t.Fatalf("unexpected message of %d bytes", n)
+	}
+
+	// the buffered messages are sent when the client wakes up
+	full.SNSend(t, conn, &mqttsn.PingReq{ClientID: clientID})
+	full.SNExpect(t, conn,
+		&mqttsn.Publish{TopicID: 1, Data: []byte("first")},
+		&mqttsn.Publish{TopicID: 1, Data: []byte("second")},
+		mqttsn.Empty(mqttsn.TpPingResp))
+
+	full.SNSend(t, conn, &mqttsn.Connect{Duration: 60, ClientID: clientID})
+	full.SNExpect(t, conn, &mqttsn.ConnAck{ReturnCode: mqttsn.RcAccepted})
+	full.SNSend(t, conn, &mqttsn.Disconnect{})
+	full.SNExpect(t, conn, &mqttsn.Disconnect{})
+}
+
+func TestMQTTSN_will(t *testing.T) {
+	ch, stop := natsChannel(t, "testing.sn.will")
+	defer stop()
+
+	conn := full.SNDial(t, snPort)
+	defer conn.Close()
+	full.SNSend(t, conn, &mqttsn.Connect{
+		Flags: mqttsn.FlagCleanSession | mqttsn.FlagWill, Duration: 1, ClientID: full.NextClientID()})
+	full.SNExpect(t, conn, mqttsn.Empty(mqttsn.TpWillTopicReq))
+	full.SNSend(t, conn, &mqttsn.WillTopic{Topic: "testing/sn/will"})
+	full.SNExpect(t, conn, mqttsn.Empty(mqttsn.TpWillMsgReq))
+	full.SNSend(t, conn, &mqttsn.WillMsg{Message: []byte("gone")})
+	full.SNExpect(t, conn, &mqttsn.ConnAck{ReturnCode: mqttsn.RcAccepted})
+
+	// the client is lost when nothing is heard from it for one and a half times its keep alive
+	select {
+	case m := <-ch:
+		t.Fatalf("will %q published too early", m)
+	case <-time.After(time.Second):
+	}
+	select {
+	case m := <-ch:
+		if string(m) != "gone" {
+			t.Fatalf("unexpected will %q", m)
+		}
+	case <-time.After(time.Second):
+		t.Fatal(`will did not arrive`)
+	}
+}
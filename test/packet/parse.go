@@ -14,10 +14,15 @@ import (
 
 // Parse is a test helper function that parses the next package from the given reader and returns it. t.Fatal(err)
 // will be called if an error occurs when reading or parsing.
+//
+// The packet is parsed using MQTT 3.1.1 unless the given reader is an *mqtt.Reader with another protocol level.
 func Parse(t *testing.T, rdr io.Reader) pkg.Packet {
 	t.Helper()
 	// Read packet type and flags
-	r := mqtt.NewReader(rdr)
+	r, ok := rdr.(*mqtt.Reader)
+	if !ok {
+		r = mqtt.NewReader(rdr)
+	}
 	var p pkg.Packet
 	b, err := r.ReadByte()
 	if err == nil {
@@ -31,7 +36,13 @@ func Parse(t *testing.T, rdr io.Reader) pkg.Packet {
 			case pkg.TpConnAck:
 				p, err = pkg.ParseConnAck(r, b, rl)
 			case pkg.TpDisconnect:
-				p = pkg.DisconnectSingleton
+				p, err = pkg.ParseDisconnect(r, b, rl)
+			case pkg.TpAuth:
+				if r.V5() {
+					p, err = pkg.ParseAuth(r, b, rl)
+				} else {
+					err = fmt.Errorf("received unknown packet type %d", (b&pkg.TpMask)>>4)
+				}
 			case pkg.TpPing:
 				p = pkg.PingRequestSingleton
 			case pkg.TpPingResp:
@@ -66,3 +77,11 @@ func Parse(t *testing.T, rdr io.Reader) pkg.Packet {
 	}
 	return p
 }
+
+// Parse5 is like Parse but uses MQTT 5 when parsing the packet
+func Parse5(t *testing.T, rdr io.Reader) pkg.Packet {
+	t.Helper()
+	r := mqtt.NewReader(rdr)
+	r.SetProtocolLevel(mqtt.ProtocolLevel5)
+	return Parse(t, r)
+}
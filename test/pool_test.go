@@ -0,0 +1,106 @@
+package test
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/tada/mqtt-nats/bridge"
+	"github.com/tada/mqtt-nats/mqtt"
+	"github.com/tada/mqtt-nats/mqtt/pkg"
+	"github.com/tada/mqtt-nats/test/full"
+)
+
+const poolMqttPort = 11885
+
+// poolBridge starts a bridge where the clients share two NATS connections and the bridge enforces the
+// permissions. The returned function stops the bridge.
+func poolBridge(t *testing.T) func() {
+	t.Helper()
+	return full.StartBridge(t, &bridge.Options{
+		Port:         poolMqttPort,
+		NATSUrls:     ":" + strconv.Itoa(natsPort),
+		RepeatRate:   50,
+		NATSPoolSize: 2,
+		Permissions: map[string]*bridge.Permission{
+			"alice": {Password: "secret", Publish: []string{"pool.alice.>"}, Subscribe: []string{"pool.>"}},
+			"":      {Publish: []string{}, Subscribe: []string{"pool.public"}}}})
+}
+
+func poolConnect(t *testing.T, creds *pkg.Credentials, rt pkg.ReturnCode) net.Conn {
+	t.Helper()
+	conn := full.MqttConnect(t, poolMqttPort)
+	full.MqttSend(t, conn, pkg.NewConnect(full.NextClientID(), true, 1, nil, creds))
+	full.MqttExpect(t, conn, pkg.NewConnAck(false, rt))
+	return conn
+}
+
+func TestPool_authentication(t *testing.T) {
+	defer poolBridge(t)()
+
+	conn := poolConnect(t, &pkg.Credentials{User: "alice", Password: []byte("wrong")}, pkg.RtBadUserNameOrPassword)
+	full.MqttExpectConnReset(t, conn)
+	conn = poolConnect(t, &pkg.Credentials{User: "mallory", Password: []byte("secret")}, pkg.RtBadUserNameOrPassword)
+	full.MqttExpectConnReset(t, conn)
+	conn = poolConnect(t, &pkg.Credentials{User: "alice", Password: []byte("secret")}, pkg.RtAccepted)
+	full.MqttDisconnect(t, conn)
+}
+
+func TestPool_permissions(t *testing.T) {
+	defer poolBridge(t)()
+
+	alice := poolConnect(t, &pkg.Credentials{User: "alice", Password: []byte("secret")}, pkg.RtAccepted)
+	anon := poolConnect(t, nil, pkg.RtAccepted)
+
+	mid := nextPacketID()
+	full.MqttSend(t, anon, pkg.NewSubscribe(mid, pkg.Topic{Name: "pool/public"}, pkg.Topic{Name: "pool/#"}))
+	full.MqttExpect(t, anon, pkg.NewSubAck(mid, 0, 0x80))
+	mid = nextPacketID()
+	full.MqttSend(t, alice, pkg.NewSubscribe(mid, pkg.Topic{Name: "pool/#"}))
+	full.MqttExpect(t, alice, pkg.NewSubAck(mid, 0))
+
+	// the denied publication is acknowledged but never delivered
+	pid := nextPacketID()
+	full.MqttSend(t, alice, pkg.NewPublish2(pid, "pool/public", []byte("denied"), 1, false, false))
+	full.MqttExpect(t, alice, pkg.PubAck(pid))
+	full.MqttSend(t, anon, pkg.NewPublish2(0, "pool/alice/x", []byte("denied"), 0, false, false))
+
+	full.MqttSend(t, alice, pkg.NewPublish2(0, "pool/alice/x", []byte("allowed"), 0, false, false))
+	full.MqttExpect(t, alice, func(p pkg.Packet) bool {
+		pp, ok := p.(*pkg.Publish)
+		return ok && pp.TopicName() == "pool/alice/x" && string(pp.Payload()) == "allowed"
+	})
+	full.MqttDisconnect(t, anon)
+	full.MqttDisconnect(t, alice)
+}
+
+func TestPool_responseTopicPermission(t *testing.T) {
+	defer poolBridge(t)()
+
+	alice := full.MqttConnect(t, poolMqttPort)
+	full.MqttSend(t, alice, pkg.NewConnect5(full.NextClientID(), true, 1, nil,
+		&pkg.Credentials{User: "alice", Password: []byte("secret")}, nil))
+	full.MqttExpect5(t, alice, func(p pkg.Packet) bool {
+		ca, ok := p.(*pkg.ConnAck)
+		return ok && ca.ReasonCode() == pkg.RcSuccess
+	})
+
+	// the response would be published to a subject that alice may not publish to
+	nc := full.NatsConnect(t, natsPort)
+	defer nc.Close()
+	ns, err := nc.SubscribeSync("pool.alice.service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid := nextPacketID()
+	pp := pkg.NewPublish2(pid, "pool/alice/service", []byte("request"), 1, false, false)
+	pp.SetProperties(mqtt.Properties{}.Add(mqtt.PropResponseTopic, "pool/public"))
+	full.MqttSend5(t, alice, pp)
+	full.MqttExpect5(t, alice, pkg.NewAckV5(pkg.TpPubAck, pid, pkg.RcNotAuthorized, nil))
+	if _, err = ns.NextMsg(100 * time.Millisecond); err != nats.ErrTimeout {
+		t.Fatalf("expected no request, got %v", err)
+	}
+	full.MqttDisconnect(t, alice)
+}
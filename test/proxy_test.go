@@ -0,0 +1,114 @@
+package test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/tada/mqtt-nats/bridge"
+	"github.com/tada/mqtt-nats/logger"
+	"github.com/tada/mqtt-nats/mqtt/pkg"
+	"github.com/tada/mqtt-nats/test/full"
+)
+
+const proxyMqttPort = 11893
+
+// syncBuffer is a bytes.Buffer that can be written to by the bridge while a test reads it
+type syncBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+// proxyBridge starts a bridge behind a load balancer that sends PROXY protocol headers and terminates TLS.
+// Only the client with a certificate for tlsDevice is permitted. The returned function stops the bridge.
+func proxyBridge(t *testing.T, log *syncBuffer) func() {
+	t.Helper()
+	_, stop := full.StartBridgeWithLogger(t, logger.New(logger.Debug, log, log), &bridge.Options{
+		NATSUrls:     ":" + strconv.Itoa(natsPort),
+		RepeatRate:   50,
+		NATSPoolSize: 1,
+		Permissions:  map[string]*bridge.Permission{tlsDevice: {}},
+		Listeners: []*bridge.Listener{{
+			Address:       ":" + strconv.Itoa(proxyMqttPort),
+			ProxyProtocol: true,
+			Auth:          bridge.ClientAuthCertificate}}})
+	return stop
+}
+
+func tlv(t byte, v []byte) []byte {
+	return append([]byte{t, byte(len(v) >> 8), byte(len(v))}, v...)
+}
+
+// proxyV2Header returns a PROXY protocol v2 header for a TCP over IPv4 connection from 192.0.2.1:56324 where
+// the load balancer verified a client certificate with the given common name
+func proxyV2Header(commonName string) []byte {
+	ssl := append([]byte{0x07, 0, 0, 0, 0}, tlv(0x21, []byte("TLSv1.3"))...)
+	ssl = append(ssl, tlv(0x22, []byte(commonName))...)
+	body := []byte{192, 0, 2, 1, 192, 0, 2, 2, 0xdc, 0x04, 0x07, 0x5b}
+	body = append(body, tlv(0x20, ssl)...)
+	h := append([]byte("\r\n\r\n\x00\r\nQUIT\n"), 0x21, 0x11, 0, 0)
+	binary.BigEndian.PutUint16(h[14:], uint16(len(body)))
+	return append(h, body...)
+}
+
+func proxyConnect(t *testing.T, header []byte, rt pkg.ReturnCode) net.Conn {
+	t.Helper()
+	conn := full.MqttConnect(t, proxyMqttPort)
+	if _, err := conn.Write(header); err != nil {
+		t.Fatal(err)
+	}
+	full.MqttSend(t, conn, pkg.NewConnect(full.NextClientID(), true, 1, nil, nil))
+	full.MqttExpect(t, conn, pkg.NewConnAck(false, rt))
+	return conn
+}
+
+func TestProxy_v2(t *testing.T) {
+	log := &syncBuffer{}
+	defer proxyBridge(t, log)()
+
+	conn := proxyConnect(t, proxyV2Header(tlsDevice), pkg.RtAccepted)
+	full.MqttDisconnect(t, conn)
+	if !strings.Contains(log.String(), "accepted connection from 192.0.2.1:56324") {
+		t.Fatal("the client address of the PROXY protocol header was not used")
+	}
+
+	conn = proxyConnect(t, proxyV2Header(tlsStranger), pkg.RtBadUserNameOrPassword)
+	full.MqttExpectConnReset(t, conn)
+}
+
+func TestProxy_v1(t *testing.T) {
+	log := &syncBuffer{}
+	defer proxyBridge(t, log)()
+
+	// the v1 header carries no certificate
+	conn := proxyConnect(t, []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 1883\r\n"), pkg.RtNotAuthorized)
+	full.MqttExpectConnReset(t, conn)
+	if !strings.Contains(log.String(), "accepted connection from [2001:db8::1]:56324") {
+		t.Fatal("the client address of the PROXY protocol header was not used")
+	}
+}
+
+func TestProxy_headerMissing(t *testing.T) {
+	log := &syncBuffer{}
+	defer proxyBridge(t, log)()
+
+	conn := full.MqttConnect(t, proxyMqttPort)
+	full.MqttSend(t, conn, pkg.NewConnect(full.NextClientID(), true, 1, nil, nil))
+	full.MqttExpectConnReset(t, conn)
+}
@@ -55,25 +55,117 @@ func TestPublishSubscribe_qos_1(t *testing.T) {
 func TestPublishSubscribe_qos_2(t *testing.T) {
 	topic := "testing/some/topic"
 	mid := nextPacketID()
-	pp := pkg.NewPublish2(mid, topic, []byte("payload"), 1, false, false)
+	pp := pkg.NewPublish2(mid, topic, []byte("payload"), 2, false, false)
 	c1 := full.MqttConnectClean(t, mqttPort)
 	gotIt := make(chan bool, 1)
 	go func() {
 		sid := nextPacketID()
 		full.MqttSend(t, c1, pkg.NewSubscribe(sid, pkg.Topic{Name: topic, QoS: 2}))
-		full.MqttExpect(t, c1, pkg.NewSubAck(sid, 1), pp)
+		full.MqttExpect(t, c1, pkg.NewSubAck(sid, 2))
+		gotIt <- true
+		full.MqttExpect(t, c1, pp)
+		full.MqttSend(t, c1, pkg.PubRec(mid))
+		full.MqttExpect(t, c1, pkg.PubRel(mid))
+		full.MqttSend(t, c1, pkg.PubComp(mid))
+		gotIt <- true
+	}()
+	full.AssertMessageReceived(t, gotIt)
+
+	c2 := full.MqttConnectClean(t, mqttPort)
+	full.MqttSend(t, c2, pp)
+	full.MqttExpect(t, c2, pkg.PubRec(mid))
+
+	// resending the packet before PUBREL must not cause a second delivery
+	dp := pkg.NewPublish2(mid, topic, []byte("payload"), 2, true, false)
+	full.MqttSend(t, c2, dp)
+	full.MqttExpect(t, c2, pkg.PubRec(mid))
+	full.MqttSend(t, c2, pkg.PubRel(mid))
+	full.MqttExpect(t, c2, pkg.PubComp(mid))
+	full.MqttDisconnect(t, c2)
+	full.AssertMessageReceived(t, gotIt)
+
+	// verify that no duplicate arrives
+	full.MqttSend(t, c1, pkg.PingRequestSingleton)
+	full.MqttExpect(t, c1, pkg.PingResponseSingleton)
+	full.MqttDisconnect(t, c1)
+}
+
+func TestPublishSubscribe_qos_2_downgrade(t *testing.T) {
+	topic := "testing/some/topic"
+	mid := nextPacketID()
+	c1 := full.MqttConnectClean(t, mqttPort)
+	gotIt := make(chan bool, 1)
+	go func() {
+		sid := nextPacketID()
+		full.MqttSend(t, c1, pkg.NewSubscribe(sid, pkg.Topic{Name: topic, QoS: 1}))
+		full.MqttExpect(t, c1, pkg.NewSubAck(sid, 1))
+		gotIt <- true
+		full.MqttExpect(t, c1, pkg.NewPublish2(mid, topic, []byte("payload"), 1, false, false))
 		full.MqttSend(t, c1, pkg.PubAck(mid))
 		full.MqttDisconnect(t, c1)
 		gotIt <- true
 	}()
+	full.AssertMessageReceived(t, gotIt)
 
 	c2 := full.MqttConnectClean(t, mqttPort)
-	full.MqttSend(t, c2, pp)
-	full.MqttExpect(t, c2, pkg.PubAck(mid))
+	full.MqttSend(t, c2, pkg.NewPublish2(mid, topic, []byte("payload"), 2, false, false))
+	full.MqttExpect(t, c2, pkg.PubRec(mid))
+	full.MqttSend(t, c2, pkg.PubRel(mid))
+	full.MqttExpect(t, c2, pkg.PubComp(mid))
 	full.MqttDisconnect(t, c2)
 	full.AssertMessageReceived(t, gotIt)
 }
 
+func TestPublishSubscribe_qos_2_restart(t *testing.T) {
+	topic := "testing/some/topic"
+	mid := nextPacketID()
+	pp := pkg.NewPublish2(mid, topic, []byte("payload"), 2, false, false)
+
+	c1ID := full.NextClientID()
+	c1 := full.MqttConnect(t, mqttPort)
+	gotIt := make(chan bool, 1)
+	go func() {
+		full.MqttSend(t, c1, pkg.NewConnect(c1ID, false, 1, nil, nil))
+		full.MqttExpect(t, c1, pkg.NewConnAck(false, 0))
+
+		sid := nextPacketID()
+		full.MqttSend(t, c1, pkg.NewSubscribe(sid, pkg.Topic{Name: topic, QoS: 2}))
+		full.MqttExpect(t, c1, pkg.NewSubAck(sid, 2))
+		gotIt <- true
+		full.MqttExpect(t, c1, pp)
+		full.MqttSend(t, c1, pkg.PubRec(mid))
+		full.MqttExpect(t, c1, pkg.PubRel(mid))
+		gotIt <- true
+	}()
+
+	c2ID := full.NextClientID()
+	c2 := full.MqttConnect(t, mqttPort)
+	full.MqttSend(t, c2, pkg.NewConnect(c2ID, false, 1, nil, nil))
+	full.MqttExpect(t, c2, pkg.NewConnAck(false, 0))
+	full.AssertMessageReceived(t, gotIt)
+	full.MqttSend(t, c2, pp)
+	full.MqttExpect(t, c2, pkg.PubRec(mid))
+	full.AssertMessageReceived(t, gotIt)
+
+	full.RestartBridge(t, mqttServer)
+
+	// client c1 reestablishes session and receives the PUBREL again
+	c1 = full.MqttConnect(t, mqttPort)
+	full.MqttSend(t, c1, pkg.NewConnect(c1ID, false, 1, nil, nil))
+	full.MqttExpect(t, c1, pkg.NewConnAck(true, 0), pkg.PubRel(mid))
+	full.MqttSend(t, c1, pkg.PubComp(mid))
+
+	// client c2 reestablishes session and completes the handshake
+	c2 = full.MqttConnect(t, mqttPort)
+	full.MqttSend(t, c2, pkg.NewConnect(c2ID, false, 1, nil, nil))
+	full.MqttExpect(t, c2, pkg.NewConnAck(true, 0))
+	full.MqttSend(t, c2, pkg.PubRel(mid))
+	full.MqttExpect(t, c2, pkg.PubComp(mid))
+
+	full.MqttDisconnect(t, c1)
+	full.MqttDisconnect(t, c2)
+}
+
 func TestPublishSubscribe_qos_1_restart(t *testing.T) {
 	topic := "testing/some/topic"
 	mid := nextPacketID()
@@ -232,13 +324,6 @@ func TestUnubscribe(t *testing.T) {
 	full.MqttDisconnect(t, c1)
 }
 
-func TestPublish_qos_2(t *testing.T) {
-	conn := full.MqttConnectClean(t, mqttPort)
-	full.MqttSend(t, conn, pkg.NewPublish2(
-		nextPacketID(), "testing/some/topic", []byte("payload"), 2, false, false))
-	full.MqttExpectConnReset(t, conn)
-}
-
 func TestPublish_qos_3(t *testing.T) {
 	conn := full.MqttConnectClean(t, mqttPort)
 	full.MqttSend(t, conn, pkg.NewPublish2(
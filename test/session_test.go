@@ -0,0 +1,306 @@
+package test
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/tada/mqtt-nats/mqtt"
+	"github.com/tada/mqtt-nats/mqtt/pkg"
+	"github.com/tada/mqtt-nats/test/full"
+)
+
+// connectUnclean5 connects an MQTT 5 client that resumes any existing session and asserts the session
+// present flag of the CONNACK
+func connectUnclean5(t *testing.T, cid string, expiry int, sessionPresent bool) net.Conn {
+	t.Helper()
+	var props mqtt.Properties
+	if expiry > 0 {
+		props = props.Add(mqtt.PropSessionExpiryInterval, expiry)
+	}
+	conn := full.MqttConnect(t, mqttPort)
+	full.MqttSend(t, conn, pkg.NewConnect5(cid, false, 1, nil, nil, props))
+	full.MqttExpect5(t, conn, func(p pkg.Packet) bool {
+		ca, ok := p.(*pkg.ConnAck)
+		return ok && ca.ReasonCode() == pkg.RcSuccess && ca.SessionPresent() == sessionPresent
+	})
+	return conn
+}
+
+// disconnect5 sends a DISCONNECT and waits for the bridge to close the connection
+func disconnect5(t *testing.T, conn net.Conn, props mqtt.Properties) {
+	t.Helper()
+	full.MqttSend5(t, conn, pkg.NewDisconnectV5(pkg.RcSuccess, props))
+	full.MqttExpectConnReset(t, conn)
+}
+
+func TestSessionExpiry5_resume(t *testing.T) {
+	cid := full.NextClientID()
+	conn := connectUnclean5(t, cid, 10, false)
+	disconnect5(t, conn, nil)
+	conn = connectUnclean5(t, cid, 10, true)
+	disconnect5(t, conn, nil)
+}
+
+func TestSessionExpiry5_zero(t *testing.T) {
+	cid := full.NextClientID()
+	conn := connectUnclean5(t, cid, 0, false)
+	disconnect5(t, conn, nil)
+	if mqttServer.SessionManager().Get(cid) != nil {
+		t.Fatal("session was not removed on disconnect")
+	}
+	conn = connectUnclean5(t, cid, 0, false)
+	disconnect5(t, conn, nil)
+}
+
+func TestSessionExpiry5_expired(t *testing.T) {
+	cid := full.NextClientID()
+	conn := connectUnclean5(t, cid, 1, false)
+	disconnect5(t, conn, nil)
+	if mqttServer.SessionManager().Get(cid) == nil {
+		t.Fatal("session was removed on disconnect")
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if mqttServer.SessionManager().Get(cid) != nil {
+		t.Fatal("expired session was not removed")
+	}
+	conn = connectUnclean5(t, cid, 1, false)
+	disconnect5(t, conn, nil)
+}
+
+func TestSessionExpiry5_setOnDisconnect(t *testing.T) {
+	cid := full.NextClientID()
+	conn := connectUnclean5(t, cid, 10, false)
+	disconnect5(t, conn, mqtt.Properties{}.Add(mqtt.PropSessionExpiryInterval, 0))
+	conn = connectUnclean5(t, cid, 10, false)
+	disconnect5(t, conn, nil)
+}
+
+func TestSessionExpiry5_badDisconnect(t *testing.T) {
+	conn := connectUnclean5(t, full.NextClientID(), 0, false)
+	full.MqttSend5(t, conn, pkg.NewDisconnectV5(pkg.RcSuccess,
+		mqtt.Properties{}.Add(mqtt.PropSessionExpiryInterval, 10)))
+	full.MqttExpect5(t, conn, pkg.NewDisconnectV5(pkg.RcProtocolError, nil))
+	full.MqttExpectConnReset(t, conn)
+}
+
+func TestSessionExpiry_persisted(t *testing.T) {
+	cid := full.NextClientID()
+	conn := connectUnclean5(t, cid, 1, false)
+	disconnect5(t, conn, nil)
+	full.RestartBridge(t, mqttServer)
+	s := mqttServer.SessionManager().Get(cid)
+	if s == nil {
+		t.Fatal("session was not restored")
+	}
+	if s.DisconnectTime().IsZero() {
+		t.Fatal("disconnect time was not restored")
+	}
+}
+
+func TestSessionSubscriptions(t *testing.T) {
+	topic := "testing/session/subscriptions"
+	c := pkg.NewConnect(full.NextClientID(), false, 1, nil, nil)
+	conn := full.MqttConnect(t, mqttPort)
+	full.MqttSend(t, conn, c)
+	full.MqttExpect(t, conn, pkg.NewConnAck(false, 0))
+	sid := nextPacketID()
+	full.MqttSend(t, conn, pkg.NewSubscribe(sid, pkg.Topic{Name: topic, QoS: 1}))
+	full.MqttExpect(t, conn, pkg.NewSubAck(sid, 1))
+	full.MqttDisconnect(t, conn)
+
+	// the subscription is restored when the session is resumed
+	pp := pkg.SimplePublish(topic, []byte("resumed"))
+	conn = full.MqttConnect(t, mqttPort)
+	full.MqttSend(t, conn, c)
+	full.MqttExpect(t, conn, pkg.NewConnAck(true, 0))
+	pub := full.MqttConnectClean(t, mqttPort)
+	full.MqttSend(t, pub, pp)
+	full.MqttExpect(t, conn, pp)
+	full.MqttDisconnect(t, conn)
+
+	// and after a restart of the bridge
+	full.RestartBridge(t, mqttServer)
+	pp = pkg.SimplePublish(topic, []byte("restarted"))
+	conn = full.MqttConnect(t, mqttPort)
+	full.MqttSend(t, conn, c)
+	full.MqttExpect(t, conn, pkg.NewConnAck(true, 0))
+	pub = full.MqttConnectClean(t, mqttPort)
+	full.MqttSend(t, pub, pp)
+	full.MqttExpect(t, conn, pp)
+
+	// an unsubscribe is remembered too
+	uid := nextPacketID()
+	full.MqttSend(t, conn, pkg.NewUnsubscribe(uid, topic))
+	full.MqttExpect(t, conn, pkg.UnsubAck(uid))
+	full.MqttDisconnect(t, conn)
+	conn = full.MqttConnect(t, mqttPort)
+	full.MqttSend(t, conn, c)
+	full.MqttExpect(t, conn, pkg.NewConnAck(true, 0))
+	full.MqttSend(t, pub, pp)
+	full.MqttSend(t, conn, pkg.PingRequestSingleton)
+	full.MqttExpect(t, conn, pkg.PingResponseSingleton)
+	full.MqttDisconnect(t, pub)
+	full.MqttDisconnect(t, conn)
+}
+
+// disconnectAndWait sends a DISCONNECT and waits for the bridge to close the connection
+func disconnectAndWait(t *testing.T, conn net.Conn) {
+	t.Helper()
+	full.MqttSend(t, conn, pkg.DisconnectSingleton)
+	full.MqttExpectConnReset(t, conn)
+	_ = conn.Close()
+}
+
+// expectOffline expects a QoS 1 publish with the given topic and payload, acknowledges it, and
+// returns its packet identifier
+func expectOffline(t *testing.T, conn net.Conn, topic, payload string) {
+	t.Helper()
+	var id uint16
+	full.MqttExpect(t, conn, func(p pkg.Packet) bool {
+		pp, ok := p.(*pkg.Publish)
+		if ok {
+			id = pp.ID()
+		}
+		return ok && pp.TopicName() == topic && string(pp.Payload()) == payload && pp.QoSLevel() == 1
+	})
+	full.MqttSend(t, conn, pkg.PubAck(id))
+}
+
+func TestSessionOfflineQueue(t *testing.T) {
+	topic := "testing/session/offline"
+	c := pkg.NewConnect(full.NextClientID(), false, 1, nil, nil)
+	conn := full.MqttConnect(t, mqttPort)
+	full.MqttSend(t, conn, c)
+	full.MqttExpect(t, conn, pkg.NewConnAck(false, 0))
+	sid := nextPacketID()
+	full.MqttSend(t, conn, pkg.NewSubscribe(sid, pkg.Topic{Name: topic, QoS: 1}))
+	full.MqttExpect(t, conn, pkg.NewSubAck(sid, 1))
+	disconnectAndWait(t, conn)
+
+	// the queue is full after three messages and the oldest are dropped
+	pub := full.MqttConnectClean(t, mqttPort)
+	mids := make([]uint16, offlineQueueSize+2)
+	for i := range mids {
+		mids[i] = nextPacketID()
+		full.MqttSend(t, pub, pkg.NewPublish2(mids[i], topic, []byte(strconv.Itoa(i+1)), 1, false, false))
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	conn = full.MqttConnect(t, mqttPort)
+	full.MqttSend(t, conn, c)
+	full.MqttExpect(t, conn, pkg.NewConnAck(true, 0))
+	expectOffline(t, conn, topic, "3")
+	expectOffline(t, conn, topic, "4")
+	expectOffline(t, conn, topic, "5")
+
+	// the acknowledgements from the client are propagated to the publisher in no particular order
+	acks := map[uint16]bool{mids[2]: true, mids[3]: true, mids[4]: true}
+	for range acks {
+		full.MqttExpect(t, pub, func(p pkg.Packet) bool {
+			a, ok := p.(pkg.PubAck)
+			return ok && acks[uint16(a)]
+		})
+	}
+	disconnectAndWait(t, conn)
+
+	// the queue is persisted and messages are queued after a restart too
+	full.MqttSend(t, pub, pkg.NewPublish2(nextPacketID(), topic, []byte("before"), 1, false, false))
+	time.Sleep(50 * time.Millisecond)
+	full.MqttDisconnect(t, pub)
+	full.RestartBridge(t, mqttServer)
+
+	p2 := full.MqttConnectClean(t, mqttPort)
+	full.MqttSend(t, p2, pkg.NewPublish2(nextPacketID(), topic, []byte("after"), 1, false, false))
+	time.Sleep(50 * time.Millisecond)
+
+	conn = full.MqttConnect(t, mqttPort)
+	full.MqttSend(t, conn, c)
+	full.MqttExpect(t, conn, pkg.NewConnAck(true, 0))
+	expectOffline(t, conn, topic, "before")
+	expectOffline(t, conn, topic, "after")
+	full.MqttDisconnect(t, p2)
+	full.MqttDisconnect(t, conn)
+}
+
+func TestSessionOfflineQueue_natsRequest(t *testing.T) {
+	topic := "testing/session/offline/request"
+	c := pkg.NewConnect(full.NextClientID(), false, 1, nil, nil)
+	conn := full.MqttConnect(t, mqttPort)
+	full.MqttSend(t, conn, c)
+	full.MqttExpect(t, conn, pkg.NewConnAck(false, 0))
+	sid := nextPacketID()
+	full.MqttSend(t, conn, pkg.NewSubscribe(sid, pkg.Topic{Name: topic, QoS: 1}))
+	full.MqttExpect(t, conn, pkg.NewSubAck(sid, 1))
+	disconnectAndWait(t, conn)
+
+	// a plain NATS request is queued as a QoS 1 message
+	nc := full.NatsConnect(t, natsPort)
+	defer nc.Close()
+	inbox := nats.NewInbox()
+	ns, err := nc.SubscribeSync(inbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = nc.PublishRequest(mqtt.ToNATS(topic), inbox, []byte("request")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	conn = full.MqttConnect(t, mqttPort)
+	full.MqttSend(t, conn, c)
+	full.MqttExpect(t, conn, pkg.NewConnAck(true, 0))
+	expectOffline(t, conn, topic, "request")
+
+	// the acknowledgement from the client is the reply to the request
+	if _, err = ns.NextMsg(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	full.MqttDisconnect(t, conn)
+}
+
+func TestSessionOfflineQueue5_natsRequest(t *testing.T) {
+	topic := "testing/session/offline/request5"
+	cid := full.NextClientID()
+	conn := connectUnclean5(t, cid, 10, false)
+	sid := nextPacketID()
+	full.MqttSend5(t, conn, pkg.NewSubscribe5(sid, nil, pkg.Topic{Name: topic, QoS: 1}))
+	full.MqttExpect5(t, conn, pkg.NewSubAck5(sid, nil, 1))
+	disconnect5(t, conn, nil)
+
+	nc := full.NatsConnect(t, natsPort)
+	defer nc.Close()
+	inbox := nats.NewInbox()
+	ns, err := nc.SubscribeSync(inbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = nc.PublishRequest(mqtt.ToNATS(topic), inbox, []byte("request")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// an MQTT 5 client gets the reply subject as a response topic
+	conn = connectUnclean5(t, cid, 10, true)
+	var responseTopic string
+	full.MqttExpect5(t, conn, func(p pkg.Packet) bool {
+		pp, ok := p.(*pkg.Publish)
+		if !ok {
+			return false
+		}
+		full.MqttSend5(t, conn, pkg.PubAck(pp.ID()))
+		responseTopic, _ = pp.Properties().Text(mqtt.PropResponseTopic)
+		return pp.TopicName() == topic && string(pp.Payload()) == "request" && pp.QoSLevel() == 1
+	})
+	full.MqttSend5(t, conn, pkg.SimplePublish(responseTopic, []byte("response")))
+	m, err := ns.NextMsg(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(m.Data) != "response" {
+		t.Fatalf("expected response, got %q", m.Data)
+	}
+	disconnect5(t, conn, nil)
+}
@@ -0,0 +1,119 @@
+package test
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/tada/mqtt-nats/mqtt"
+	"github.com/tada/mqtt-nats/mqtt/pkg"
+	"github.com/tada/mqtt-nats/test/full"
+	"github.com/tada/mqtt-nats/test/packet"
+)
+
+// countPublished sends a PINGREQ and returns the number of publish packets that arrives before the PINGRESP
+func countPublished(t *testing.T, conn net.Conn, topic string) int {
+	t.Helper()
+	full.MqttSend(t, conn, pkg.PingRequestSingleton)
+	n := 0
+	for {
+		switch p := packet.Parse(t, conn).(type) {
+		case *pkg.Publish:
+			if p.TopicName() != topic {
+				t.Fatalf("unexpected publish to %s", p.TopicName())
+			}
+			n++
+		case pkg.PingResponse:
+			return n
+		default:
+			t.Fatalf("unexpected packet %s", p)
+		}
+	}
+}
+
+func TestSharedSubscription(t *testing.T) {
+	topic := "testing/shared/topic"
+	shared := "$share/workers/" + topic
+	c1 := full.MqttConnectClean(t, mqttPort)
+	c2 := full.MqttConnectClean(t, mqttPort)
+	sid := nextPacketID()
+	full.MqttSend(t, c1, pkg.NewSubscribe(sid, pkg.Topic{Name: shared}))
+	full.MqttExpect(t, c1, pkg.NewSubAck(sid, 0))
+	sid = nextPacketID()
+	full.MqttSend(t, c2, pkg.NewSubscribe(sid, pkg.Topic{Name: shared}))
+	full.MqttExpect(t, c2, pkg.NewSubAck(sid, 0))
+
+	nc := full.NatsConnect(t, natsPort)
+	defer nc.Close()
+	count := 20
+	for i := 0; i < count; i++ {
+		if err := nc.Publish(mqtt.ToNATS(topic), []byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := nc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// each message is delivered to one member of the group
+	n1 := countPublished(t, c1, topic)
+	n2 := countPublished(t, c2, topic)
+	if n1+n2 != count {
+		t.Fatalf("expected %d messages in total, got %d + %d", count, n1, n2)
+	}
+	full.MqttDisconnect(t, c1)
+	full.MqttDisconnect(t, c2)
+}
+
+func TestSharedSubscription_unsubscribe(t *testing.T) {
+	topic := "testing/shared/topic"
+	shared := "$share/workers/" + topic
+	conn := full.MqttConnectClean5(t, mqttPort, nil)
+	sid := nextPacketID()
+	full.MqttSend5(t, conn, pkg.NewSubscribe5(sid, nil, pkg.Topic{Name: shared}, pkg.Topic{Name: topic}))
+	full.MqttExpect5(t, conn, pkg.NewSubAck5(sid, nil, 0, 0))
+
+	pp := pkg.SimplePublish(topic, []byte("payload"))
+	c2 := full.MqttConnectClean(t, mqttPort)
+	full.MqttSend(t, c2, pp)
+	full.MqttExpect5(t, conn, pp, pp)
+
+	// the plain subscription remains when the shared subscription is removed
+	uid := nextPacketID()
+	full.MqttSend5(t, conn, pkg.NewUnsubscribe5(uid, nil, shared))
+	full.MqttExpect5(t, conn, pkg.NewUnsubAckV5(uid, nil, byte(pkg.RcSuccess)))
+	full.MqttSend(t, c2, pp)
+	full.MqttExpect5(t, conn, pp)
+	full.MqttSend5(t, conn, pkg.PingRequestSingleton)
+	full.MqttExpect5(t, conn, pkg.PingResponseSingleton)
+	full.MqttDisconnect(t, c2)
+	full.MqttDisconnect(t, conn)
+}
+
+func TestSharedSubscription_noRetained(t *testing.T) {
+	topic := "testing/shared/retained"
+	conn := full.MqttConnectClean(t, mqttPort)
+	full.MqttSend(t, conn, pkg.NewPublish2(0, topic, []byte("retained"), 0, false, true))
+
+	sid := nextPacketID()
+	full.MqttSend(t, conn, pkg.NewSubscribe(sid, pkg.Topic{Name: "$share/workers/" + topic}))
+	full.MqttExpect(t, conn, pkg.NewSubAck(sid, 0))
+	full.MqttSend(t, conn, pkg.PingRequestSingleton)
+	full.MqttExpect(t, conn, pkg.PingResponseSingleton)
+
+	// remove the retained message
+	full.MqttSend(t, conn, pkg.NewPublish2(0, topic, nil, 0, false, true))
+	full.MqttExpect(t, conn, pkg.NewPublish2(0, topic, nil, 0, false, false))
+	full.MqttDisconnect(t, conn)
+}
+
+func TestSharedSubscription_malformed(t *testing.T) {
+	conn := full.MqttConnectClean5(t, mqttPort, nil)
+	sid := nextPacketID()
+	full.MqttSend5(t, conn, pkg.NewSubscribe5(sid, nil,
+		pkg.Topic{Name: "$share/workers"}, pkg.Topic{Name: "$share/a+b/testing/shared/topic"}))
+	full.MqttExpect5(t, conn, pkg.NewSubAck5(sid, nil, byte(pkg.RcTopicFilterInvalid), byte(pkg.RcTopicFilterInvalid)))
+	full.MqttDisconnect(t, conn)
+}
@@ -0,0 +1,210 @@
+package test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/tada/mqtt-nats/bridge"
+	"github.com/tada/mqtt-nats/mqtt/pkg"
+	"github.com/tada/mqtt-nats/test/full"
+)
+
+const (
+	tlsMqttPort = 11887
+	tlsWSPort   = 11889
+	tlsDevice   = "device@example.com"
+	tlsStranger = "stranger@example.com"
+)
+
+// tlsMapBridge starts a bridge that maps client certificates to user names and only permits the user
+// tlsDevice. The bridge checks for changed certificates at the given rate. It returns the directory with the
+// certificates and a function that stops the bridge.
+func tlsMapBridge(t *testing.T, reloadRate int) (string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir(``, `mqtt-nats-tls`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	full.Certificates(t, dir, tlsDevice, tlsStranger)
+	stop := full.StartBridge(t, &bridge.Options{
+		Port:          tlsMqttPort,
+		WSPort:        tlsWSPort,
+		WSTLS:         true,
+		NATSUrls:      ":" + strconv.Itoa(natsPort),
+		RepeatRate:    50,
+		TLS:           true,
+		TLSMap:        true,
+		TLSTimeout:    0.2,
+		TLSReloadRate: reloadRate,
+		TLSCaCert:     filepath.Join(dir, "ca.pem"),
+		TLSCert:       filepath.Join(dir, "server.pem"),
+		TLSKey:        filepath.Join(dir, "server-key.pem"),
+		NATSPoolSize:  1,
+		Permissions:   map[string]*bridge.Permission{tlsDevice: {}}})
+	return dir, func() {
+		stop()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+// tlsMapConfig returns a client configuration that trusts the CA in the given directory and uses the client
+// certificate of the given user, or no client certificate when the user is empty
+func tlsMapConfig(t *testing.T, dir, user string) *tls.Config {
+	t.Helper()
+	pbs, err := ioutil.ReadFile(filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(pbs)
+	cfg := &tls.Config{ServerName: "127.0.0.1", RootCAs: roots}
+	if user != `` {
+		cert, err := tls.LoadX509KeyPair(filepath.Join(dir, user+".pem"), filepath.Join(dir, user+"-key.pem"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg
+}
+
+// tlsMapDial establishes a TLS connection to the bridge using the client certificate of the given user,
+// or no client certificate when the user is empty
+func tlsMapDial(t *testing.T, dir, user string) net.Conn {
+	t.Helper()
+	return tlsDial(t, tlsMqttPort, dir, user)
+}
+
+// tlsDial establishes a TLS connection to the given port using the client certificate of the given user,
+// or no client certificate when the user is empty
+func tlsDial(t *testing.T, port int, dir, user string) net.Conn {
+	t.Helper()
+	conn, err := tls.Dial("tcp", ":"+strconv.Itoa(port), tlsMapConfig(t, dir, user))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func TestTLSMap_identity(t *testing.T) {
+	dir, stop := tlsMapBridge(t, 0)
+	defer stop()
+
+	conn := tlsMapDial(t, dir, tlsDevice)
+	full.MqttSend(t, conn, pkg.NewConnect(full.NextClientID(), true, 1, nil, nil))
+	full.MqttExpect(t, conn, pkg.NewConnAck(false, pkg.RtAccepted))
+	full.MqttDisconnect(t, conn)
+}
+
+func TestTLSMap_webSocket(t *testing.T) {
+	dir, stop := tlsMapBridge(t, 0)
+	defer stop()
+
+	conn := full.WSConnect(t, tlsWSPort, bridge.DefaultWSPath, tlsMapConfig(t, dir, tlsDevice))
+	full.MqttSend(t, conn, pkg.NewConnect(full.NextClientID(), true, 1, nil, nil))
+	full.MqttExpect(t, conn, pkg.NewConnAck(false, pkg.RtAccepted))
+	full.MqttDisconnect(t, conn)
+
+	conn = full.WSConnect(t, tlsWSPort, bridge.DefaultWSPath, tlsMapConfig(t, dir, tlsStranger))
+	full.MqttSend(t, conn, pkg.NewConnect(full.NextClientID(), true, 1, nil, nil))
+	full.MqttExpect(t, conn, pkg.NewConnAck(false, pkg.RtBadUserNameOrPassword))
+	full.MqttExpectConnReset(t, conn)
+}
+
+func TestTLSMap_unknownIdentity(t *testing.T) {
+	dir, stop := tlsMapBridge(t, 0)
+	defer stop()
+
+	// the user name in the CONNECT is replaced by the identity of the certificate
+	conn := tlsMapDial(t, dir, tlsStranger)
+	full.MqttSend(t, conn, pkg.NewConnect(full.NextClientID(), true, 1, nil, &pkg.Credentials{User: tlsDevice}))
+	full.MqttExpect(t, conn, pkg.NewConnAck(false, pkg.RtBadUserNameOrPassword))
+	full.MqttExpectConnReset(t, conn)
+}
+
+func TestTLSMap_noCertificate(t *testing.T) {
+	dir, stop := tlsMapBridge(t, 0)
+	defer stop()
+
+	conn := tlsMapDial(t, dir, ``)
+	full.MqttSend(t, conn, pkg.NewConnect(full.NextClientID(), true, 1, nil, nil))
+	if _, err := conn.Read([]byte{0}); err == nil {
+		t.Fatal("connection without client certificate was accepted")
+	}
+}
+
+func TestTLS_handshakeTimeout(t *testing.T) {
+	_, stop := tlsMapBridge(t, 0)
+	defer stop()
+
+	conn := full.MqttConnect(t, tlsMqttPort)
+	defer func() {
+		_ = conn.Close()
+	}()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err := conn.Read([]byte{0})
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("the bridge did not close the connection when the TLS handshake timed out")
+	}
+}
+
+// tlsRenewed replaces all certificates in the given directory and waits until the bridge accepts a handshake
+// with the new ones
+func tlsRenewed(t *testing.T, dir string, renew func()) net.Conn {
+	t.Helper()
+	full.Certificates(t, dir, tlsDevice)
+	renew()
+	cfg := tlsMapConfig(t, dir, tlsDevice)
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); {
+		conn, err := tls.Dial("tcp", ":"+strconv.Itoa(tlsMqttPort), cfg)
+		if err == nil {
+			return conn
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("the bridge did not reload the TLS files")
+	return nil
+}
+
+func testTLSReload(t *testing.T, reloadRate int, renew func()) {
+	dir, stop := tlsMapBridge(t, reloadRate)
+	defer stop()
+
+	oldConn := tlsMapDial(t, dir, tlsDevice)
+	full.MqttSend(t, oldConn, pkg.NewConnect(full.NextClientID(), true, 1, nil, nil))
+	full.MqttExpect(t, oldConn, pkg.NewConnAck(false, pkg.RtAccepted))
+
+	conn := tlsRenewed(t, dir, renew)
+	full.MqttSend(t, conn, pkg.NewConnect(full.NextClientID(), true, 1, nil, nil))
+	full.MqttExpect(t, conn, pkg.NewConnAck(false, pkg.RtAccepted))
+
+	// connections established before the reload stay up
+	full.MqttSend(t, oldConn, pkg.PingRequestSingleton)
+	full.MqttExpect(t, oldConn, pkg.PingResponseSingleton)
+	full.MqttDisconnect(t, oldConn)
+	full.MqttDisconnect(t, conn)
+}
+
+func TestTLS_reloadOnChange(t *testing.T) {
+	testTLSReload(t, 50, func() {})
+}
+
+func TestTLS_reloadOnSignal(t *testing.T) {
+	testTLSReload(t, 60000, func() {
+		p, err := os.FindProcess(os.Getpid())
+		if err == nil {
+			err = p.Signal(syscall.SIGHUP)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -0,0 +1,103 @@
+// +build linux
+
+package test
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/tada/mqtt-nats/bridge"
+	"github.com/tada/mqtt-nats/mqtt/pkg"
+	"github.com/tada/mqtt-nats/test/full"
+)
+
+// unixBridge starts a bridge on a Unix domain socket in the given directory. The bridge uses the peer
+// credentials as the user name and only permits the given user. The returned function stops the bridge.
+func unixBridge(t *testing.T, path, permitted string) func() {
+	t.Helper()
+	return full.StartBridge(t, &bridge.Options{
+		NATSUrls:     ":" + strconv.Itoa(natsPort),
+		RepeatRate:   50,
+		NATSPoolSize: 1,
+		Permissions:  map[string]*bridge.Permission{permitted: {}},
+		Listeners: []*bridge.Listener{
+			{Transport: bridge.TransportUnix, Address: path, SocketMode: "0600", Auth: bridge.ClientAuthPeer}}})
+}
+
+func unixConnect(t *testing.T, path string, rt pkg.ReturnCode) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	full.MqttSend(t, conn, pkg.NewConnect(full.NextClientID(), true, 1, nil, &pkg.Credentials{User: "someone"}))
+	full.MqttExpect(t, conn, pkg.NewConnAck(false, rt))
+	return conn
+}
+
+func tempSocket(t *testing.T) (string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir(``, `mqtt-nats-unix`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "mqtt.sock"), func() {
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func TestUnix_peerCredentials(t *testing.T) {
+	path, cleanup := tempSocket(t)
+	defer cleanup()
+	u, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := unixBridge(t, path, u.Username)
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Fatalf("expected socket mode 0600, got %o", fi.Mode().Perm())
+	}
+	conn := unixConnect(t, path, pkg.RtAccepted)
+	full.MqttDisconnect(t, conn)
+	stop()
+
+	stop = unixBridge(t, path, "someone")
+	conn = unixConnect(t, path, pkg.RtBadUserNameOrPassword)
+	full.MqttExpectConnReset(t, conn)
+	stop()
+
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("socket file remains after shutdown")
+	}
+}
+
+func TestUnix_staleSocket(t *testing.T) {
+	path, cleanup := tempSocket(t)
+	defer cleanup()
+
+	// a listener that is closed without removing the socket file leaves a stale socket
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.SetUnlinkOnClose(false)
+	_ = l.Close()
+
+	u, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unixBridge(t, path, u.Username)()
+	conn := unixConnect(t, path, pkg.RtAccepted)
+	full.MqttDisconnect(t, conn)
+}
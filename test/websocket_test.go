@@ -0,0 +1,156 @@
+package test
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+
+	"github.com/tada/mqtt-nats/bridge"
+	"github.com/tada/mqtt-nats/mqtt"
+	"github.com/tada/mqtt-nats/mqtt/pkg"
+	"github.com/tada/mqtt-nats/test/full"
+)
+
+func TestWebSocket_connect(t *testing.T) {
+	conn := full.WSConnect(t, wsMqttPort, bridge.DefaultWSPath, nil)
+	full.MqttSend(t, conn, pkg.NewConnect(full.NextClientID(), true, 1, nil, nil))
+	full.MqttExpect(t, conn, pkg.NewConnAck(false, 0))
+	full.MqttDisconnect(t, conn)
+}
+
+func TestWebSocket_packetsSpanningFrames(t *testing.T) {
+	conn := full.WSConnect(t, wsMqttPort, bridge.DefaultWSPath, nil)
+
+	// the CONNECT is split over three frames
+	w := mqtt.NewWriter()
+	pkg.NewConnect(full.NextClientID(), true, 1, nil, nil).Write(w)
+	bs := w.Bytes()
+	for _, frame := range [][]byte{bs[:1], bs[1:5], bs[5:]} {
+		if _, err := conn.Write(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	full.MqttExpect(t, conn, pkg.NewConnAck(false, 0))
+
+	// a SUBSCRIBE and the start of a PUBLISH share a frame
+	mid := nextPacketID()
+	w = mqtt.NewWriter()
+	pkg.NewSubscribe(mid, pkg.Topic{Name: "ws/frames"}).Write(w)
+	sl := len(w.Bytes())
+	pp := pkg.NewPublish2(0, "ws/frames", []byte("spanning"), 0, false, false)
+	pp.Write(w)
+	bs = w.Bytes()
+	if _, err := conn.Write(bs[:sl+3]); err != nil {
+		t.Fatal(err)
+	}
+	full.MqttExpect(t, conn, pkg.NewSubAck(mid, 0))
+	if _, err := conn.Write(bs[sl+3:]); err != nil {
+		t.Fatal(err)
+	}
+	full.MqttExpect(t, conn, pp)
+	full.MqttDisconnect(t, conn)
+}
+
+func TestWebSocket_ping(t *testing.T) {
+	conn := full.WSConnect(t, wsMqttPort, bridge.DefaultWSPath, nil)
+	if err := conn.WriteFrame(0x9, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	op, payload, err := conn.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if op != 0xa || string(payload) != "hello" {
+		t.Fatalf("expected pong with payload hello, got opcode %d with payload %q", op, payload)
+	}
+	full.MqttSend(t, conn, pkg.NewConnect(full.NextClientID(), true, 1, nil, nil))
+	full.MqttExpect(t, conn, pkg.NewConnAck(false, 0))
+	full.MqttDisconnect(t, conn)
+}
+
+func TestWebSocket_textFrame(t *testing.T) {
+	conn := full.WSConnect(t, wsMqttPort, bridge.DefaultWSPath, nil)
+	w := mqtt.NewWriter()
+	pkg.NewConnect(full.NextClientID(), true, 1, nil, nil).Write(w)
+	if err := conn.WriteFrame(0x1, w.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	expectWSClose(t, conn, 1003)
+}
+
+func TestWebSocket_fragmentedMessage(t *testing.T) {
+	conn := full.WSConnect(t, wsMqttPort, bridge.DefaultWSPath, nil)
+	w := mqtt.NewWriter()
+	pkg.NewConnect(full.NextClientID(), true, 1, nil, nil).Write(w)
+	bs := w.Bytes()
+	if err := conn.WriteFragment(0x2, false, bs[:3]); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteFragment(0x0, false, bs[3:6]); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteFragment(0x0, true, bs[6:]); err != nil {
+		t.Fatal(err)
+	}
+	full.MqttExpect(t, conn, pkg.NewConnAck(false, 0))
+	full.MqttDisconnect(t, conn)
+}
+
+func TestWebSocket_continuationWithoutMessage(t *testing.T) {
+	conn := full.WSConnect(t, wsMqttPort, bridge.DefaultWSPath, nil)
+	w := mqtt.NewWriter()
+	pkg.NewConnect(full.NextClientID(), true, 1, nil, nil).Write(w)
+	if err := conn.WriteFrame(0x0, w.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	expectWSClose(t, conn, 1002)
+}
+
+func TestWebSocket_messageBeforeFin(t *testing.T) {
+	conn := full.WSConnect(t, wsMqttPort, bridge.DefaultWSPath, nil)
+	w := mqtt.NewWriter()
+	pkg.NewConnect(full.NextClientID(), true, 1, nil, nil).Write(w)
+	bs := w.Bytes()
+	if err := conn.WriteFragment(0x2, false, bs[:3]); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteFrame(0x2, bs[3:]); err != nil {
+		t.Fatal(err)
+	}
+	expectWSClose(t, conn, 1002)
+}
+
+// expectWSClose reads a frame and fails unless it is a close frame with the given status
+func expectWSClose(t *testing.T, conn *full.WSConn, status uint16) {
+	t.Helper()
+	op, payload, err := conn.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if op != 0x8 || !bytes.Equal(payload, []byte{byte(status >> 8), byte(status)}) {
+		t.Fatalf("expected close with status %d, got opcode %d with payload %v", status, op, payload)
+	}
+	full.MqttExpectConnReset(t, conn)
+}
+
+func TestWebSocket_subprotocolRequired(t *testing.T) {
+	conn := full.MqttConnect(t, wsMqttPort)
+	defer func() {
+		_ = conn.Close()
+	}()
+	resp, _ := full.WSUpgrade(t, conn, bridge.DefaultWSPath, "chat")
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected %d, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func TestWebSocket_unknownPath(t *testing.T) {
+	conn := full.MqttConnect(t, wsMqttPort)
+	defer func() {
+		_ = conn.Close()
+	}()
+	resp, _ := full.WSUpgrade(t, conn, "/other", "mqtt")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected %d, got %d", http.StatusNotFound, resp.StatusCode)
+	}
+}